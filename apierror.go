@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// -------------------- 结构化错误 --------------------
+
+// 稳定的错误码：客户端应按 code 判断错误类型，message 为中文说明，措辞可能随版本调整。
+const (
+	errCodeInvalidParam        = "INVALID_PARAM"
+	errCodeMissingParam        = "MISSING_PARAM"
+	errCodeMissingLocation     = "MISSING_LOCATION"
+	errCodeInvalidCoords       = "INVALID_COORDS"
+	errCodeInvalidTimezone     = "INVALID_TIMEZONE"
+	errCodeInvalidDate         = "INVALID_DATE"
+	errCodeInvalidMode         = "INVALID_MODE"
+	errCodeInvalidFormat       = "INVALID_FORMAT"
+	errCodeInvalidHorizon      = "INVALID_HORIZON"
+	errCodeInvalidBody         = "INVALID_BODY"
+	errCodeMethodNotAllowed    = "METHOD_NOT_ALLOWED"
+	errCodeCityNotFound        = "CITY_NOT_FOUND"
+	errCodeGeocoderUnavailable = "GEOCODER_UNAVAILABLE"
+	errCodeNotReady            = "NOT_READY"
+	errCodeInternal            = "INTERNAL_ERROR"
+)
+
+// errorCodeStatus 为各错误码固定对应的 HTTP 状态码，同一错误码在所有接口返回相同状态。
+var errorCodeStatus = map[string]int{
+	errCodeInvalidParam:        http.StatusBadRequest,
+	errCodeMissingParam:        http.StatusBadRequest,
+	errCodeMissingLocation:     http.StatusBadRequest,
+	errCodeInvalidCoords:       http.StatusBadRequest,
+	errCodeInvalidTimezone:     http.StatusBadRequest,
+	errCodeInvalidDate:         http.StatusBadRequest,
+	errCodeInvalidMode:         http.StatusBadRequest,
+	errCodeInvalidFormat:       http.StatusBadRequest,
+	errCodeInvalidHorizon:      http.StatusBadRequest,
+	errCodeInvalidBody:         http.StatusBadRequest,
+	errCodeMethodNotAllowed:    http.StatusMethodNotAllowed,
+	errCodeCityNotFound:        http.StatusNotFound,
+	errCodeGeocoderUnavailable: http.StatusBadGateway,
+	errCodeNotReady:            http.StatusServiceUnavailable,
+	errCodeInternal:            http.StatusInternalServerError,
+}
+
+// apiError 为带稳定错误码的错误；Error() 只返回中文说明，CLI 的错误输出与原先一致。
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"` // 出错的查询参数名，与具体参数无关时为空
+	err     error
+}
+
+// apiErrorResponse 为 HTTP 接口出错时的返回体：{"error": {"code": ..., "message": ..., "field": ...}}。
+type apiErrorResponse struct {
+	Error *apiError `json:"error"`
+}
+
+// apiErrorf 按 fmt.Errorf 的规则生成带错误码的错误，format 中的 %w 会被包装以便 errors.Is/As 继续识别。
+func apiErrorf(code, field, format string, args ...interface{}) *apiError {
+	err := fmt.Errorf(format, args...)
+	return &apiError{Code: code, Message: err.Error(), Field: field, err: errors.Unwrap(err)}
+}
+
+func (e *apiError) Error() string { return e.Message }
+
+func (e *apiError) Unwrap() error { return e.err }
+
+// status 返回错误码对应的 HTTP 状态码，未登记的错误码按 500 处理。
+func (e *apiError) status() int {
+	if s, ok := errorCodeStatus[e.Code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// asAPIError 取出错误链中的 apiError；没有时视为服务端内部错误。
+func asAPIError(err error) *apiError {
+	var e *apiError
+	if errors.As(err, &e) {
+		return e
+	}
+	return &apiError{Code: errCodeInternal, Message: err.Error(), err: err}
+}
+
+// apiErrorCodes 返回全部错误码（升序），供 OpenAPI 文档列举。
+func apiErrorCodes() []string {
+	codes := make([]string, 0, len(errorCodeStatus))
+	for c := range errorCodeStatus {
+		codes = append(codes, c)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// writeAPIError 以 JSON 输出错误，状态码由错误码决定；内部错误同时记录日志。
+func writeAPIError(w http.ResponseWriter, err error) {
+	e := asAPIError(err)
+	if e.Code == errCodeInternal {
+		logErrorf("HTTP 接口内部错误: %s", e.Message)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status())
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(apiErrorResponse{Error: e})
+}
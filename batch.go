@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------- 批量天文数据 --------------------
+
+// 批量接口限制：单次请求的地点数、请求体大小，以及解析地点（含地理编码）的总时限。
+const (
+	maxAstroBatchItems      = 200
+	maxAstroBatchBody       = 1 << 20
+	astroBatchResolveBudget = 60 * time.Second
+)
+
+// astroBatchItem 为批量请求中的一个地点：city（可配 country/pick）或 lat+lon（tz 可选），
+// mode/date/from/to 省略时使用查询参数中的默认值。CSV 输入的列名与 JSON 字段名相同。
+type astroBatchItem struct {
+	ID      string   `json:"id,omitempty"` // 调用方自定义标识，原样返回；CLI 用作文件名前缀与工作表名
+	City    string   `json:"city,omitempty"`
+	Country string   `json:"country,omitempty"`
+	Pick    int      `json:"pick,omitempty"`
+	Lat     *float64 `json:"lat,omitempty"`
+	Lon     *float64 `json:"lon,omitempty"`
+	TZ      string   `json:"tz,omitempty"`
+	Elev    *float64 `json:"elev,omitempty"`
+	Mode    string   `json:"mode,omitempty"`
+	Date    string   `json:"date,omitempty"`
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to,omitempty"`
+}
+
+// query 将地点转换为与 /api/astro 相同的查询参数，复用单地点接口的校验与错误码。
+func (it astroBatchItem) query(defaults url.Values) url.Values {
+	q := url.Values{}
+	for k, vs := range defaults {
+		q[k] = vs
+	}
+	set := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	setFloat := func(k string, v *float64) {
+		if v != nil {
+			q.Set(k, strconv.FormatFloat(*v, 'f', -1, 64))
+		}
+	}
+	set("city", it.City)
+	set("country", it.Country)
+	if it.Pick != 0 {
+		q.Set("pick", strconv.Itoa(it.Pick))
+	}
+	setFloat("lat", it.Lat)
+	setFloat("lon", it.Lon)
+	set("tz", it.TZ)
+	setFloat("elev", it.Elev)
+	set("mode", it.Mode)
+	set("date", it.Date)
+	set("from", it.From)
+	set("to", it.To)
+	return q
+}
+
+// label 返回地点在日志与工作表中的名称：优先 id，其次 city，最后为坐标。
+func (it astroBatchItem) label() string {
+	switch {
+	case it.ID != "":
+		return it.ID
+	case it.City != "":
+		return it.City
+	case it.Lat != nil && it.Lon != nil:
+		return fmt.Sprintf("%.4f,%.4f", *it.Lat, *it.Lon)
+	}
+	return ""
+}
+
+// name 返回结果在合并输出中的名称（工作表名、长表 CSV 的 city 列）：优先 id，其次解析出的城市名。
+func (j *astroBatchJob) name() string {
+	if j.Item.ID != "" {
+		return j.Item.ID
+	}
+	return j.Ctx.City
+}
+
+// astroBatchDefaults 取出批量请求中作用于全部地点的查询参数（时间范围与黄金/蓝调阈值）。
+func astroBatchDefaults(q url.Values) url.Values {
+	out := url.Values{}
+	for _, k := range []string{"mode", "date", "from", "to", "golden_low", "golden_high", "blue_low", "blue_high"} {
+		if v := q.Get(k); v != "" {
+			out.Set(k, v)
+		}
+	}
+	return out
+}
+
+// astroBatchJob 为批量计算中的一项：解析阶段填入 Ctx/Query/Mode，计算阶段填入 Data/Desc/BaseName，任一阶段出错记入 Err。
+type astroBatchJob struct {
+	Index    int
+	Item     astroBatchItem
+	Mode     string
+	Query    url.Values
+	Ctx      *CityContext
+	Data     []dailyAstro
+	Desc     string
+	BaseName string
+	Err      error
+}
+
+// resolveAstroBatch 依次解析各地点：整批只读一次缓存，新解析的城市随即写回同一份缓存，
+// 地理编码请求保持串行（避免并发保存缓存互相覆盖；公共 Nominatim 另由 nominatimLimiter 限速）。
+// reqCtx 结束（客户端断开或超过时限）后不再发起网络请求，已缓存的地点仍正常解析，其余项记为地理编码失败。
+func resolveAstroBatch(reqCtx context.Context, items []astroBatchItem, defaults url.Values) []*astroBatchJob {
+	cache := loadCache()
+	jobs := make([]*astroBatchJob, len(items))
+	for i, it := range items {
+		job := &astroBatchJob{Index: i, Item: it, Query: it.query(defaults)}
+		jobs[i] = job
+		job.Mode = strings.ToLower(job.Query.Get("mode"))
+		if job.Mode == "" {
+			job.Mode = "year"
+		}
+		ctx, err := resolveContextIn(reqCtx, cache, job.Query)
+		if err != nil && reqCtx.Err() != nil && asAPIError(err).Code == errCodeGeocoderUnavailable {
+			err = apiErrorf(errCodeGeocoderUnavailable, "", "批量解析已超时或被取消，未完成地理编码: %w", err)
+		}
+		if err != nil {
+			job.Err = err
+			continue
+		}
+		if err := applyPhotoBandsQuery(ctx, job.Query); err != nil {
+			job.Err = err
+			continue
+		}
+		job.Ctx = ctx
+	}
+	return jobs
+}
+
+// astroBatchWorkers 返回批量计算的并发数：不超过可用 CPU 数。
+func astroBatchWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// runBounded 以至多 workers 个 goroutine 对 0..n-1 调用 fn，全部完成后返回。
+func runBounded(n, workers int, fn func(i int)) {
+	workers = max(min(workers, n), 1)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// computeAstroBatch 并发生成已解析地点的天文数据。
+func computeAstroBatch(jobs []*astroBatchJob, workers int) {
+	runBounded(len(jobs), workers, func(i int) {
+		job := jobs[i]
+		if job.Err != nil {
+			return
+		}
+		job.Data, job.Desc, job.BaseName, job.Err = buildAstroDataFromQuery(job.Ctx, job.Mode, job.Query)
+	})
+}
+
+// uniqueBatchBaseNames 为成功的各项确定输出文件基础名（填了 id 时以 id 为前缀），重名时依次追加 -2、-3……
+// （不区分大小写）：未填 id、解析到同一城市且模式相同的地点不会写入同一文件而互相覆盖。
+func uniqueBatchBaseNames(jobs []*astroBatchJob) []string {
+	names := make([]string, len(jobs))
+	used := make(map[string]bool)
+	for i, job := range jobs {
+		if job.Err != nil {
+			continue
+		}
+		base := job.BaseName
+		if job.Item.ID != "" {
+			base = sanitizeFileName(job.Item.ID) + "-" + base
+		}
+		name := base
+		for n := 2; used[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[strings.ToLower(name)] = true
+		names[i] = name
+	}
+	return names
+}
+
+// astroBatchResult 为批量响应中的一项，result 与 error 二者必居其一。
+type astroBatchResult struct {
+	Index  int               `json:"index"`
+	ID     string            `json:"id,omitempty"`
+	Result *astroAPIResponse `json:"result,omitempty"`
+	Error  *apiError         `json:"error,omitempty"`
+}
+
+// astroBatchResponse 为 /api/astro/batch 的返回体，items 与请求数组一一对应且顺序相同。
+type astroBatchResponse struct {
+	Generated string             `json:"generated_at"`
+	Count     int                `json:"count"`
+	Succeeded int                `json:"succeeded"`
+	Failed    int                `json:"failed"`
+	Items     []astroBatchResult `json:"items"`
+}
+
+// readAstroBatchBody 读取并校验批量请求体（地点 JSON 数组）。
+func readAstroBatchBody(w http.ResponseWriter, r *http.Request) ([]astroBatchItem, error) {
+	body := http.MaxBytesReader(w, r.Body, maxAstroBatchBody)
+	defer body.Close()
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	var items []astroBatchItem
+	if err := dec.Decode(&items); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, apiErrorf(errCodeInvalidBody, "", "请求体超过 %d 字节", maxAstroBatchBody)
+		}
+		return nil, apiErrorf(errCodeInvalidBody, "", "请求体必须为地点 JSON 数组: %w", err)
+	}
+	if len(items) == 0 {
+		return nil, apiErrorf(errCodeInvalidBody, "", "地点数组不能为空")
+	}
+	if len(items) > maxAstroBatchItems {
+		return nil, apiErrorf(errCodeInvalidBody, "", "一次最多 %d 个地点（收到 %d 个）", maxAstroBatchItems, len(items))
+	}
+	return items, nil
+}
+
+// astroBatchHandler 处理 POST /api/astro/batch：请求体为地点数组，查询参数 mode/date/from/to 与黄金/蓝调阈值作为各项默认值；
+// 单个地点出错只记入该项的 error，整体仍返回 200。
+func astroBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIError(w, apiErrorf(errCodeMethodNotAllowed, "", "仅支持 POST，请求体为地点 JSON 数组"))
+		return
+	}
+	q := r.URL.Query()
+	defaults := astroBatchDefaults(q)
+	items, err := readAstroBatchBody(w, r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	resolveCtx, cancel := context.WithTimeout(r.Context(), astroBatchResolveBudget)
+	jobs := resolveAstroBatch(resolveCtx, items, defaults)
+	cancel()
+	if r.Context().Err() != nil {
+		return // 客户端已断开，不再计算
+	}
+	computeAstroBatch(jobs, astroBatchWorkers())
+
+	resp := astroBatchResponse{
+		Generated: app.now().Format(time.RFC3339),
+		Count:     len(jobs),
+		Items:     make([]astroBatchResult, len(jobs)),
+	}
+	for i, job := range jobs {
+		item := astroBatchResult{Index: i, ID: job.Item.ID}
+		if job.Err != nil {
+			item.Error = asAPIError(job.Err)
+			resp.Failed++
+		} else {
+			res := newAstroAPIResponse(job.Ctx, job.Mode, job.Desc, job.Data)
+			item.Result = &res
+			resp.Succeeded++
+		}
+		resp.Items[i] = item
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(resp)
+}
+
+// -------------------- batch 子命令 --------------------
+
+// readAstroBatchFile 读取地点列表：.json 为与批量接口相同的数组，其余按带表头的 CSV 解析。
+func readAstroBatchFile(path string) ([]astroBatchItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取地点列表失败: %w", err)
+	}
+	var items []astroBatchItem
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("解析地点 JSON 失败: %w", err)
+		}
+	} else if items, err = parseAstroBatchCSV(string(data)); err != nil {
+		return nil, fmt.Errorf("解析地点 CSV 失败: %w", err)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("地点列表为空: %s", path)
+	}
+	return items, nil
+}
+
+// parseAstroBatchCSV 解析地点 CSV：首行为表头，列名为 id/city/country/pick/lat/lon/tz/elev/mode/date/from/to（可任意顺序、可省略），
+// 未知列忽略，空行跳过。
+func parseAstroBatchCSV(data string) ([]astroBatchItem, error) {
+	r := csv.NewReader(strings.NewReader(data))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	col := map[string]int{}
+	for i, h := range rows[0] {
+		col[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+	get := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	float := func(row []string, name string, n int) (*float64, error) {
+		v := get(row, name)
+		if v == "" {
+			return nil, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 行 %s 无效: %w", n, name, err)
+		}
+		return &f, nil
+	}
+	var out []astroBatchItem
+	for i, row := range rows[1:] {
+		n := i + 2
+		if strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		it := astroBatchItem{
+			ID: get(row, "id"), City: get(row, "city"), Country: get(row, "country"), TZ: get(row, "tz"),
+			Mode: get(row, "mode"), Date: get(row, "date"), From: get(row, "from"), To: get(row, "to"),
+		}
+		if v := get(row, "pick"); v != "" {
+			if it.Pick, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("第 %d 行 pick 无效: %w", n, err)
+			}
+		}
+		if it.Lat, err = float(row, "lat", n); err != nil {
+			return nil, err
+		}
+		if it.Lon, err = float(row, "lon", n); err != nil {
+			return nil, err
+		}
+		if it.Elev, err = float(row, "elev", n); err != nil {
+			return nil, err
+		}
+		out = append(out, it)
+	}
+	return out, nil
+}
+
+// astroBatchOptions 为 batch 子命令的参数。
+type astroBatchOptions struct {
+	Defaults url.Values // mode/date/from/to 默认值
+	Combine  bool       // 合并为一个文件（见 writeAstroCombined）
+	Output   string     // 合并文件路径，留空时为 batch-<日期>.xlsx/.csv
+}
+
+// runAstroBatch 批量生成地点列表的天文数据：默认每个地点按 --format 各写一个文件（文件名以 id 为前缀），
+// Combine 时按 --format 合并为一个工作簿或长表 CSV；有地点失败时在处理完其余地点后返回错误。
+func runAstroBatch(items []astroBatchItem, opts astroBatchOptions, out OutputOptions) error {
+	var combined string
+	if opts.Combine {
+		var err error
+		if combined, err = combinedAstroFormat(out.Format); err != nil {
+			return err
+		}
+	}
+	jobs := resolveAstroBatch(context.Background(), items, opts.Defaults)
+	computeAstroBatch(jobs, astroBatchWorkers())
+	if !opts.Combine {
+		names := uniqueBatchBaseNames(jobs)
+		runBounded(len(jobs), astroBatchWorkers(), func(i int) {
+			job := jobs[i]
+			if job.Err != nil {
+				return
+			}
+			outFile, err := writeAstroFile(out.Format, out.AllowOverwrite, out.OutDir, job.Ctx.City, job.Ctx.observerElevation(), job.Ctx.Now, job.Data, job.Desc, names[i])
+			if err != nil {
+				job.Err = fmt.Errorf("写入文件失败: %w", err)
+				return
+			}
+			logInfof("已生成 [%s] 天文数据文件：%s", job.Item.label(), outFile)
+		})
+	}
+
+	failed := 0
+	for _, job := range jobs {
+		if job.Err != nil {
+			failed++
+			logErrorf("第 %d 个地点 [%s] 失败: %v", job.Index+1, job.Item.label(), job.Err)
+		}
+	}
+	if opts.Combine && failed < len(jobs) {
+		path := opts.Output
+		if path == "" {
+			path = fmt.Sprintf("batch-%s.%s", app.now().Format("2006-01-02"), astroFormatSpecs[combined].Ext)
+			if out.OutDir != "" {
+				path = filepath.Join(out.OutDir, path)
+			}
+		}
+		outFile, err := writeAstroCombined(combined, jobs, path, out.AllowOverwrite)
+		if err != nil {
+			return fmt.Errorf("写入文件失败: %w", err)
+		}
+		logInfof("已生成合并文件（%d 个地点）：%s", len(jobs)-failed, outFile)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d/%d 个地点生成失败", failed, len(jobs))
+	}
+	logInfof("批量生成完成：共 %d 个地点", len(jobs))
+	return nil
+}
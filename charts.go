@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------- 日序列图表（SVG / HTML） --------------------
+
+// 图表画布尺寸：每个面板等高，纵向依次排列。
+const (
+	chartWidth       = 960.0
+	chartHeaderH     = 70.0
+	chartPanelH      = 230.0
+	chartPlotLeft    = 70.0
+	chartPlotRight   = 930.0
+	chartPlotTop     = 34.0 // 面板内标题占用高度
+	chartPlotBottom  = 196.0
+	chartShortSeries = 62 // 不超过该天数时按周标注横轴，否则按月初标注
+)
+
+// astroChartSeries 为从 dailyAstro 解析出的数值序列，缺失值为 NaN。
+type astroChartSeries struct {
+	Dates        []string
+	DayLength    []float64 // 昼长（小时），极昼 24、极夜 0
+	NoonAltitude []float64 // 正午太阳高度（度）
+	Sunrise      []float64 // 日出（当地时间，小时）
+	Sunset       []float64 // 日落（当地时间，小时）
+	MoonIllum    []float64 // 月面照亮比例（%）
+}
+
+// chartLine 为面板中的一条曲线。
+type chartLine struct {
+	Name   string
+	Color  string
+	Values []float64
+}
+
+// chartPanel 为一个带坐标轴的折线图面板。
+type chartPanel struct {
+	Title      string
+	Unit       string
+	Lines      []chartLine
+	Min, Max   float64
+	Step       float64
+	FormatTick func(float64) string
+}
+
+// parseClockHours 将 "15:04" 解析为小时数，"--" 等无法解析时返回 NaN。
+func parseClockHours(s string) float64 {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok {
+		return math.NaN()
+	}
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil {
+		return math.NaN()
+	}
+	return float64(hh) + float64(mm)/60
+}
+
+// newAstroChartSeries 从天文数据的数值字段（DayLengthMinutes、MaxAltitudeNum、MoonIlluminationNum 与 Has* 标志）提取图表序列，
+// 日出/日落时刻按当地时间 "15:04" 换算为小时；当天既无日出也无日落时按正午高度判断极昼（24 小时）或极夜（0）。
+func newAstroChartSeries(data []dailyAstro) astroChartSeries {
+	s := astroChartSeries{
+		Dates:        make([]string, len(data)),
+		DayLength:    make([]float64, len(data)),
+		NoonAltitude: make([]float64, len(data)),
+		Sunrise:      make([]float64, len(data)),
+		Sunset:       make([]float64, len(data)),
+		MoonIllum:    make([]float64, len(data)),
+	}
+	for i, d := range data {
+		s.Dates[i] = d.Date
+		s.NoonAltitude[i] = d.MaxAltitudeNum
+		s.MoonIllum[i] = d.MoonIlluminationNum * 100
+		s.Sunrise[i], s.Sunset[i], s.DayLength[i] = math.NaN(), math.NaN(), math.NaN()
+		if d.HasSunrise {
+			s.Sunrise[i] = parseClockHours(d.Sunrise)
+		}
+		if d.HasSunset {
+			s.Sunset[i] = parseClockHours(d.Sunset)
+		}
+		switch {
+		case d.HasDayLength:
+			s.DayLength[i] = float64(d.DayLengthMinutes) / 60
+		case !d.HasSunrise && !d.HasSunset && d.MaxAltitudeNum > 0:
+			s.DayLength[i] = 24
+		case !d.HasSunrise && !d.HasSunset:
+			s.DayLength[i] = 0
+		}
+	}
+	return s
+}
+
+// formatHoursTick 将小时数格式化为 "hh:mm"。
+func formatHoursTick(v float64) string {
+	m := int(math.Round(v * 60))
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+// niceRange 返回包含所有有效值、按 step 对齐的坐标范围，并限制在 [lo, hi] 内；无有效值时返回 [lo, hi]。
+func niceRange(step, lo, hi float64, series ...[]float64) (float64, float64) {
+	minV, maxV := math.Inf(1), math.Inf(-1)
+	for _, s := range series {
+		for _, v := range s {
+			if !math.IsNaN(v) {
+				minV, maxV = min(minV, v), max(maxV, v)
+			}
+		}
+	}
+	if math.IsInf(minV, 1) {
+		return lo, hi
+	}
+	minV = max(math.Floor(minV/step)*step, lo)
+	maxV = min(math.Ceil(maxV/step)*step, hi)
+	if maxV <= minV {
+		if maxV+step <= hi {
+			maxV += step
+		} else {
+			minV -= step
+		}
+	}
+	return minV, maxV
+}
+
+// astroChartPanels 构造昼长、正午高度、日出日落与月面照亮比例四个面板。
+func astroChartPanels(s astroChartSeries) []chartPanel {
+	deg := func(v float64) string { return fmt.Sprintf("%.0f°", v) }
+	dlMin, dlMax := niceRange(2, 0, 24, s.DayLength)
+	altMin, altMax := niceRange(10, -90, 90, s.NoonAltitude)
+	rsMin, rsMax := niceRange(2, 0, 24, s.Sunrise, s.Sunset)
+	return []chartPanel{
+		{Title: "昼长", Unit: "小时", Min: dlMin, Max: dlMax, Step: 2, FormatTick: formatHoursTick,
+			Lines: []chartLine{{Name: "昼长", Color: "#e8590c", Values: s.DayLength}}},
+		{Title: "正午太阳高度", Unit: "度", Min: altMin, Max: altMax, Step: 10, FormatTick: deg,
+			Lines: []chartLine{{Name: "正午高度", Color: "#d6336c", Values: s.NoonAltitude}}},
+		{Title: "日出 / 日落", Unit: "当地时间", Min: rsMin, Max: rsMax, Step: 2, FormatTick: formatHoursTick,
+			Lines: []chartLine{
+				{Name: "日出", Color: "#f59f00", Values: s.Sunrise},
+				{Name: "日落", Color: "#5f3dc4", Values: s.Sunset},
+			}},
+		{Title: "月面照亮比例", Unit: "%", Min: 0, Max: 100, Step: 25, FormatTick: func(v float64) string { return fmt.Sprintf("%.0f%%", v) },
+			Lines: []chartLine{{Name: "照亮比例", Color: "#1c7ed6", Values: s.MoonIllum}}},
+	}
+}
+
+// chartX 返回第 i 个数据点的横坐标。
+func chartX(i, n int) float64 {
+	if n <= 1 {
+		return (chartPlotLeft + chartPlotRight) / 2
+	}
+	return chartPlotLeft + float64(i)/float64(n-1)*(chartPlotRight-chartPlotLeft)
+}
+
+// chartXLabels 返回需要标注的横轴下标：长序列标注每月 1 日，短序列约每周一个。
+func chartXLabels(dates []string) []int {
+	var idx []int
+	if len(dates) > chartShortSeries {
+		for i, d := range dates {
+			if strings.HasSuffix(d, "-01") {
+				idx = append(idx, i)
+			}
+		}
+		return idx
+	}
+	step := max(1, (len(dates)+9)/10)
+	for i := 0; i < len(dates); i += step {
+		idx = append(idx, i)
+	}
+	return idx
+}
+
+// shortChartDate 将 YYYY-MM-DD 缩写为 MM-DD 作为横轴标签。
+func shortChartDate(d string) string {
+	if len(d) == len("2006-01-02") {
+		return d[5:]
+	}
+	return d
+}
+
+// renderAstroChartsSVG 将四个面板绘制为一个完整的 SVG；svg 根元素带 data-* 属性供 HTML 页面换算鼠标位置。
+func renderAstroChartsSVG(w io.Writer, title, subtitle string, s astroChartSeries) error {
+	bw := bufio.NewWriter(w)
+	panels := astroChartPanels(s)
+	n := len(s.Dates)
+	height := chartHeaderH + float64(len(panels))*chartPanelH
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f" font-family="sans-serif" font-size="12" data-x0="%.0f" data-x1="%.0f" data-n="%d">`+"\n",
+		chartWidth, height, chartWidth, height, chartPlotLeft, chartPlotRight, n)
+	fmt.Fprintln(bw, `<rect width="100%" height="100%" fill="#ffffff"/>`)
+	fmt.Fprintf(bw, `<text x="20" y="30" font-size="20" font-weight="bold">%s</text>`+"\n", html.EscapeString(title))
+	fmt.Fprintf(bw, `<text x="20" y="52" fill="#555">%s</text>`+"\n", html.EscapeString(subtitle))
+
+	labels := chartXLabels(s.Dates)
+	for pi, p := range panels {
+		top := chartHeaderH + float64(pi)*chartPanelH
+		y := func(v float64) float64 {
+			return top + chartPlotBottom - (v-p.Min)/(p.Max-p.Min)*(chartPlotBottom-chartPlotTop)
+		}
+		fmt.Fprintln(bw, `<g>`)
+		fmt.Fprintf(bw, `<text x="%.0f" y="%.0f" font-size="14" font-weight="bold">%s</text>`+"\n", chartPlotLeft, top+20, html.EscapeString(p.Title+"（"+p.Unit+"）"))
+		// 图例
+		lx := chartPlotRight
+		for li := len(p.Lines) - 1; li >= 0; li-- {
+			l := p.Lines[li]
+			fmt.Fprintf(bw, `<text x="%.0f" y="%.0f" text-anchor="end">%s</text>`+"\n", lx, top+20, html.EscapeString(l.Name))
+			lx -= float64(len([]rune(l.Name)))*12 + 6
+			fmt.Fprintf(bw, `<line x1="%.0f" y1="%.0f" x2="%.0f" y2="%.0f" stroke="%s" stroke-width="3"/>`+"\n", lx-20, top+16, lx, top+16, l.Color)
+			lx -= 32
+		}
+		// 网格与刻度
+		for v := p.Min; v <= p.Max+1e-9; v += p.Step {
+			yy := y(v)
+			fmt.Fprintf(bw, `<line x1="%.0f" y1="%.1f" x2="%.0f" y2="%.1f" stroke="#e5e5e5"/>`+"\n", chartPlotLeft, yy, chartPlotRight, yy)
+			fmt.Fprintf(bw, `<text x="%.0f" y="%.1f" text-anchor="end" fill="#555" font-size="11">%s</text>`+"\n", chartPlotLeft-6, yy+4, html.EscapeString(p.FormatTick(v)))
+		}
+		for _, i := range labels {
+			x := chartX(i, n)
+			fmt.Fprintf(bw, `<line x1="%.1f" y1="%.0f" x2="%.1f" y2="%.0f" stroke="#f0f0f0"/>`+"\n", x, top+chartPlotTop, x, top+chartPlotBottom)
+			fmt.Fprintf(bw, `<text x="%.1f" y="%.0f" text-anchor="middle" fill="#555" font-size="11">%s</text>`+"\n", x, top+chartPlotBottom+16, html.EscapeString(shortChartDate(s.Dates[i])))
+		}
+		fmt.Fprintf(bw, `<rect x="%.0f" y="%.0f" width="%.0f" height="%.0f" fill="none" stroke="#999"/>`+"\n",
+			chartPlotLeft, top+chartPlotTop, chartPlotRight-chartPlotLeft, chartPlotBottom-chartPlotTop)
+		// 曲线：NaN 处断开，孤立点画圆点
+		for _, l := range p.Lines {
+			var b strings.Builder
+			run := 0
+			flush := func(i int) {
+				if run == 1 {
+					fmt.Fprintf(bw, `<circle cx="%.1f" cy="%.1f" r="2.5" fill="%s"/>`+"\n", chartX(i-1, n), y(l.Values[i-1]), l.Color)
+				}
+				run = 0
+			}
+			for i, v := range l.Values {
+				if math.IsNaN(v) {
+					flush(i)
+					continue
+				}
+				if run == 0 {
+					fmt.Fprintf(&b, " M%.1f %.1f", chartX(i, n), y(v))
+				} else {
+					fmt.Fprintf(&b, " L%.1f %.1f", chartX(i, n), y(v))
+				}
+				run++
+			}
+			flush(len(l.Values))
+			if b.Len() > 0 {
+				fmt.Fprintf(bw, `<path d="%s" fill="none" stroke="%s" stroke-width="1.6"/>`+"\n", strings.TrimSpace(b.String()), l.Color)
+			}
+		}
+		fmt.Fprintln(bw, `</g>`)
+	}
+	fmt.Fprintln(bw, `</svg>`)
+	return bw.Flush()
+}
+
+// astroChartTitles 生成图表标题与副标题（范围、海拔、生成时间）。
+func astroChartTitles(cityName string, elev observerElevation, now time.Time, desc string) (string, string) {
+	sub := []string{}
+	if desc != "" {
+		sub = append(sub, "范围："+desc)
+	}
+	sub = append(sub, "海拔："+elev.String(), "生成："+now.Format("2006-01-02 15:04"), "所有时间均为城市所在时区的当地时间")
+	return "eSunMoon 城市天文数据图表：" + cityName, strings.Join(sub, "；")
+}
+
+// writeAstroSVG 以 SVG 图表输出天文数据。
+func writeAstroSVG(cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
+	return writeAstroToFile(filePath, allowOverwrite, func(w io.Writer) error {
+		return writeAstroSVGTo(w, cityName, elev, now, data, desc)
+	})
+}
+
+// writeAstroSVGTo 将昼长、正午高度、日出日落与月面照亮比例图表以 SVG 写入 w。
+func writeAstroSVGTo(w io.Writer, cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc string) error {
+	title, sub := astroChartTitles(cityName, elev, now, desc)
+	return renderAstroChartsSVG(w, title, sub, newAstroChartSeries(data))
+}
+
+// writeAstroHTML 以自包含 HTML 页面输出天文数据图表。
+func writeAstroHTML(cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
+	return writeAstroToFile(filePath, allowOverwrite, func(w io.Writer) error {
+		return writeAstroHTMLTo(w, cityName, elev, now, data, desc)
+	})
+}
+
+// writeAstroHTMLTo 输出内嵌 SVG 图表与原始数据（JSON）的自包含页面，不依赖外部脚本，鼠标悬停显示当日数值。
+func writeAstroHTMLTo(w io.Writer, cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc string) error {
+	title, sub := astroChartTitles(cityName, elev, now, desc)
+	var svg bytes.Buffer
+	if err := renderAstroChartsSVG(&svg, title, sub, newAstroChartSeries(data)); err != nil {
+		return err
+	}
+	// json.Marshal 默认转义 <、>、&，可安全嵌入 <script>
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>%s</title>
+<style>
+body { margin: 0; padding: 16px; font-family: sans-serif; background: #f8f9fa; color: #212529; }
+#charts { position: relative; max-width: 960px; margin: 0 auto; }
+#charts svg { width: 100%%; height: auto; display: block; background: #fff; border: 1px solid #dee2e6; }
+#tip { position: absolute; pointer-events: none; display: none; background: rgba(33,37,41,.9); color: #fff; padding: 6px 8px; border-radius: 4px; font-size: 12px; line-height: 1.5; white-space: nowrap; }
+</style>
+</head>
+<body>
+<div id="charts">
+%s<div id="tip"></div>
+</div>
+<script type="application/json" id="astro-data">%s</script>
+<script>
+(function () {
+  var data = JSON.parse(document.getElementById("astro-data").textContent);
+  var box = document.getElementById("charts");
+  var svg = box.querySelector("svg");
+  var tip = document.getElementById("tip");
+  var x0 = +svg.dataset.x0, x1 = +svg.dataset.x1, n = +svg.dataset.n;
+  var cursor = document.createElementNS("http://www.w3.org/2000/svg", "line");
+  cursor.setAttribute("y1", "0");
+  cursor.setAttribute("y2", svg.viewBox.baseVal.height);
+  cursor.setAttribute("stroke", "#adb5bd");
+  cursor.setAttribute("visibility", "hidden");
+  svg.appendChild(cursor);
+  svg.addEventListener("mousemove", function (ev) {
+    var pt = svg.createSVGPoint();
+    pt.x = ev.clientX; pt.y = ev.clientY;
+    var p = pt.matrixTransform(svg.getScreenCTM().inverse());
+    if (!n || p.x < x0 - 5 || p.x > x1 + 5) { hide(); return; }
+    var i = n > 1 ? Math.round((p.x - x0) / (x1 - x0) * (n - 1)) : 0;
+    i = Math.max(0, Math.min(n - 1, i));
+    var d = data[i], x = n > 1 ? x0 + i / (n - 1) * (x1 - x0) : (x0 + x1) / 2;
+    cursor.setAttribute("x1", x); cursor.setAttribute("x2", x);
+    cursor.setAttribute("visibility", "visible");
+    tip.textContent = "";
+    [d.date, "昼长 " + d.day_length_hhmm, "正午高度 " + d.max_altitude_deg + "°",
+     "日出 " + d.sunrise + " / 日落 " + d.sunset, "月面照亮 " + d.moon_illumination].forEach(function (s) {
+      var div = document.createElement("div"); div.textContent = s; tip.appendChild(div);
+    });
+    var r = box.getBoundingClientRect();
+    tip.style.display = "block";
+    tip.style.left = Math.min(ev.clientX - r.left + 12, r.width - tip.offsetWidth) + "px";
+    tip.style.top = (ev.clientY - r.top + 12) + "px";
+  });
+  function hide() { tip.style.display = "none"; cursor.setAttribute("visibility", "hidden"); }
+  svg.addEventListener("mouseleave", hide);
+})();
+</script>
+</body>
+</html>
+`, html.EscapeString(title), svg.String(), dataJSON)
+	return err
+}
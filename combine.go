@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// -------------------- 多城市合并输出 --------------------
+
+// astroSummarySheet 为合并工作簿中按日期对比各城市的汇总表名。
+const astroSummarySheet = "Summary"
+
+// combineFormat 返回 --combine 使用的输出格式：未显式指定 --format 时默认 excel（根命令的 txt 默认值没有合并形式），
+// 显式指定时原样返回，由 combinedAstroFormat 校验。
+func combineFormat(format string, explicit bool) string {
+	if !explicit {
+		return "excel"
+	}
+	return format
+}
+
+// combinedAstroFormat 校验 --combine 的输出格式：excel/xlsx 为每城市一个工作表的工作簿，csv 为带 city 列的长表。
+func combinedAstroFormat(format string) (string, error) {
+	f, ok := normalizeAstroFormat(format)
+	if !ok || (f != "excel" && f != "csv") {
+		return "", fmt.Errorf("--combine 仅支持 --format excel 或 csv（当前为 %s）", format)
+	}
+	return f, nil
+}
+
+// writeAstroCombined 将成功的结果合并写入一个文件（失败项跳过），format 为 combinedAstroFormat 的返回值。
+func writeAstroCombined(format string, jobs []*astroBatchJob, filePath string, allowOverwrite bool) (string, error) {
+	return writeAstroToFile(filePath, allowOverwrite, func(w io.Writer) error {
+		if format == "csv" {
+			return writeAstroLongCSVTo(w, jobs)
+		}
+		return writeAstroWorkbookTo(w, jobs)
+	})
+}
+
+// writeAstroWorkbookTo 写出多城市工作簿：首个工作表为 Summary（各城市同日的日出、日落、日照时长对比），
+// 其后每个城市一个工作表，表内格式与单城市 Excel 相同。
+func writeAstroWorkbookTo(w io.Writer, jobs []*astroBatchJob) error {
+	f := excelize.NewFile()
+	f.SetSheetName(f.GetSheetName(0), astroSummarySheet)
+	used := map[string]bool{strings.ToLower(astroSummarySheet): true}
+	var names []string
+	var ok []*astroBatchJob
+	for _, job := range jobs {
+		if job.Err != nil {
+			continue
+		}
+		sheet := excelSheetName(job.name(), used)
+		if _, err := f.NewSheet(sheet); err != nil {
+			return err
+		}
+		fillAstroSheet(f, sheet, job.Ctx.City, job.Ctx.observerElevation(), job.Ctx.Now, job.Data, job.Desc)
+		names = append(names, sheet)
+		ok = append(ok, job)
+	}
+	fillAstroSummarySheet(f, astroSummarySheet, names, ok)
+	return f.Write(w)
+}
+
+// fillAstroSummarySheet 按日期逐行对比各城市：日期取所有城市数据的并集，某城市缺少该日时留空；
+// 日照时长为分钟数（极昼/极夜为 "--"），便于在 Excel 中直接比较或作图。
+func fillAstroSummarySheet(f *excelize.File, sheet string, names []string, jobs []*astroBatchJob) {
+	byDate := make([]map[string]dailyAstro, len(jobs))
+	var dates []string
+	seen := make(map[string]bool)
+	for i, job := range jobs {
+		byDate[i] = make(map[string]dailyAstro, len(job.Data))
+		for _, d := range job.Data {
+			byDate[i][d.Date] = d
+			if !seen[d.Date] {
+				seen[d.Date] = true
+				dates = append(dates, d.Date)
+			}
+		}
+	}
+	sort.Strings(dates)
+
+	f.SetCellValue(sheet, "A1", "日期")
+	for i, name := range names {
+		for j, label := range []string{"日出", "日落", "日照时长(分钟)"} {
+			cell, _ := excelize.CoordinatesToCellName(2+i*3+j, 1)
+			f.SetCellValue(sheet, cell, name+" "+label)
+		}
+	}
+	for r, date := range dates {
+		row := r + 2
+		f.SetCellValue(sheet, fmt.Sprintf("A%d", row), date)
+		for i := range jobs {
+			d, ok := byDate[i][date]
+			if !ok {
+				continue
+			}
+			var minutes interface{} = "--"
+			if d.HasDayLength {
+				minutes = d.DayLengthMinutes
+			}
+			for j, v := range []interface{}{d.Sunrise, d.Sunset, minutes} {
+				cell, _ := excelize.CoordinatesToCellName(2+i*3+j, row)
+				f.SetCellValue(sheet, cell, v)
+			}
+		}
+	}
+	_ = f.SetPanes(sheet, &excelize.Panes{Freeze: true, XSplit: 1, YSplit: 1, TopLeftCell: "B2", ActivePane: "bottomRight"})
+}
+
+// writeAstroLongCSVTo 写出长表 CSV：首列为 city，其后与单城市 CSV 的数据列相同，每个城市每天一行；
+// 不含元信息行，可直接用 pandas.read_csv 读取后按 city 分组或透视。
+func writeAstroLongCSVTo(out io.Writer, jobs []*astroBatchJob) error {
+	var all []dailyAstro
+	for _, job := range jobs {
+		if job.Err == nil {
+			all = append(all, job.Data...)
+		}
+	}
+	columns := activeAstroColumns(all)
+	w := csv.NewWriter(out)
+	header := []string{"city"}
+	for _, c := range columns {
+		header = append(header, c.Key)
+	}
+	_ = w.Write(header)
+	for _, job := range jobs {
+		if job.Err != nil {
+			continue
+		}
+		for _, d := range job.Data {
+			row := []string{job.name()}
+			for _, c := range columns {
+				row = append(row, formatColumnValue(c.Value(d)))
+			}
+			_ = w.Write(row)
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// excelSheetName 将名称整理为合法且不重复的 Excel 工作表名（去掉 :\/?*[]，最长 31 个字符），used 记录已用名称。
+func excelSheetName(name string, used map[string]bool) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`:\/?*[]`, r) {
+			return '_'
+		}
+		return r
+	}, strings.Trim(strings.TrimSpace(name), "'"))
+	if name == "" {
+		name = "Sheet"
+	}
+	truncate := func(s string, n int) string {
+		if r := []rune(s); len(r) > n {
+			return string(r[:n])
+		}
+		return s
+	}
+	base := truncate(name, 31)
+	out := base
+	for i := 2; used[strings.ToLower(out)]; i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		out = truncate(base, 31-len(suffix)) + suffix
+	}
+	used[strings.ToLower(out)] = true
+	return out
+}
+
+// combinedBaseName 返回多城市合并文件的基础名：前三个城市名加时间范围，如 北京_上海_广州-2025-01-01_to_2025-01-31。
+func combinedBaseName(jobs []*astroBatchJob) string {
+	var parts []string
+	for _, job := range jobs {
+		if len(parts) == 3 {
+			parts = append(parts, fmt.Sprintf("等%d城", len(jobs)))
+			break
+		}
+		parts = append(parts, sanitizeFileName(job.Ctx.City))
+	}
+	first := jobs[0]
+	return strings.Join(parts, "_") + strings.TrimPrefix(first.BaseName, sanitizeFileName(first.Ctx.City))
+}
+
+// runCombinedCities 供 year/range 的 --combine 使用：逐个解析命令行中的城市（每个参数一个城市），
+// 并发生成 mode（year 或 range）的数据后合并为一个工作簿或长表 CSV；任一城市失败即返回错误。
+func runCombinedCities(cities []string, mode, fromStr, toStr string, opts OutputOptions) error {
+	if len(cities) == 0 {
+		return fmt.Errorf("--combine 需要在命令行给出城市名（每个参数一个城市，含空格的城市名请加引号）")
+	}
+	format, err := combinedAstroFormat(opts.Format)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"from": {fromStr}, "to": {toStr}}
+	jobs := make([]*astroBatchJob, 0, len(cities))
+	for i, city := range cities {
+		ctx, err := prepareCity(city, config.Offline)
+		if err != nil {
+			return fmt.Errorf("城市 [%s]: %w", city, err)
+		}
+		jobs = append(jobs, &astroBatchJob{Index: i, Item: astroBatchItem{City: city}, Mode: mode, Query: query, Ctx: ctx})
+	}
+	computeAstroBatch(jobs, astroBatchWorkers())
+	for _, job := range jobs {
+		if job.Err != nil {
+			return fmt.Errorf("城市 [%s]: %w", job.Item.City, job.Err)
+		}
+	}
+
+	path := combinedBaseName(jobs) + "." + astroFormatSpecs[format].Ext
+	if opts.OutDir != "" {
+		path = filepath.Join(opts.OutDir, path)
+	}
+	outFile, err := writeAstroCombined(format, jobs, path, opts.AllowOverwrite)
+	if err != nil {
+		return fmt.Errorf("写入文件失败: %w", err)
+	}
+	logInfof("已生成 %d 个城市的合并文件：%s", len(jobs), outFile)
+	return nil
+}
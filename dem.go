@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// -------------------- 观测点海拔与离线 DEM --------------------
+
+// 海拔取值范围（米）：下限覆盖死海等洼地，上限覆盖珠峰及高空观景台。
+const (
+	minElevation = -500.0
+	maxElevation = 9000.0
+)
+
+// srtmVoid 为 SRTM 数据中的空值标记。
+const srtmVoid = -32768
+
+var errDEMNoData = errors.New("DEM 无数据")
+
+// validateElevation 检查海拔是否在合理范围内。
+func validateElevation(elev float64) error {
+	if math.IsNaN(elev) || elev < minElevation || elev > maxElevation {
+		return fmt.Errorf("海拔 %.1f m 超出范围（%.0f ~ %.0f m）", elev, minElevation, maxElevation)
+	}
+	return nil
+}
+
+// horizonDipDeg 返回观测点高于周边地平时的地平俯角（度），公式与 sunmooncalc 的 observerAngle 一致：
+// 2.076′ × √h。海拔不为正时无俯角。
+func horizonDipDeg(elev float64) float64 {
+	if elev <= 0 {
+		return 0
+	}
+	return 2.076 * math.Sqrt(elev) / 60
+}
+
+// observerElevation 为观测点海拔（米）及其来源（dem/manual，为空表示未知）。
+type observerElevation struct {
+	Meters float64
+	Source string
+}
+
+// String 返回导出文件头中的海拔描述（见 formatElevation）。
+func (e observerElevation) String() string {
+	return formatElevation(e.Meters, e.Source)
+}
+
+// formatElevation 生成导出文件头中的海拔描述，如 “3000 m（地平俯角 1.90°，DEM）”。
+func formatElevation(elev float64, source string) string {
+	s := fmt.Sprintf("%.0f m", elev)
+	var extra []string
+	if dip := horizonDipDeg(elev); dip > 0 {
+		extra = append(extra, fmt.Sprintf("地平俯角 %.2f°", dip))
+	}
+	switch source {
+	case "dem":
+		extra = append(extra, "DEM")
+	case "manual":
+		extra = append(extra, "手动指定")
+	}
+	for i, e := range extra {
+		if i == 0 {
+			s += "（" + e
+		} else {
+			s += "，" + e
+		}
+	}
+	if len(extra) > 0 {
+		s += "）"
+	}
+	return s
+}
+
+// srtmTileName 返回覆盖 (lat, lon) 的 SRTM 瓦片文件名，如 N39E116.hgt、S34W071.hgt。
+func srtmTileName(lat, lon float64) string {
+	la, lo := int(math.Floor(lat)), int(math.Floor(lon))
+	ns, ew := 'N', 'E'
+	if la < 0 {
+		ns, la = 'S', -la
+	}
+	if lo < 0 {
+		ew, lo = 'W', -lo
+	}
+	return fmt.Sprintf("%c%02d%c%03d.hgt", ns, la, ew, lo)
+}
+
+// lookupSRTM 从 dir 下的 SRTM .hgt 瓦片（SRTM1 3601×3601 或 SRTM3 1201×1201，大端 int16）
+// 读取 (lat, lon) 的海拔，四邻点双线性插值，空值点不参与插值。
+func lookupSRTM(dir string, lat, lon float64) (float64, error) {
+	path := filepath.Join(dir, srtmTileName(lat, lon))
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, fmt.Errorf("%w：缺少瓦片 %s", errDEMNoData, filepath.Base(path))
+		}
+		return 0, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	switch st.Size() {
+	case 3601 * 3601 * 2:
+		n = 3601
+	case 1201 * 1201 * 2:
+		n = 1201
+	default:
+		return 0, fmt.Errorf("无法识别的 SRTM 瓦片大小 %d 字节: %s", st.Size(), path)
+	}
+
+	// 行从北向南、列从西向东排列
+	y := (math.Floor(lat) + 1 - lat) * float64(n-1)
+	x := (lon - math.Floor(lon)) * float64(n-1)
+	r0, c0 := min(int64(y), n-2), min(int64(x), n-2)
+	fy, fx := y-float64(r0), x-float64(c0)
+
+	var sum, weight float64
+	buf := make([]byte, 2)
+	for _, p := range [4]struct {
+		dr, dc int64
+		w      float64
+	}{
+		{0, 0, (1 - fy) * (1 - fx)},
+		{0, 1, (1 - fy) * fx},
+		{1, 0, fy * (1 - fx)},
+		{1, 1, fy * fx},
+	} {
+		if _, err := f.ReadAt(buf, ((r0+p.dr)*n+c0+p.dc)*2); err != nil {
+			return 0, fmt.Errorf("读取 SRTM 瓦片失败: %w", err)
+		}
+		v := int16(binary.BigEndian.Uint16(buf))
+		if v == srtmVoid {
+			continue
+		}
+		sum += float64(v) * p.w
+		weight += p.w
+	}
+	if weight == 0 {
+		return 0, fmt.Errorf("%w：(%.4f, %.4f) 为空值区域", errDEMNoData, lat, lon)
+	}
+	return sum / weight, nil
+}
+
+// demWarned 记录已告警过的 DEM 瓦片：同一瓦片查询失败只告警一次（HTTP 服务每个请求都会查询），之后降为 debug 日志。
+var demWarned sync.Map
+
+// demElevation 在配置了 --dem-dir 时查询坐标海拔；未配置或无数据时返回 false。
+func demElevation(lat, lon float64) (float64, bool) {
+	if config.DEMDir == "" {
+		return 0, false
+	}
+	elev, err := lookupSRTM(config.DEMDir, lat, lon)
+	if err != nil {
+		if _, warned := demWarned.LoadOrStore(srtmTileName(lat, lon), true); warned {
+			logDebugf("DEM 海拔查询失败，按 0 m 处理: %v", err)
+		} else {
+			logWarnf("DEM 海拔查询失败，按 0 m 处理（同一瓦片不再重复提示）: %v", err)
+		}
+		return 0, false
+	}
+	return elev, true
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// -------------------- 日食与月食预报 --------------------
+
+const (
+	eclipseSolar = "solar"
+	eclipseLunar = "lunar"
+
+	earthRadiusKm = 6378.14
+	sunRadiusKm   = 696000.0
+	auKmExact     = 149597870.7
+	// 月球半径与地球赤道半径之比：初亏/复圆用 0.2725076，食既/生光用 0.2722810（与 NASA 星历表一致）
+	moonRatioPenumbral = 0.2725076
+	moonRatioUmbral    = 0.2722810
+)
+
+// eclipseEvent 为一次日食/月食：全球参数来自 Meeus 第 54 章，Local 为指定地点的本地情况。
+type eclipseEvent struct {
+	Kind       string    // solar / lunar
+	GlobalType string    // partial / annular / hybrid / total / penumbral
+	Greatest   time.Time // 全球食甚（UTC）
+	Gamma      float64   // 月影轴（或月心）到地心的最小距离（地球赤道半径）
+	U          float64   // 本影锥在基本面上的半径
+	Magnitude  float64   // 全球食分：偏食为最大食分，月食为本影食分（半影月食为半影食分）
+	meanAnom   float64   // 月亮平近点角 M'（度），用于月食半持续时间
+	Local      localEclipse
+}
+
+// localEclipse 为指定地点所见的日食/月食情况；零值时间表示该接触不发生。
+// 日食：PartialStart/TotalStart/TotalEnd/PartialEnd 对应 C1/C2/C3/C4（环食时 Total* 表示环食阶段）；
+// 月食：PenumbralStart~PenumbralEnd 对应 P1/U1/U2/U3/U4/P4。
+type localEclipse struct {
+	Type         string // partial / annular / total / penumbral；日食本地不可见时为 none
+	Visible      bool   // 食相期间天体位于地平线以上
+	Maximum      time.Time
+	Magnitude    float64
+	Obscuration  float64 // 日面被遮挡的面积比例（仅日食）
+	SunAltitude  float64 // 食甚时太阳高度（度）
+	MoonAltitude float64 // 食甚时月亮高度（度）
+
+	PenumbralStart time.Time
+	PartialStart   time.Time
+	TotalStart     time.Time
+	TotalEnd       time.Time
+	PartialEnd     time.Time
+	PenumbralEnd   time.Time
+}
+
+// eclipseTypeNames 为食相类型的中文名称。
+var eclipseTypeNames = map[string]string{
+	"partial":   "偏食",
+	"annular":   "环食",
+	"hybrid":    "全环食",
+	"total":     "全食",
+	"penumbral": "半影食",
+	"none":      "不可见",
+}
+
+// eclipseTitle 返回如 "日全食"、"月偏食"、"半影月食" 的中文标题。
+func eclipseTitle(kind, typ string) string {
+	body := "日"
+	if kind == eclipseLunar {
+		body = "月"
+	}
+	if typ == "penumbral" {
+		return "半影" + body + "食"
+	}
+	if typ == "none" || typ == "" {
+		return body + "食（本地不可见）"
+	}
+	return body + eclipseTypeNames[typ]
+}
+
+// findEclipses 按 Meeus 第 54 章在 [from, to) 区间内搜索日食（新月）与月食（满月），只含全球参数。
+func findEclipses(from, to time.Time) []eclipseEvent {
+	if !to.After(from) {
+		return nil
+	}
+	var events []eclipseEvent
+	k := math.Floor((decimalYear(from)-2000)*12.3685) - 1
+	for ; ; k += 0.5 {
+		e, ok := eclipseAtLunation(k)
+		if !ok {
+			// 无食时仍需判断是否已越过区间终点
+			if jdeToTime(truePhaseJDE(k)).After(to) {
+				break
+			}
+			continue
+		}
+		if !e.Greatest.Before(to) {
+			break
+		}
+		if !e.Greatest.Before(from) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// eclipseAtLunation 计算第 k 个朔（整数）或望（.5）是否发生食及其全球参数。
+func eclipseAtLunation(k float64) (eclipseEvent, bool) {
+	jde, e, m, mp, f, om := meanLunationArgs(k)
+	if math.Abs(degSin(f)) > 0.36 {
+		return eclipseEvent{}, false
+	}
+	t := k / 1236.85
+	f1 := f - 0.02665*degSin(om)
+	a1 := 299.77 + 0.107408*k - 0.009173*t*t
+	solar := k == math.Floor(k)
+
+	if solar {
+		jde += -0.4075*degSin(mp) + 0.1721*e*degSin(m)
+	} else {
+		jde += -0.4065*degSin(mp) + 0.1727*e*degSin(m)
+	}
+	jde += 0.0161*degSin(2*mp) - 0.0097*degSin(2*f1) + 0.0073*e*degSin(mp-m) -
+		0.0050*e*degSin(mp+m) - 0.0023*degSin(mp-2*f1) + 0.0021*e*degSin(2*m) +
+		0.0012*degSin(mp+2*f1) + 0.0006*e*degSin(2*mp+m) - 0.0004*degSin(3*mp) -
+		0.0003*e*degSin(m+2*f1) + 0.0003*degSin(a1) - 0.0002*e*degSin(m-2*f1) -
+		0.0002*e*degSin(2*mp-m) - 0.0002*degSin(om)
+
+	p := 0.2070*e*degSin(m) + 0.0024*e*degSin(2*m) - 0.0392*degSin(mp) + 0.0116*degSin(2*mp) -
+		0.0073*e*degSin(mp+m) + 0.0067*e*degSin(mp-m) + 0.0118*degSin(2*f1)
+	q := 5.2207 - 0.0048*e*degCos(m) + 0.0020*e*degCos(2*m) - 0.3299*degCos(mp) -
+		0.0060*e*degCos(mp+m) + 0.0041*e*degCos(mp-m)
+	w := math.Abs(degCos(f1))
+	gamma := (p*degCos(f1) + q*degSin(f1)) * (1 - 0.0048*w)
+	u := 0.0059 + 0.0046*e*degCos(m) - 0.0182*degCos(mp) + 0.0004*degCos(2*mp) - 0.0005*degCos(m+mp)
+	g := math.Abs(gamma)
+
+	ev := eclipseEvent{Greatest: jdeToTime(jde), Gamma: gamma, U: u, meanAnom: mp}
+	if solar {
+		ev.Kind = eclipseSolar
+		switch {
+		case g > 1.5433+u:
+			return eclipseEvent{}, false
+		case g < 0.9972 || g < 0.9972+math.Abs(u):
+			switch {
+			case u < 0:
+				ev.GlobalType = "total"
+			case u > 0.0047:
+				ev.GlobalType = "annular"
+			case u < 0.00464*math.Sqrt(1-math.Min(g*g, 1)):
+				ev.GlobalType = "hybrid"
+			default:
+				ev.GlobalType = "annular"
+			}
+			ev.Magnitude = 1
+		default:
+			ev.GlobalType = "partial"
+			ev.Magnitude = (1.5433 + u - g) / (0.5461 + 2*u)
+		}
+		return ev, true
+	}
+
+	ev.Kind = eclipseLunar
+	penMag := (1.5573 + u - g) / 0.5450
+	umbMag := (1.0128 - u - g) / 0.5450
+	switch {
+	case penMag <= 0:
+		return eclipseEvent{}, false
+	case umbMag >= 1:
+		ev.GlobalType, ev.Magnitude = "total", umbMag
+	case umbMag > 0:
+		ev.GlobalType, ev.Magnitude = "partial", umbMag
+	default:
+		ev.GlobalType, ev.Magnitude = "penumbral", penMag
+	}
+	return ev, true
+}
+
+// localize 计算该次食在 (lat, lon) 处的本地情况。
+func (e eclipseEvent) localize(lat, lon float64) eclipseEvent {
+	if e.Kind == eclipseSolar {
+		e.Local = localSolarEclipse(e, lat, lon)
+	} else {
+		e.Local = localLunarEclipse(e, lat, lon)
+	}
+	return e
+}
+
+// findLocalEclipses 搜索区间内的日食/月食并计算指定地点的本地情况。
+func findLocalEclipses(from, to time.Time, lat, lon float64) []eclipseEvent {
+	events := findEclipses(from, to)
+	for i := range events {
+		events[i] = events[i].localize(lat, lon)
+	}
+	return events
+}
+
+// localLunarEclipse 按 Meeus 第 54 章半持续时间给出各接触时刻，并以月亮高度判断本地可见性。
+func localLunarEclipse(e eclipseEvent, lat, lon float64) localEclipse {
+	g := math.Abs(e.Gamma)
+	n := 0.5458 + 0.0400*degCos(e.meanAnom)
+	semi := func(x float64) time.Duration {
+		if x <= g {
+			return 0
+		}
+		return time.Duration(60 / n * math.Sqrt(x*x-g*g) * float64(time.Minute))
+	}
+	greatest := e.Greatest
+	le := localEclipse{Type: e.GlobalType, Maximum: greatest, Magnitude: e.Magnitude}
+	if d := semi(1.5573 + e.U); d > 0 {
+		le.PenumbralStart, le.PenumbralEnd = greatest.Add(-d), greatest.Add(d)
+	}
+	if d := semi(1.0128 - e.U); d > 0 {
+		le.PartialStart, le.PartialEnd = greatest.Add(-d), greatest.Add(d)
+	}
+	if d := semi(0.4678 - e.U); d > 0 {
+		le.TotalStart, le.TotalEnd = greatest.Add(-d), greatest.Add(d)
+	}
+
+	_, _, moonAlt := bodyTopocentric(greatest, lat, lon, false)
+	_, _, sunAlt := bodyTopocentric(greatest, lat, lon, true)
+	le.MoonAltitude, le.SunAltitude = moonAlt, sunAlt
+
+	// 半影月食肉眼几乎不可察觉，但仍按半影阶段判断可见；其余按本影阶段判断。
+	start, end := le.PartialStart, le.PartialEnd
+	if start.IsZero() {
+		start, end = le.PenumbralStart, le.PenumbralEnd
+	}
+	for t := start; !t.After(end); t = t.Add(5 * time.Minute) {
+		if _, _, alt := bodyTopocentric(t, lat, lon, false); alt > -0.833 {
+			le.Visible = true
+			break
+		}
+	}
+	return le
+}
+
+// localSolarEclipse 以 1 分钟步长扫描全球食甚前后 4 小时的日月视距离，二分求各接触时刻。
+func localSolarEclipse(e eclipseEvent, lat, lon float64) localEclipse {
+	type sample struct {
+		t                     time.Time
+		sep, sunR, penR, umbR float64
+		sunAlt                float64
+	}
+	at := func(t time.Time) sample {
+		sep, sunR, moonR, sunAlt := sunMoonApparent(t, lat, lon)
+		return sample{t, sep, sunR, moonR, moonR * moonRatioUmbral / moonRatioPenumbral, sunAlt}
+	}
+	outer := func(s sample) float64 { return s.sep - (s.sunR + s.penR) }
+	inner := func(s sample) float64 { return s.sep - math.Abs(s.umbR-s.sunR) }
+
+	le := localEclipse{Type: "none"}
+	step := time.Minute
+	start := e.Greatest.Add(-4 * time.Hour)
+	prev := at(start)
+	best := prev
+	for t := start.Add(step); !t.After(e.Greatest.Add(4 * time.Hour)); t = t.Add(step) {
+		cur := at(t)
+		if cur.sep < best.sep {
+			best = cur
+		}
+		if outer(cur) < 0 && cur.sunAlt > -0.833 {
+			le.Visible = true
+		}
+		if (outer(prev) < 0) != (outer(cur) < 0) {
+			c := bisectContact(prev.t, cur.t, func(x time.Time) float64 { return outer(at(x)) })
+			if outer(cur) < 0 {
+				le.PartialStart = c
+			} else {
+				le.PartialEnd = c
+			}
+		}
+		if (inner(prev) < 0) != (inner(cur) < 0) {
+			c := bisectContact(prev.t, cur.t, func(x time.Time) float64 { return inner(at(x)) })
+			if inner(cur) < 0 {
+				le.TotalStart = c
+			} else {
+				le.TotalEnd = c
+			}
+		}
+		prev = cur
+	}
+	// 日月圆面重叠期间太阳始终在地平线下时，穿过地球的几何重叠没有意义，按本地无食处理
+	if outer(best) >= 0 || !le.Visible {
+		return localEclipse{Type: "none"}
+	}
+
+	// 在最佳采样点附近细化食甚（黄金分割搜索）
+	lo, hi := best.t.Add(-step), best.t.Add(step)
+	for hi.Sub(lo) > time.Second {
+		m1 := lo.Add(hi.Sub(lo) / 3)
+		m2 := hi.Add(-hi.Sub(lo) / 3)
+		if at(m1).sep < at(m2).sep {
+			hi = m2
+		} else {
+			lo = m1
+		}
+	}
+	best = at(lo.Add(hi.Sub(lo) / 2))
+
+	le.Maximum = best.t
+	le.SunAltitude = best.sunAlt
+	_, _, le.MoonAltitude = bodyTopocentric(best.t, lat, lon, false)
+	le.Magnitude = (best.sunR + best.penR - best.sep) / (2 * best.sunR)
+	le.Obscuration = diskOverlapFraction(best.sunR, best.umbR, best.sep)
+	switch {
+	case best.sep <= best.umbR-best.sunR:
+		le.Type = "total"
+	case best.sep <= best.sunR-best.umbR:
+		le.Type = "annular"
+	default:
+		le.Type = "partial"
+		le.TotalStart, le.TotalEnd = time.Time{}, time.Time{}
+	}
+	return le
+}
+
+// bisectContact 在 [a, b] 内二分求 f 的符号变化点，精度 1 秒。
+func bisectContact(a, b time.Time, f func(time.Time) float64) time.Time {
+	fa := f(a)
+	for b.Sub(a) > time.Second {
+		mid := a.Add(b.Sub(a) / 2)
+		fm := f(mid)
+		if (fm < 0) == (fa < 0) {
+			a, fa = mid, fm
+		} else {
+			b = mid
+		}
+	}
+	return a.Add(b.Sub(a) / 2).Round(time.Second)
+}
+
+// diskOverlapFraction 返回半径 rs 的日面被半径 rm、圆心距 d 的月面遮挡的面积比例。
+func diskOverlapFraction(rs, rm, d float64) float64 {
+	switch {
+	case d >= rs+rm:
+		return 0
+	case d <= math.Abs(rm-rs):
+		return math.Min(1, (rm*rm)/(rs*rs))
+	}
+	a := rs*rs*math.Acos((d*d+rs*rs-rm*rm)/(2*d*rs)) +
+		rm*rm*math.Acos((d*d+rm*rm-rs*rs)/(2*d*rm)) -
+		0.5*math.Sqrt((-d+rs+rm)*(d+rs-rm)*(d-rs+rm)*(d+rs+rm))
+	return a / (math.Pi * rs * rs)
+}
+
+// sunMoonApparent 返回 t 时刻 (lat, lon) 处日月站心视距离、太阳与月亮视半径（度，月亮按初亏半径）及太阳高度。
+func sunMoonApparent(t time.Time, lat, lon float64) (sep, sunR, moonR, sunAlt float64) {
+	sunVec, sunDist, sunAlt := bodyTopocentric(t, lat, lon, true)
+	moonVec, moonDist, _ := bodyTopocentric(t, lat, lon, false)
+	cosSep := (sunVec[0]*moonVec[0] + sunVec[1]*moonVec[1] + sunVec[2]*moonVec[2]) / (sunDist * moonDist)
+	sep = math.Acos(math.Max(-1, math.Min(1, cosSep))) * 180 / math.Pi
+	sunR = math.Asin(sunRadiusKm/sunDist) * 180 / math.Pi
+	moonR = math.Asin(moonRatioPenumbral*earthRadiusKm/moonDist) * 180 / math.Pi
+	return
+}
+
+// bodyTopocentric 返回太阳（sun=true）或月亮在 t 时刻相对观测者的赤道直角坐标（km）、距离（km）与高度角（度，几何高度）。
+func bodyTopocentric(t time.Time, lat, lon float64, sun bool) (vec [3]float64, dist, altDeg float64) {
+	jde := timeToJDE(t)
+	tc := (jde - 2451545.0) / 36525
+	dpsi, deps := nutation(tc)
+	eps := 23.4392911 - 0.0130042*tc + deps/3600
+
+	var lam, beta, r float64
+	if sun {
+		var rAU float64
+		lam, rAU = sunApparentPosition(jde)
+		r = rAU * auKmExact
+	} else {
+		lam, beta, r = moonGeocentric(jde)
+		lam += dpsi / 3600
+	}
+
+	ra, dec := eclipticToEquatorial(lam, beta, eps)
+	body := [3]float64{r * math.Cos(dec) * math.Cos(ra), r * math.Cos(dec) * math.Sin(ra), r * math.Sin(dec)}
+
+	// 观测者地心坐标（WGS 扁率，海平面）
+	theta := (apparentSiderealDeg(t, dpsi, eps) + lon) * math.Pi / 180
+	uu := math.Atan(0.99664719 * math.Tan(lat*math.Pi/180))
+	rhoSin, rhoCos := 0.99664719*math.Sin(uu), math.Cos(uu)
+	obs := [3]float64{earthRadiusKm * rhoCos * math.Cos(theta), earthRadiusKm * rhoCos * math.Sin(theta), earthRadiusKm * rhoSin}
+
+	for i := range vec {
+		vec[i] = body[i] - obs[i]
+	}
+	dist = math.Sqrt(vec[0]*vec[0] + vec[1]*vec[1] + vec[2]*vec[2])
+	raT := math.Atan2(vec[1], vec[0])
+	decT := math.Asin(vec[2] / dist)
+	h := theta - raT
+	sinAlt := degSin(lat)*math.Sin(decT) + degCos(lat)*math.Cos(decT)*math.Cos(h)
+	altDeg = math.Asin(sinAlt) * 180 / math.Pi
+	return
+}
+
+// moonTerm 为 Meeus 表 47.A/47.B 的一项：D、M、M'、F 的系数与正弦/余弦振幅。
+type moonTerm struct {
+	d, m, mp, f int
+	a, b        float64
+}
+
+// moonLR 为月亮黄经（1e-6 度，正弦）与距离（1e-3 km，余弦）主要周期项。
+var moonLR = []moonTerm{
+	{0, 0, 1, 0, 6288774, -20905355}, {2, 0, -1, 0, 1274027, -3699111},
+	{2, 0, 0, 0, 658314, -2955968}, {0, 0, 2, 0, 213618, -569925},
+	{0, 1, 0, 0, -185116, 48888}, {0, 0, 0, 2, -114332, -3149},
+	{2, 0, -2, 0, 58793, 246158}, {2, -1, -1, 0, 57066, -152138},
+	{2, 0, 1, 0, 53322, -170733}, {2, -1, 0, 0, 45758, -204586},
+	{0, 1, -1, 0, -40923, -129620}, {1, 0, 0, 0, -34720, 108743},
+	{0, 1, 1, 0, -30383, 104755}, {2, 0, 0, -2, 15327, 10321},
+	{0, 0, 1, 2, -12528, 0}, {0, 0, 1, -2, 10980, 79661},
+	{4, 0, -1, 0, 10675, -34782}, {0, 0, 3, 0, 10034, -23210},
+	{4, 0, -2, 0, 8548, -21636}, {2, 1, -1, 0, -7888, 24208},
+	{2, 1, 0, 0, -6766, 30824}, {1, 0, -1, 0, -5163, -8379},
+	{1, 1, 0, 0, 4987, -16675}, {2, -1, 1, 0, 4036, -12831},
+	{2, 0, 2, 0, 3994, -10445}, {4, 0, 0, 0, 3861, -11650},
+	{2, 0, -3, 0, 3665, 14403}, {0, 1, -2, 0, -2689, -7003},
+	{2, 0, -1, 2, -2602, 0}, {2, -1, -2, 0, 2390, 10056},
+	{1, 0, 1, 0, -2348, 6322}, {2, -2, 0, 0, 2236, -9884},
+	{0, 1, 2, 0, -2120, 5751}, {0, 2, 0, 0, -2069, 0},
+	{2, -2, -1, 0, 2048, -4950}, {2, 0, 1, -2, -1773, 4130},
+	{2, 0, 0, 2, -1595, 0}, {4, -1, -1, 0, 1215, -3958},
+	{0, 0, 2, 2, -1110, 0}, {3, 0, -1, 0, -892, 3258},
+	{2, 1, 1, 0, -810, 2616}, {4, -1, -2, 0, 759, -1897},
+	{0, 2, -1, 0, -713, -2117}, {2, 2, -1, 0, -700, 2354},
+	{2, 1, -2, 0, 691, 0}, {2, -1, 0, -2, 596, 0},
+	{4, 0, 1, 0, 549, -1423}, {0, 0, 4, 0, 537, -1117},
+	{4, -1, 0, 0, 520, -1571}, {1, 0, -2, 0, -487, -1739},
+	{2, 1, 0, -2, -399, 0}, {0, 0, 2, -2, -381, -4421},
+	{1, 1, 1, 0, 351, 0}, {3, 0, -2, 0, -340, 0},
+	{4, 0, -3, 0, 330, 0}, {2, -1, 2, 0, 327, 0},
+	{0, 2, 1, 0, -323, 1165}, {1, 1, -1, 0, 299, 0},
+	{2, 0, 3, 0, 294, 0}, {2, 0, -1, -2, 0, 8752},
+}
+
+// moonB 为月亮黄纬（1e-6 度，正弦）主要周期项。
+var moonB = []moonTerm{
+	{0, 0, 0, 1, 5128122, 0}, {0, 0, 1, 1, 280602, 0}, {0, 0, 1, -1, 277693, 0},
+	{2, 0, 0, -1, 173237, 0}, {2, 0, -1, 1, 55413, 0}, {2, 0, -1, -1, 46271, 0},
+	{2, 0, 0, 1, 32573, 0}, {0, 0, 2, 1, 17198, 0}, {2, 0, 1, -1, 9266, 0},
+	{0, 0, 2, -1, 8822, 0}, {2, -1, 0, -1, 8216, 0}, {2, 0, -2, -1, 4324, 0},
+	{2, 0, 1, 1, 4200, 0}, {2, 1, 0, -1, -3359, 0}, {2, -1, -1, 1, 2463, 0},
+	{2, -1, 0, 1, 2211, 0}, {2, -1, -1, -1, 2065, 0}, {0, 1, -1, -1, -1870, 0},
+	{4, 0, -1, -1, 1828, 0}, {0, 1, 0, 1, -1794, 0}, {0, 0, 0, 3, -1749, 0},
+	{0, 1, -1, 1, -1565, 0}, {1, 0, 0, 1, -1491, 0}, {0, 1, 1, 1, -1475, 0},
+	{0, 1, 1, -1, -1410, 0}, {0, 1, 0, -1, -1344, 0}, {1, 0, 0, -1, -1335, 0},
+	{0, 0, 3, 1, 1107, 0}, {4, 0, 0, -1, 1021, 0}, {4, 0, -1, 1, 833, 0},
+}
+
+// moonGeocentric 按 Meeus 第 47 章（截断）计算月亮地心黄经、黄纬（度，未加章动）与地月距离（km）。
+func moonGeocentric(jde float64) (lonDeg, latDeg, distKm float64) {
+	t := (jde - 2451545.0) / 36525
+	t2, t3, t4 := t*t, t*t*t, t*t*t*t
+	lp := 218.3164477 + 481267.88123421*t - 0.0015786*t2 + t3/538841 - t4/65194000
+	d := 297.8501921 + 445267.1114034*t - 0.0018819*t2 + t3/545868 - t4/113065000
+	m := 357.5291092 + 35999.0502909*t - 0.0001536*t2 + t3/24490000
+	mp := 134.9633964 + 477198.8675055*t + 0.0087414*t2 + t3/69699 - t4/14712000
+	f := 93.2720950 + 483202.0175233*t - 0.0036539*t2 - t3/3526000 + t4/863310000
+	a1 := 119.75 + 131.849*t
+	a2 := 53.09 + 479264.290*t
+	a3 := 313.45 + 481266.484*t
+	e := 1 - 0.002516*t - 0.0000074*t2
+
+	eFactor := func(m int) float64 {
+		switch m {
+		case 1, -1:
+			return e
+		case 2, -2:
+			return e * e
+		}
+		return 1
+	}
+	var sl, sr, sb float64
+	for _, x := range moonLR {
+		arg := float64(x.d)*d + float64(x.m)*m + float64(x.mp)*mp + float64(x.f)*f
+		ef := eFactor(x.m)
+		sl += x.a * ef * degSin(arg)
+		sr += x.b * ef * degCos(arg)
+	}
+	for _, x := range moonB {
+		arg := float64(x.d)*d + float64(x.m)*m + float64(x.mp)*mp + float64(x.f)*f
+		sb += x.a * eFactor(x.m) * degSin(arg)
+	}
+	sl += 3958*degSin(a1) + 1962*degSin(lp-f) + 318*degSin(a2)
+	sb += -2235*degSin(lp) + 382*degSin(a3) + 175*degSin(a1-f) + 175*degSin(a1+f) +
+		127*degSin(lp-mp) - 115*degSin(lp+mp)
+
+	return normalizeDeg(lp + sl/1e6), sb / 1e6, 385000.56 + sr/1000
+}
+
+// eclipseJSON 为日食/月食的对外 JSON 结构（时间为城市当地时间，RFC3339；不发生的接触省略）。
+type eclipseJSON struct {
+	Kind            string  `json:"kind"`
+	Title           string  `json:"title"`
+	GlobalType      string  `json:"global_type"`
+	Type            string  `json:"local_type"`
+	Visible         bool    `json:"visible"`
+	Date            string  `json:"date"`
+	GlobalGreatest  string  `json:"global_greatest"`
+	Maximum         string  `json:"maximum,omitempty"`
+	Magnitude       float64 `json:"magnitude"`
+	Obscuration     float64 `json:"obscuration,omitempty"`
+	SunAltitudeDeg  float64 `json:"sun_altitude_deg"`
+	MoonAltitudeDeg float64 `json:"moon_altitude_deg"`
+	Gamma           float64 `json:"gamma"`
+	PenumbralStart  string  `json:"penumbral_start,omitempty"`
+	PartialStart    string  `json:"partial_start,omitempty"`
+	TotalStart      string  `json:"total_start,omitempty"`
+	TotalEnd        string  `json:"total_end,omitempty"`
+	PartialEnd      string  `json:"partial_end,omitempty"`
+	PenumbralEnd    string  `json:"penumbral_end,omitempty"`
+}
+
+// toJSON 将日食/月食转换为指定时区下的 JSON 结构。
+func (e eclipseEvent) toJSON(loc *time.Location) eclipseJSON {
+	local := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.In(loc).Format(time.RFC3339)
+	}
+	dateRef := e.Local.Maximum
+	if dateRef.IsZero() {
+		dateRef = e.Greatest
+	}
+	l := e.Local
+	return eclipseJSON{
+		Kind:            e.Kind,
+		Title:           eclipseTitle(e.Kind, l.Type),
+		GlobalType:      e.GlobalType,
+		Type:            l.Type,
+		Visible:         l.Visible,
+		Date:            dateRef.In(loc).Format("2006-01-02"),
+		GlobalGreatest:  local(e.Greatest),
+		Maximum:         local(l.Maximum),
+		Magnitude:       math.Round(l.Magnitude*1000) / 1000,
+		Obscuration:     math.Round(l.Obscuration*1000) / 1000,
+		SunAltitudeDeg:  math.Round(l.SunAltitude*10) / 10,
+		MoonAltitudeDeg: math.Round(l.MoonAltitude*10) / 10,
+		Gamma:           math.Round(e.Gamma*10000) / 10000,
+		PenumbralStart:  local(l.PenumbralStart),
+		PartialStart:    local(l.PartialStart),
+		TotalStart:      local(l.TotalStart),
+		TotalEnd:        local(l.TotalEnd),
+		PartialEnd:      local(l.PartialEnd),
+		PenumbralEnd:    local(l.PenumbralEnd),
+	}
+}
+
+// span 返回本地食相的起止时刻（最早/最晚接触），用于日历事件；无接触时退回全球食甚。
+func (e eclipseEvent) span() (start, end time.Time) {
+	l := e.Local
+	for _, t := range []time.Time{l.PenumbralStart, l.PartialStart, l.TotalStart, l.Maximum} {
+		if !t.IsZero() {
+			start = t
+			break
+		}
+	}
+	for _, t := range []time.Time{l.PenumbralEnd, l.PartialEnd, l.TotalEnd, l.Maximum} {
+		if !t.IsZero() {
+			end = t
+			break
+		}
+	}
+	if start.IsZero() {
+		start, end = e.Greatest, e.Greatest
+	}
+	return start, end
+}
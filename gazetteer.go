@@ -0,0 +1,257 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// -------------------- 内置离线城市库 --------------------
+
+//go:embed gazetteer.tsv
+var gazetteerTSV string
+
+// gazetteerCity 为内置城市库中的一条记录；keys 为归一化后的名称/中文名/拼音/别名，initials 为拼音首字母。
+type gazetteerCity struct {
+	Name       string
+	Zh         string
+	Pinyin     string
+	Country    string
+	Admin      string
+	Lat        float64
+	Lon        float64
+	Population int64
+	Timezone   string
+	Aliases    []string
+
+	keys     []string
+	initials string
+}
+
+var (
+	gazetteerOnce   sync.Once
+	gazetteerCities []gazetteerCity
+)
+
+// gazetteerFold 将带声调/变音符号的拉丁字母折叠为基本字母，便于拼音与外文地名匹配。
+var gazetteerFold = strings.NewReplacer(
+	"ā", "a", "á", "a", "ǎ", "a", "à", "a", "â", "a", "ã", "a", "å", "a", "ä", "a",
+	"ē", "e", "é", "e", "ě", "e", "è", "e", "ê", "e",
+	"ī", "i", "í", "i", "ǐ", "i", "ì", "i", "î", "i",
+	"ō", "o", "ó", "o", "ǒ", "o", "ò", "o", "ô", "o", "ö", "o", "ø", "o",
+	"ū", "u", "ú", "u", "ǔ", "u", "ù", "u", "û", "u", "ü", "u", "ǖ", "u", "ǘ", "u", "ǚ", "u", "ǜ", "u",
+	"ç", "c", "ñ", "n",
+)
+
+// normalizeGazetteerKey 归一化地名：小写、去声调、去掉空格/连字符/撇号/点号及末尾的“市”。
+func normalizeGazetteerKey(s string) string {
+	s = gazetteerFold.Replace(strings.ToLower(strings.TrimSpace(s)))
+	s = strings.TrimSuffix(s, "市")
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsSpace(r) || strings.ContainsRune("-'’.·", r) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// parseGazetteer 解析内置 TSV 数据，跳过以 # 开头的注释行。
+func parseGazetteer(data string) ([]gazetteerCity, error) {
+	var out []gazetteerCity
+	for i, line := range strings.Split(data, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) != 10 {
+			return nil, fmt.Errorf("城市库第 %d 行字段数为 %d，应为 10", i+1, len(f))
+		}
+		lat, err := strconv.ParseFloat(f[5], 64)
+		if err != nil {
+			return nil, fmt.Errorf("城市库第 %d 行纬度无效: %w", i+1, err)
+		}
+		lon, err := strconv.ParseFloat(f[6], 64)
+		if err != nil {
+			return nil, fmt.Errorf("城市库第 %d 行经度无效: %w", i+1, err)
+		}
+		pop, err := strconv.ParseInt(f[7], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("城市库第 %d 行人口无效: %w", i+1, err)
+		}
+		c := gazetteerCity{
+			Name: f[0], Zh: f[1], Pinyin: f[2], Country: f[3], Admin: f[4],
+			Lat: lat, Lon: lon, Population: pop, Timezone: f[8],
+		}
+		if f[9] != "" {
+			c.Aliases = strings.Split(f[9], ",")
+		}
+		c.index()
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// index 根据名称、中文名、拼音与别名生成匹配用的归一化键和拼音首字母。
+func (c *gazetteerCity) index() {
+	c.keys, c.initials = nil, ""
+	for _, k := range append([]string{c.Name, c.Zh, c.Pinyin}, c.Aliases...) {
+		if k = normalizeGazetteerKey(k); k != "" {
+			c.keys = append(c.keys, k)
+		}
+	}
+	for _, syl := range strings.Fields(c.Pinyin) {
+		c.initials += syl[:1]
+	}
+}
+
+// loadGazetteer 惰性解析内置城市库（内置数据格式错误属于构建问题，直接 panic）。
+func loadGazetteer() []gazetteerCity {
+	gazetteerOnce.Do(func() {
+		cities, err := parseGazetteer(gazetteerTSV)
+		if err != nil {
+			panic(err)
+		}
+		gazetteerCities = cities
+	})
+	return gazetteerCities
+}
+
+// editDistance 计算两个字符串按字符（rune）的 Levenshtein 距离。
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// gazetteerTier 返回城市与查询的匹配档位：0 完全匹配，1 前缀，2 拼音首字母，3 以上为模糊匹配（3+编辑距离），-1 不匹配。
+func (c gazetteerCity) gazetteerTier(q string) int {
+	for _, k := range c.keys {
+		if k == q {
+			return 0
+		}
+	}
+	n := len([]rune(q))
+	if n >= 2 {
+		for _, k := range c.keys {
+			if strings.HasPrefix(k, q) {
+				return 1
+			}
+		}
+	}
+	if n >= 2 && c.initials == q {
+		return 2
+	}
+	if n >= 4 {
+		maxDist := 1
+		if n >= 7 {
+			maxDist = 2
+		}
+		best := -1
+		for _, k := range c.keys {
+			if d := editDistance(q, k); d <= maxDist && (best < 0 || d < best) {
+				best = d
+			}
+		}
+		if best >= 0 {
+			return 3 + best
+		}
+	}
+	return -1
+}
+
+// candidate 将城市库记录转换为地理编码候选。
+func (c gazetteerCity) candidate() GeoCandidate {
+	display := c.Name
+	if c.Zh != "" {
+		display += " " + c.Zh
+	}
+	if c.Admin != "" && c.Admin != c.Name {
+		display += ", " + c.Admin
+	}
+	display += ", " + c.Country
+	aliases := []string{c.Name}
+	if c.Zh != "" {
+		aliases = append(aliases, c.Zh)
+	}
+	return GeoCandidate{
+		DisplayName: display,
+		Name:        c.Name,
+		Lat:         c.Lat,
+		Lon:         c.Lon,
+		Country:     c.Country,
+		CountryCode: strings.ToLower(c.Country),
+		AdminArea:   c.Admin,
+		Type:        "city",
+		Population:  c.Population,
+		Timezone:    c.Timezone,
+		Source:      "gazetteer",
+		Aliases:     append(aliases, c.Aliases...),
+	}
+}
+
+// searchGazetteer 在内置城市库中按名称、中文名、拼音、别名搜索，按匹配档位和人口排序。
+// exactOnly 为 true 时只返回完全匹配；否则有完全匹配时只返回完全匹配，没有时再给出前缀/首字母/模糊结果。
+func searchGazetteer(query, country string, exactOnly bool, limit int) []GeoCandidate {
+	return searchCities(loadGazetteer(), query, country, exactOnly, limit)
+}
+
+// searchCities 在给定城市列表中执行与 searchGazetteer 相同的匹配与排序。
+func searchCities(cities []gazetteerCity, query, country string, exactOnly bool, limit int) []GeoCandidate {
+	q := normalizeGazetteerKey(query)
+	if q == "" {
+		return nil
+	}
+	type hit struct {
+		city gazetteerCity
+		tier int
+	}
+	var hits []hit
+	for _, c := range cities {
+		tier := c.gazetteerTier(q)
+		if tier < 0 || (exactOnly && tier > 0) {
+			continue
+		}
+		if !candidateInCountry(GeoCandidate{CountryCode: strings.ToLower(c.Country)}, country) {
+			continue
+		}
+		hits = append(hits, hit{c, tier})
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].tier != hits[j].tier {
+			return hits[i].tier < hits[j].tier
+		}
+		return hits[i].city.Population > hits[j].city.Population
+	})
+	var out []GeoCandidate
+	for _, h := range hits {
+		if len(out) > 0 && hits[0].tier == 0 && h.tier > 0 {
+			break
+		}
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+		out = append(out, h.city.candidate())
+	}
+	return out
+}
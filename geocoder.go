@@ -0,0 +1,832 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -------------------- 地理编码器 --------------------
+
+const (
+	defaultNominatimURL = "https://nominatim.openstreetmap.org/search"
+	defaultPhotonURL    = "https://photon.komoot.io/api"
+	defaultGeocoders    = "gazetteer,nominatim"
+	geocoderAppName     = "eSunMoon/1.0"
+)
+
+var (
+	// errCityNotFound 表示数据源中没有匹配的地点；链式地理编码器遇到它会继续尝试下一个数据源。
+	errCityNotFound = errors.New("未找到城市")
+	// errGeocoderOffline 表示离线模式下跳过了需要联网的数据源。
+	errGeocoderOffline = errors.New("离线模式下不进行网络地理编码")
+)
+
+// GeoQuery 为一次地理编码查询。
+type GeoQuery struct {
+	Text    string
+	Country string // ISO 3166-1 二位国家代码，可逗号分隔多个
+	Limit   int
+	Offline bool // 离线：网络数据源直接跳过，本地数据源放宽为前缀/拼音首字母/模糊匹配
+}
+
+// Geocoder 将城市名解析为候选地点，按相关度排序；无结果时返回包装 errCityNotFound 的错误。
+type Geocoder interface {
+	Name() string
+	Search(ctx context.Context, q GeoQuery) ([]GeoCandidate, error)
+}
+
+// ReverseGeocoder 由支持坐标 → 地名反查的数据源实现；offline 为 true 时网络数据源返回 errGeocoderOffline。
+type ReverseGeocoder interface {
+	Reverse(ctx context.Context, lat, lon float64, offline bool) (GeoCandidate, error)
+}
+
+// reverseNearestKm 为本地城市库反查的最大距离，超出时视为附近没有已知城市。
+const reverseNearestKm = 50.0
+
+// haversineKm 返回两点间的大圆距离（公里）。
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	p1, p2 := lat1*math.Pi/180, lat2*math.Pi/180
+	dp, dl := p2-p1, (lon2-lon1)*math.Pi/180
+	a := math.Sin(dp/2)*math.Sin(dp/2) + math.Cos(p1)*math.Cos(p2)*math.Sin(dl/2)*math.Sin(dl/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// nearestCity 返回 maxKm 范围内距离最近的城市候选，DisplayName 注明距离。
+func nearestCity(cities []gazetteerCity, lat, lon, maxKm float64) (GeoCandidate, bool) {
+	best, bestKm := -1, maxKm
+	for i, c := range cities {
+		if d := haversineKm(lat, lon, c.Lat, c.Lon); d <= bestKm {
+			best, bestKm = i, d
+		}
+	}
+	if best < 0 {
+		return GeoCandidate{}, false
+	}
+	cand := cities[best].candidate()
+	cand.DistanceKm = math.Round(bestKm*10) / 10
+	if bestKm >= 1 {
+		cand.DisplayName += fmt.Sprintf("（约 %.0f km）", bestKm)
+	}
+	return cand, true
+}
+
+// notFound 返回包装 errCityNotFound 的错误，消息保持“未找到城市: X”。
+func notFound(city string) error {
+	return fmt.Errorf("%w: %s", errCityNotFound, city)
+}
+
+// geocoderUserAgent 生成请求头 User-Agent：显式配置优先，否则为应用名并附上联系邮箱（Nominatim 使用政策要求可识别来源）。
+func geocoderUserAgent(userAgent, email string) string {
+	if userAgent != "" {
+		return userAgent
+	}
+	if email != "" {
+		return fmt.Sprintf("%s (contact: %s)", geocoderAppName, email)
+	}
+	return geocoderAppName
+}
+
+// rateLimiter 保证经它发出的相邻两次请求至少间隔 interval；nil 表示不限速。
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// nominatimLimiter 为公共 Nominatim 服务的全局限速器（使用政策要求每秒至多 1 次请求），自建实例不受限。
+var nominatimLimiter = &rateLimiter{interval: time.Second}
+
+// wait 阻塞到下一个可用的请求时刻；ctx 先结束时返回 ctx.Err()。
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+	if at.Equal(now) {
+		return ctx.Err()
+	}
+	t := time.NewTimer(at.Sub(now))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// geocoderGet 发送 GET 请求并将 JSON 响应解码到 out。
+func geocoderGet(ctx context.Context, client HTTPClient, service, rawURL, userAgent string, out interface{}) error {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s HTTP 错误: %s", service, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// -------------------- Nominatim --------------------
+
+type nominatimPlace struct {
+	Lat         string           `json:"lat"`
+	Lon         string           `json:"lon"`
+	DisplayName string           `json:"display_name"`
+	Name        string           `json:"name"`
+	Class       string           `json:"class"`
+	Type        string           `json:"type"`
+	AddressType string           `json:"addresstype"`
+	Importance  float64          `json:"importance"`
+	Address     nominatimAddress `json:"address"`
+}
+
+type nominatimAddress struct {
+	City        string `json:"city"`
+	Town        string `json:"town"`
+	Village     string `json:"village"`
+	Country     string `json:"country"`
+	CountryCode string `json:"country_code"`
+	State       string `json:"state"`
+	Province    string `json:"province"`
+	Region      string `json:"region"`
+	County      string `json:"county"`
+}
+
+// NominatimGeocoder 查询 Nominatim（公共服务或自建实例）的 /search 接口。
+type NominatimGeocoder struct {
+	BaseURL   string       // 为空时使用公共服务
+	UserAgent string       // 为空时按 Email 生成
+	Email     string       // 联系邮箱，同时作为 email 参数发送
+	Client    HTTPClient   // 为空时使用 app.client
+	Limiter   *rateLimiter // 请求限速，为空时不限速
+}
+
+// Name 返回数据源名称。
+func (g *NominatimGeocoder) Name() string { return "nominatim" }
+
+// Search 调用 Nominatim 搜索城市，附带 addressdetails 以获取国家与行政区。
+func (g *NominatimGeocoder) Search(ctx context.Context, q GeoQuery) ([]GeoCandidate, error) {
+	if strings.TrimSpace(q.Text) == "" {
+		return nil, fmt.Errorf("城市名不能为空")
+	}
+	if q.Offline {
+		return nil, errGeocoderOffline
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = geocodeDefaultLimit
+	}
+	baseURL := g.BaseURL
+	if baseURL == "" {
+		baseURL = defaultNominatimURL
+	}
+	params := url.Values{}
+	params.Set("q", q.Text)
+	params.Set("format", "json")
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("addressdetails", "1")
+	params.Set("accept-language", "zh-CN,en")
+	if q.Country != "" {
+		params.Set("countrycodes", strings.ToLower(q.Country))
+	}
+	if g.Email != "" {
+		params.Set("email", g.Email)
+	}
+
+	client := g.Client
+	if client == nil {
+		client = app.client
+	}
+	var places []nominatimPlace
+	if err := g.Limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	if err := geocoderGet(ctx, client, "Nominatim", baseURL+"?"+params.Encode(), geocoderUserAgent(g.UserAgent, g.Email), &places); err != nil {
+		return nil, err
+	}
+
+	var cands []GeoCandidate
+	for _, p := range places {
+		c, err := p.candidate()
+		if err != nil {
+			return nil, err
+		}
+		if !candidateInCountry(c, q.Country) {
+			continue
+		}
+		cands = append(cands, c)
+	}
+	if len(cands) == 0 {
+		return nil, notFound(q.Text)
+	}
+	return cands, nil
+}
+
+// candidate 将 Nominatim 结果转换为候选地点。
+func (p nominatimPlace) candidate() (GeoCandidate, error) {
+	lat, err := strconv.ParseFloat(p.Lat, 64)
+	if err != nil {
+		return GeoCandidate{}, err
+	}
+	lon, err := strconv.ParseFloat(p.Lon, 64)
+	if err != nil {
+		return GeoCandidate{}, err
+	}
+	c := GeoCandidate{
+		DisplayName: p.DisplayName,
+		Name:        p.Name,
+		Lat:         lat,
+		Lon:         lon,
+		Country:     p.Address.Country,
+		CountryCode: strings.ToLower(p.Address.CountryCode),
+		Type:        p.AddressType,
+		Importance:  p.Importance,
+		Source:      "nominatim",
+	}
+	if c.Type == "" {
+		c.Type = p.Type
+	}
+	for _, a := range []string{p.Address.State, p.Address.Province, p.Address.Region, p.Address.County} {
+		if a != "" {
+			c.AdminArea = a
+			break
+		}
+	}
+	return c, nil
+}
+
+// Reverse 调用 Nominatim /reverse（zoom=10，城市级别）查找坐标所在地名。
+func (g *NominatimGeocoder) Reverse(ctx context.Context, lat, lon float64, offline bool) (GeoCandidate, error) {
+	if offline {
+		return GeoCandidate{}, errGeocoderOffline
+	}
+	baseURL := g.BaseURL
+	if baseURL == "" {
+		baseURL = defaultNominatimURL
+	}
+	params := url.Values{}
+	params.Set("lat", strconv.FormatFloat(lat, 'f', 6, 64))
+	params.Set("lon", strconv.FormatFloat(lon, 'f', 6, 64))
+	params.Set("format", "json")
+	params.Set("zoom", "10")
+	params.Set("addressdetails", "1")
+	params.Set("accept-language", "zh-CN,en")
+	if g.Email != "" {
+		params.Set("email", g.Email)
+	}
+	client := g.Client
+	if client == nil {
+		client = app.client
+	}
+	var place struct {
+		nominatimPlace
+		Error string `json:"error"`
+	}
+	if err := g.Limiter.wait(ctx); err != nil {
+		return GeoCandidate{}, err
+	}
+	if err := geocoderGet(ctx, client, "Nominatim", siblingEndpoint(baseURL, "search", "reverse")+"?"+params.Encode(), geocoderUserAgent(g.UserAgent, g.Email), &place); err != nil {
+		return GeoCandidate{}, err
+	}
+	if place.Error != "" || place.Lat == "" {
+		return GeoCandidate{}, notFound(fmt.Sprintf("%.4f,%.4f", lat, lon))
+	}
+	c, err := place.candidate()
+	if err != nil {
+		return GeoCandidate{}, err
+	}
+	for _, n := range []string{place.Address.City, place.Address.Town, place.Address.Village, place.Name, place.Address.County, place.Address.State} {
+		if n != "" {
+			c.Name = n
+			break
+		}
+	}
+	return c, nil
+}
+
+// siblingEndpoint 将以 /from 结尾的接口地址替换为同级的 /to（如 .../search → .../reverse），否则直接追加。
+func siblingEndpoint(baseURL, from, to string) string {
+	trimmed := strings.TrimRight(baseURL, "/")
+	if strings.HasSuffix(trimmed, "/"+from) {
+		return strings.TrimSuffix(trimmed, from) + to
+	}
+	return trimmed + "/" + to
+}
+
+// -------------------- Photon --------------------
+
+type photonResponse struct {
+	Features []struct {
+		Geometry struct {
+			Coordinates []float64 `json:"coordinates"` // [lon, lat]
+		} `json:"geometry"`
+		Properties struct {
+			Name        string `json:"name"`
+			City        string `json:"city"`
+			County      string `json:"county"`
+			State       string `json:"state"`
+			Country     string `json:"country"`
+			CountryCode string `json:"countrycode"`
+			OSMValue    string `json:"osm_value"`
+			Type        string `json:"type"`
+		} `json:"properties"`
+	} `json:"features"`
+}
+
+// PhotonGeocoder 查询 Photon（komoot 公共服务或自建实例）的 /api 接口。
+type PhotonGeocoder struct {
+	BaseURL   string
+	UserAgent string
+	Client    HTTPClient
+}
+
+// Name 返回数据源名称。
+func (g *PhotonGeocoder) Name() string { return "photon" }
+
+// Search 调用 Photon 搜索城市；Photon 不支持国家过滤参数，指定国家时多取一些结果后在本地过滤。
+func (g *PhotonGeocoder) Search(ctx context.Context, q GeoQuery) ([]GeoCandidate, error) {
+	if strings.TrimSpace(q.Text) == "" {
+		return nil, fmt.Errorf("城市名不能为空")
+	}
+	if q.Offline {
+		return nil, errGeocoderOffline
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = geocodeDefaultLimit
+	}
+	fetch := limit
+	if q.Country != "" {
+		fetch = min(limit*3, 50)
+	}
+	baseURL := g.BaseURL
+	if baseURL == "" {
+		baseURL = defaultPhotonURL
+	}
+	params := url.Values{}
+	params.Set("q", q.Text)
+	params.Set("limit", strconv.Itoa(fetch))
+
+	client := g.Client
+	if client == nil {
+		client = app.client
+	}
+	var resp photonResponse
+	if err := geocoderGet(ctx, client, "Photon", baseURL+"?"+params.Encode(), geocoderUserAgent(g.UserAgent, ""), &resp); err != nil {
+		return nil, err
+	}
+
+	var cands []GeoCandidate
+	for _, c := range resp.candidates() {
+		if !candidateInCountry(c, q.Country) {
+			continue
+		}
+		cands = append(cands, c)
+		if len(cands) >= limit {
+			break
+		}
+	}
+	if len(cands) == 0 {
+		return nil, notFound(q.Text)
+	}
+	return cands, nil
+}
+
+// candidates 将 Photon 的 GeoJSON 要素转换为候选地点。
+func (r photonResponse) candidates() []GeoCandidate {
+	var out []GeoCandidate
+	for _, f := range r.Features {
+		if len(f.Geometry.Coordinates) < 2 {
+			continue
+		}
+		p := f.Properties
+		var parts []string
+		for _, s := range []string{p.Name, p.City, p.County, p.State, p.Country} {
+			if s != "" && !containsFold(parts, s) {
+				parts = append(parts, s)
+			}
+		}
+		c := GeoCandidate{
+			DisplayName: strings.Join(parts, ", "),
+			Name:        p.Name,
+			Lat:         f.Geometry.Coordinates[1],
+			Lon:         f.Geometry.Coordinates[0],
+			Country:     p.Country,
+			CountryCode: strings.ToLower(p.CountryCode),
+			AdminArea:   p.State,
+			Type:        p.OSMValue,
+			Source:      "photon",
+		}
+		if c.AdminArea == "" {
+			c.AdminArea = p.County
+		}
+		if c.Type == "" {
+			c.Type = p.Type
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// Reverse 调用 Photon /reverse 查找坐标附近的地名。
+func (g *PhotonGeocoder) Reverse(ctx context.Context, lat, lon float64, offline bool) (GeoCandidate, error) {
+	if offline {
+		return GeoCandidate{}, errGeocoderOffline
+	}
+	baseURL := g.BaseURL
+	if baseURL == "" {
+		baseURL = defaultPhotonURL
+	}
+	params := url.Values{}
+	params.Set("lat", strconv.FormatFloat(lat, 'f', 6, 64))
+	params.Set("lon", strconv.FormatFloat(lon, 'f', 6, 64))
+	client := g.Client
+	if client == nil {
+		client = app.client
+	}
+	var resp photonResponse
+	if err := geocoderGet(ctx, client, "Photon", siblingEndpoint(baseURL, "api", "reverse")+"?"+params.Encode(), geocoderUserAgent(g.UserAgent, ""), &resp); err != nil {
+		return GeoCandidate{}, err
+	}
+	cands := resp.candidates()
+	if len(cands) == 0 {
+		return GeoCandidate{}, notFound(fmt.Sprintf("%.4f,%.4f", lat, lon))
+	}
+	c := cands[0]
+	if p := resp.Features[0].Properties; p.City != "" {
+		c.Name = p.City
+	}
+	return c, nil
+}
+
+// containsFold 判断 list 中是否已有与 s 忽略大小写相同的字符串。
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// -------------------- 内置城市库 / 本地文件 --------------------
+
+// GazetteerGeocoder 查询内置离线城市库（约 210 个主要城市的种子列表）：联网时只接受完全匹配，离线时允许前缀/拼音首字母/模糊匹配。
+type GazetteerGeocoder struct{}
+
+// localGeocoder 由本地数据源（内置城市库、本地文件）实现：联网时 ChainGeocoder 将其结果与网络数据源合并，不直接返回。
+type localGeocoder interface {
+	local()
+}
+
+func (GazetteerGeocoder) local() {}
+
+func (g *FileGeocoder) local() {}
+
+// Name 返回数据源名称。
+func (GazetteerGeocoder) Name() string { return "gazetteer" }
+
+// Search 在内置城市库中搜索。
+func (GazetteerGeocoder) Search(ctx context.Context, q GeoQuery) ([]GeoCandidate, error) {
+	if cands := searchGazetteer(q.Text, q.Country, !q.Offline, q.Limit); len(cands) > 0 {
+		return cands, nil
+	}
+	return nil, notFound(q.Text)
+}
+
+// Reverse 返回 50 km 内最近的内置城市。
+func (GazetteerGeocoder) Reverse(ctx context.Context, lat, lon float64, offline bool) (GeoCandidate, error) {
+	if c, ok := nearestCity(loadGazetteer(), lat, lon, reverseNearestKm); ok {
+		return c, nil
+	}
+	return GeoCandidate{}, notFound(fmt.Sprintf("%.4f,%.4f", lat, lon))
+}
+
+// fileGazetteerRecord 为本地城市文件中的一条记录（JSON 字段名与 CSV 表头相同）。
+type fileGazetteerRecord struct {
+	Name       string   `json:"name"`
+	Zh         string   `json:"zh"`
+	Pinyin     string   `json:"pinyin"`
+	Country    string   `json:"country"`
+	Admin      string   `json:"admin"`
+	Lat        float64  `json:"lat"`
+	Lon        float64  `json:"lon"`
+	Population int64    `json:"population"`
+	Timezone   string   `json:"timezone"`
+	Aliases    []string `json:"aliases"`
+}
+
+// FileGeocoder 查询用户提供的本地城市文件（.csv 或 .json），匹配规则与内置城市库相同。
+type FileGeocoder struct {
+	Path   string
+	cities []gazetteerCity
+}
+
+// NewFileGeocoder 读取并解析本地城市文件。
+// CSV 需有表头，至少包含 name/lat/lon 列，可选 zh/pinyin/country/admin/population/timezone/aliases（别名以分号分隔）；
+// JSON 为对象数组，字段名相同，aliases 为字符串数组。
+func NewFileGeocoder(path string) (*FileGeocoder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取城市文件失败: %w", err)
+	}
+	var records []fileGazetteerRecord
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if err := json.Unmarshal(data, &records); err != nil {
+			return nil, fmt.Errorf("解析城市文件失败 (%s): %w", path, err)
+		}
+	case ".csv":
+		if records, err = parseGazetteerCSV(string(data)); err != nil {
+			return nil, fmt.Errorf("解析城市文件失败 (%s): %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("城市文件仅支持 .csv 或 .json: %s", path)
+	}
+
+	g := &FileGeocoder{Path: path}
+	for i, r := range records {
+		if r.Name == "" || r.Lat < -90 || r.Lat > 90 || r.Lon < -180 || r.Lon > 180 {
+			return nil, fmt.Errorf("城市文件第 %d 条记录无效（name 为空或经纬度超出范围）", i+1)
+		}
+		c := gazetteerCity{
+			Name: r.Name, Zh: r.Zh, Pinyin: r.Pinyin, Country: r.Country, Admin: r.Admin,
+			Lat: r.Lat, Lon: r.Lon, Population: r.Population, Timezone: r.Timezone, Aliases: r.Aliases,
+		}
+		c.index()
+		g.cities = append(g.cities, c)
+	}
+	return g, nil
+}
+
+// parseGazetteerCSV 按表头列名解析 CSV 城市文件。
+func parseGazetteerCSV(data string) ([]fileGazetteerRecord, error) {
+	rows, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	col := map[string]int{}
+	for i, h := range rows[0] {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, required := range []string{"name", "lat", "lon"} {
+		if _, ok := col[required]; !ok {
+			return nil, fmt.Errorf("CSV 缺少 %s 列", required)
+		}
+	}
+	get := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	var out []fileGazetteerRecord
+	for n, row := range rows[1:] {
+		r := fileGazetteerRecord{
+			Name: get(row, "name"), Zh: get(row, "zh"), Pinyin: get(row, "pinyin"),
+			Country: get(row, "country"), Admin: get(row, "admin"), Timezone: get(row, "timezone"),
+		}
+		if r.Lat, err = strconv.ParseFloat(get(row, "lat"), 64); err != nil {
+			return nil, fmt.Errorf("第 %d 行纬度无效: %w", n+2, err)
+		}
+		if r.Lon, err = strconv.ParseFloat(get(row, "lon"), 64); err != nil {
+			return nil, fmt.Errorf("第 %d 行经度无效: %w", n+2, err)
+		}
+		if v := get(row, "population"); v != "" {
+			if r.Population, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, fmt.Errorf("第 %d 行人口无效: %w", n+2, err)
+			}
+		}
+		if v := get(row, "aliases"); v != "" {
+			r.Aliases = strings.Split(v, ";")
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
+
+// Name 返回数据源名称。
+func (g *FileGeocoder) Name() string { return "file" }
+
+// Search 在本地城市文件中搜索。
+func (g *FileGeocoder) Search(ctx context.Context, q GeoQuery) ([]GeoCandidate, error) {
+	cands := searchCities(g.cities, q.Text, q.Country, !q.Offline, q.Limit)
+	if len(cands) == 0 {
+		return nil, notFound(q.Text)
+	}
+	for i := range cands {
+		cands[i].Source = "file"
+	}
+	return cands, nil
+}
+
+// Reverse 返回本地城市文件中 50 km 内最近的地点。
+func (g *FileGeocoder) Reverse(ctx context.Context, lat, lon float64, offline bool) (GeoCandidate, error) {
+	c, ok := nearestCity(g.cities, lat, lon, reverseNearestKm)
+	if !ok {
+		return GeoCandidate{}, notFound(fmt.Sprintf("%.4f,%.4f", lat, lon))
+	}
+	c.Source = "file"
+	return c, nil
+}
+
+// -------------------- 链式回退 --------------------
+
+// ChainGeocoder 依次尝试各数据源，返回第一个有结果的数据源的候选；联网时本地数据源的结果与其后网络数据源的结果合并。
+type ChainGeocoder []Geocoder
+
+// Name 返回以逗号连接的数据源名称。
+func (c ChainGeocoder) Name() string {
+	names := make([]string, len(c))
+	for i, g := range c {
+		names[i] = g.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Search 按顺序查询；数据源未找到、离线跳过或出错时继续尝试下一个，全部失败时返回最后一个真实错误。
+// 联网时本地数据源的完全匹配不会跳过网络查询（本地库只收录少量城市，London、Perth 等同名地点需要网络候选供 --pick 选择），
+// 而是与下一个有结果的网络数据源合并（见 mergeLocalCandidates）；网络数据源均无结果或失败时返回本地结果。
+func (c ChainGeocoder) Search(ctx context.Context, q GeoQuery) ([]GeoCandidate, error) {
+	var lastErr error
+	var local []GeoCandidate
+	for _, g := range c {
+		cands, err := g.Search(ctx, q)
+		if err == nil && len(cands) > 0 {
+			if _, ok := g.(localGeocoder); ok && !q.Offline {
+				local = append(local, cands...)
+				continue
+			}
+			return mergeLocalCandidates(cands, local, q.Limit), nil
+		}
+		if err != nil && !errors.Is(err, errCityNotFound) && !errors.Is(err, errGeocoderOffline) {
+			logDebugf("地理编码 [%s] 查询 %s 失败: %v", g.Name(), q.Text, err)
+			lastErr = err
+		}
+	}
+	if len(local) > 0 {
+		return mergeLocalCandidates(nil, local, q.Limit), nil
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, notFound(q.Text)
+}
+
+// sameCandidateKm 为判定本地与网络候选是同一地点的最大距离。
+const sameCandidateKm = 30.0
+
+// mergeLocalCandidates 以网络候选的顺序为准合并本地候选：同一地点（同国且相距 sameCandidateKm 内）只保留网络候选，
+// 并补上本地记录的时区与别名；其余本地候选追加在后，最多返回 limit 个（limit <= 0 时不限）。
+func mergeLocalCandidates(remote, local []GeoCandidate, limit int) []GeoCandidate {
+	out := append([]GeoCandidate(nil), remote...)
+	for _, l := range local {
+		dup := false
+		for i := range out {
+			o := &out[i]
+			if (o.CountryCode == "" || l.CountryCode == "" || strings.EqualFold(o.CountryCode, l.CountryCode)) &&
+				haversineKm(o.Lat, o.Lon, l.Lat, l.Lon) <= sameCandidateKm {
+				if o.Timezone == "" {
+					o.Timezone = l.Timezone
+				}
+				for _, a := range l.Aliases {
+					if !containsFold(o.Aliases, a) {
+						o.Aliases = append(o.Aliases, a)
+					}
+				}
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			out = append(out, l)
+		}
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// Reverse 依次尝试支持反查的数据源，规则与 Search 相同。
+func (c ChainGeocoder) Reverse(ctx context.Context, lat, lon float64, offline bool) (GeoCandidate, error) {
+	var lastErr error
+	for _, g := range c {
+		rg, ok := g.(ReverseGeocoder)
+		if !ok {
+			continue
+		}
+		cand, err := rg.Reverse(ctx, lat, lon, offline)
+		if err == nil {
+			return cand, nil
+		}
+		if !errors.Is(err, errCityNotFound) && !errors.Is(err, errGeocoderOffline) {
+			logDebugf("地理编码 [%s] 反查 %.4f,%.4f 失败: %v", g.Name(), lat, lon, err)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return GeoCandidate{}, lastErr
+	}
+	return GeoCandidate{}, notFound(fmt.Sprintf("%.4f,%.4f", lat, lon))
+}
+
+// geocoderEnvKeys 为地理编码配置项对应的环境变量（部署 serve 时无需修改启动参数），键为命令行参数名。
+var geocoderEnvKeys = []struct {
+	flag, env string
+	field     func(cfg *AppConfig) *string
+}{
+	{"geocoder", "ESUNMOON_GEOCODER", func(cfg *AppConfig) *string { return &cfg.Geocoder }},
+	{"nominatim-url", "ESUNMOON_NOMINATIM_URL", func(cfg *AppConfig) *string { return &cfg.NominatimURL }},
+	{"photon-url", "ESUNMOON_PHOTON_URL", func(cfg *AppConfig) *string { return &cfg.PhotonURL }},
+	{"geocoder-file", "ESUNMOON_GEOCODER_FILE", func(cfg *AppConfig) *string { return &cfg.GeocoderFile }},
+	{"geocoder-user-agent", "ESUNMOON_GEOCODER_USER_AGENT", func(cfg *AppConfig) *string { return &cfg.GeocoderUserAgent }},
+	{"geocoder-email", "ESUNMOON_GEOCODER_EMAIL", func(cfg *AppConfig) *string { return &cfg.GeocoderEmail }},
+}
+
+// applyGeocoderEnv 用环境变量填充未在命令行显式指定（changed 返回 false）的地理编码配置；命令行参数优先。
+func applyGeocoderEnv(cfg *AppConfig, changed func(flag string) bool) {
+	for _, k := range geocoderEnvKeys {
+		if changed(k.flag) {
+			continue
+		}
+		if v, ok := os.LookupEnv(k.env); ok && strings.TrimSpace(v) != "" {
+			*k.field(cfg) = strings.TrimSpace(v)
+		}
+	}
+}
+
+// buildGeocoder 根据 --geocoder 等配置（或 ESUNMOON_GEOCODER 等环境变量，见 applyGeocoderEnv）构造地理编码器；多个数据源以逗号分隔，按顺序回退。
+func buildGeocoder(cfg *AppConfig) (Geocoder, error) {
+	names := cfg.Geocoder
+	if strings.TrimSpace(names) == "" {
+		names = defaultGeocoders
+	}
+	var chain ChainGeocoder
+	for _, name := range strings.Split(names, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gazetteer", "builtin":
+			chain = append(chain, GazetteerGeocoder{})
+		case "nominatim":
+			g := &NominatimGeocoder{BaseURL: cfg.NominatimURL, UserAgent: cfg.GeocoderUserAgent, Email: cfg.GeocoderEmail}
+			if g.BaseURL == "" || g.BaseURL == defaultNominatimURL {
+				g.Limiter = nominatimLimiter
+			}
+			chain = append(chain, g)
+		case "photon":
+			chain = append(chain, &PhotonGeocoder{BaseURL: cfg.PhotonURL, UserAgent: geocoderUserAgent(cfg.GeocoderUserAgent, cfg.GeocoderEmail)})
+		case "file":
+			if cfg.GeocoderFile == "" {
+				return nil, fmt.Errorf("--geocoder file 需要同时指定 --geocoder-file")
+			}
+			g, err := NewFileGeocoder(cfg.GeocoderFile)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, g)
+		case "":
+		default:
+			return nil, fmt.Errorf("未知的地理编码服务: %s（可选 gazetteer/nominatim/photon/file）", name)
+		}
+	}
+	switch len(chain) {
+	case 0:
+		return nil, fmt.Errorf("未配置任何地理编码服务")
+	case 1:
+		return chain[0], nil
+	}
+	return chain, nil
+}
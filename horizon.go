@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	suncalc "github.com/redtim/sunmooncalc"
+)
+
+// -------------------- 地平线轮廓（地形/建筑遮挡） --------------------
+
+// horizonPoint 为地平线轮廓上的一点：Az 为罗盘方位（正北 0°、顺时针），Alt 为该方向可见地平线的最低高度（度）。
+type horizonPoint struct {
+	Az  float64 `json:"az"`
+	Alt float64 `json:"alt"`
+}
+
+// horizonProfile 为按方位升序排列的地平线轮廓，方位之间线性插值，首尾跨 0° 相接。
+type horizonProfile []horizonPoint
+
+// 可见升落扫描步长与二分精度。
+const (
+	horizonScanStep  = 2 * time.Minute
+	horizonPrecision = 10 * time.Second
+)
+
+// 与 sunmooncalc 保持一致的升落阈值（度）：日出日落为几何高度 -0.833°（地平折射 34′ + 视半径），
+// 月出月落为含折射的月亮高度 0.133°。sunClearance 按比例缩放折射使地平处恰为 34′，
+// 因此平坦地平线（高度 0）下可见升落与几何升落一致。
+const (
+	sunRiseAltitudeDeg      = -0.833
+	horizontalRefractionDeg = 34.0 / 60
+	sunSemiDiameterDeg      = -sunRiseAltitudeDeg - horizontalRefractionDeg
+	moonRiseOffsetDeg       = 0.133
+)
+
+// newHorizonProfile 校验并排序轮廓点（方位 0~360，高度 -5~90），方位 360 视为 0。
+func newHorizonProfile(points []horizonPoint) (horizonProfile, error) {
+	if len(points) == 0 {
+		return nil, fmt.Errorf("地平线轮廓为空")
+	}
+	out := make(horizonProfile, 0, len(points))
+	for i, p := range points {
+		if math.IsNaN(p.Az) || p.Az < 0 || p.Az > 360 {
+			return nil, fmt.Errorf("地平线轮廓第 %d 点方位 %.2f 超出 0~360", i+1, p.Az)
+		}
+		if math.IsNaN(p.Alt) || p.Alt < -5 || p.Alt > 90 {
+			return nil, fmt.Errorf("地平线轮廓第 %d 点高度 %.2f 超出 -5~90", i+1, p.Alt)
+		}
+		if p.Az == 360 {
+			p.Az = 0
+		}
+		out = append(out, p)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Az < out[j].Az })
+	return out, nil
+}
+
+// altitudeAt 返回罗盘方位 az（度）处地平线的高度。
+func (h horizonProfile) altitudeAt(az float64) float64 {
+	if len(h) == 0 {
+		return 0
+	}
+	if len(h) == 1 {
+		return h[0].Alt
+	}
+	az = math.Mod(az, 360)
+	if az < 0 {
+		az += 360
+	}
+	i := sort.Search(len(h), func(i int) bool { return h[i].Az >= az })
+	var a, b horizonPoint
+	switch {
+	case i < len(h) && h[i].Az == az:
+		return h[i].Alt
+	case i == 0 || i == len(h):
+		// 位于最后一点与第一点之间（跨 0°）
+		a, b = h[len(h)-1], h[0]
+		b.Az += 360
+		if az < a.Az {
+			az += 360
+		}
+	default:
+		a, b = h[i-1], h[i]
+	}
+	if b.Az == a.Az {
+		return max(a.Alt, b.Alt)
+	}
+	return a.Alt + (b.Alt-a.Alt)*(az-a.Az)/(b.Az-a.Az)
+}
+
+// parseHorizonCSV 解析 “方位,高度” 两列文本（逗号、分号、制表符或空白分隔），
+// 忽略空行、# 注释与无法解析的首行表头。
+func parseHorizonCSV(r io.Reader) (horizonProfile, error) {
+	var points []horizonPoint
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		f := strings.FieldsFunc(text, func(r rune) bool {
+			return r == ',' || r == ';' || r == '\t' || r == ' '
+		})
+		if len(f) < 2 {
+			return nil, fmt.Errorf("地平线轮廓第 %d 行需要 方位,高度 两列", line)
+		}
+		az, err1 := strconv.ParseFloat(f[0], 64)
+		alt, err2 := strconv.ParseFloat(f[1], 64)
+		if err1 != nil || err2 != nil {
+			if len(points) == 0 && line == 1 {
+				continue // 表头
+			}
+			return nil, fmt.Errorf("地平线轮廓第 %d 行无法解析: %q", line, text)
+		}
+		points = append(points, horizonPoint{Az: az, Alt: alt})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return newHorizonProfile(points)
+}
+
+// parseHorizonJSON 解析 [{"az":..,"alt":..}] 或 {"points":[...]} 形式的 JSON 轮廓。
+func parseHorizonJSON(r io.Reader) (horizonProfile, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("地平线轮廓 JSON 解析失败: %w", err)
+	}
+	var points []horizonPoint
+	if err := json.Unmarshal(raw, &points); err != nil {
+		var wrapper struct {
+			Points []horizonPoint `json:"points"`
+		}
+		if err := json.Unmarshal(raw, &wrapper); err != nil {
+			return nil, fmt.Errorf("地平线轮廓 JSON 格式应为点数组或 {\"points\": [...]}: %w", err)
+		}
+		points = wrapper.Points
+	}
+	return newHorizonProfile(points)
+}
+
+// loadHorizonFile 按扩展名读取地平线轮廓文件（.json 为 JSON，其余按 CSV）。
+func loadHorizonFile(path string) (horizonProfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取地平线轮廓失败: %w", err)
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return parseHorizonJSON(f)
+	}
+	return parseHorizonCSV(f)
+}
+
+// maxHorizonBody 限制 POST 上传的地平线轮廓大小。
+const maxHorizonBody = 1 << 20
+
+// readHorizonBody 从 POST 请求体读取地平线轮廓：Content-Type 为 application/json 时按 JSON，否则按 CSV。
+func readHorizonBody(w http.ResponseWriter, r *http.Request) (horizonProfile, error) {
+	body := http.MaxBytesReader(w, r.Body, maxHorizonBody)
+	defer body.Close()
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		return parseHorizonJSON(body)
+	}
+	return parseHorizonCSV(body)
+}
+
+// sunClearance 返回太阳上缘（含大气折射）高出地平线轮廓的角度，正值表示可见。折射按 Meeus 16.4 的形状、
+// 缩放到地平处 34′（与 sunmooncalc 日出阈值 -0.833° 的约定相同）。
+func sunClearance(t time.Time, lat, lon float64, h horizonProfile) float64 {
+	pos := suncalc.GetPosition(t, lat, lon)
+	alt := radToDeg(pos.Altitude)
+	refraction := refractionDeg(alt) * horizontalRefractionDeg / refractionDeg(0)
+	return alt + refraction + sunSemiDiameterDeg - h.altitudeAt(radToDeg(pos.Azimuth)+180)
+}
+
+// moonClearance 返回月亮高出地平线轮廓的角度（sunmooncalc 的月亮高度已含折射）。
+func moonClearance(t time.Time, lat, lon float64, h horizonProfile) float64 {
+	pos := suncalc.GetMoonPosition(t, lat, lon)
+	return radToDeg(pos.Altitude) - moonRiseOffsetDeg - h.altitudeAt(radToDeg(pos.Azimuth)+180)
+}
+
+// refractionDeg 为 Meeus 16.4 的大气折射（度），与 sunmooncalc 的 astroRefraction 相同，负高度按 0 处理。
+func refractionDeg(alt float64) float64 {
+	alt = max(alt, 0)
+	return 1.02 / math.Tan((alt+10.26/(alt+5.10))*math.Pi/180) / 60
+}
+
+// visibleRiseSet 在 [from, to) 内按步长扫描天体相对地平线轮廓的高度，
+// 返回首次越过轮廓（可见升起）与最后一次落入轮廓（可见落下）的时刻，缺失时为零值。
+func visibleRiseSet(from, to time.Time, clearance func(time.Time) float64) (rise, set time.Time) {
+	prevT, prev := from, clearance(from)
+	for t := from.Add(horizonScanStep); !t.After(to); t = t.Add(horizonScanStep) {
+		cur := clearance(t)
+		if prev < 0 && cur >= 0 && rise.IsZero() {
+			rise = bisectCrossing(prevT, t, clearance, true)
+		}
+		if prev >= 0 && cur < 0 {
+			set = bisectCrossing(prevT, t, clearance, false)
+		}
+		prevT, prev = t, cur
+	}
+	return rise, set
+}
+
+// bisectCrossing 在 [a, b] 内二分查找 clearance 过零时刻；rising 表示由负变正。
+func bisectCrossing(a, b time.Time, clearance func(time.Time) float64, rising bool) time.Time {
+	for b.Sub(a) > horizonPrecision {
+		mid := a.Add(b.Sub(a) / 2)
+		if (clearance(mid) >= 0) == rising {
+			b = mid
+		} else {
+			a = mid
+		}
+	}
+	return a.Add(b.Sub(a) / 2)
+}
+
+// visibleTimes 记录某日（当地 0 点起 24 小时）太阳与月亮越过地平线轮廓的可见升落时刻。
+type visibleTimes struct {
+	Sunrise, Sunset   time.Time
+	Moonrise, Moonset time.Time
+}
+
+// computeVisibleTimes 按地平线轮廓计算 day 当天的可见日出日落与月出月落。
+func computeVisibleTimes(day time.Time, lat, lon float64, h horizonProfile) visibleTimes {
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	to := from.AddDate(0, 0, 1)
+	var v visibleTimes
+	v.Sunrise, v.Sunset = visibleRiseSet(from, to, func(t time.Time) float64 { return sunClearance(t, lat, lon, h) })
+	v.Moonrise, v.Moonset = visibleRiseSet(from, to, func(t time.Time) float64 { return moonClearance(t, lat, lon, h) })
+	return v
+}
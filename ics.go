@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// -------------------- iCalendar（RFC 5545）输出 --------------------
+
+// icsEvent 为一条日历事件；End 为零值时按瞬时事件处理（DTEND = DTSTART）。
+type icsEvent struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	Start       time.Time
+	End         time.Time
+}
+
+// icsEscape 按 RFC 5545 转义 TEXT 值中的特殊字符。
+func icsEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// icsFoldLine 将超过 75 字节的内容行折叠（续行以空格开头），不拆分 UTF-8 字符。
+func icsFoldLine(line string) string {
+	if len(line) <= 75 {
+		return line
+	}
+	var b strings.Builder
+	width := 0
+	for _, r := range line {
+		n := len(string(r))
+		if width+n > 75 {
+			b.WriteString("\r\n ")
+			width = 1
+		}
+		b.WriteRune(r)
+		width += n
+	}
+	return b.String()
+}
+
+// icsUTC 将时间格式化为 UTC 的 iCalendar DATE-TIME（如 20250101T120000Z）。
+func icsUTC(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsOffset 将 UTC 偏移秒数格式化为 ±HHMM（含秒时为 ±HHMMSS）。
+func icsOffset(sec int) string {
+	sign := "+"
+	if sec < 0 {
+		sign, sec = "-", -sec
+	}
+	if sec%60 != 0 {
+		return fmt.Sprintf("%s%02d%02d%02d", sign, sec/3600, sec%3600/60, sec%60)
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, sec/3600, sec%3600/60)
+}
+
+// icsUseTZID 判断是否以 TZID 输出当地时间；nil 或 UTC 时区直接输出 UTC。
+func icsUseTZID(loc *time.Location) bool {
+	return loc != nil && loc != time.UTC && loc.String() != "UTC"
+}
+
+// icsDateTime 返回 DTSTART/DTEND 等属性的参数与取值部分，例如 ";TZID=Asia/Shanghai:20250101T071500"。
+func icsDateTime(t time.Time, loc *time.Location) string {
+	if !icsUseTZID(loc) {
+		return ":" + icsUTC(t)
+	}
+	return fmt.Sprintf(";TZID=%s:%s", loc.String(), t.In(loc).Format("20060102T150405"))
+}
+
+// tzTransitions 以 1 天步长扫描 [from, to] 内的 UTC 偏移变化，二分到秒，返回每次变化生效的瞬间。
+func tzTransitions(loc *time.Location, from, to time.Time) []time.Time {
+	offsetAt := func(t time.Time) int {
+		_, off := t.In(loc).Zone()
+		return off
+	}
+	var out []time.Time
+	prev := from
+	prevOff := offsetAt(prev)
+	for t := from.Add(24 * time.Hour); !prev.After(to); t = t.Add(24 * time.Hour) {
+		if off := offsetAt(t); off != prevOff {
+			lo, hi := prev, t
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2)
+				if offsetAt(mid) == prevOff {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			out = append(out, hi.Truncate(time.Second))
+			prevOff = off
+		}
+		prev = t
+	}
+	return out
+}
+
+// writeVTimezone 输出覆盖 [from, to] 的 VTIMEZONE：先给出起点所处的观测规则，再逐次列出偏移变化（不使用 RRULE）。
+func writeVTimezone(line func(string, ...interface{}), loc *time.Location, from, to time.Time) {
+	observance := func(t time.Time, offFrom int) {
+		lt := t.In(loc)
+		name, offTo := lt.Zone()
+		kind := "STANDARD"
+		if lt.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		line("BEGIN:%s", kind)
+		// DTSTART 为变化前的当地墙钟时间（按 TZOFFSETFROM 计）
+		line("DTSTART:%s", t.UTC().Add(time.Duration(offFrom)*time.Second).Format("20060102T150405"))
+		line("TZOFFSETFROM:%s", icsOffset(offFrom))
+		line("TZOFFSETTO:%s", icsOffset(offTo))
+		line("TZNAME:%s", icsEscape(name))
+		line("END:%s", kind)
+	}
+
+	start := time.Date(from.In(loc).Year(), 1, 1, 0, 0, 0, 0, loc)
+	line("BEGIN:VTIMEZONE")
+	line("TZID:%s", loc.String())
+	_, off := start.Zone()
+	observance(start, off)
+	for _, t := range tzTransitions(loc, start, to) {
+		observance(t, off)
+		_, off = t.In(loc).Zone()
+	}
+	line("END:VTIMEZONE")
+}
+
+// writeICS 输出一个 VCALENDAR；calName 用作 X-WR-CALNAME，stamp 为 DTSTAMP。
+// loc 非 UTC 时附带 VTIMEZONE 并以 TZID 当地时间输出事件，否则全部使用 UTC。
+func writeICS(w io.Writer, calName string, stamp time.Time, loc *time.Location, events []icsEvent) error {
+	bw := bufio.NewWriter(w)
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(bw, "%s\r\n", icsFoldLine(fmt.Sprintf(format, args...)))
+	}
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//eSunMoon//esunmoon//ZH")
+	line("CALSCALE:GREGORIAN")
+	line("METHOD:PUBLISH")
+	line("X-WR-CALNAME:%s", icsEscape(calName))
+	if icsUseTZID(loc) {
+		line("X-WR-TIMEZONE:%s", loc.String())
+		if len(events) > 0 {
+			from, to := events[0].Start, events[0].Start
+			for _, e := range events {
+				if e.Start.Before(from) {
+					from = e.Start
+				}
+				for _, t := range []time.Time{e.Start, e.End} {
+					if t.After(to) {
+						to = t
+					}
+				}
+			}
+			writeVTimezone(line, loc, from, to)
+		}
+	}
+	for _, e := range events {
+		end := e.End
+		if end.IsZero() {
+			end = e.Start
+		}
+		line("BEGIN:VEVENT")
+		line("UID:%s", e.UID)
+		line("DTSTAMP:%s", icsUTC(stamp))
+		line("DTSTART%s", icsDateTime(e.Start, loc))
+		line("DTEND%s", icsDateTime(end, loc))
+		line("SUMMARY:%s", icsEscape(e.Summary))
+		if e.Description != "" {
+			line("DESCRIPTION:%s", icsEscape(e.Description))
+		}
+		if e.Location != "" {
+			line("LOCATION:%s", icsEscape(e.Location))
+		}
+		line("TRANSP:TRANSPARENT")
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return bw.Flush()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// -------------------- 农历（1900~2100） --------------------
+
+// lunarInfo 为 1900~2100 年农历数据表（与查看页 JS 原表一致）：
+// 低 4 位为闰月月份（0 表示无闰月），bit4~15 依次为 12~1 月大小（1=30 天），bit16 为闰月大小。
+var lunarInfo = [...]uint32{
+	0x04bd8, 0x04ae0, 0x0a570, 0x054d5, 0x0d260, 0x0d950, 0x16554, 0x056a0, 0x09ad0, 0x055d2,
+	0x04ae0, 0x0a5b6, 0x0a4d0, 0x0d250, 0x1d255, 0x0b540, 0x0d6a0, 0x0ada2, 0x095b0, 0x14977,
+	0x04970, 0x0a4b0, 0x0b4b5, 0x06a50, 0x06d40, 0x1ab54, 0x02b60, 0x09570, 0x052f2, 0x04970,
+	0x06566, 0x0d4a0, 0x0ea50, 0x06e95, 0x05ad0, 0x02b60, 0x186e3, 0x092e0, 0x1c8d7, 0x0c950,
+	0x0d4a0, 0x1d8a6, 0x0b550, 0x056a0, 0x1a5b4, 0x025d0, 0x092d0, 0x0d2b2, 0x0a950, 0x0b557,
+	0x06ca0, 0x0b550, 0x15355, 0x04da0, 0x0a5d0, 0x14573, 0x052d0, 0x0a9a8, 0x0e950, 0x06aa0,
+	0x0aea6, 0x0ab50, 0x04b60, 0x0aae4, 0x0a570, 0x05260, 0x0f263, 0x0d950, 0x05b57, 0x056a0,
+	0x096d0, 0x04dd5, 0x04ad0, 0x0a4d0, 0x0d4d4, 0x0d250, 0x0d558, 0x0b540, 0x0b6a0, 0x195a6,
+	0x095b0, 0x049b0, 0x0a974, 0x0a4b0, 0x0b27a, 0x06a50, 0x06d40, 0x0af46, 0x0ab60, 0x09570,
+	0x04af5, 0x04970, 0x064b0, 0x074a3, 0x0ea50, 0x06b58, 0x05ac0, 0x0ab60, 0x096d5, 0x092e0,
+	0x0c960, 0x0d954, 0x0d4a0, 0x0da50, 0x07552, 0x056a0, 0x0abb7, 0x025d0, 0x092d0, 0x0cab5,
+	0x0a950, 0x0b4a0, 0x0baa4, 0x0ad50, 0x055d9, 0x04ba0, 0x0a5b0, 0x15176, 0x052b0, 0x0a930,
+	0x07954, 0x06aa0, 0x0ad50, 0x05b52, 0x04b60, 0x0a6e6, 0x0a4e0, 0x0d260, 0x0ea65, 0x0d530,
+	0x05aa0, 0x076a3, 0x096d0, 0x04bd7, 0x04ad0, 0x0a4d0, 0x1d0b6, 0x0d250, 0x0d520, 0x0dd45,
+	0x0b5a0, 0x056d0, 0x055b2, 0x049b0, 0x0a577, 0x0a4b0, 0x0aa50, 0x1b255, 0x06d20, 0x0ada0,
+	0x14b63, 0x09370, 0x049f8, 0x04970, 0x064b0, 0x168a6, 0x0ea50, 0x06b20, 0x1a6c4, 0x0aae0,
+	0x0a2e0, 0x0d2e3, 0x0c960, 0x0d557, 0x0d4a0, 0x0da50, 0x05d55, 0x056a0, 0x0a6d0, 0x055d4,
+	0x052d0, 0x0a9b8, 0x0a950, 0x0b4a0, 0x0b6a6, 0x0ad50, 0x055a0, 0x0aba4, 0x0a5b0, 0x052b0,
+	0x0b273, 0x06930, 0x07337, 0x06aa0, 0x0ad50, 0x14b55, 0x04b60, 0x0a570, 0x054e4, 0x0d160,
+	0x0e968, 0x0d520, 0x0daa0, 0x16aa6, 0x056d0, 0x04ae0, 0x0a9d4, 0x0a2d0, 0x0d150, 0x0f252,
+	0x0d520,
+}
+
+const lunarBaseYear = 1900
+
+var (
+	lunarMonthNames = [...]string{"正月", "二月", "三月", "四月", "五月", "六月", "七月", "八月", "九月", "十月", "冬月", "腊月"}
+	lunarDayNames   = [...]string{
+		"初一", "初二", "初三", "初四", "初五", "初六", "初七", "初八", "初九", "初十",
+		"十一", "十二", "十三", "十四", "十五", "十六", "十七", "十八", "十九", "二十",
+		"廿一", "廿二", "廿三", "廿四", "廿五", "廿六", "廿七", "廿八", "廿九", "三十",
+	}
+	heavenlyStems   = [...]string{"甲", "乙", "丙", "丁", "戊", "己", "庚", "辛", "壬", "癸"}
+	earthlyBranches = [...]string{"子", "丑", "寅", "卯", "辰", "巳", "午", "未", "申", "酉", "戌", "亥"}
+	zodiacAnimals   = [...]string{"鼠", "牛", "虎", "兔", "龙", "蛇", "马", "羊", "猴", "鸡", "狗", "猪"}
+)
+
+// lunarDate 表示一个农历日期。
+type lunarDate struct {
+	Year   int
+	Month  int
+	Day    int
+	IsLeap bool
+}
+
+// lunarLeapMonth 返回农历年的闰月月份，0 表示无闰月。
+func lunarLeapMonth(y int) int {
+	return int(lunarInfo[y-lunarBaseYear] & 0xf)
+}
+
+// lunarLeapDays 返回农历年闰月的天数，无闰月返回 0。
+func lunarLeapDays(y int) int {
+	if lunarLeapMonth(y) == 0 {
+		return 0
+	}
+	if lunarInfo[y-lunarBaseYear]&0x10000 != 0 {
+		return 30
+	}
+	return 29
+}
+
+// lunarMonthDays 返回农历年第 m 个（非闰）月的天数。
+func lunarMonthDays(y, m int) int {
+	if lunarInfo[y-lunarBaseYear]&(0x10000>>uint(m)) != 0 {
+		return 30
+	}
+	return 29
+}
+
+// lunarYearDays 返回农历年的总天数（含闰月）。
+func lunarYearDays(y int) int {
+	sum := 0
+	for m := 1; m <= 12; m++ {
+		sum += lunarMonthDays(y, m)
+	}
+	return sum + lunarLeapDays(y)
+}
+
+// solarToLunar 将公历日期转换为农历，支持 1900-01-31 ~ 2100 年底；超出范围返回错误。
+func solarToLunar(year int, month time.Month, day int) (lunarDate, error) {
+	base := time.Date(1900, 1, 31, 0, 0, 0, 0, time.UTC) // 农历 1900 年正月初一
+	target := time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	offset := int(target.Sub(base).Hours() / 24)
+	if offset < 0 {
+		return lunarDate{}, fmt.Errorf("农历仅支持 1900-01-31 之后的日期: %s", target.Format("2006-01-02"))
+	}
+
+	y := lunarBaseYear
+	for ; y < lunarBaseYear+len(lunarInfo); y++ {
+		days := lunarYearDays(y)
+		if offset < days {
+			break
+		}
+		offset -= days
+	}
+	if y >= lunarBaseYear+len(lunarInfo) {
+		return lunarDate{}, fmt.Errorf("农历仅支持到 2100 年: %s", target.Format("2006-01-02"))
+	}
+
+	leap := lunarLeapMonth(y)
+	for m := 1; m <= 12; m++ {
+		days := lunarMonthDays(y, m)
+		if offset < days {
+			return lunarDate{Year: y, Month: m, Day: offset + 1}, nil
+		}
+		offset -= days
+		if m == leap {
+			if days = lunarLeapDays(y); offset < days {
+				return lunarDate{Year: y, Month: m, Day: offset + 1, IsLeap: true}, nil
+			}
+			offset -= days
+		}
+	}
+	return lunarDate{}, fmt.Errorf("农历换算越界: %s", target.Format("2006-01-02"))
+}
+
+// lunarDateOf 返回时间 t 在其所在时区的农历日期。
+func lunarDateOf(t time.Time) (lunarDate, error) {
+	return solarToLunar(t.Year(), t.Month(), t.Day())
+}
+
+// MonthName 返回农历月名称，闰月带“闰”前缀，例如 "闰六月"。
+func (l lunarDate) MonthName() string {
+	name := lunarMonthNames[l.Month-1]
+	if l.IsLeap {
+		return "闰" + name
+	}
+	return name
+}
+
+// DayName 返回农历日名称，例如 "初一"、"廿九"。
+func (l lunarDate) DayName() string {
+	return lunarDayNames[l.Day-1]
+}
+
+// String 返回月日形式，例如 "正月初一"（与查看页显示一致）。
+func (l lunarDate) String() string {
+	return l.MonthName() + l.DayName()
+}
+
+// GanZhiYear 返回农历年的干支纪年，例如 "甲辰"。
+func (l lunarDate) GanZhiYear() string {
+	idx := l.Year - 4 // 公元 4 年为甲子年
+	return heavenlyStems[((idx%10)+10)%10] + earthlyBranches[((idx%12)+12)%12]
+}
+
+// Zodiac 返回农历年的生肖，例如 "龙"。
+func (l lunarDate) Zodiac() string {
+	return zodiacAnimals[(((l.Year-4)%12)+12)%12]
+}
+
+// lunarSummary 返回完整的农历描述，例如 "乙巳年（蛇）正月初一"；超出支持范围返回空串。
+func lunarSummary(t time.Time) string {
+	l, err := lunarDateOf(t)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s年（%s）%s", l.GanZhiYear(), l.Zodiac(), l.String())
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/csv"
 	"encoding/json"
@@ -11,11 +12,13 @@ import (
 	"io"
 	"log"
 	"math"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -27,16 +30,41 @@ import (
 	suncalc "github.com/redtim/sunmooncalc"
 	"github.com/spf13/cobra"
 	"github.com/xuri/excelize/v2"
+	"golang.org/x/term"
 
 	"github.com/bradfitz/latlong"
 )
 
 // -------------------- 数据结构 --------------------
 
-type nominatimPlace struct {
-	Lat         string `json:"lat"`
-	Lon         string `json:"lon"`
-	DisplayName string `json:"display_name"`
+// GeoCandidate 为地理编码返回的一个候选地点（供 CLI/TUI 选择、/api/geocode 输出与缓存记录）。
+type GeoCandidate struct {
+	DisplayName string   `json:"display_name"`
+	Name        string   `json:"name,omitempty"`
+	Lat         float64  `json:"lat"`
+	Lon         float64  `json:"lon"`
+	Country     string   `json:"country,omitempty"`
+	CountryCode string   `json:"country_code,omitempty"`
+	AdminArea   string   `json:"admin_area,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Importance  float64  `json:"importance,omitempty"`
+	Population  int64    `json:"population,omitempty"`
+	Timezone    string   `json:"timezone,omitempty"` // 内置城市库提供的 IANA 时区，为空时按经纬度推断
+	Source      string   `json:"source,omitempty"`   // gazetteer / nominatim / photon / file
+	Aliases     []string `json:"aliases,omitempty"`
+	DistanceKm  float64  `json:"distance_km,omitempty"` // 反查时与查询坐标的距离
+}
+
+// Label 返回候选的单行描述，用于交互选择列表。
+func (c GeoCandidate) Label() string {
+	label := c.DisplayName
+	if c.Type != "" {
+		label += fmt.Sprintf("  [%s]", c.Type)
+	}
+	if c.Importance > 0 {
+		label += fmt.Sprintf("  重要度 %.2f", c.Importance)
+	}
+	return label
 }
 
 // 每日天文数据（既有人类可读字符串，也有数值字段，方便 chart）
@@ -53,39 +81,156 @@ type dailyAstro struct {
 	Moonset       string `json:"moonset"`
 	MoonIllumFrac string `json:"moon_illumination"`
 
+	// 按地平线轮廓（地形/建筑遮挡）扫描得到的可见升落，未设置轮廓时为空
+	VisibleSunrise  string `json:"visible_sunrise,omitempty"`
+	VisibleSunset   string `json:"visible_sunset,omitempty"`
+	VisibleMoonrise string `json:"visible_moonrise,omitempty"`
+	VisibleMoonset  string `json:"visible_moonset,omitempty"`
+
+	// 民用/航海/天文晨昏蒙影（太阳高度 -6°/-12°/-18°）
+	CivilDawn        string `json:"civil_dawn"`
+	CivilDusk        string `json:"civil_dusk"`
+	NauticalDawn     string `json:"nautical_dawn"`
+	NauticalDusk     string `json:"nautical_dusk"`
+	AstronomicalDawn string `json:"astronomical_dawn"`
+	AstronomicalDusk string `json:"astronomical_dusk"`
+	Darkness         string `json:"darkness_hhmm"` // 当日天文暮光结束至次日天文晨光开始
+
+	// 黄金时刻/蓝调时刻（阈值可配置，默认黄金 -4°~6°、蓝调 -6°~-4°）
+	GoldenMorningStart string `json:"golden_hour_morning_start"`
+	GoldenMorningEnd   string `json:"golden_hour_morning_end"`
+	GoldenEveningStart string `json:"golden_hour_evening_start"`
+	GoldenEveningEnd   string `json:"golden_hour_evening_end"`
+	BlueMorningStart   string `json:"blue_hour_morning_start"`
+	BlueMorningEnd     string `json:"blue_hour_morning_end"`
+	BlueEveningStart   string `json:"blue_hour_evening_start"`
+	BlueEveningEnd     string `json:"blue_hour_evening_end"`
+
+	// 月相事件：当日发生新月/上弦/满月/下弦时标注，例如 "满月 21:58"
+	PhaseEvent     string `json:"phase_event,omitempty"`
+	PhaseEventType string `json:"phase_event_type,omitempty"`
+
+	// 节气：当日交节时标注名称与时刻，例如 "冬至 17:21"
+	SolarTerm string `json:"solar_term,omitempty"`
+
+	// 农历（仅支持 1900~2100，超出范围时为空）
+	LunarDate  string `json:"lunar_date,omitempty"` // 例如 "正月初一"、"闰六月十五"
+	LunarYear  int    `json:"lunar_year,omitempty"`
+	LunarMonth int    `json:"lunar_month,omitempty"`
+	LunarDay   int    `json:"lunar_day,omitempty"`
+	LunarLeap  bool   `json:"lunar_leap_month,omitempty"`
+	GanZhiYear string `json:"ganzhi_year,omitempty"`
+	Zodiac     string `json:"zodiac,omitempty"`
+
 	MaxAltitudeNum      float64 `json:"max_altitude_num,omitempty"`
 	DayLengthMinutes    int     `json:"day_length_minutes,omitempty"`
 	MoonIlluminationNum float64 `json:"moon_illumination_num,omitempty"` // 0~1
+	DarknessMinutes     int     `json:"darkness_minutes,omitempty"`
 	HasSunrise          bool    `json:"has_sunrise,omitempty"`
 	HasSunset           bool    `json:"has_sunset,omitempty"`
 	HasDayLength        bool    `json:"has_day_length,omitempty"`
+	HasCivilDawn        bool    `json:"has_civil_dawn,omitempty"`
+	HasCivilDusk        bool    `json:"has_civil_dusk,omitempty"`
+	HasNauticalDawn     bool    `json:"has_nautical_dawn,omitempty"`
+	HasNauticalDusk     bool    `json:"has_nautical_dusk,omitempty"`
+	HasAstronomicalDawn bool    `json:"has_astronomical_dawn,omitempty"`
+	HasAstronomicalDusk bool    `json:"has_astronomical_dusk,omitempty"`
+	HasGoldenHour       bool    `json:"has_golden_hour,omitempty"`
+	HasBlueHour         bool    `json:"has_blue_hour,omitempty"`
+	GoldenHourAllDay    bool    `json:"golden_hour_all_day,omitempty"`
+	BlueHourAllDay      bool    `json:"blue_hour_all_day,omitempty"`
+}
+
+// altitudeBand 表示一个太阳高度区间（度），用于黄金时刻/蓝调时刻。
+type altitudeBand struct {
+	Low  float64 `json:"low_deg"`
+	High float64 `json:"high_deg"`
+}
+
+// photoBands 汇总摄影用的黄金时刻与蓝调时刻阈值。
+type photoBands struct {
+	Golden altitudeBand `json:"golden"`
+	Blue   altitudeBand `json:"blue"`
+}
+
+var defaultPhotoBands = photoBands{
+	Golden: altitudeBand{Low: -4, High: 6},
+	Blue:   altitudeBand{Low: -6, High: -4},
 }
 
 type CityContext struct {
-	City        string
-	DisplayName string
-	Lat, Lon    float64
-	TZID        string
-	Loc         *time.Location
-	Now         time.Time
+	City            string
+	DisplayName     string
+	Lat, Lon        float64
+	TZID            string
+	Loc             *time.Location
+	Now             time.Time
+	Photo           *photoBands    // 为 nil 时使用全局配置的黄金/蓝调阈值
+	Elevation       float64        // 观测点海拔（米），高于 0 时对日出日落/晨昏蒙影/黄金蓝调时刻做地平俯角修正
+	ElevationSource string         // 海拔来源：manual/dem，为空表示未知（按 0 m）
+	Warnings        []string       // 解析过程中的提示（如指定时区与坐标所在时区不一致）
+	Horizon         horizonProfile // 地平线轮廓，非空时额外计算可见升落
+	Atmosphere      *atmosphere    // 为 nil 时使用全局配置的气温/气压计算大气折射
+}
+
+// observerElevation 返回观测点海拔及其来源，供导出文件头使用。
+func (c *CityContext) observerElevation() observerElevation {
+	return observerElevation{Meters: c.Elevation, Source: c.ElevationSource}
+}
+
+// atmosphereOrDefault 返回计算视高度用的气温/气压，未设置时回退全局配置。
+func (c *CityContext) atmosphereOrDefault() atmosphere {
+	if c != nil && c.Atmosphere != nil {
+		return *c.Atmosphere
+	}
+	return config.Atmosphere
+}
+
+// photoBandsOrDefault 返回城市上下文使用的黄金/蓝调阈值，未设置时回退全局配置。
+func (c *CityContext) photoBandsOrDefault() photoBands {
+	if c != nil && c.Photo != nil {
+		return *c.Photo
+	}
+	return config.Photo
 }
 
 // 缓存结构
 type CityCacheEntry struct {
-	City        string   `json:"city"`
-	Normalized  string   `json:"normalized"`
-	DisplayName string   `json:"display_name"`
-	Lat         float64  `json:"lat"`
-	Lon         float64  `json:"lon"`
-	TimezoneID  string   `json:"timezone_id"`
-	Aliases     []string `json:"aliases,omitempty"`
-	UpdatedAt   string   `json:"updated_at"`
+	City            string         `json:"city"`
+	Normalized      string         `json:"normalized"`
+	DisplayName     string         `json:"display_name"`
+	Lat             float64        `json:"lat"`
+	Lon             float64        `json:"lon"`
+	TimezoneID      string         `json:"timezone_id"`
+	Aliases         []string       `json:"aliases,omitempty"`
+	UpdatedAt       string         `json:"updated_at"`
+	Candidate       *GeoCandidate  `json:"candidate,omitempty"` // 多候选时用户选定的地点
+	Pick            int            `json:"pick,omitempty"`      // 选定候选在结果中的序号（从 1 开始）
+	Elevation       float64        `json:"elevation_m,omitempty"`
+	ElevationSource string         `json:"elevation_source,omitempty"` // dem 或 manual
+	Horizon         horizonProfile `json:"horizon,omitempty"`          // --horizon 指定的地平线轮廓
 }
 
 type CityCache struct {
-	Entries map[string]CityCacheEntry `json:"entries"`
+	Entries map[string]CityCacheEntry    `json:"entries"`
+	Reverse map[string]ReverseCacheEntry `json:"reverse,omitempty"` // 坐标反查地名，键见 reverseCacheKey
+}
+
+// ReverseCacheEntry 为一次坐标反查地名的缓存结果。
+type ReverseCacheEntry struct {
+	City        string `json:"city"` // 为空表示反查失败或无结果（短期负缓存，见 reverseRetryTTL）
+	DisplayName string `json:"display_name"`
+	Source      string `json:"source,omitempty"`
+	UpdatedAt   string `json:"updated_at"`
 }
 
+// reverseRetryTTL 为反查失败、无结果或只得到本地近似结果时的缓存时长：期间同一坐标不再请求网络，
+// 避免 /api/positions 轮询与 SSE 订阅每次都触发一次上游请求。
+const reverseRetryTTL = 10 * time.Minute
+
+// reverseLookupTimeout 为单次网络反查的超时时间。
+const reverseLookupTimeout = 8 * time.Second
+
 // 内置别名
 var builtinAliases = map[string][]string{
 	"beijing":   {"北京", "Beijing", "Peking"},
@@ -94,6 +239,9 @@ var builtinAliases = map[string][]string{
 }
 
 const polarNote = "HasSunrise/HasSunset/HasDayLength 标志指示极昼/极夜等情况，false 表示当日无对应事件"
+const photoNote = "黄金/蓝调时刻：morning 为上午太阳升过阈值区间，evening 为傍晚下落经过阈值区间；*_all_day 表示全天处于区间内，has_* 为 false 表示当日不出现"
+const eclipseNote = "日食接触时刻为站心计算（未计月面地形），精度约 1 分钟；月食接触时刻全球一致，visible 表示食相期间天体在本地地平线以上；magnitude 对日食为本地食分，对月食为本影食分（半影月食为半影食分）"
+const twilightNote = "晨昏蒙影：民用 -6°、航海 -12°、天文 -18°；Has*Dawn/Has*Dusk 为 false 表示高纬度当日该蒙影不开始或不结束；黑夜时长为当日天文暮光结束至次日天文晨光开始"
 const defaultPositionsRefresh = 30 * time.Second
 
 // -------------------- 工具函数 --------------------
@@ -321,6 +469,14 @@ type AstroApp struct {
 	logger   *Logger
 	tzLookup func(float64, float64) (string, error)
 	loadTZ   func(string) (*time.Location, error)
+	// geocoder 为城市名 → 候选地点的数据源，由 --geocoder 等参数配置
+	geocoder Geocoder
+	// promptCandidate 在终端让用户从多个地理编码候选中选择，返回从 1 开始的序号
+	promptCandidate func(city string, cands []GeoCandidate) (int, error)
+	// stdinIsTerminal 判断标准输入是否为终端；管道、cron 等非终端环境下不提示选择候选
+	stdinIsTerminal func() bool
+	// streams 为 /api/positions/stream 的订阅中心，服务关闭时统一断开
+	streams *positionsHub
 }
 
 // newAstroApp 创建默认的应用单例。
@@ -332,6 +488,12 @@ func newAstroApp() *AstroApp {
 		logger:   NewLogger(os.Stdout, LevelInfo, false, false, time.Now),
 		tzLookup: lookupTimeZone,
 		loadTZ:   time.LoadLocation,
+		geocoder: ChainGeocoder{GazetteerGeocoder{}, &NominatimGeocoder{Limiter: nominatimLimiter}},
+		promptCandidate: func(city string, cands []GeoCandidate) (int, error) {
+			return promptCandidate(os.Stdin, os.Stdout, city, cands)
+		},
+		stdinIsTerminal: func() bool { return term.IsTerminal(int(os.Stdin.Fd())) },
+		streams:         newPositionsHub(),
 	}
 }
 
@@ -347,6 +509,23 @@ type AppConfig struct {
 	LogQuiet       bool
 	LiveOnly       bool
 	LiveInterval   time.Duration
+	Photo          photoBands
+	ICSEvents      string
+	Pick           int
+	Country        string
+
+	Geocoder          string
+	NominatimURL      string
+	PhotonURL         string
+	GeocoderFile      string
+	GeocoderUserAgent string
+	GeocoderEmail     string
+
+	Elevation    float64    // --elevation 指定的观测点海拔（米）
+	ElevationSet bool       // 是否显式指定了 --elevation
+	DEMDir       string     // SRTM .hgt 瓦片目录，用于离线查询海拔
+	HorizonFile  string     // 地平线轮廓文件（CSV 或 JSON）
+	Atmosphere   atmosphere // 视高度折射计算用的气温/气压（--temp-c/--pressure-hpa）
 }
 
 var config = &AppConfig{
@@ -359,6 +538,9 @@ var config = &AppConfig{
 	LogQuiet:       false,
 	LiveOnly:       false,
 	LiveInterval:   5 * time.Second,
+	Photo:          defaultPhotoBands,
+	Geocoder:       defaultGeocoders,
+	Atmosphere:     standardAtmosphere,
 }
 
 // -------------------- Logger --------------------
@@ -452,57 +634,87 @@ func logErrorf(format string, args ...interface{}) {
 
 // -------------------- 网络调用：地理编码 --------------------
 
-// Nominatim: 城市 → 经纬度
-// geocodeCity 使用 Nominatim 服务将城市名解析为经纬度和显示名。
-func geocodeCity(ctx context.Context, client HTTPClient, city string) (lat, lon float64, displayName string, err error) {
-	if strings.TrimSpace(city) == "" {
-		return 0, 0, "", fmt.Errorf("城市名不能为空")
-	}
-	baseURL := "https://nominatim.openstreetmap.org/search"
-	q := url.Values{}
-	q.Set("q", city)
-	q.Set("format", "json")
-	q.Set("limit", "1")
-	q.Set("accept-language", "zh-CN,en")
+// geocodeDefaultLimit 为地理编码返回的默认候选数量。
+const geocodeDefaultLimit = 10
 
-	req, err := http.NewRequest("GET", baseURL+"?"+q.Encode(), nil)
-	if err != nil {
-		return
+// candidateInCountry 判断候选是否属于 country 列出的国家代码之一；country 为空或候选缺少国家代码时视为匹配。
+func candidateInCountry(c GeoCandidate, country string) bool {
+	if country == "" || c.CountryCode == "" {
+		return true
+	}
+	for _, code := range strings.Split(country, ",") {
+		if strings.EqualFold(strings.TrimSpace(code), c.CountryCode) {
+			return true
+		}
 	}
-	req = req.WithContext(ctx)
-	req.Header.Set("User-Agent", "eSunMoon/1.0 (https://example.com; contact: esunmoon@example.com)")
+	return false
+}
+
+// lookupCandidates 通过当前配置的地理编码器（默认内置城市库 + Nominatim）查找城市候选。
+func lookupCandidates(ctx context.Context, city, country string, offline bool, limit int) ([]GeoCandidate, error) {
+	return app.geocoder.Search(ctx, GeoQuery{Text: city, Country: country, Limit: limit, Offline: offline})
+}
+
+// geocodeCandidates 使用 Nominatim 公共服务搜索城市，返回按相关度排序的候选；country 为 ISO 3166-1 二位代码（可逗号分隔多个）。
+func geocodeCandidates(ctx context.Context, client HTTPClient, city, country string, limit int) ([]GeoCandidate, error) {
+	g := &NominatimGeocoder{Client: client}
+	return g.Search(ctx, GeoQuery{Text: city, Country: country, Limit: limit})
+}
 
-	resp, err := client.Do(req)
+// geocodeCity 使用 Nominatim 服务将城市名解析为经纬度和显示名（取相关度最高的候选）。
+func geocodeCity(ctx context.Context, client HTTPClient, city string) (lat, lon float64, displayName string, err error) {
+	cands, err := geocodeCandidates(ctx, client, city, "", 1)
 	if err != nil {
-		return
+		return 0, 0, "", err
 	}
-	defer resp.Body.Close()
+	return cands[0].Lat, cands[0].Lon, cands[0].DisplayName, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Nominatim HTTP 错误: %s", resp.Status)
-		return
+// promptCandidate 在终端列出候选并读取用户输入的序号（从 1 开始，回车默认 1）。
+func promptCandidate(in io.Reader, out io.Writer, city string, cands []GeoCandidate) (int, error) {
+	fmt.Fprintf(out, "城市 [%s] 有 %d 个匹配结果：\n", city, len(cands))
+	for i, c := range cands {
+		fmt.Fprintf(out, "  %d) %s\n", i+1, c.Label())
 	}
-
-	var places []nominatimPlace
-	if err = json.NewDecoder(resp.Body).Decode(&places); err != nil {
-		return
+	fmt.Fprint(out, "请选择序号（回车默认 1）：")
+	text, err := bufio.NewReader(in).ReadString('\n')
+	text = strings.TrimSpace(text)
+	if text == "" {
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		return 1, nil
 	}
-
-	if len(places) == 0 {
-		err = fmt.Errorf("未找到城市: %s", city)
-		return
+	n, convErr := strconv.Atoi(text)
+	if convErr != nil || n < 1 || n > len(cands) {
+		return 0, fmt.Errorf("无效的序号: %s（应为 1~%d）", text, len(cands))
 	}
+	return n, nil
+}
 
-	lat, err = strconv.ParseFloat(places[0].Lat, 64)
-	if err != nil {
-		return
+// selectCandidate 按 --pick/交互选择/默认第一个的顺序从候选中选定地点，返回候选及其序号（从 1 开始）。
+func selectCandidate(city string, cands []GeoCandidate, opts geoOptions) (GeoCandidate, int, error) {
+	if len(cands) == 0 {
+		return GeoCandidate{}, 0, apiErrorf(errCodeCityNotFound, "city", "未找到城市: %s", city)
 	}
-	lon, err = strconv.ParseFloat(places[0].Lon, 64)
-	if err != nil {
-		return
+	if opts.Pick > 0 {
+		if opts.Pick > len(cands) {
+			return GeoCandidate{}, 0, apiErrorf(errCodeInvalidParam, "pick", "--pick %d 超出候选数量（共 %d 个）", opts.Pick, len(cands))
+		}
+		return cands[opts.Pick-1], opts.Pick, nil
 	}
-	displayName = places[0].DisplayName
-	return
+	if len(cands) == 1 {
+		return cands[0], 1, nil
+	}
+	if opts.Interactive && app.promptCandidate != nil {
+		n, err := app.promptCandidate(city, cands)
+		if err != nil {
+			return GeoCandidate{}, 0, err
+		}
+		return cands[n-1], n, nil
+	}
+	logWarnf("城市 [%s] 有 %d 个候选，默认使用第 1 个：%s（可用 --pick N 或 --country 指定）", city, len(cands), cands[0].DisplayName)
+	return cands[0], 1, nil
 }
 
 // 本地 latlong：经纬度 → 时区 ID（如 Asia/Shanghai），不依赖任何网络
@@ -515,20 +727,111 @@ func lookupTimeZone(lat, lon float64) (string, error) {
 	return tzID, nil
 }
 
+// fallbackTimeZone 在 latlong 无法映射（如公海）时按经度返回整点时区 Etc/GMT±N（注意 Etc 区名符号与 UTC 偏移相反）。
+func fallbackTimeZone(lon float64) string {
+	h := int(math.Round(lon / 15))
+	switch {
+	case h == 0:
+		return "UTC"
+	case h > 0:
+		return fmt.Sprintf("Etc/GMT-%d", min(h, 12))
+	default:
+		return fmt.Sprintf("Etc/GMT+%d", min(-h, 12))
+	}
+}
+
+// resolveCoordsTimezone 确定坐标查询使用的时区：未指定 tz 时按经纬度自动推断；
+// 指定 tz 时以其为准，若与推断时区在冬夏至日的 UTC 偏移都不同则返回提示（如新疆用户刻意使用 Asia/Shanghai），
+// 提示中的偏移取 ref 时刻。
+func resolveCoordsTimezone(lat, lon float64, tzID string, ref time.Time) (string, *time.Location, []string, error) {
+	inferred, lookupErr := app.tzLookup(lat, lon)
+	var warnings []string
+	if tzID == "" {
+		if lookupErr != nil {
+			inferred = fallbackTimeZone(lon)
+			warnings = append(warnings, fmt.Sprintf("无法根据经纬度推断时区，按经度使用 %s（可用 tz 指定）", inferred))
+		}
+		loc, err := app.loadTZ(inferred)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("加载推断时区失败 (%s): %w", inferred, err)
+		}
+		return inferred, loc, warnings, nil
+	}
+	loc, err := app.loadTZ(tzID)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("加载时区失败 (%s): %w", tzID, err)
+	}
+	if lookupErr == nil && inferred != tzID {
+		if infLoc, err := app.loadTZ(inferred); err == nil {
+			// 只在冬夏两个至日的偏移都不同时提示，仅夏令时规则不同（如 America/Phoenix 与 America/Denver）不算不一致
+			year := ref.UTC().Year()
+			differs := true
+			for _, at := range []time.Time{
+				time.Date(year, 6, 21, 12, 0, 0, 0, time.UTC),
+				time.Date(year, 12, 21, 12, 0, 0, 0, time.UTC),
+			} {
+				_, got := at.In(loc).Zone()
+				_, want := at.In(infLoc).Zone()
+				if got == want {
+					differs = false
+				}
+			}
+			if differs {
+				_, got := ref.In(loc).Zone()
+				_, want := ref.In(infLoc).Zone()
+				warnings = append(warnings, fmt.Sprintf("指定时区 %s（%s）与坐标所在时区 %s（%s）不一致，按指定时区输出",
+					tzID, formatUTCOffset(got), inferred, formatUTCOffset(want)))
+			}
+		}
+	}
+	return tzID, loc, warnings, nil
+}
+
+// formatUTCOffset 将秒级偏移格式化为 UTC+08:00 形式。
+func formatUTCOffset(sec int) string {
+	sign := '+'
+	if sec < 0 {
+		sign, sec = '-', -sec
+	}
+	return fmt.Sprintf("UTC%c%02d:%02d", sign, sec/3600, sec%3600/60)
+}
+
 // -------------------- 天文数据生成 --------------------
 
 // generateAstroData 生成指定起始日期和天数的太阳月亮数据（当地时间）。
 func generateAstroData(cityName string, lat, lon float64, loc *time.Location, start time.Time, days int) ([]dailyAstro, error) {
+	return generateAstroDataFor(&CityContext{City: cityName, Lat: lat, Lon: lon, Loc: loc}, start, days)
+}
+
+// generateAstroDataFor 按城市上下文（含观测参数）生成逐日天文数据。
+func generateAstroDataFor(ctx *CityContext, start time.Time, days int) ([]dailyAstro, error) {
 	if days <= 0 {
 		return nil, fmt.Errorf("天数必须 > 0")
 	}
+	bands := ctx.photoBandsOrDefault()
+	if err := bands.validate(); err != nil {
+		return nil, err
+	}
+	lat, lon, loc := ctx.Lat, ctx.Lon, ctx.Loc
+	// 观测者高度使日出日落与晨昏蒙影阈值整体下移一个地平俯角（负海拔不修正）
+	obs := suncalc.Observer{Latitude: lat, Longitude: lon, Height: max(ctx.Elevation, 0), Location: time.UTC}
+	// 黄金/蓝调阈值同样下移，使其与同一行的日出日落一致
+	dip := horizonDipDeg(ctx.Elevation)
+	bands.Golden, bands.Blue = bands.Golden.lowered(dip), bands.Blue.lowered(dip)
 	var result []dailyAstro
 
+	firstDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc)
+	phases := moonPhasesByDate(firstDay, firstDay.AddDate(0, 0, days), loc)
+	terms := solarTermsByDate(firstDay, firstDay.AddDate(0, 0, days), loc)
+
+	// 次日的太阳事件用于计算黑夜时长，循环中复用避免重复计算。
+	nextTimes := suncalc.GetTimesWithObserver(start, obs)
 	for i := 0; i < days; i++ {
 		day := start.AddDate(0, 0, i)
 		dayDateStr := day.Format("2006-01-02")
 
-		sunTimes := suncalc.GetTimes(day, lat, lon)
+		sunTimes := nextTimes
+		nextTimes = suncalc.GetTimesWithObserver(day.AddDate(0, 0, 1), obs)
 		sunrise := sunTimes[suncalc.Sunrise].Value.In(loc)
 		sunset := sunTimes[suncalc.Sunset].Value.In(loc)
 		solarNoon := sunTimes[suncalc.SolarNoon].Value.In(loc)
@@ -553,13 +856,54 @@ func generateAstroData(cityName string, lat, lon float64, loc *time.Location, st
 			dayLengthMinutes = int(dayLength.Minutes())
 		}
 
-		moonTimes := suncalc.GetMoonTimes(day, lat, lon, false)
+		civilDawn := sunTimes[suncalc.Dawn].Value.In(loc)
+		civilDusk := sunTimes[suncalc.Dusk].Value.In(loc)
+		nauticalDawn := sunTimes[suncalc.NauticalDawn].Value.In(loc)
+		nauticalDusk := sunTimes[suncalc.NauticalDusk].Value.In(loc)
+		astroDawn := sunTimes[suncalc.NightEnd].Value.In(loc)
+		astroDusk := sunTimes[suncalc.Night].Value.In(loc)
+		darkness := darknessDuration(astroDusk, nextTimes[suncalc.NightEnd].Value, solarNoon, lat, lon)
+
+		var golden, blue lightWindow
+		if !solarNoon.IsZero() {
+			noonAlt := radToDeg(suncalc.GetPosition(solarNoon, lat, lon).Altitude)
+			nadirAlt := radToDeg(suncalc.GetPosition(solarNoon.Add(-12*time.Hour), lat, lon).Altitude)
+			golden = bandWindow(day, lat, lon, bands.Golden, noonAlt, nadirAlt)
+			blue = bandWindow(day, lat, lon, bands.Blue, noonAlt, nadirAlt)
+		}
+
+		moonObs := obs
+		moonObs.Location = day.Location()
+		moonTimes := suncalc.GetMoonTimesWithObserver(day, moonObs)
 		moonrise := moonTimes.Rise.In(loc)
 		moonset := moonTimes.Set.In(loc)
 		moonIllum := suncalc.GetMoonIllumination(day)
 		moonIllumFrac := moonIllum.Fraction
+
+		var visible [4]string
+		if len(ctx.Horizon) > 0 {
+			v := computeVisibleTimes(day.In(loc), lat, lon, ctx.Horizon)
+			for i, t := range []time.Time{v.Sunrise, v.Sunset, v.Moonrise, v.Moonset} {
+				visible[i] = formatTimeLocal(t.In(loc))
+			}
+		}
 		moonIllumPct := fmt.Sprintf("%.1f%%", moonIllumFrac*100)
 
+		var phaseEvent, phaseEventType string
+		if e, ok := phases[dayDateStr]; ok {
+			phaseEvent = fmt.Sprintf("%s %s", e.Kind.Name(), e.Time.In(loc).Format("15:04"))
+			phaseEventType = e.Kind.Key()
+		}
+		var solarTerm string
+		if e, ok := terms[dayDateStr]; ok {
+			solarTerm = fmt.Sprintf("%s %s", e.Term.Name, e.Time.In(loc).Format("15:04"))
+		}
+		lunar, lunarErr := lunarDateOf(day)
+		var lunarStr, ganZhi, zodiac string
+		if lunarErr == nil {
+			lunarStr, ganZhi, zodiac = lunar.String(), lunar.GanZhiYear(), lunar.Zodiac()
+		}
+
 		result = append(result, dailyAstro{
 			Date: dayDateStr,
 
@@ -573,17 +917,163 @@ func generateAstroData(cityName string, lat, lon float64, loc *time.Location, st
 			Moonset:       formatTimeLocal(moonset),
 			MoonIllumFrac: moonIllumPct,
 
+			VisibleSunrise:  visible[0],
+			VisibleSunset:   visible[1],
+			VisibleMoonrise: visible[2],
+			VisibleMoonset:  visible[3],
+
+			CivilDawn:        formatTimeLocal(civilDawn),
+			CivilDusk:        formatTimeLocal(civilDusk),
+			NauticalDawn:     formatTimeLocal(nauticalDawn),
+			NauticalDusk:     formatTimeLocal(nauticalDusk),
+			AstronomicalDawn: formatTimeLocal(astroDawn),
+			AstronomicalDusk: formatTimeLocal(astroDusk),
+			Darkness:         formatDuration(darkness),
+
+			GoldenMorningStart: formatTimeLocal(golden.MorningStart.In(loc)),
+			GoldenMorningEnd:   formatTimeLocal(golden.MorningEnd.In(loc)),
+			GoldenEveningStart: formatTimeLocal(golden.EveningStart.In(loc)),
+			GoldenEveningEnd:   formatTimeLocal(golden.EveningEnd.In(loc)),
+			BlueMorningStart:   formatTimeLocal(blue.MorningStart.In(loc)),
+			BlueMorningEnd:     formatTimeLocal(blue.MorningEnd.In(loc)),
+			BlueEveningStart:   formatTimeLocal(blue.EveningStart.In(loc)),
+			BlueEveningEnd:     formatTimeLocal(blue.EveningEnd.In(loc)),
+
+			PhaseEvent:     phaseEvent,
+			PhaseEventType: phaseEventType,
+			SolarTerm:      solarTerm,
+
+			LunarDate:  lunarStr,
+			LunarYear:  lunar.Year,
+			LunarMonth: lunar.Month,
+			LunarDay:   lunar.Day,
+			LunarLeap:  lunar.IsLeap,
+			GanZhiYear: ganZhi,
+			Zodiac:     zodiac,
+
 			MaxAltitudeNum:      maxAltitudeNum,
 			DayLengthMinutes:    dayLengthMinutes,
 			MoonIlluminationNum: moonIllumFrac,
+			DarknessMinutes:     int(darkness.Minutes()),
 			HasSunrise:          hasSunrise,
 			HasSunset:           hasSunset,
 			HasDayLength:        hasDayLength,
+			HasCivilDawn:        !civilDawn.IsZero(),
+			HasCivilDusk:        !civilDusk.IsZero(),
+			HasNauticalDawn:     !nauticalDawn.IsZero(),
+			HasNauticalDusk:     !nauticalDusk.IsZero(),
+			HasAstronomicalDawn: !astroDawn.IsZero(),
+			HasAstronomicalDusk: !astroDusk.IsZero(),
+			HasGoldenHour:       golden.Any,
+			HasBlueHour:         blue.Any,
+			GoldenHourAllDay:    golden.AllDay,
+			BlueHourAllDay:      blue.AllDay,
 		})
 	}
 	return result, nil
 }
 
+// darknessDuration 计算当日天文暮光结束到次日天文晨光开始的黑夜时长。
+// 两端事件缺失时按正午太阳高度判断：全天低于 -18° 视为整日黑夜，否则为 0（白夜）。
+func darknessDuration(astroDusk, nextAstroDawn, solarNoon time.Time, lat, lon float64) time.Duration {
+	if !astroDusk.IsZero() && !nextAstroDawn.IsZero() && nextAstroDawn.After(astroDusk) {
+		return nextAstroDawn.Sub(astroDusk)
+	}
+	if astroDusk.IsZero() && nextAstroDawn.IsZero() && !solarNoon.IsZero() {
+		if radToDeg(suncalc.GetPosition(solarNoon, lat, lon).Altitude) < -18 {
+			return 24 * time.Hour
+		}
+	}
+	return 0
+}
+
+// lightWindow 记录某个太阳高度区间在一天中的上午/傍晚时段。
+type lightWindow struct {
+	MorningStart, MorningEnd time.Time
+	EveningStart, EveningEnd time.Time
+	Any                      bool // 当日是否进入过该区间
+	AllDay                   bool // 全天都处于区间内（极区）
+}
+
+// lowered 返回整体下移 dip 度的区间：与日出日落、晨昏蒙影相同的地平俯角修正。
+func (b altitudeBand) lowered(dip float64) altitudeBand {
+	return altitudeBand{Low: b.Low - dip, High: b.High - dip}
+}
+
+// validate 检查高度区间是否合法（-90~90 且下限小于上限）。
+func (b altitudeBand) validate(name string) error {
+	if b.Low < -90 || b.High > 90 || b.Low >= b.High {
+		return fmt.Errorf("%s 高度阈值非法：需满足 -90 <= low < high <= 90（当前 %.2f ~ %.2f）", name, b.Low, b.High)
+	}
+	return nil
+}
+
+// validate 检查黄金/蓝调两组阈值。
+func (p photoBands) validate() error {
+	if err := p.Golden.validate("黄金时刻"); err != nil {
+		return err
+	}
+	return p.Blue.validate("蓝调时刻")
+}
+
+// bandWindow 根据正午/子夜太阳高度判断区间状态，并求出上午与傍晚穿越阈值的时刻。
+// 上午窗口：太阳上升经过 low → high；傍晚窗口：太阳下降经过 high → low。
+func bandWindow(day time.Time, lat, lon float64, band altitudeBand, noonAlt, nadirAlt float64) lightWindow {
+	if noonAlt < band.Low || nadirAlt > band.High {
+		return lightWindow{}
+	}
+	if nadirAlt >= band.Low && noonAlt <= band.High {
+		return lightWindow{Any: true, AllDay: true}
+	}
+	lowRise, lowSet := sunTimesAtAltitude(day, lat, lon, band.Low)
+	highRise, highSet := sunTimesAtAltitude(day, lat, lon, band.High)
+	return lightWindow{
+		MorningStart: lowRise,
+		MorningEnd:   highRise,
+		EveningStart: highSet,
+		EveningEnd:   lowSet,
+		Any:          true,
+	}
+}
+
+// sunTimesAtAltitude 计算太阳中心到达指定高度（度）的上升/下降时刻。
+// 算法与 sunmooncalc 的 GetTimes 一致（儒略周期 + 时角），不可达时返回零值。
+func sunTimesAtAltitude(date time.Time, lat, lon, altDeg float64) (rise, set time.Time) {
+	const (
+		rad  = math.Pi / 180
+		j0   = 0.0009
+		j2k  = 2451545.0
+		obli = 23.4397 * rad
+	)
+	lw := -lon * rad
+	phi := lat * rad
+	d := julianDay(date) - j2k
+	n := math.Round(d - j0 - lw/(2*math.Pi))
+	ds := j0 + lw/(2*math.Pi) + n
+	m := rad * (357.5291 + 0.98560028*ds)
+	c := rad * (1.9148*math.Sin(m) + 0.02*math.Sin(2*m) + 0.0003*math.Sin(3*m))
+	l := m + c + rad*102.9372 + math.Pi
+	dec := math.Asin(math.Sin(obli) * math.Sin(l))
+	jNoon := j2k + ds + 0.0053*math.Sin(m) - 0.0069*math.Sin(2*l)
+
+	cosW := (math.Sin(altDeg*rad) - math.Sin(phi)*math.Sin(dec)) / (math.Cos(phi) * math.Cos(dec))
+	if cosW < -1 || cosW > 1 || math.IsNaN(cosW) {
+		return time.Time{}, time.Time{}
+	}
+	w := math.Acos(cosW)
+	a := j0 + (w+lw)/(2*math.Pi) + n
+	jSet := j2k + a + 0.0053*math.Sin(m) - 0.0069*math.Sin(2*l)
+	jRise := jNoon - (jSet - jNoon)
+	return julianToTime(jRise), julianToTime(jSet)
+}
+
+// julianToTime 将儒略日转换为 UTC 时间（julianDay 的逆运算）。
+func julianToTime(jd float64) time.Time {
+	sec := (jd - 2440587.5) * 86400
+	whole := math.Floor(sec)
+	return time.Unix(int64(whole), int64((sec-whole)*1e9)).UTC()
+}
+
 // -------------------- 多格式输出 --------------------
 
 type OutputOptions struct {
@@ -592,8 +1082,91 @@ type OutputOptions struct {
 	OutDir         string
 }
 
+// astroColumn 描述一列导出字段：CSV 使用 Key 作为表头，TXT/Excel 使用中文 Label。
+type astroColumn struct {
+	Key     string
+	Label   string
+	Numeric bool // 数值列仅出现在 CSV/Excel 中，TXT 只保留可读字符串
+	Value   func(d dailyAstro) interface{}
+}
+
+// astroColumns 是 TXT/CSV/Excel 共用的列定义，新增字段只需在此追加。
+var astroColumns = []astroColumn{
+	{"date", "日期", false, func(d dailyAstro) interface{} { return d.Date }},
+	{"sunrise", "日出", false, func(d dailyAstro) interface{} { return d.Sunrise }},
+	{"visible_sunrise", "可见日出", false, func(d dailyAstro) interface{} { return d.VisibleSunrise }},
+	{"sunset", "日落", false, func(d dailyAstro) interface{} { return d.Sunset }},
+	{"visible_sunset", "可见日落", false, func(d dailyAstro) interface{} { return d.VisibleSunset }},
+	{"solar_noon", "太阳最高时刻", false, func(d dailyAstro) interface{} { return d.SolarNoon }},
+	{"max_altitude_deg", "太阳最高高度(°)", false, func(d dailyAstro) interface{} { return d.MaxAltitude }},
+	{"max_altitude_num", "最高高度数值", true, func(d dailyAstro) interface{} { return d.MaxAltitudeNum }},
+	{"day_length_hhmm", "日照时长(hh:mm)", false, func(d dailyAstro) interface{} { return d.DayLength }},
+	{"day_length_minutes", "日照时长(分钟)", true, func(d dailyAstro) interface{} { return d.DayLengthMinutes }},
+	{"moonrise", "月出", false, func(d dailyAstro) interface{} { return d.Moonrise }},
+	{"visible_moonrise", "可见月出", false, func(d dailyAstro) interface{} { return d.VisibleMoonrise }},
+	{"moonset", "月落", false, func(d dailyAstro) interface{} { return d.Moonset }},
+	{"visible_moonset", "可见月落", false, func(d dailyAstro) interface{} { return d.VisibleMoonset }},
+	{"moon_illumination", "月亮可见光比例", false, func(d dailyAstro) interface{} { return d.MoonIllumFrac }},
+	{"moon_illumination_num", "月亮光照数值", true, func(d dailyAstro) interface{} { return d.MoonIlluminationNum }},
+	{"civil_dawn", "民用晨光始", false, func(d dailyAstro) interface{} { return d.CivilDawn }},
+	{"civil_dusk", "民用暮光终", false, func(d dailyAstro) interface{} { return d.CivilDusk }},
+	{"nautical_dawn", "航海晨光始", false, func(d dailyAstro) interface{} { return d.NauticalDawn }},
+	{"nautical_dusk", "航海暮光终", false, func(d dailyAstro) interface{} { return d.NauticalDusk }},
+	{"astronomical_dawn", "天文晨光始", false, func(d dailyAstro) interface{} { return d.AstronomicalDawn }},
+	{"astronomical_dusk", "天文暮光终", false, func(d dailyAstro) interface{} { return d.AstronomicalDusk }},
+	{"darkness_hhmm", "黑夜时长(hh:mm)", false, func(d dailyAstro) interface{} { return d.Darkness }},
+	{"darkness_minutes", "黑夜时长(分钟)", true, func(d dailyAstro) interface{} { return d.DarknessMinutes }},
+	{"golden_hour_morning_start", "上午黄金时刻始", false, func(d dailyAstro) interface{} { return d.GoldenMorningStart }},
+	{"golden_hour_morning_end", "上午黄金时刻终", false, func(d dailyAstro) interface{} { return d.GoldenMorningEnd }},
+	{"golden_hour_evening_start", "傍晚黄金时刻始", false, func(d dailyAstro) interface{} { return d.GoldenEveningStart }},
+	{"golden_hour_evening_end", "傍晚黄金时刻终", false, func(d dailyAstro) interface{} { return d.GoldenEveningEnd }},
+	{"blue_hour_morning_start", "上午蓝调时刻始", false, func(d dailyAstro) interface{} { return d.BlueMorningStart }},
+	{"blue_hour_morning_end", "上午蓝调时刻终", false, func(d dailyAstro) interface{} { return d.BlueMorningEnd }},
+	{"blue_hour_evening_start", "傍晚蓝调时刻始", false, func(d dailyAstro) interface{} { return d.BlueEveningStart }},
+	{"blue_hour_evening_end", "傍晚蓝调时刻终", false, func(d dailyAstro) interface{} { return d.BlueEveningEnd }},
+	{"phase_event", "月相事件", false, func(d dailyAstro) interface{} { return d.PhaseEvent }},
+	{"solar_term", "节气", false, func(d dailyAstro) interface{} { return d.SolarTerm }},
+	{"lunar_date", "农历", false, func(d dailyAstro) interface{} { return d.LunarDate }},
+	{"ganzhi_year", "干支年", false, func(d dailyAstro) interface{} { return d.GanZhiYear }},
+	{"zodiac", "生肖", false, func(d dailyAstro) interface{} { return d.Zodiac }},
+	{"lunar_year", "农历年", true, func(d dailyAstro) interface{} { return d.LunarYear }},
+	{"lunar_month", "农历月", true, func(d dailyAstro) interface{} { return d.LunarMonth }},
+	{"lunar_day", "农历日", true, func(d dailyAstro) interface{} { return d.LunarDay }},
+	{"lunar_leap_month", "农历闰月", true, func(d dailyAstro) interface{} { return d.LunarLeap }},
+}
+
+// activeAstroColumns 返回本次导出使用的列：未设置地平线轮廓（可见升落为空）时省略 visible_* 列。
+func activeAstroColumns(data []dailyAstro) []astroColumn {
+	if slices.ContainsFunc(data, func(d dailyAstro) bool { return d.VisibleSunrise != "" }) {
+		return astroColumns
+	}
+	cols := make([]astroColumn, 0, len(astroColumns))
+	for _, c := range astroColumns {
+		if !strings.HasPrefix(c.Key, "visible_") {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// formatColumnValue 将列值格式化为 CSV/TXT 单元格文本。
+func formatColumnValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case float64:
+		return fmt.Sprintf("%.4f", x)
+	case int:
+		return strconv.Itoa(x)
+	case bool:
+		return strconv.FormatBool(x)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
 // writeAstroFile 根据输出格式写文件，返回文件路径。
-func writeAstroFile(format string, allowOverwrite bool, outDir string, cityName string, now time.Time, data []dailyAstro, desc, baseName string) (string, error) {
+func writeAstroFile(format string, allowOverwrite bool, outDir string, cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc, baseName string) (string, error) {
 	if baseName == "" {
 		baseName = fmt.Sprintf("%s-%s", sanitizeFileName(cityName), now.Format("2006-01-02"))
 	}
@@ -602,16 +1175,28 @@ func writeAstroFile(format string, allowOverwrite bool, outDir string, cityName
 	}
 	switch strings.ToLower(format) {
 	case "txt":
-		return writeAstroTxt(cityName, now, data, desc, baseName+".txt", allowOverwrite)
+		return writeAstroTxt(cityName, elev, now, data, desc, baseName+".txt", allowOverwrite)
 	case "csv":
-		return writeAstroCSV(cityName, now, data, desc, baseName+".csv", allowOverwrite)
+		return writeAstroCSV(cityName, elev, now, data, desc, baseName+".csv", allowOverwrite)
 	case "json":
-		return writeAstroJSON(cityName, now, data, desc, baseName+".json", allowOverwrite)
+		return writeAstroJSON(cityName, elev, now, data, desc, baseName+".json", allowOverwrite)
 	case "excel", "xlsx":
-		return writeAstroExcel(cityName, now, data, desc, baseName+".xlsx", allowOverwrite)
+		return writeAstroExcel(cityName, elev, now, data, desc, baseName+".xlsx", allowOverwrite)
+	case "ics":
+		types, err := parseICSEventTypes(config.ICSEvents)
+		if err != nil {
+			return "", err
+		}
+		return writeAstroICSFile(cityName, elev, now, data, types, baseName+".ics", allowOverwrite)
+	case "svg":
+		return writeAstroSVG(cityName, elev, now, data, desc, baseName+".svg", allowOverwrite)
+	case "html":
+		return writeAstroHTML(cityName, elev, now, data, desc, baseName+".html", allowOverwrite)
+	case "report":
+		return writeAstroReport(cityName, elev, now, data, desc, baseName+".report.html", allowOverwrite)
 	default:
 		// 未知格式时回退到 txt，保持行为可预期。
-		return writeAstroTxt(cityName, now, data, desc, baseName+".txt", allowOverwrite)
+		return writeAstroTxt(cityName, elev, now, data, desc, baseName+".txt", allowOverwrite)
 	}
 }
 
@@ -629,101 +1214,157 @@ func ensureWritableFile(path string, allowOverwrite bool) error {
 	return nil
 }
 
-// writeAstroTxt 以制表符文本输出天文数据。
-func writeAstroTxt(cityName string, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
+// astroFormatSpec 描述一种导出格式的文件扩展名与 HTTP Content-Type。
+type astroFormatSpec struct {
+	Ext         string
+	ContentType string
+}
+
+// astroFormatSpecs 为 writeAstroFile 与 /api/astro 支持的输出格式（xlsx 为 excel 的别名）。
+var astroFormatSpecs = map[string]astroFormatSpec{
+	"txt":    {"txt", "text/plain; charset=utf-8"},
+	"csv":    {"csv", "text/csv; charset=utf-8"},
+	"json":   {"json", "application/json; charset=utf-8"},
+	"excel":  {"xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+	"ics":    {"ics", "text/calendar; charset=utf-8"},
+	"svg":    {"svg", "image/svg+xml; charset=utf-8"},
+	"html":   {"html", "text/html; charset=utf-8"},
+	"report": {"report.html", "text/html; charset=utf-8"},
+}
+
+// normalizeAstroFormat 规范化格式名（xlsx → excel），未知格式返回 false。
+func normalizeAstroFormat(format string) (string, bool) {
+	f := strings.ToLower(strings.TrimSpace(format))
+	if f == "xlsx" {
+		f = "excel"
+	}
+	_, ok := astroFormatSpecs[f]
+	return f, ok
+}
+
+// writeAstroToFile 检查目标可写后创建文件，并交由 write 写入内容。
+func writeAstroToFile(filePath string, allowOverwrite bool, write func(io.Writer) error) (string, error) {
 	if err := ensureWritableFile(filePath, allowOverwrite); err != nil {
 		return "", err
 	}
-	f, err := os.Create(filePath)
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !allowOverwrite {
+		flag |= os.O_EXCL // 检查之后被并发写入抢先创建时同样报错，不覆盖
+	}
+	f, err := os.OpenFile(filePath, flag, 0o666)
+	if errors.Is(err, os.ErrExist) {
+		return "", fmt.Errorf("文件已存在: %s（使用 --overwrite 允许覆盖）", filePath)
+	}
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
+	if err := write(f); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return filePath, nil
+}
+
+// writeAstroTxt 以制表符文本输出天文数据。
+func writeAstroTxt(cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
+	return writeAstroToFile(filePath, allowOverwrite, func(w io.Writer) error {
+		return writeAstroTxtTo(w, cityName, elev, now, data, desc)
+	})
+}
 
-	w := bufio.NewWriter(f)
+// writeAstroTxtTo 将制表符文本写入 w。
+func writeAstroTxtTo(out io.Writer, cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc string) error {
+	w := bufio.NewWriter(out)
 	fmt.Fprintf(w, "# eSunMoon 城市天文数据：%s\n", cityName)
 	fmt.Fprintf(w, "# 生成日期（当地时间）：%s\n", now.Format("2006-01-02 15:04:05"))
 	if desc != "" {
 		fmt.Fprintf(w, "# 范围：%s\n", desc)
 	}
+	fmt.Fprintf(w, "# 海拔：%s\n", elev)
 	fmt.Fprintln(w, "# 所有时间均为城市所在时区的当地时间。")
 	fmt.Fprintf(w, "# 提示：%s\n", polarNote)
-
-	fmt.Fprintln(w, "日期\t日出\t日落\t太阳最高时刻\t太阳最高高度(°)\t日照时长(hh:mm)\t月出\t月落\t月亮可见光比例")
+	fmt.Fprintf(w, "# 提示：%s\n", twilightNote)
+	fmt.Fprintf(w, "# 提示：%s\n", photoNote)
+
+	columns := activeAstroColumns(data)
+	var header []string
+	for _, c := range columns {
+		if !c.Numeric {
+			header = append(header, c.Label)
+		}
+	}
+	fmt.Fprintln(w, strings.Join(header, "\t"))
 	for _, d := range data {
-		line := fmt.Sprintf(
-			"%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s",
-			d.Date, d.Sunrise, d.Sunset, d.SolarNoon,
-			d.MaxAltitude, d.DayLength,
-			d.Moonrise, d.Moonset, d.MoonIllumFrac,
-		)
-		fmt.Fprintln(w, line)
-	}
-	if err := w.Flush(); err != nil {
-		return "", err
+		fields := make([]string, 0, len(header))
+		for _, c := range columns {
+			if !c.Numeric {
+				fields = append(fields, formatColumnValue(c.Value(d)))
+			}
+		}
+		fmt.Fprintln(w, strings.Join(fields, "\t"))
 	}
-	return filePath, nil
+	return w.Flush()
 }
 
 // writeAstroCSV 以 CSV 输出天文数据。
-func writeAstroCSV(cityName string, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
-	if err := ensureWritableFile(filePath, allowOverwrite); err != nil {
-		return "", err
-	}
-	f, err := os.Create(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
+func writeAstroCSV(cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
+	return writeAstroToFile(filePath, allowOverwrite, func(w io.Writer) error {
+		return writeAstroCSVTo(w, cityName, elev, now, data, desc)
+	})
+}
 
-	w := csv.NewWriter(f)
+// writeAstroCSVTo 将 CSV 写入 w。
+func writeAstroCSVTo(out io.Writer, cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc string) error {
+	w := csv.NewWriter(out)
 	_ = w.Write([]string{"city", cityName})
 	_ = w.Write([]string{"generated_at", now.Format(time.RFC3339)})
 	if desc != "" {
 		_ = w.Write([]string{"range", desc})
 	}
+	_ = w.Write([]string{"elevation_m", strconv.FormatFloat(elev.Meters, 'f', -1, 64)})
+	if elev.Source != "" {
+		_ = w.Write([]string{"elevation_source", elev.Source})
+	}
 	_ = w.Write([]string{"note", polarNote})
+	_ = w.Write([]string{"note", twilightNote})
+	_ = w.Write([]string{"note", photoNote})
 	_ = w.Write([]string{})
-	_ = w.Write([]string{
-		"date", "sunrise", "sunset", "solar_noon",
-		"max_altitude_deg", "max_altitude_num",
-		"day_length_hhmm", "day_length_minutes",
-		"moonrise", "moonset",
-		"moon_illumination", "moon_illumination_num",
-	})
+	columns := activeAstroColumns(data)
+	header := make([]string, 0, len(columns))
+	for _, c := range columns {
+		header = append(header, c.Key)
+	}
+	_ = w.Write(header)
 
 	for _, d := range data {
-		_ = w.Write([]string{
-			d.Date,
-			d.Sunrise,
-			d.Sunset,
-			d.SolarNoon,
-			d.MaxAltitude,
-			fmt.Sprintf("%.4f", d.MaxAltitudeNum),
-			d.DayLength,
-			strconv.Itoa(d.DayLengthMinutes),
-			d.Moonrise,
-			d.Moonset,
-			d.MoonIllumFrac,
-			fmt.Sprintf("%.4f", d.MoonIlluminationNum),
-		})
+		row := make([]string, 0, len(columns))
+		for _, c := range columns {
+			row = append(row, formatColumnValue(c.Value(d)))
+		}
+		_ = w.Write(row)
 	}
 	w.Flush()
-	if err := w.Error(); err != nil {
-		return "", err
-	}
-	return filePath, nil
+	return w.Error()
 }
 
 // writeAstroJSON 以 JSON 输出天文数据。
-func writeAstroJSON(cityName string, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
-	if err := ensureWritableFile(filePath, allowOverwrite); err != nil {
-		return "", err
-	}
+func writeAstroJSON(cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
+	return writeAstroToFile(filePath, allowOverwrite, func(w io.Writer) error {
+		return writeAstroJSONTo(w, cityName, elev, now, data, desc)
+	})
+}
+
+// writeAstroJSONTo 将 JSON 写入 w。
+func writeAstroJSONTo(w io.Writer, cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc string) error {
 	wrapper := struct {
 		City       string       `json:"city"`
 		Generated  string       `json:"generated_at"`
 		Range      string       `json:"range,omitempty"`
+		Elevation  float64      `json:"elevation_m"`
+		ElevSource string       `json:"elevation_source,omitempty"` // dem 或 manual
 		Data       []dailyAstro `json:"data"`
 		LocalTZTip string       `json:"local_time_tip"`
 		Notes      []string     `json:"notes,omitempty"`
@@ -731,29 +1372,38 @@ func writeAstroJSON(cityName string, now time.Time, data []dailyAstro, desc, fil
 		City:       cityName,
 		Generated:  now.Format(time.RFC3339),
 		Range:      desc,
+		Elevation:  elev.Meters,
+		ElevSource: elev.Source,
 		Data:       data,
 		LocalTZTip: "所有时间均为城市所在时区的当地时间",
-		Notes:      []string{polarNote},
+		Notes:      []string{polarNote, twilightNote, photoNote},
 	}
 	b, err := json.MarshalIndent(wrapper, "", "  ")
 	if err != nil {
-		return "", err
-	}
-	if err := os.WriteFile(filePath, b, 0o644); err != nil {
-		return "", err
+		return err
 	}
-	return filePath, nil
+	_, err = w.Write(b)
+	return err
 }
 
 // writeAstroExcel 以 Excel 输出天文数据。
-func writeAstroExcel(cityName string, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
-	if err := ensureWritableFile(filePath, allowOverwrite); err != nil {
-		return "", err
-	}
+func writeAstroExcel(cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
+	return writeAstroToFile(filePath, allowOverwrite, func(w io.Writer) error {
+		return writeAstroExcelTo(w, cityName, elev, now, data, desc)
+	})
+}
+
+// writeAstroExcelTo 将 xlsx 工作簿写入 w。
+func writeAstroExcelTo(w io.Writer, cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc string) error {
 	f := excelize.NewFile()
 	sheet := "Astro"
 	f.SetSheetName(f.GetSheetName(0), sheet)
+	fillAstroSheet(f, sheet, cityName, elev, now, data, desc)
+	return f.Write(w)
+}
 
+// fillAstroSheet 在工作表 sheet 中写入表头信息、说明与逐日数据（单城市与多地点工作簿共用）。
+func fillAstroSheet(f *excelize.File, sheet, cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc string) {
 	f.SetCellValue(sheet, "A1", "城市")
 	f.SetCellValue(sheet, "B1", cityName)
 	f.SetCellValue(sheet, "A2", "生成时间")
@@ -762,44 +1412,142 @@ func writeAstroExcel(cityName string, now time.Time, data []dailyAstro, desc, fi
 		f.SetCellValue(sheet, "A3", "范围")
 		f.SetCellValue(sheet, "B3", desc)
 	}
-	f.SetCellValue(sheet, "A4", "提示")
-	f.SetCellValue(sheet, "B4", "所有时间均为城市所在时区的当地时间")
-	f.SetCellValue(sheet, "A5", "说明")
-	f.SetCellValue(sheet, "B5", polarNote)
-
-	headers := []string{
-		"日期",
-		"日出", "日落", "太阳最高时刻",
-		"太阳最高高度(°)", "最高高度数值",
-		"日照时长(hh:mm)", "日照时长(分钟)",
-		"月出", "月落",
-		"月亮可见光比例", "月亮光照数值",
+	f.SetCellValue(sheet, "A4", "海拔")
+	f.SetCellValue(sheet, "B4", elev.String())
+	f.SetCellValue(sheet, "A5", "提示")
+	f.SetCellValue(sheet, "B5", "所有时间均为城市所在时区的当地时间")
+	row := 6
+	for _, note := range []string{polarNote, twilightNote, photoNote} {
+		f.SetCellValue(sheet, fmt.Sprintf("A%d", row), "说明")
+		f.SetCellValue(sheet, fmt.Sprintf("B%d", row), note)
+		row++
 	}
-	for i, h := range headers {
-		cell, _ := excelize.CoordinatesToCellName(i+1, 7)
-		f.SetCellValue(sheet, cell, h)
+	row++
+
+	columns := activeAstroColumns(data)
+	for i, c := range columns {
+		cell, _ := excelize.CoordinatesToCellName(i+1, row)
+		f.SetCellValue(sheet, cell, c.Label)
 	}
 
-	row := 8
+	row++
 	for _, d := range data {
-		values := []interface{}{
-			d.Date,
-			d.Sunrise, d.Sunset, d.SolarNoon,
-			d.MaxAltitude, d.MaxAltitudeNum,
-			d.DayLength, d.DayLengthMinutes,
-			d.Moonrise, d.Moonset,
-			d.MoonIllumFrac, d.MoonIlluminationNum,
-		}
-		for col, v := range values {
+		for col, c := range columns {
 			cell, _ := excelize.CoordinatesToCellName(col+1, row)
-			f.SetCellValue(sheet, cell, v)
+			f.SetCellValue(sheet, cell, c.Value(d))
 		}
 		row++
 	}
-	if err := f.SaveAs(filePath); err != nil {
-		return "", err
+}
+
+// astroICSEventTypes 为 ICS 导出支持的事件类型（--ics-events / events= 的取值）。
+var astroICSEventTypes = []string{"sunrise", "sunset", "moonrise", "moonset", "phase", "solar_term"}
+
+// parseICSEventTypes 解析逗号分隔的事件类型列表；空串或 "all" 表示全部类型，未知类型返回错误。
+func parseICSEventTypes(s string) (map[string]bool, error) {
+	types := make(map[string]bool)
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "" || s == "all" {
+		for _, t := range astroICSEventTypes {
+			types[t] = true
+		}
+		return types, nil
 	}
-	return filePath, nil
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		known := false
+		for _, t := range astroICSEventTypes {
+			if t == part {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("未知的 ICS 事件类型: %s（可选：%s）", part, strings.Join(astroICSEventTypes, ","))
+		}
+		types[part] = true
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("ICS 事件类型不能为空")
+	}
+	return types, nil
+}
+
+// parseLocalClock 将 "YYYY-MM-DD" 与 "HH:MM" 组合为当地时间；"--" 等无效值返回 false。
+func parseLocalClock(date, clock string, loc *time.Location) (time.Time, bool) {
+	t, err := time.ParseInLocation("2006-01-02 15:04", date+" "+clock, loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// astroICSEvents 将逐日数据转换为日历事件（瞬时事件，精确到分钟），仅保留 types 中的类型。
+func astroICSEvents(cityName string, loc *time.Location, data []dailyAstro, types map[string]bool) []icsEvent {
+	uidCity := strings.ToLower(strings.ReplaceAll(sanitizeFileName(cityName), " ", "_"))
+	var out []icsEvent
+	// visible_* 事件随对应的 sunrise/sunset/moonrise/moonset 类型一同筛选
+	add := func(kind, date, clock, summary, desc string) {
+		if !types[strings.TrimPrefix(kind, "visible_")] {
+			return
+		}
+		t, ok := parseLocalClock(date, clock, loc)
+		if !ok {
+			return
+		}
+		out = append(out, icsEvent{
+			UID:         fmt.Sprintf("%s-%s-%s@esunmoon", kind, strings.ReplaceAll(date, "-", ""), uidCity),
+			Summary:     summary,
+			Description: desc,
+			Location:    cityName,
+			Start:       t,
+		})
+	}
+	// splitEvent 拆分 "满月 21:58" 形式的事件文本。
+	splitEvent := func(v string) (name, clock string) {
+		if i := strings.LastIndex(v, " "); i > 0 {
+			return v[:i], v[i+1:]
+		}
+		return "", ""
+	}
+
+	for _, d := range data {
+		add("sunrise", d.Date, d.Sunrise, "日出", fmt.Sprintf("昼长 %s，正午太阳高度 %s°", d.DayLength, d.MaxAltitude))
+		add("sunset", d.Date, d.Sunset, "日落", fmt.Sprintf("昼长 %s，黑夜时长 %s", d.DayLength, d.Darkness))
+		add("moonrise", d.Date, d.Moonrise, "月出", "月面照亮比例 "+d.MoonIllumFrac)
+		add("moonset", d.Date, d.Moonset, "月落", "月面照亮比例 "+d.MoonIllumFrac)
+		add("visible_sunrise", d.Date, d.VisibleSunrise, "可见日出", "太阳越过地平线轮廓（地形/建筑遮挡）")
+		add("visible_sunset", d.Date, d.VisibleSunset, "可见日落", "太阳落入地平线轮廓（地形/建筑遮挡）")
+		add("visible_moonrise", d.Date, d.VisibleMoonrise, "可见月出", "月亮越过地平线轮廓，照亮比例 "+d.MoonIllumFrac)
+		add("visible_moonset", d.Date, d.VisibleMoonset, "可见月落", "月亮落入地平线轮廓，照亮比例 "+d.MoonIllumFrac)
+		if name, clock := splitEvent(d.PhaseEvent); name != "" {
+			add("phase", d.Date, clock, name, "农历 "+d.LunarDate)
+		}
+		if name, clock := splitEvent(d.SolarTerm); name != "" {
+			add("solar_term", d.Date, clock, name, "二十四节气")
+		}
+	}
+	return out
+}
+
+// writeAstroICS 将逐日数据以 iCalendar 输出到 w（含城市时区的 VTIMEZONE）。
+func writeAstroICS(w io.Writer, cityName string, elev observerElevation, now time.Time, data []dailyAstro, types map[string]bool) error {
+	loc := now.Location()
+	calName := fmt.Sprintf("%s 日月事件", cityName)
+	if elev.Meters != 0 {
+		calName += fmt.Sprintf("（海拔 %.0f m）", elev.Meters)
+	}
+	return writeICS(w, calName, now, loc, astroICSEvents(cityName, loc, data, types))
+}
+
+// writeAstroICSFile 以 ICS 文件输出天文事件。
+func writeAstroICSFile(cityName string, elev observerElevation, now time.Time, data []dailyAstro, types map[string]bool, filePath string, allowOverwrite bool) (string, error) {
+	return writeAstroToFile(filePath, allowOverwrite, func(w io.Writer) error {
+		return writeAstroICS(w, cityName, elev, now, data, types)
+	})
 }
 
 // -------------------- City & 缓存 & 实时位置 --------------------
@@ -823,14 +1571,170 @@ func findEntryInCache(cache *CityCache, city string) (CityCacheEntry, bool) {
 	return CityCacheEntry{}, false
 }
 
-// prepareCity 解析城市（缓存/网络），并加载时区与当前时间。
-func prepareCity(city string, offline bool) (*CityContext, error) {
-	if city == "" {
-		return nil, fmt.Errorf("未输入城市名")
-	}
-	cache := loadCache()
+// geoOptions 控制多候选城市的选择：Pick 为 1 起的候选序号，Country 为国家代码过滤，
+// Chosen 为已选定的候选（跳过地理编码），Interactive 表示允许在终端提示用户选择。
+type geoOptions struct {
+	Pick        int
+	Country     string
+	Chosen      *GeoCandidate
+	Interactive bool
+}
+
+// cliGeoOptions 返回命令行模式下由 --pick/--country 构成的选择参数；仅当标准输入为终端时才允许交互选择，
+// 否则按 --pick 或排名第一的候选。
+func cliGeoOptions() geoOptions {
+	return geoOptions{Pick: config.Pick, Country: config.Country, Interactive: app.stdinIsTerminal()}
+}
+
+// cacheEntryMatches 判断缓存条目是否满足本次的候选选择要求（显式指定的序号、国家或候选与缓存不一致时需重新查询）。
+func cacheEntryMatches(entry CityCacheEntry, opts geoOptions) bool {
+	if opts.Chosen != nil {
+		return entry.Lat == opts.Chosen.Lat && entry.Lon == opts.Chosen.Lon
+	}
+	if opts.Pick > 0 && opts.Pick != max(entry.Pick, 1) {
+		return false
+	}
+	if opts.Country != "" {
+		if entry.Candidate == nil {
+			return false
+		}
+		return candidateInCountry(*entry.Candidate, opts.Country)
+	}
+	return true
+}
+
+// reverseCacheKey 将坐标四舍五入到 0.01°（约 1 km）作为反查缓存键。
+func reverseCacheKey(lat, lon float64) string {
+	round := func(v float64) float64 {
+		r := math.Round(v*100) / 100
+		if r == 0 {
+			r = 0 // 去掉 -0
+		}
+		return r
+	}
+	return fmt.Sprintf("%.2f,%.2f", round(lat), round(lon))
+}
 
-	if entry, ok := findEntryInCache(cache, city); ok {
+// reverseGeocodeName 为坐标查找地名（缓存 → 地理编码器反查），返回城市名与显示名；
+// 找不到时回退为 coords_lat_lon。网络反查结果写入缓存，之后同一坐标（约 1 km 内）可离线复用。
+func reverseGeocodeName(lat, lon float64, offline bool) (city, displayName string) {
+	return reverseGeocodeNameIn(context.Background(), loadCache(), lat, lon, offline)
+}
+
+// reverseGeocodeNameIn 与 reverseGeocodeName 相同，但读写调用方传入的缓存（批量解析时整批共用一份），
+// 网络请求随 reqCtx 取消（API 调用时为请求的 context）。失败与无结果同样写入缓存，reverseRetryTTL 内不再重试。
+func reverseGeocodeNameIn(reqCtx context.Context, cache *CityCache, lat, lon float64, offline bool) (city, displayName string) {
+	fallback := fmt.Sprintf("coords_%.4f_%.4f", lat, lon)
+	key := reverseCacheKey(lat, lon)
+	if e, ok := cache.Reverse[key]; ok {
+		ttl := app.cacheTTL
+		if e.Source != "nominatim" && e.Source != "photon" {
+			ttl = reverseRetryTTL
+		}
+		expired := true
+		if t, err := time.Parse(time.RFC3339, e.UpdatedAt); err == nil {
+			expired = app.now().Sub(t) > ttl
+		}
+		if e.City != "" && (offline || !expired) {
+			return e.City, e.DisplayName
+		}
+		if e.City == "" && !offline && !expired {
+			return fallback, fallback
+		}
+	}
+
+	rg, ok := app.geocoder.(ReverseGeocoder)
+	if !ok {
+		return fallback, fallback
+	}
+	ctx, cancel := context.WithTimeout(reqCtx, reverseLookupTimeout)
+	defer cancel()
+	cand, err := rg.Reverse(ctx, lat, lon, offline)
+	if err != nil || cand.Name == "" {
+		logDebugf("坐标 %.4f,%.4f 反查地名失败: %v", lat, lon, err)
+		cand = GeoCandidate{}
+	}
+	if offline || reqCtx.Err() != nil {
+		// 离线查询不涉及网络，无需负缓存；调用方已取消时不把取消当作失败记录
+		if cand.Name == "" {
+			return fallback, fallback
+		}
+		return cand.Name, cand.DisplayName
+	}
+	if cache.Reverse == nil {
+		cache.Reverse = make(map[string]ReverseCacheEntry)
+	}
+	cache.Reverse[key] = ReverseCacheEntry{
+		City:        cand.Name,
+		DisplayName: cand.DisplayName,
+		Source:      cand.Source,
+		UpdatedAt:   app.now().Format(time.RFC3339),
+	}
+	if err := saveCache(cache); err != nil {
+		logWarnf("保存反查缓存失败: %v", err)
+	}
+	if cand.Name == "" {
+		return fallback, fallback
+	}
+	return cand.Name, cand.DisplayName
+}
+
+// prepareCity 解析城市（缓存/网络），并加载时区与当前时间；多候选时按 --pick/--country 或终端交互选择。
+func prepareCity(city string, offline bool) (*CityContext, error) {
+	ctx, err := prepareCityWith(city, offline, cliGeoOptions())
+	if err != nil {
+		return nil, err
+	}
+	if config.ElevationSet {
+		ctx.Elevation, ctx.ElevationSource = config.Elevation, "manual"
+		logInfof("海拔（手动指定）: %s", formatElevation(config.Elevation, ""))
+	}
+	if config.HorizonFile != "" {
+		h, err := loadHorizonFile(config.HorizonFile)
+		if err != nil {
+			return nil, err
+		}
+		ctx.Horizon = h
+		logInfof("地平线轮廓: %s（%d 个点）", config.HorizonFile, len(h))
+	}
+	if config.ElevationSet || config.HorizonFile != "" {
+		saveObserverSettings(ctx)
+	}
+	return ctx, nil
+}
+
+// saveObserverSettings 将手动海拔与地平线轮廓写回该城市的缓存条目，供后续运行及 HTTP 服务复用。
+func saveObserverSettings(ctx *CityContext) {
+	cache := loadCache()
+	entry, ok := findEntryInCache(cache, ctx.City)
+	if !ok {
+		return
+	}
+	if ctx.ElevationSource == "manual" {
+		entry.Elevation, entry.ElevationSource = ctx.Elevation, "manual"
+	}
+	if len(ctx.Horizon) > 0 {
+		entry.Horizon = ctx.Horizon
+	}
+	cache.Entries[entry.Normalized] = entry
+	if err := saveCache(cache); err != nil {
+		logWarnf("保存观测点设置到缓存失败: %v", err)
+	}
+}
+
+// prepareCityWith 与 prepareCity 相同，但由 opts 指定候选选择方式。
+func prepareCityWith(city string, offline bool, opts geoOptions) (*CityContext, error) {
+	return prepareCityIn(context.Background(), loadCache(), city, offline, opts)
+}
+
+// prepareCityIn 与 prepareCityWith 相同，但读写调用方传入的缓存，新解析的城市写入 cache 后整体保存；
+// 地理编码请求随 reqCtx 取消（API 调用时为请求的 context）。
+func prepareCityIn(reqCtx context.Context, cache *CityCache, city string, offline bool, opts geoOptions) (*CityContext, error) {
+	if city == "" {
+		return nil, fmt.Errorf("未输入城市名")
+	}
+
+	if entry, ok := findEntryInCache(cache, city); ok && (offline || cacheEntryMatches(entry, opts)) {
 		expired := true
 		if entry.UpdatedAt != "" {
 			if t, err := time.Parse(time.RFC3339, entry.UpdatedAt); err == nil {
@@ -838,7 +1742,7 @@ func prepareCity(city string, offline bool) (*CityContext, error) {
 			}
 		}
 		if expired && offline {
-			return nil, fmt.Errorf("离线模式：城市 [%s] 缓存已过期，请联网刷新缓存后再试。", city)
+			return nil, apiErrorf(errCodeCityNotFound, "city", "离线模式：城市 [%s] 缓存已过期，请联网刷新缓存后再试。", city)
 		}
 		if !expired {
 			loc, err := time.LoadLocation(entry.TimezoneID)
@@ -847,19 +1751,34 @@ func prepareCity(city string, offline bool) (*CityContext, error) {
 			}
 			now := app.now().In(loc)
 			ctx := &CityContext{
-				City:        entry.City,
-				DisplayName: entry.DisplayName,
-				Lat:         entry.Lat,
-				Lon:         entry.Lon,
-				TZID:        entry.TimezoneID,
-				Loc:         loc,
-				Now:         now,
+				City:            entry.City,
+				DisplayName:     entry.DisplayName,
+				Lat:             entry.Lat,
+				Lon:             entry.Lon,
+				TZID:            entry.TimezoneID,
+				Loc:             loc,
+				Now:             now,
+				Elevation:       entry.Elevation,
+				ElevationSource: entry.ElevationSource,
+				Horizon:         entry.Horizon,
+			}
+			if ctx.ElevationSource == "" {
+				if elev, ok := demElevation(entry.Lat, entry.Lon); ok {
+					ctx.Elevation, ctx.ElevationSource = elev, "dem"
+					// 写回缓存，之后的运行与 HTTP 请求直接使用，不再读取 DEM 瓦片
+					entry.Elevation, entry.ElevationSource = elev, "dem"
+					cache.Entries[entry.Normalized] = entry
+					if err := saveCache(cache); err != nil {
+						logWarnf("保存 DEM 海拔到缓存失败: %v", err)
+					}
+				}
 			}
 			fmt.Println("-------------------------------------------------")
 			logInfof("城市输入: %s", city)
 			logInfof("解析结果（来自缓存）: %s", entry.DisplayName)
 			logInfof("经纬度（缓存）:  %.4f, %.4f", entry.Lat, entry.Lon)
 			logInfof("时区（缓存）:    %s", entry.TimezoneID)
+			logInfof("海拔:    %s", formatElevation(ctx.Elevation, ctx.ElevationSource))
 			logInfof("当前当地时间: %s", now.Format("2006-01-02 15:04:05"))
 			fmt.Println("-------------------------------------------------")
 			printSunMoonPosition(ctx)
@@ -867,19 +1786,36 @@ func prepareCity(city string, offline bool) (*CityContext, error) {
 		}
 	}
 
-	if offline {
-		return nil, fmt.Errorf("离线模式：城市 [%s] 未在缓存中，无法联网查询，请先在联网状态下运行一次。", city)
-	}
-
-	ctxWithTimeout, cancel := context.WithTimeout(context.Background(), 12*time.Second)
-	defer cancel()
-	lat, lon, displayName, err := geocodeCity(ctxWithTimeout, app.client, city)
-	if err != nil {
-		return nil, fmt.Errorf("获取城市坐标失败: %w", err)
+	var chosen GeoCandidate
+	pick := 1
+	if opts.Chosen != nil {
+		chosen = *opts.Chosen
+		pick = max(opts.Pick, 1)
+	} else {
+		ctxWithTimeout, cancel := context.WithTimeout(reqCtx, 12*time.Second)
+		defer cancel()
+		cands, err := lookupCandidates(ctxWithTimeout, city, opts.Country, offline, geocodeDefaultLimit)
+		if err != nil && offline {
+			return nil, apiErrorf(errCodeCityNotFound, "city", "离线模式：城市 [%s] 未在缓存或内置城市库中，无法联网查询，请先在联网状态下运行一次。", city)
+		}
+		if err != nil {
+			if errors.Is(err, errCityNotFound) {
+				return nil, apiErrorf(errCodeCityNotFound, "city", "获取城市坐标失败: %w", err)
+			}
+			return nil, apiErrorf(errCodeGeocoderUnavailable, "", "获取城市坐标失败: %w", err)
+		}
+		chosen, pick, err = selectCandidate(city, cands, opts)
+		if err != nil {
+			return nil, err
+		}
 	}
-	tzID, err := app.tzLookup(lat, lon)
-	if err != nil {
-		return nil, fmt.Errorf("自动检测时区失败: %w", err)
+	lat, lon, displayName := chosen.Lat, chosen.Lon, chosen.DisplayName
+	tzID := chosen.Timezone
+	if tzID == "" {
+		var err error
+		if tzID, err = app.tzLookup(lat, lon); err != nil {
+			return nil, fmt.Errorf("自动检测时区失败: %w", err)
+		}
 	}
 	loc, err := app.loadTZ(tzID)
 	if err != nil {
@@ -896,12 +1832,27 @@ func prepareCity(city string, offline bool) (*CityContext, error) {
 		Loc:         loc,
 		Now:         now,
 	}
+	// 刷新缓存时保留此前手动设置的海拔与地平线轮廓
+	prev, hasPrev := findEntryInCache(cache, city)
+	if hasPrev && prev.ElevationSource == "manual" {
+		ctx.Elevation, ctx.ElevationSource = prev.Elevation, "manual"
+	} else if elev, ok := demElevation(lat, lon); ok {
+		ctx.Elevation, ctx.ElevationSource = elev, "dem"
+	}
+	if hasPrev {
+		ctx.Horizon = prev.Horizon
+	}
 
 	fmt.Println("-------------------------------------------------")
 	logInfof("城市输入: %s", city)
-	logInfof("解析结果: %s", displayName)
+	if chosen.Source == "gazetteer" {
+		logInfof("解析结果（内置城市库）: %s", displayName)
+	} else {
+		logInfof("解析结果: %s", displayName)
+	}
 	logInfof("经纬度:  %.4f, %.4f", lat, lon)
 	logInfof("时区:    %s", tzID)
+	logInfof("海拔:    %s", formatElevation(ctx.Elevation, ctx.ElevationSource))
 	logInfof("当前当地时间: %s", now.Format("2006-01-02 15:04:05"))
 	fmt.Println("-------------------------------------------------")
 	printSunMoonPosition(ctx)
@@ -910,6 +1861,11 @@ func prepareCity(city string, offline bool) (*CityContext, error) {
 	if extra, ok := builtinAliases[normalizeCityKey(city)]; ok {
 		aliases = append(aliases, extra...)
 	}
+	for _, a := range chosen.Aliases {
+		if !slices.ContainsFunc(aliases, func(s string) bool { return normalizeCityKey(s) == normalizeCityKey(a) }) {
+			aliases = append(aliases, a)
+		}
+	}
 	entry := CityCacheEntry{
 		City:        city,
 		Normalized:  normalizeCityKey(city),
@@ -919,6 +1875,12 @@ func prepareCity(city string, offline bool) (*CityContext, error) {
 		TimezoneID:  tzID,
 		Aliases:     aliases,
 		UpdatedAt:   time.Now().Format(time.RFC3339),
+		Candidate:   &chosen,
+		Pick:        pick,
+
+		Elevation:       ctx.Elevation,
+		ElevationSource: ctx.ElevationSource,
+		Horizon:         ctx.Horizon,
 	}
 	cache.Entries[entry.Normalized] = entry
 	if err := saveCache(cache); err != nil {
@@ -928,26 +1890,36 @@ func prepareCity(city string, offline bool) (*CityContext, error) {
 	return ctx, nil
 }
 
-// printSunMoonPosition 打印当前太阳与月亮方位、高度和距离。
+// printSunMoonPosition 打印当前太阳、月亮与行星的方位、高度和距离。
 func printSunMoonPosition(ctx *CityContext) {
 	sunPos := suncalc.GetPosition(ctx.Now, ctx.Lat, ctx.Lon)
 	moonPos := suncalc.GetMoonPosition(ctx.Now, ctx.Lat, ctx.Lon)
 
+	atm := ctx.atmosphereOrDefault()
 	sunAzDeg := radToDeg(sunPos.Azimuth)
 	sunAltDeg := radToDeg(sunPos.Altitude)
 	sunDistKm := earthSunDistanceKm(ctx.Now)
 
 	moonAzDeg := radToDeg(moonPos.Azimuth)
-	moonAltDeg := radToDeg(moonPos.Altitude)
+	moonAltDeg := moonGeometricAltitude(radToDeg(moonPos.Altitude))
 	moonDistKm := moonPos.Distance
 
 	fmt.Println("实时天体位置（当地时间）")
-	logInfof("太阳：方位角 %.2f°（%s），高度角 %.2f°，距离约 %.0f km", sunAzDeg, describeAzimuth(sunAzDeg), sunAltDeg, sunDistKm)
-	logInfof("月亮：方位角 %.2f°（%s），高度角 %.2f°，距离约 %.0f km", moonAzDeg, describeAzimuth(moonAzDeg), moonAltDeg, moonDistKm)
+	if lunar := lunarSummary(ctx.Now); lunar != "" {
+		fmt.Printf("农历：%s\n", lunar)
+	}
+	logInfof("太阳：方位角 %.2f°（%s），高度角 %.2f°（视高度 %.2f°），距离约 %.0f km",
+		sunAzDeg, describeAzimuth(sunAzDeg), sunAltDeg, apparentAltitude(sunAltDeg, atm), sunDistKm)
+	logInfof("月亮：方位角 %.2f°（%s），高度角 %.2f°（视高度 %.2f°），距离约 %.0f km",
+		moonAzDeg, describeAzimuth(moonAzDeg), moonAltDeg, apparentAltitude(moonAltDeg, atm), moonDistKm)
+	for _, p := range withApparentAltitudes(buildPlanetPositions(ctx.Now, ctx.Lat, ctx.Lon, ctx.Loc), atm) {
+		logInfof("%s：方位角 %.2f°（%s），高度角 %.2f°（视高度 %.2f°），距离 %.3f AU，星等 %.1f，升 %s / 落 %s",
+			p.Name, p.AzimuthDeg, p.AzimuthText, p.AltitudeDeg, p.ApparentAltitudeDeg, p.DistanceAU, p.Magnitude, p.Rise, p.Set)
+	}
 	fmt.Println("-------------------------------------------------")
 }
 
-// runLivePositions 按指定间隔持续输出实时太阳/月亮位置，直到收到终止信号。
+// runLivePositions 按指定间隔持续输出实时太阳/月亮/行星位置，直到收到终止信号。
 func runLivePositions(ctx *CityContext, interval time.Duration) error {
 	if interval <= 0 {
 		// 防御非法或零间隔，回退默认 5 秒。
@@ -989,7 +1961,7 @@ func sanitizeFileName(name string) string {
 // buildYearData 生成从当前日开始的一年数据。
 func buildYearData(ctx *CityContext) (data []dailyAstro, desc, baseName string, err error) {
 	start := time.Date(ctx.Now.Year(), ctx.Now.Month(), ctx.Now.Day(), 12, 0, 0, 0, ctx.Loc)
-	data, err = generateAstroData(ctx.City, ctx.Lat, ctx.Lon, ctx.Loc, start, 365)
+	data, err = generateAstroDataFor(ctx, start, 365)
 	if err != nil {
 		return nil, "", "", fmt.Errorf("生成年度天文数据失败: %w", err)
 	}
@@ -1002,9 +1974,9 @@ func buildYearData(ctx *CityContext) (data []dailyAstro, desc, baseName string,
 func buildDayData(ctx *CityContext, dateStr string) (data []dailyAstro, desc, baseName string, err error) {
 	day, err := parseDateInLocation(dateStr, ctx.Loc)
 	if err != nil {
-		return nil, "", "", fmt.Errorf("解析日期失败（格式应为 YYYY-MM-DD）: %w", err)
+		return nil, "", "", apiErrorf(errCodeInvalidDate, "date", "解析日期失败（格式应为 YYYY-MM-DD）: %w", err)
 	}
-	data, err = generateAstroData(ctx.City, ctx.Lat, ctx.Lon, ctx.Loc, day, 1)
+	data, err = generateAstroDataFor(ctx, day, 1)
 	if err != nil {
 		return nil, "", "", fmt.Errorf("生成指定日期天文数据失败: %w", err)
 	}
@@ -1017,17 +1989,17 @@ func buildDayData(ctx *CityContext, dateStr string) (data []dailyAstro, desc, ba
 func buildRangeData(ctx *CityContext, fromStr, toStr string) (data []dailyAstro, desc, baseName string, err error) {
 	start, err := parseDateInLocation(fromStr, ctx.Loc)
 	if err != nil {
-		return nil, "", "", fmt.Errorf("解析起始日期失败（格式应为 YYYY-MM-DD）: %w", err)
+		return nil, "", "", apiErrorf(errCodeInvalidDate, "from", "解析起始日期失败（格式应为 YYYY-MM-DD）: %w", err)
 	}
 	end, err := parseDateInLocation(toStr, ctx.Loc)
 	if err != nil {
-		return nil, "", "", fmt.Errorf("解析结束日期失败（格式应为 YYYY-MM-DD）: %w", err)
+		return nil, "", "", apiErrorf(errCodeInvalidDate, "to", "解析结束日期失败（格式应为 YYYY-MM-DD）: %w", err)
 	}
 	if end.Before(start) {
-		return nil, "", "", fmt.Errorf("结束日期不能早于起始日期")
+		return nil, "", "", apiErrorf(errCodeInvalidDate, "to", "结束日期不能早于起始日期")
 	}
 	days := int(end.Sub(start).Hours()/24) + 1
-	data, err = generateAstroData(ctx.City, ctx.Lat, ctx.Lon, ctx.Loc, start, days)
+	data, err = generateAstroDataFor(ctx, start, days)
 	if err != nil {
 		return nil, "", "", fmt.Errorf("生成区间天文数据失败: %w", err)
 	}
@@ -1042,7 +2014,7 @@ func runYear(ctx *CityContext, opts OutputOptions) error {
 	if err != nil {
 		return err
 	}
-	outFile, err := writeAstroFile(opts.Format, opts.AllowOverwrite, opts.OutDir, ctx.City, ctx.Now, data, desc, baseName)
+	outFile, err := writeAstroFile(opts.Format, opts.AllowOverwrite, opts.OutDir, ctx.City, ctx.observerElevation(), ctx.Now, data, desc, baseName)
 	if err != nil {
 		return fmt.Errorf("写入文件失败: %w", err)
 	}
@@ -1056,7 +2028,7 @@ func runDay(ctx *CityContext, dateStr string, opts OutputOptions) error {
 	if err != nil {
 		return err
 	}
-	outFile, err := writeAstroFile(opts.Format, opts.AllowOverwrite, opts.OutDir, ctx.City, ctx.Now, data, desc, baseName)
+	outFile, err := writeAstroFile(opts.Format, opts.AllowOverwrite, opts.OutDir, ctx.City, ctx.observerElevation(), ctx.Now, data, desc, baseName)
 	if err != nil {
 		return fmt.Errorf("写入文件失败: %w", err)
 	}
@@ -1070,7 +2042,7 @@ func runRange(ctx *CityContext, fromStr, toStr string, opts OutputOptions) error
 	if err != nil {
 		return err
 	}
-	outFile, err := writeAstroFile(opts.Format, opts.AllowOverwrite, opts.OutDir, ctx.City, ctx.Now, data, desc, baseName)
+	outFile, err := writeAstroFile(opts.Format, opts.AllowOverwrite, opts.OutDir, ctx.City, ctx.observerElevation(), ctx.Now, data, desc, baseName)
 	if err != nil {
 		return fmt.Errorf("写入文件失败: %w", err)
 	}
@@ -1078,6 +2050,34 @@ func runRange(ctx *CityContext, fromStr, toStr string, opts OutputOptions) error
 	return nil
 }
 
+// runSunPath 生成太阳轨迹图 SVG：output 为 "-" 时写到标准输出，留空时按城市/年份/投影在输出目录下命名。
+func runSunPath(ctx *CityContext, year int, projection, output string, opts OutputOptions) error {
+	if year <= 0 {
+		year = ctx.Now.Year()
+	}
+	if output == "-" {
+		return renderSunPathSVG(os.Stdout, ctx, year, projection)
+	}
+	proj, err := parseSunPathProjection(projection)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = fmt.Sprintf("%s-sunpath-%d-%s.svg", sanitizeFileName(ctx.City), year, proj)
+		if opts.OutDir != "" {
+			output = filepath.Join(opts.OutDir, output)
+		}
+	}
+	outFile, err := writeAstroToFile(output, opts.AllowOverwrite, func(w io.Writer) error {
+		return renderSunPathSVG(w, ctx, year, proj)
+	})
+	if err != nil {
+		return fmt.Errorf("写入文件失败: %w", err)
+	}
+	logInfof("已生成太阳轨迹图：%s", outFile)
+	return nil
+}
+
 // validateRangeFlags 校验 range 子命令的起止日期参数是否成对提供。
 func validateRangeFlags(fromStr, toStr string) error {
 	// 只要有一端缺失即视为错误，避免运行期再报解析失败。
@@ -1087,6 +2087,231 @@ func validateRangeFlags(fromStr, toStr string) error {
 	return nil
 }
 
+// resolveEventWindow 将 year/day/range 模式解析为城市当地的 [start, end) 时间窗口（year 为从今天起 365 天）。
+func resolveEventWindow(ctx *CityContext, mode, dateStr, fromStr, toStr string) (start, end time.Time, desc string, err error) {
+	switch strings.ToLower(mode) {
+	case "", "year":
+		start = time.Date(ctx.Now.Year(), ctx.Now.Month(), ctx.Now.Day(), 0, 0, 0, 0, ctx.Loc)
+		end = start.AddDate(0, 0, 365)
+		desc = fmt.Sprintf("从 %s 起连续 365 天", start.Format("2006-01-02"))
+	case "day":
+		if dateStr == "" {
+			return start, end, "", apiErrorf(errCodeMissingParam, "date", "mode=day 时必须指定日期（YYYY-MM-DD）")
+		}
+		day, err := parseDateInLocation(dateStr, ctx.Loc)
+		if err != nil {
+			return start, end, "", apiErrorf(errCodeInvalidDate, "date", "解析日期失败（格式应为 YYYY-MM-DD）: %w", err)
+		}
+		start = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, ctx.Loc)
+		end = start.AddDate(0, 0, 1)
+		desc = fmt.Sprintf("指定日期：%s", start.Format("2006-01-02"))
+	case "range":
+		if fromStr == "" || toStr == "" {
+			return start, end, "", apiErrorf(errCodeMissingParam, missingRangeField(fromStr), "mode=range 时必须同时指定起止日期（YYYY-MM-DD）")
+		}
+		from, err := parseDateInLocation(fromStr, ctx.Loc)
+		if err != nil {
+			return start, end, "", apiErrorf(errCodeInvalidDate, "from", "解析起始日期失败（格式应为 YYYY-MM-DD）: %w", err)
+		}
+		to, err := parseDateInLocation(toStr, ctx.Loc)
+		if err != nil {
+			return start, end, "", apiErrorf(errCodeInvalidDate, "to", "解析结束日期失败（格式应为 YYYY-MM-DD）: %w", err)
+		}
+		if to.Before(from) {
+			return start, end, "", apiErrorf(errCodeInvalidDate, "to", "结束日期不能早于起始日期")
+		}
+		start = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, ctx.Loc)
+		end = time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, ctx.Loc).AddDate(0, 0, 1)
+		desc = fmt.Sprintf("日期区间：%s ~ %s", from.Format("2006-01-02"), to.Format("2006-01-02"))
+	default:
+		return start, end, "", apiErrorf(errCodeInvalidMode, "mode", "mode 必须为 year/day/range")
+	}
+	return start, end, desc, nil
+}
+
+// missingRangeField 返回 mode=range 缺失的日期参数名（from 缺失时为 from，否则为 to）。
+func missingRangeField(fromStr string) string {
+	if fromStr == "" {
+		return "from"
+	}
+	return "to"
+}
+
+// buildPhasesData 按 year/day/range 模式查找月相事件（year 为从今天起 365 天）。
+func buildPhasesData(ctx *CityContext, mode, dateStr, fromStr, toStr string) (events []moonPhaseEvent, desc string, err error) {
+	start, end, desc, err := resolveEventWindow(ctx, mode, dateStr, fromStr, toStr)
+	if err != nil {
+		return nil, "", err
+	}
+	return findMoonPhases(start, end), desc, nil
+}
+
+// buildEclipsesData 按 year/day/range 模式搜索日食/月食并计算城市本地情况；visibleOnly 时仅保留本地可见的食。
+func buildEclipsesData(ctx *CityContext, mode, dateStr, fromStr, toStr string, visibleOnly bool) (events []eclipseEvent, desc string, err error) {
+	start, end, desc, err := resolveEventWindow(ctx, mode, dateStr, fromStr, toStr)
+	if err != nil {
+		return nil, "", err
+	}
+	// 食相可能跨越窗口边界，按全球食甚归属窗口。
+	for _, e := range findLocalEclipses(start, end, ctx.Lat, ctx.Lon) {
+		if visibleOnly && !e.Local.Visible {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, desc, nil
+}
+
+// writeEclipses 将日食/月食按 txt/csv/json/ics 输出到 w（excel 按 txt 处理）。
+func writeEclipses(w io.Writer, format string, ctx *CityContext, events []eclipseEvent, desc string) error {
+	list := make([]eclipseJSON, 0, len(events))
+	for _, e := range events {
+		list = append(list, e.toJSON(ctx.Loc))
+	}
+	switch strings.ToLower(format) {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newEclipsesAPIResponse(ctx, "", desc, list))
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"kind", "title", "global_type", "local_type", "visible", "date", "maximum", "magnitude", "obscuration",
+			"sun_altitude_deg", "moon_altitude_deg", "penumbral_start", "partial_start", "total_start", "total_end", "partial_end", "penumbral_end"})
+		for _, e := range list {
+			_ = cw.Write([]string{e.Kind, e.Title, e.GlobalType, e.Type, strconv.FormatBool(e.Visible), e.Date, e.Maximum,
+				formatColumnValue(e.Magnitude), formatColumnValue(e.Obscuration), formatColumnValue(e.SunAltitudeDeg), formatColumnValue(e.MoonAltitudeDeg),
+				e.PenumbralStart, e.PartialStart, e.TotalStart, e.TotalEnd, e.PartialEnd, e.PenumbralEnd})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "ics":
+		return writeICS(w, fmt.Sprintf("%s 日月食", ctx.City), app.now(), ctx.Loc, eclipseICSEvents(ctx, events))
+	default:
+		fmt.Fprintf(w, "# 城市：%s\n", ctx.City)
+		fmt.Fprintf(w, "# 时区：%s\n", ctx.TZID)
+		fmt.Fprintf(w, "# 海拔：%s\n", formatElevation(ctx.Elevation, ctx.ElevationSource))
+		fmt.Fprintf(w, "# 范围：%s\n", desc)
+		fmt.Fprintln(w, "日期\t类型\t本地可见\t食甚\t食分\t太阳高度(°)\t月亮高度(°)")
+		for i, e := range list {
+			maxTime := "--"
+			if m := events[i].Local.Maximum; !m.IsZero() {
+				maxTime = m.In(ctx.Loc).Format("15:04:05")
+			}
+			visible := "否"
+			if e.Visible {
+				visible = "是"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.3f\t%.1f\t%.1f\n", e.Date, e.Title, visible, maxTime, e.Magnitude, e.SunAltitudeDeg, e.MoonAltitudeDeg)
+		}
+		return nil
+	}
+}
+
+// eclipseICSEvents 将日食/月食转换为日历事件，时长覆盖本地首末接触。
+func eclipseICSEvents(ctx *CityContext, events []eclipseEvent) []icsEvent {
+	out := make([]icsEvent, 0, len(events))
+	for _, e := range events {
+		j := e.toJSON(ctx.Loc)
+		start, end := e.span()
+		summary := j.Title
+		if !j.Visible && j.Type != "none" {
+			summary += "（本地不可见）"
+		}
+		desc := fmt.Sprintf("全球类型：%s\n本地食分：%.3f\n食甚时太阳高度：%.1f°，月亮高度：%.1f°",
+			eclipseTitle(e.Kind, e.GlobalType), j.Magnitude, j.SunAltitudeDeg, j.MoonAltitudeDeg)
+		if j.Maximum != "" {
+			desc += "\n本地食甚：" + e.Local.Maximum.In(ctx.Loc).Format("2006-01-02 15:04:05")
+		}
+		if e.Kind == eclipseSolar && j.Obscuration > 0 {
+			desc += fmt.Sprintf("\n日面遮挡：%.1f%%", j.Obscuration*100)
+		}
+		out = append(out, icsEvent{
+			UID:         fmt.Sprintf("%s-%s@esunmoon", e.Kind, e.Greatest.UTC().Format("20060102T1504")),
+			Summary:     summary,
+			Description: desc,
+			Location:    ctx.DisplayName,
+			Start:       start,
+			End:         end,
+		})
+	}
+	return out
+}
+
+// writeMoonPhases 将月相事件按 txt/csv/json 输出到 w（excel 按 txt 处理）。
+func writeMoonPhases(w io.Writer, format string, ctx *CityContext, events []moonPhaseEvent, desc string) error {
+	list := make([]moonPhaseJSON, 0, len(events))
+	for _, e := range events {
+		list = append(list, e.toJSON(ctx.Loc))
+	}
+	switch strings.ToLower(format) {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newPhasesAPIResponse(ctx, "", desc, list))
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"type", "name", "date", "local_time", "time"})
+		for _, p := range list {
+			_ = cw.Write([]string{p.Type, p.Name, p.Date, p.LocalTime, p.Time})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		fmt.Fprintf(w, "# 城市：%s\n", ctx.City)
+		fmt.Fprintf(w, "# 时区：%s\n", ctx.TZID)
+		fmt.Fprintf(w, "# 海拔：%s\n", formatElevation(ctx.Elevation, ctx.ElevationSource))
+		fmt.Fprintf(w, "# 范围：%s\n", desc)
+		fmt.Fprintln(w, "日期\t时刻\t月相")
+		for _, p := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", p.Date, p.LocalTime, p.Name)
+		}
+		return nil
+	}
+}
+
+// buildTermsData 计算城市当地公历年内的二十四节气，year<=0 时取当前年份，返回实际年份。
+func buildTermsData(ctx *CityContext, year int) (events []solarTermEvent, resolvedYear int, desc string, err error) {
+	if year <= 0 {
+		year = ctx.Now.Year()
+	}
+	if year < 1900 || year > 2150 {
+		return nil, 0, "", apiErrorf(errCodeInvalidParam, "year", "年份超出支持范围（1900~2150）: %d", year)
+	}
+	return solarTermsInYear(year, ctx.Loc), year, fmt.Sprintf("%d 年二十四节气", year), nil
+}
+
+// writeSolarTerms 将节气按 txt/csv/json 输出到 w（excel 按 txt 处理）。
+func writeSolarTerms(w io.Writer, format string, ctx *CityContext, year int, events []solarTermEvent, desc string) error {
+	list := make([]solarTermJSON, 0, len(events))
+	for _, e := range events {
+		list = append(list, e.toJSON(ctx.Loc))
+	}
+	switch strings.ToLower(format) {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newTermsAPIResponse(ctx, year, list))
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"name", "pinyin", "longitude_deg", "date", "local_time", "time"})
+		for _, t := range list {
+			_ = cw.Write([]string{t.Name, t.Pinyin, strconv.Itoa(t.Longitude), t.Date, t.LocalTime, t.Time})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		fmt.Fprintf(w, "# 城市：%s\n", ctx.City)
+		fmt.Fprintf(w, "# 时区：%s\n", ctx.TZID)
+		fmt.Fprintf(w, "# 海拔：%s\n", formatElevation(ctx.Elevation, ctx.ElevationSource))
+		fmt.Fprintf(w, "# 范围：%s\n", desc)
+		fmt.Fprintln(w, "日期\t时刻\t节气\t太阳黄经(°)")
+		for _, t := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", t.Date, t.LocalTime, t.Name, t.Longitude)
+		}
+		return nil
+	}
+}
+
 // -------------------- TUI 模型 --------------------
 
 type tuiStep int
@@ -1096,18 +2321,34 @@ const (
 	stepDayInput
 	stepRangeFromInput
 	stepRangeToInput
+	stepPickCandidate
 	stepDone
 )
 
+// tuiCandidatesMsg 为后台地理编码完成后送回 TUI 的结果。
+type tuiCandidatesMsg struct {
+	city  string
+	cands []GeoCandidate
+	err   error
+}
+
 type tuiModel struct {
 	step       tuiStep
 	input      string
 	cachedKeys []string
+	cache      *CityCache
 
 	chosenCity string
 	modeIndex  int
 	modes      []string
 
+	// geocode 为空时不查询候选，直接按城市名交给 prepareCity 处理
+	geocode         func(city string) ([]GeoCandidate, error)
+	searching       bool
+	candidates      []GeoCandidate
+	pickIndex       int
+	chosenCandidate *GeoCandidate
+
 	formatIndex int
 	formats     []string
 
@@ -1129,10 +2370,11 @@ func newTuiModel(cache *CityCache) tuiModel {
 		step:        stepMain,
 		input:       "",
 		cachedKeys:  keys,
+		cache:       cache,
 		modeIndex:   0,
 		modes:       []string{"Year", "Day", "Range"},
 		formatIndex: 0,
-		formats:     []string{"txt", "csv", "json", "excel"},
+		formats:     []string{"txt", "csv", "json", "excel", "ics"},
 	}
 }
 
@@ -1144,6 +2386,8 @@ func (m tuiModel) Init() tea.Cmd {
 // Update 处理按键事件并驱动状态机。
 func (m tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
+	case tuiCandidatesMsg:
+		return m.handleCandidates(msg)
 	case tea.KeyMsg:
 		key := msg.String()
 		switch key {
@@ -1168,12 +2412,18 @@ func (m tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if m.step == stepMain && m.formatIndex > 0 {
 				m.formatIndex--
 			}
+			if m.step == stepPickCandidate && m.pickIndex > 0 {
+				m.pickIndex--
+			}
 		case "down", "j":
 			if m.step == stepMain && m.formatIndex < len(m.formats)-1 {
 				m.formatIndex++
 			}
+			if m.step == stepPickCandidate && m.pickIndex < len(m.candidates)-1 {
+				m.pickIndex++
+			}
 		default:
-			if len(msg.String()) == 1 {
+			if len(msg.String()) == 1 && m.step != stepPickCandidate {
 				m.input += msg.String()
 			}
 		}
@@ -1185,6 +2435,9 @@ func (m tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 func (m tuiModel) handleEnter() (tea.Model, tea.Cmd) {
 	switch m.step {
 	case stepMain:
+		if m.searching {
+			return m, nil
+		}
 		m.errMsg = ""
 		city := strings.TrimSpace(m.input)
 		if city == "" && len(m.cachedKeys) > 0 {
@@ -1200,18 +2453,22 @@ func (m tuiModel) handleEnter() (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 		m.chosenCity = city
-		switch m.modes[m.modeIndex] {
-		case "Year":
-			m.step = stepDone
-			m.quitting = true
-			return m, tea.Quit
-		case "Day":
-			m.step = stepDayInput
-			m.input = ""
-		case "Range":
-			m.step = stepRangeFromInput
-			m.input = ""
+		m.chosenCandidate = nil
+		if m.geocode != nil {
+			if _, cached := findEntryInCache(m.cache, city); !cached {
+				m.searching = true
+				geocode := m.geocode
+				return m, func() tea.Msg {
+					cands, err := geocode(city)
+					return tuiCandidatesMsg{city: city, cands: cands, err: err}
+				}
+			}
 		}
+		return m.cityChosen()
+	case stepPickCandidate:
+		c := m.candidates[m.pickIndex]
+		m.chosenCandidate = &c
+		return m.cityChosen()
 	case stepDayInput:
 		m.errMsg = ""
 		dateStr := strings.TrimSpace(m.input)
@@ -1248,6 +2505,43 @@ func (m tuiModel) handleEnter() (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// handleCandidates 处理地理编码结果：唯一结果直接选定，多个结果进入候选选择步骤。
+func (m tuiModel) handleCandidates(msg tuiCandidatesMsg) (tea.Model, tea.Cmd) {
+	m.searching = false
+	if msg.city != m.chosenCity {
+		return m, nil
+	}
+	if msg.err != nil {
+		m.errMsg = fmt.Sprintf("获取城市候选失败：%v", msg.err)
+		return m, nil
+	}
+	if len(msg.cands) == 1 {
+		m.chosenCandidate = &msg.cands[0]
+		return m.cityChosen()
+	}
+	m.candidates = msg.cands
+	m.pickIndex = 0
+	m.step = stepPickCandidate
+	return m, nil
+}
+
+// cityChosen 在城市确定后按所选模式进入下一步。
+func (m tuiModel) cityChosen() (tea.Model, tea.Cmd) {
+	switch m.modes[m.modeIndex] {
+	case "Year":
+		m.step = stepDone
+		m.quitting = true
+		return m, tea.Quit
+	case "Day":
+		m.step = stepDayInput
+		m.input = ""
+	case "Range":
+		m.step = stepRangeFromInput
+		m.input = ""
+	}
+	return m, nil
+}
+
 // View 渲染不同步骤下的文本界面。
 func (m tuiModel) View() string {
 	if m.quitting {
@@ -1256,6 +2550,8 @@ func (m tuiModel) View() string {
 	var b strings.Builder
 	fmt.Fprintln(&b, "eSunMoon - 城市天文数据生成器 (TUI)")
 	fmt.Fprintln(&b, "====================================")
+	today := app.now()
+	fmt.Fprintf(&b, "今天：%s  农历 %s\n", today.Format("2006-01-02"), lunarSummary(today))
 	switch m.step {
 	case stepMain:
 		fmt.Fprintln(&b, "缓存中的城市：")
@@ -1287,6 +2583,18 @@ func (m tuiModel) View() string {
 		fmt.Fprintln(&b, "")
 		fmt.Fprintln(&b, "请输入城市名（支持中文/英文），回车确认；Ctrl+C 退出。")
 		fmt.Fprintf(&b, "> %s\n", m.input)
+		if m.searching {
+			fmt.Fprintf(&b, "正在查询 [%s] 的候选地点……\n", m.chosenCity)
+		}
+	case stepPickCandidate:
+		fmt.Fprintf(&b, "城市 [%s] 有 %d 个匹配结果（↑/↓ 选择，回车确认）：\n", m.chosenCity, len(m.candidates))
+		for i, c := range m.candidates {
+			marker := "  "
+			if i == m.pickIndex {
+				marker = "> "
+			}
+			fmt.Fprintf(&b, "%s%d) %s\n", marker, i+1, c.Label())
+		}
 	case stepDayInput:
 		fmt.Fprintf(&b, "城市：%s\n", m.chosenCity)
 		fmt.Fprintf(&b, "模式：Day    输出格式：%s\n", m.formats[m.formatIndex])
@@ -1307,6 +2615,11 @@ func (m tuiModel) View() string {
 		fmt.Fprintln(&b, "请输入结束日期 To (YYYY-MM-DD)，回车确认；Ctrl+C 取消。")
 		fmt.Fprintf(&b, "> %s\n", m.input)
 	}
+	if m.step != stepMain && m.step != stepPickCandidate {
+		if preview := m.lunarPreview(); preview != "" {
+			fmt.Fprintf(&b, "  农历：%s\n", preview)
+		}
+	}
 	if m.errMsg != "" {
 		fmt.Fprintln(&b, "")
 		fmt.Fprintf(&b, "错误：%s\n", m.errMsg)
@@ -1314,6 +2627,15 @@ func (m tuiModel) View() string {
 	return b.String()
 }
 
+// lunarPreview 在日期输入步骤中，对已输入的完整日期给出农历预览。
+func (m tuiModel) lunarPreview() string {
+	day, err := time.Parse("2006-01-02", strings.TrimSpace(m.input))
+	if err != nil {
+		return ""
+	}
+	return lunarSummary(day)
+}
+
 // -------------------- HTTP API --------------------
 
 type astroAPIResponse struct {
@@ -1322,6 +2644,7 @@ type astroAPIResponse struct {
 	Lat        float64      `json:"lat"`
 	Lon        float64      `json:"lon"`
 	Timezone   string       `json:"timezone"`
+	Elevation  float64      `json:"elevation_m"`
 	Mode       string       `json:"mode"`
 	Range      string       `json:"range,omitempty"`
 	Generated  string       `json:"generated_at"`
@@ -1330,26 +2653,139 @@ type astroAPIResponse struct {
 	Notes      []string     `json:"notes,omitempty"`
 }
 
+// newAstroAPIResponse 组装逐日天文数据的 JSON 响应（/api/astro 与批量接口共用）。
+func newAstroAPIResponse(ctx *CityContext, mode, desc string, data []dailyAstro) astroAPIResponse {
+	return astroAPIResponse{
+		City:       ctx.City,
+		Display:    ctx.DisplayName,
+		Lat:        ctx.Lat,
+		Lon:        ctx.Lon,
+		Timezone:   ctx.TZID,
+		Elevation:  ctx.Elevation,
+		Mode:       mode,
+		Range:      desc,
+		Generated:  ctx.Now.Format(time.RFC3339),
+		Data:       data,
+		LocalTZTip: "所有时间均为城市所在时区的当地时间",
+		Notes:      []string{polarNote, twilightNote, photoNote},
+	}
+}
+
 type bodyPosition struct {
-	AzimuthDeg   float64 `json:"azimuth_deg"`
-	AzimuthText  string  `json:"azimuth_text"`
-	AltitudeDeg  float64 `json:"altitude_deg"`
-	DistanceKm   float64 `json:"distance_km"`
-	Illumination string  `json:"illumination,omitempty"`
-	IllumNum     float64 `json:"illumination_num,omitempty"`
-	Phase        float64 `json:"phase,omitempty"` // 0=new, 0.25=上弦, 0.5=满月, 0.75=下弦, 1=新月
+	AzimuthDeg          float64 `json:"azimuth_deg"`
+	AzimuthText         string  `json:"azimuth_text"`
+	AltitudeDeg         float64 `json:"altitude_deg"`          // 几何高度（未含大气折射）
+	ApparentAltitudeDeg float64 `json:"apparent_altitude_deg"` // 按气温/气压修正折射后的视高度
+	DistanceKm          float64 `json:"distance_km"`
+	Illumination        string  `json:"illumination,omitempty"`
+	IllumNum            float64 `json:"illumination_num,omitempty"`
+	Phase               float64 `json:"phase,omitempty"` // 0=new, 0.25=上弦, 0.5=满月, 0.75=下弦, 1=新月
 }
 
 type livePositionsResponse struct {
-	City      string       `json:"city"`
-	Display   string       `json:"display"`
-	Lat       float64      `json:"lat"`
-	Lon       float64      `json:"lon"`
-	Timezone  string       `json:"timezone"`
-	Generated string       `json:"generated_at"`
-	LocalTime string       `json:"local_time"`
-	Sun       bodyPosition `json:"sun"`
-	Moon      bodyPosition `json:"moon"`
+	City       string           `json:"city"`
+	Display    string           `json:"display"`
+	Lat        float64          `json:"lat"`
+	Lon        float64          `json:"lon"`
+	Timezone   string           `json:"timezone"`
+	Elevation  float64          `json:"elevation_m"`
+	Atmosphere atmosphere       `json:"atmosphere"`
+	Generated  string           `json:"generated_at"`
+	LocalTime  string           `json:"local_time"`
+	LunarDate  string           `json:"lunar_date,omitempty"`
+	GanZhi     string           `json:"ganzhi_year,omitempty"`
+	Zodiac     string           `json:"zodiac,omitempty"`
+	Sun        bodyPosition     `json:"sun"`
+	Moon       bodyPosition     `json:"moon"`
+	Planets    []planetPosition `json:"planets"`
+	Warnings   []string         `json:"warnings,omitempty"`
+}
+
+type phasesAPIResponse struct {
+	City      string          `json:"city"`
+	Display   string          `json:"display_name"`
+	Lat       float64         `json:"lat"`
+	Lon       float64         `json:"lon"`
+	Timezone  string          `json:"timezone"`
+	Elevation float64         `json:"elevation_m"`
+	Mode      string          `json:"mode,omitempty"`
+	Range     string          `json:"range,omitempty"`
+	Generated string          `json:"generated_at"`
+	Events    []moonPhaseJSON `json:"events"`
+}
+
+// newPhasesAPIResponse 组装月相事件的 JSON 响应（CLI 与 HTTP 共用）。
+func newPhasesAPIResponse(ctx *CityContext, mode, desc string, events []moonPhaseJSON) phasesAPIResponse {
+	return phasesAPIResponse{
+		City:      ctx.City,
+		Display:   ctx.DisplayName,
+		Lat:       ctx.Lat,
+		Lon:       ctx.Lon,
+		Timezone:  ctx.TZID,
+		Elevation: ctx.Elevation,
+		Mode:      mode,
+		Range:     desc,
+		Generated: ctx.Now.Format(time.RFC3339),
+		Events:    events,
+	}
+}
+
+type eclipsesAPIResponse struct {
+	City      string        `json:"city"`
+	Display   string        `json:"display_name"`
+	Lat       float64       `json:"lat"`
+	Lon       float64       `json:"lon"`
+	Timezone  string        `json:"timezone"`
+	Elevation float64       `json:"elevation_m"`
+	Mode      string        `json:"mode,omitempty"`
+	Range     string        `json:"range,omitempty"`
+	Generated string        `json:"generated_at"`
+	Eclipses  []eclipseJSON `json:"eclipses"`
+	Notes     []string      `json:"notes,omitempty"`
+}
+
+// newEclipsesAPIResponse 组装日月食的 JSON 响应（CLI 与 HTTP 共用）。
+func newEclipsesAPIResponse(ctx *CityContext, mode, desc string, eclipses []eclipseJSON) eclipsesAPIResponse {
+	return eclipsesAPIResponse{
+		City:      ctx.City,
+		Display:   ctx.DisplayName,
+		Lat:       ctx.Lat,
+		Lon:       ctx.Lon,
+		Timezone:  ctx.TZID,
+		Elevation: ctx.Elevation,
+		Mode:      mode,
+		Range:     desc,
+		Generated: ctx.Now.Format(time.RFC3339),
+		Eclipses:  eclipses,
+		Notes:     []string{eclipseNote},
+	}
+}
+
+type termsAPIResponse struct {
+	City      string          `json:"city"`
+	Display   string          `json:"display_name"`
+	Lat       float64         `json:"lat"`
+	Lon       float64         `json:"lon"`
+	Timezone  string          `json:"timezone"`
+	Elevation float64         `json:"elevation_m"`
+	Year      int             `json:"year"`
+	Generated string          `json:"generated_at"`
+	Terms     []solarTermJSON `json:"terms"`
+}
+
+// newTermsAPIResponse 组装节气的 JSON 响应（CLI 与 HTTP 共用）。
+func newTermsAPIResponse(ctx *CityContext, year int, terms []solarTermJSON) termsAPIResponse {
+	return termsAPIResponse{
+		City:      ctx.City,
+		Display:   ctx.DisplayName,
+		Lat:       ctx.Lat,
+		Lon:       ctx.Lon,
+		Timezone:  ctx.TZID,
+		Elevation: ctx.Elevation,
+		Year:      year,
+		Generated: ctx.Now.Format(time.RFC3339),
+		Terms:     terms,
+	}
 }
 
 type cachedCity struct {
@@ -1366,7 +2802,7 @@ type cachedCity struct {
 func readyHandler(w http.ResponseWriter, r *http.Request) {
 	dir := filepath.Dir(cacheFilePath())
 	if err := os.MkdirAll(dir, 0o755); err != nil {
-		http.Error(w, "cache dir not writable", http.StatusServiceUnavailable)
+		writeAPIError(w, apiErrorf(errCodeNotReady, "", "cache dir not writable: %w", err))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -1376,6 +2812,7 @@ func readyHandler(w http.ResponseWriter, r *http.Request) {
 // serveWithGracefulShutdown 启动 HTTP 服务并在接收到停止信号时优雅关闭。
 func serveWithGracefulShutdown(addr string, handler http.Handler, stop <-chan os.Signal) error {
 	srv := &http.Server{Addr: addr, Handler: handler}
+	srv.RegisterOnShutdown(app.streams.closeAll)
 	errCh := make(chan error, 1)
 
 	go func() {
@@ -1404,54 +2841,170 @@ func serveWithGracefulShutdown(addr string, handler http.Handler, stop <-chan os
 	}
 }
 
-// resolveContextFromQuery 根据查询参数获取城市上下文，支持 lat/lon/tz 或 city。
-func resolveContextFromQuery(q url.Values) (*CityContext, int, error) {
+// resolveContextFromQuery 根据查询参数获取城市上下文，支持 lat/lon/tz 或 city；出错时返回带错误码的 *apiError。
+// reqCtx 一般为 HTTP 请求的 context，客户端断开时取消其中的网络查询。
+func resolveContextFromQuery(reqCtx context.Context, q url.Values) (*CityContext, error) {
+	return resolveContextIn(reqCtx, loadCache(), q)
+}
+
+// resolveContextIn 与 resolveContextFromQuery 相同，但城市与坐标反查都使用传入的缓存。
+func resolveContextIn(reqCtx context.Context, cache *CityCache, q url.Values) (*CityContext, error) {
 	latStr := q.Get("lat")
 	lonStr := q.Get("lon")
 	tzID := q.Get("tz")
 
-	if latStr != "" && lonStr != "" && tzID != "" {
-		lat, err1 := strconv.ParseFloat(latStr, 64)
-		lon, err2 := strconv.ParseFloat(lonStr, 64)
-		if err1 != nil || err2 != nil {
-			return nil, http.StatusBadRequest, errors.New("lat/lon 解析失败")
+	if latStr != "" && lonStr != "" {
+		lat, err := strconv.ParseFloat(latStr, 64)
+		if err != nil {
+			return nil, apiErrorf(errCodeInvalidCoords, "lat", "lat/lon 解析失败")
 		}
-		if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
-			return nil, http.StatusBadRequest, errors.New("lat/lon 超出范围")
+		lon, err := strconv.ParseFloat(lonStr, 64)
+		if err != nil {
+			return nil, apiErrorf(errCodeInvalidCoords, "lon", "lat/lon 解析失败")
 		}
-		loc, err := time.LoadLocation(tzID)
+		if lat < -90 || lat > 90 {
+			return nil, apiErrorf(errCodeInvalidCoords, "lat", "lat/lon 超出范围")
+		}
+		if lon < -180 || lon > 180 {
+			return nil, apiErrorf(errCodeInvalidCoords, "lon", "lat/lon 超出范围")
+		}
+		tzID, loc, warnings, err := resolveCoordsTimezone(lat, lon, tzID, app.now())
 		if err != nil {
-			return nil, http.StatusBadRequest, fmt.Errorf("tz 加载失败: %w", err)
+			return nil, apiErrorf(errCodeInvalidTimezone, "tz", "tz 加载失败: %w", err)
 		}
 		now := app.now().In(loc)
-		cityName := q.Get("city")
+		cityName, displayName := q.Get("city"), q.Get("city")
 		if cityName == "" {
-			cityName = fmt.Sprintf("coords_%.4f_%.4f", lat, lon)
+			cityName, displayName = reverseGeocodeNameIn(reqCtx, cache, lat, lon, config.Offline)
 		}
 		ctx := &CityContext{
 			City:        cityName,
-			DisplayName: cityName,
+			DisplayName: displayName,
 			Lat:         lat,
 			Lon:         lon,
 			TZID:        tzID,
 			Loc:         loc,
 			Now:         now,
+			Warnings:    warnings,
+		}
+		if elev, ok := demElevation(lat, lon); ok {
+			ctx.Elevation, ctx.ElevationSource = elev, "dem"
 		}
-		return ctx, http.StatusOK, nil
+		if err := applyElevationQuery(ctx, q); err != nil {
+			return nil, err
+		}
+		return ctx, nil
 	}
 
 	city := q.Get("city")
 	if city == "" {
-		return nil, http.StatusBadRequest, errors.New("必须提供 city 或 lat+lon+tz 参数")
+		return nil, apiErrorf(errCodeMissingLocation, "city", "必须提供 city 或 lat+lon 参数（tz 可选，默认按坐标推断）")
+	}
+	opts := geoOptions{Country: q.Get("country")}
+	if v := q.Get("pick"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, apiErrorf(errCodeInvalidParam, "pick", "pick 必须为正整数")
+		}
+		opts.Pick = n
 	}
-	ctx, err := prepareCity(city, config.Offline)
+	ctx, err := prepareCityIn(reqCtx, cache, city, config.Offline, opts)
 	if err != nil {
-		return nil, http.StatusBadRequest, fmt.Errorf("城市解析失败: %w", err)
+		// 保留下层错误码（未找到城市 404、地理编码服务失败 502），其余为服务端错误
+		e := asAPIError(err)
+		return nil, apiErrorf(e.Code, e.Field, "城市解析失败: %w", err)
+	}
+	if err := applyElevationQuery(ctx, q); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// applyElevationQuery 读取 elev 查询参数（米）覆盖观测点海拔。
+func applyElevationQuery(ctx *CityContext, q url.Values) error {
+	v := q.Get("elev")
+	if v == "" {
+		return nil
+	}
+	elev, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return apiErrorf(errCodeInvalidParam, "elev", "elev 解析失败: %w", err)
+	}
+	if err := validateElevation(elev); err != nil {
+		return apiErrorf(errCodeInvalidParam, "elev", "%w", err)
+	}
+	ctx.Elevation, ctx.ElevationSource = elev, "manual"
+	return nil
+}
+
+// applyAtmosphereQuery 读取 temp_c/pressure_hpa 查询参数覆盖折射计算用的气温与气压。
+func applyAtmosphereQuery(ctx *CityContext, q url.Values) error {
+	atm := ctx.atmosphereOrDefault()
+	changed := false
+	for _, f := range []struct {
+		key string
+		dst *float64
+	}{
+		{"temp_c", &atm.TempC},
+		{"pressure_hpa", &atm.PressureHPa},
+	} {
+		v := q.Get(f.key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return apiErrorf(errCodeInvalidParam, f.key, "%s 解析失败: %w", f.key, err)
+		}
+		*f.dst = n
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if err := atm.validate(); err != nil {
+		return apiErrorf(errCodeInvalidParam, "", "%w", err)
+	}
+	ctx.Atmosphere = &atm
+	return nil
+}
+
+// applyPhotoBandsQuery 读取 golden_low/golden_high/blue_low/blue_high 查询参数覆盖黄金/蓝调阈值。
+func applyPhotoBandsQuery(ctx *CityContext, q url.Values) error {
+	bands := ctx.photoBandsOrDefault()
+	fields := []struct {
+		key string
+		dst *float64
+	}{
+		{"golden_low", &bands.Golden.Low},
+		{"golden_high", &bands.Golden.High},
+		{"blue_low", &bands.Blue.Low},
+		{"blue_high", &bands.Blue.High},
+	}
+	changed := false
+	for _, f := range fields {
+		v := q.Get(f.key)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return apiErrorf(errCodeInvalidParam, f.key, "%s 解析失败: %w", f.key, err)
+		}
+		*f.dst = n
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	if err := bands.validate(); err != nil {
+		return apiErrorf(errCodeInvalidParam, "", "%w", err)
 	}
-	return ctx, http.StatusOK, nil
+	ctx.Photo = &bands
+	return nil
 }
 
-// buildLivePositions 返回当前时刻的太阳、月亮位置。
+// buildLivePositions 返回当前时刻的太阳、月亮与五颗肉眼行星位置。
 func buildLivePositions(ctx *CityContext) livePositionsResponse {
 	now := app.now().In(ctx.Loc)
 	ctx.Now = now
@@ -1463,39 +3016,59 @@ func buildLivePositions(ctx *CityContext) livePositionsResponse {
 	sunAz := radToDeg(sunPos.Azimuth)
 	sunAlt := radToDeg(sunPos.Altitude)
 	moonAz := radToDeg(moonPos.Azimuth)
-	moonAlt := radToDeg(moonPos.Altitude)
+	moonAlt := moonGeometricAltitude(radToDeg(moonPos.Altitude))
+	atm := ctx.atmosphereOrDefault()
+
+	var lunarStr, ganZhi, zodiac string
+	if lunar, err := lunarDateOf(now); err == nil {
+		lunarStr, ganZhi, zodiac = lunar.String(), lunar.GanZhiYear(), lunar.Zodiac()
+	}
 
 	return livePositionsResponse{
-		City:      ctx.City,
-		Display:   ctx.DisplayName,
-		Lat:       ctx.Lat,
-		Lon:       ctx.Lon,
-		Timezone:  ctx.TZID,
-		Generated: now.Format(time.RFC3339),
-		LocalTime: now.Format("2006-01-02 15:04:05"),
+		City:       ctx.City,
+		Display:    ctx.DisplayName,
+		Lat:        ctx.Lat,
+		Lon:        ctx.Lon,
+		Timezone:   ctx.TZID,
+		Elevation:  ctx.Elevation,
+		Generated:  now.Format(time.RFC3339),
+		LocalTime:  now.Format("2006-01-02 15:04:05"),
+		LunarDate:  lunarStr,
+		GanZhi:     ganZhi,
+		Zodiac:     zodiac,
+		Atmosphere: atm,
 		Sun: bodyPosition{
-			AzimuthDeg:  sunAz,
-			AzimuthText: describeAzimuth(sunAz),
-			AltitudeDeg: sunAlt,
-			DistanceKm:  earthSunDistanceKm(now),
+			AzimuthDeg:          sunAz,
+			AzimuthText:         describeAzimuth(sunAz),
+			AltitudeDeg:         sunAlt,
+			ApparentAltitudeDeg: apparentAltitude(sunAlt, atm),
+			DistanceKm:          earthSunDistanceKm(now),
 		},
 		Moon: bodyPosition{
-			AzimuthDeg:   moonAz,
-			AzimuthText:  describeAzimuth(moonAz),
-			AltitudeDeg:  moonAlt,
-			DistanceKm:   moonPos.Distance,
-			Illumination: fmt.Sprintf("%.1f%%", moonIllum.Fraction*100),
-			IllumNum:     moonIllum.Fraction,
-			Phase:        moonIllum.Phase,
+			AzimuthDeg:          moonAz,
+			AzimuthText:         describeAzimuth(moonAz),
+			AltitudeDeg:         moonAlt,
+			ApparentAltitudeDeg: apparentAltitude(moonAlt, atm),
+			DistanceKm:          moonPos.Distance,
+			Illumination:        fmt.Sprintf("%.1f%%", moonIllum.Fraction*100),
+			IllumNum:            moonIllum.Fraction,
+			Phase:               moonIllum.Phase,
 		},
+		Planets:  withApparentAltitudes(buildPlanetPositions(now, ctx.Lat, ctx.Lon, ctx.Loc), atm),
+		Warnings: ctx.Warnings,
 	}
 }
 
 // positionsAPIHandler 提供当前太阳/月亮位置 JSON。
 func positionsAPIHandler(w http.ResponseWriter, r *http.Request) {
-	ctx, status, err := resolveContextFromQuery(r.URL.Query())
+	q := r.URL.Query()
+	ctx, err := resolveContextFromQuery(r.Context(), q)
 	if err != nil {
-		http.Error(w, err.Error(), status)
+		writeAPIError(w, err)
+		return
+	}
+	if err := applyAtmosphereQuery(ctx, q); err != nil {
+		writeAPIError(w, err)
 		return
 	}
 
@@ -1532,6 +3105,92 @@ func citiesAPIHandler(w http.ResponseWriter, r *http.Request) {
 	_ = enc.Encode(list)
 }
 
+// geocodeAPIResponse 为 /api/geocode 的返回体。
+type geocodeAPIResponse struct {
+	Query      string         `json:"query"`
+	Country    string         `json:"country,omitempty"`
+	Source     string         `json:"source"`
+	Candidates []GeoCandidate `json:"candidates"`
+}
+
+// cachedCandidates 离线时从缓存中查找与 query 匹配（城市名、别名或显示名包含）的地点。
+func cachedCandidates(cache *CityCache, query, country string) []GeoCandidate {
+	key := normalizeCityKey(query)
+	var out []GeoCandidate
+	for _, e := range cache.Entries {
+		matched := strings.Contains(strings.ToLower(e.DisplayName), strings.ToLower(query)) || normalizeCityKey(e.City) == key
+		for _, a := range e.Aliases {
+			matched = matched || normalizeCityKey(a) == key
+		}
+		if !matched {
+			continue
+		}
+		c := GeoCandidate{DisplayName: e.DisplayName, Lat: e.Lat, Lon: e.Lon}
+		if e.Candidate != nil {
+			c = *e.Candidate
+		}
+		if candidateInCountry(c, country) {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].DisplayName < out[j].DisplayName })
+	return out
+}
+
+// geocodeAPIHandler 返回城市名的全部候选地点，供前端消歧后以 pick/country 参数调用其他接口。
+func geocodeAPIHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" {
+		writeAPIError(w, apiErrorf(errCodeMissingParam, "q", "必须提供 q 参数"))
+		return
+	}
+	limit := geocodeDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 50 {
+			writeAPIError(w, apiErrorf(errCodeInvalidParam, "limit", "limit 必须为 1~50 的整数"))
+			return
+		}
+		limit = n
+	}
+	resp := geocodeAPIResponse{Query: query, Country: q.Get("country"), Source: "nominatim"}
+	if config.Offline {
+		// 离线：缓存优先，再补充内置城市库中坐标不重复的结果
+		resp.Source = "offline"
+		resp.Candidates = cachedCandidates(loadCache(), query, resp.Country)
+		for _, g := range searchGazetteer(query, resp.Country, false, limit) {
+			dup := slices.ContainsFunc(resp.Candidates, func(c GeoCandidate) bool {
+				return math.Abs(c.Lat-g.Lat) < 0.05 && math.Abs(c.Lon-g.Lon) < 0.05
+			})
+			if !dup {
+				resp.Candidates = append(resp.Candidates, g)
+			}
+		}
+		if len(resp.Candidates) > limit {
+			resp.Candidates = resp.Candidates[:limit]
+		}
+	} else {
+		cands, err := lookupCandidates(r.Context(), query, resp.Country, false, limit)
+		if err != nil && !errors.Is(err, errCityNotFound) {
+			writeAPIError(w, apiErrorf(errCodeGeocoderUnavailable, "", "地理编码失败: %w", err))
+			return
+		}
+		if len(cands) > 0 {
+			resp.Source = cands[0].Source
+		}
+		resp.Candidates = cands
+	}
+	if resp.Candidates == nil {
+		resp.Candidates = []GeoCandidate{}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(resp)
+}
+
 // positionsPageHandler 提供一个 2D 可视化页面，周期性拉取 /api/positions。
 func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
@@ -1568,8 +3227,9 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
 		title = fmt.Sprintf("%s - %s", title, city)
 	}
 
-	// 页面使用的 positions 接口基准路径，后续由前端补齐查询参数与绝对前缀。
+	// 页面使用的 positions 接口与推送流基准路径，后续由前端补齐查询参数与绝对前缀。
 	apiBasePath := "/api/positions"
+	streamBasePath := "/api/positions/stream"
 
 	htmlStr := fmt.Sprintf(`<!DOCTYPE html>
 <html lang="zh-CN">
@@ -1650,12 +3310,14 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       <div class="legend">
         <span><span class="dot" style="background:#ffd166;"></span>太阳</span>
         <span><span class="dot" style="background:#9ad1ff;"></span>月亮</span>
+        <span><span class="dot" style="background:#e0c3fc; width:8px; height:8px;"></span>行星（外圈，虚化为地平线下）</span>
         <span><span class="dot" style="background:#74c0ff; width:14px; height:4px; border-radius:6px;"></span>方位线</span>
         <span><span class="dot" style="background:#f8d061; width:14px; height:4px; border-radius:6px;"></span>高度线</span>
       </div>
       <div class="info">
         <div id="sunInfo"></div>
         <div id="moonInfo"></div>
+        <div id="planetInfo"></div>
         <div id="moonPhaseBox" class="phaseBox" aria-live="polite">
           <span class="phaseGlyph" id="moonGlyph">🌑</span>
           <div class="phaseMeta">
@@ -1671,12 +3333,14 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
   <script>
     const apiBaseUrlRaw = "%s";
     const apiBaseUrl = new URL(apiBaseUrlRaw, window.location.origin).toString();
+    const streamBaseUrl = new URL("%s", window.location.origin).toString();
     const baseQuery = "%s"; // 不含 city/refresh
     const initialCity = "%s";
     const hasCityParam = initialCity !== "";
     let currentCity = initialCity;
     let refreshMs = %d * 1000;
     let timer = null;
+    let stream = null;
     // 轨迹记录：限定时间窗与点数，避免无限增长
     const sunTrack = [];
     const moonTrack = [];
@@ -1696,6 +3360,7 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
     const moonPhaseDetail = document.getElementById("moonPhaseDetail");
 
     const deg = Math.PI / 180;
+    const planetColors = { mercury: "#c9c9c9", venus: "#fff2b3", mars: "#ff8a65", jupiter: "#f3c98b", saturn: "#e0c3fc" };
     // 原始方位：南=0，东=-90，西=+90，北=±180
     const normRawAz = (azDeg) => {
       // 数据原始定义：南=0，东=-90，西=+90，北=±180
@@ -1785,93 +3450,6 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       compassCtx.fillText("地球", cx + 10, cy + 4);
     }
 
-    // 农历换算（支持 1900-2100，足够覆盖常规使用）
-    const lunarInfo = [
-      0x04bd8,0x04ae0,0x0a570,0x054d5,0x0d260,0x0d950,0x16554,0x056a0,0x09ad0,0x055d2,
-      0x04ae0,0x0a5b6,0x0a4d0,0x0d250,0x1d255,0x0b540,0x0d6a0,0x0ada2,0x095b0,0x14977,
-      0x04970,0x0a4b0,0x0b4b5,0x06a50,0x06d40,0x1ab54,0x02b60,0x09570,0x052f2,0x04970,
-      0x06566,0x0d4a0,0x0ea50,0x06e95,0x05ad0,0x02b60,0x186e3,0x092e0,0x1c8d7,0x0c950,
-      0x0d4a0,0x1d8a6,0x0b550,0x056a0,0x1a5b4,0x025d0,0x092d0,0x0d2b2,0x0a950,0x0b557,
-      0x06ca0,0x0b550,0x15355,0x04da0,0x0a5d0,0x14573,0x052d0,0x0a9a8,0x0e950,0x06aa0,
-      0x0aea6,0x0ab50,0x04b60,0x0aae4,0x0a570,0x05260,0x0f263,0x0d950,0x05b57,0x056a0,
-      0x096d0,0x04dd5,0x04ad0,0x0a4d0,0x0d4d4,0x0d250,0x0d558,0x0b540,0x0b6a0,0x195a6,
-      0x095b0,0x049b0,0x0a974,0x0a4b0,0x0b27a,0x06a50,0x06d40,0x0af46,0x0ab60,0x09570,
-      0x04af5,0x04970,0x064b0,0x074a3,0x0ea50,0x06b58,0x05ac0,0x0ab60,0x096d5,0x092e0,
-      0x0c960,0x0d954,0x0d4a0,0x0da50,0x07552,0x056a0,0x0abb7,0x025d0,0x092d0,0x0cab5,
-      0x0a950,0x0b4a0,0x0baa4,0x0ad50,0x055d9,0x04ba0,0x0a5b0,0x15176,0x052b0,0x0a930,
-      0x07954,0x06aa0,0x0ad50,0x05b52,0x04b60,0x0a6e6,0x0a4e0,0x0d260,0x0ea65,0x0d530,
-      0x05aa0,0x076a3,0x096d0,0x04bd7,0x04ad0,0x0a4d0,0x1d0b6,0x0d250,0x0d520,0x0dd45,
-      0x0b5a0,0x056d0,0x055b2,0x049b0,0x0a577,0x0a4b0,0x0aa50,0x1b255,0x06d20,0x0ada0,
-      0x14b63,0x09370,0x049f8,0x04970,0x064b0,0x168a6,0x0ea50,0x06b20,0x1a6c4,0x0aae0,
-      0x0a2e0,0x0d2e3,0x0c960,0x0d557,0x0d4a0,0x0da50,0x05d55,0x056a0,0x0a6d0,0x055d4,
-      0x052d0,0x0a9b8,0x0a950,0x0b4a0,0x0b6a6,0x0ad50,0x055a0,0x0aba4,0x0a5b0,0x052b0,
-      0x0b273,0x06930,0x07337,0x06aa0,0x0ad50,0x14b55,0x04b60,0x0a570,0x054e4,0x0d160,
-      0x0e968,0x0d520,0x0daa0,0x16aa6,0x056d0,0x04ae0,0x0a9d4,0x0a2d0,0x0d150,0x0f252,
-      0x0d520
-    ];
-
-    function leapMonth(y) {
-      return lunarInfo[y - 1900] & 0xf;
-    }
-    function leapDays(y) {
-      const lm = leapMonth(y);
-      if (lm === 0) return 0;
-      return (lunarInfo[y - 1900] & 0x10000) ? 30 : 29;
-    }
-    function monthDays(y, m) {
-      return (lunarInfo[y - 1900] & (0x10000 >> m)) ? 30 : 29;
-    }
-    function lYearDays(y) {
-      let sum = 348;
-      for (let i = 0x8000; i > 0x8; i >>= 1) {
-        sum += (lunarInfo[y - 1900] & i) ? 1 : 0;
-      }
-      return sum + leapDays(y);
-    }
-    function solarToLunar(y, m, d) {
-      const baseDate = new Date(1900, 0, 31);
-      const target = new Date(y, m - 1, d);
-      let offset = Math.floor((target.getTime() - baseDate.getTime()) / 86400000);
-      let i, temp, leap, isLeap = false;
-      for (i = 1900; i < 2101 && offset > 0; i++) {
-        temp = lYearDays(i);
-        offset -= temp;
-      }
-      if (offset < 0) {
-        offset += temp;
-        i--;
-      }
-      const lunarYear = i;
-      leap = leapMonth(lunarYear);
-      for (i = 1; i < 13 && offset >= 0; i++) {
-        if (leap > 0 && i === (leap + 1) && !isLeap) {
-          --i;
-          isLeap = true;
-          temp = leapDays(lunarYear);
-        } else {
-          temp = monthDays(lunarYear, i);
-        }
-        if (isLeap && i === (leap + 1)) {
-          isLeap = false;
-        }
-        offset -= temp;
-      }
-      if (offset < 0) {
-        offset += temp;
-        i--;
-      }
-      const lunarMonth = i;
-      const lunarDay = offset + 1;
-      return { year: lunarYear, month: lunarMonth, day: lunarDay, isLeap };
-    }
-    function lunarToStr(lunar) {
-      const monthNames = ["正月","二月","三月","四月","五月","六月","七月","八月","九月","十月","冬月","腊月"];
-      const dayNames = ["初一","初二","初三","初四","初五","初六","初七","初八","初九","初十","十一","十二","十三","十四","十五","十六","十七","十八","十九","二十","廿一","廿二","廿三","廿四","廿五","廿六","廿七","廿八","廿九","三十"];
-      const mStr = lunar.isLeap ? "闰" + monthNames[(lunar.month || 1) - 1] : monthNames[(lunar.month || 1) - 1];
-      const dStr = dayNames[(lunar.day || 1) - 1] || "";
-      return mStr + dStr;
-    }
-
     function phaseToGlyph(phase) {
       // 8 阶梯：新月、娥眉月、上弦月、盈凸月、满月、亏凸月、下弦月、残月
       const glyphs = ["🌑","🌒","🌓","🌔","🌕","🌖","🌗","🌘"];
@@ -1983,25 +3561,32 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       compassCtx.textBaseline = "alphabetic";
     }
 
-    function getLocalYMD(dateObj, tz) {
-      const parts = new Intl.DateTimeFormat("en-CA", { timeZone: tz, year: "numeric", month: "2-digit", day: "2-digit" }).formatToParts(dateObj);
-      const map = {};
-      parts.forEach(p => { map[p.type] = p.value; });
-      return {
-        year: parseInt(map.year, 10),
-        month: parseInt(map.month, 10),
-        day: parseInt(map.day, 10),
-      };
+    // drawPlanet 在外圈绘制行星小圆点；地平线下的行星半透明显示。
+    function drawPlanet(p, r, cx, cy) {
+      const pos = azToXY(p.azimuth_deg, r);
+      const x = cx + pos.x;
+      const y = cy + pos.y;
+      const color = planetColors[p.key] || "#e0c3fc";
+      compassCtx.globalAlpha = p.altitude_deg >= 0 ? 1 : 0.35;
+      compassCtx.shadowColor = color;
+      compassCtx.shadowBlur = 8;
+      compassCtx.fillStyle = color;
+      compassCtx.beginPath();
+      compassCtx.arc(x, y, 5, 0, Math.PI * 2);
+      compassCtx.fill();
+      compassCtx.shadowBlur = 0;
+      compassCtx.font = "12px 'Segoe UI', Arial";
+      compassCtx.fillText(p.name + " " + p.altitude_deg.toFixed(1) + "°", x + 8, y - 8);
+      compassCtx.globalAlpha = 1;
     }
 
     function renderNowBar(data) {
       if (!data || !data.generated_at || !data.timezone) return;
       const nowDate = new Date(data.generated_at);
-      const ymd = getLocalYMD(nowDate, data.timezone);
-      const lunar = solarToLunar(ymd.year, ymd.month, ymd.day);
       const dateStr = new Intl.DateTimeFormat("zh-CN", { timeZone: data.timezone, year: "numeric", month: "2-digit", day: "2-digit", weekday: "short" }).format(nowDate);
       const timeStr = new Intl.DateTimeFormat("zh-CN", { timeZone: data.timezone, hour12: false, hour: "2-digit", minute: "2-digit", second: "2-digit" }).format(nowDate);
-      nowText.textContent = dateStr + "（农历" + lunarToStr(lunar) + "） " + timeStr + " " + data.timezone;
+      const lunarStr = data.lunar_date ? "（农历" + data.ganzhi_year + "年" + data.lunar_date + "） " : " ";
+      nowText.textContent = dateStr + lunarStr + timeStr + " " + data.timezone;
     }
 
     function drawAltitudeView(data, baseR, sunTrackData, moonTrackData) {
@@ -2121,6 +3706,20 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       drawAltTrack(sunTrackData, "#ffd166");
       drawAltTrack(moonTrackData, "#9ad1ff");
 
+      (data.planets || []).forEach(p => {
+        const color = planetColors[p.key] || "#e0c3fc";
+        const x = toX(normRawAz(p.azimuth_deg));
+        const y = toY(p.altitude_deg);
+        altCtx.globalAlpha = p.altitude_deg >= 0 ? 1 : 0.35;
+        altCtx.fillStyle = color;
+        altCtx.beginPath();
+        altCtx.arc(x, y, 4, 0, Math.PI * 2);
+        altCtx.fill();
+        altCtx.font = "11px 'Segoe UI', Arial";
+        altCtx.fillText(p.name, x + 6, y - 6);
+        altCtx.globalAlpha = 1;
+      });
+
       slots.forEach(slot => {
         const alt = Math.max(altMin, Math.min(altMax, slot.obj.altitude_deg));
         const headingSigned = normRawAz(slot.obj.azimuth_deg);
@@ -2176,6 +3775,7 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       drawTrackCompass(moonTrack, moonR, "#9ad1ff", cx, cy);
       drawBody(data.sun, sunR, "#ffd166", "太阳", 1, cx, cy, baseR);
       drawBody(data.moon, moonR, "#9ad1ff", "月亮", 0.7, cx, cy, baseR);
+      (data.planets || []).forEach(p => drawPlanet(p, baseR * 0.9, cx, cy));
       drawAltitudeView(data, baseR, sunTrack, moonTrack);
 
       document.getElementById("apiPreview").textContent = buildApiUrl();
@@ -2185,8 +3785,11 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       const sun = data.sun;
       const moon = data.moon;
       const moonIllum = moon.illumination || (typeof moon.illumination_num === "number" ? (moon.illumination_num * 100).toFixed(1) + "%%" : "--");
-      document.getElementById("sunInfo").innerHTML = "<strong>太阳</strong><br>方位角: " + sun.azimuth_deg.toFixed(2) + "° (" + sun.azimuth_text + ")<br>高度角: " + sun.altitude_deg.toFixed(2) + "°<br>地日距离: " + sun.distance_km.toFixed(0) + " km";
-      document.getElementById("moonInfo").innerHTML = "<strong>月亮</strong><br>方位角: " + moon.azimuth_deg.toFixed(2) + "° (" + moon.azimuth_text + ")<br>高度角: " + moon.altitude_deg.toFixed(2) + "°<br>地月距离: " + moon.distance_km.toFixed(0) + " km<br>可见光比例: " + moonIllum;
+      document.getElementById("sunInfo").innerHTML = "<strong>太阳</strong><br>方位角: " + sun.azimuth_deg.toFixed(2) + "° (" + sun.azimuth_text + ")<br>高度角: " + sun.altitude_deg.toFixed(2) + "°（视 " + sun.apparent_altitude_deg.toFixed(2) + "°）<br>地日距离: " + sun.distance_km.toFixed(0) + " km";
+      document.getElementById("moonInfo").innerHTML = "<strong>月亮</strong><br>方位角: " + moon.azimuth_deg.toFixed(2) + "° (" + moon.azimuth_text + ")<br>高度角: " + moon.altitude_deg.toFixed(2) + "°（视 " + moon.apparent_altitude_deg.toFixed(2) + "°）<br>地月距离: " + moon.distance_km.toFixed(0) + " km<br>可见光比例: " + moonIllum;
+      document.getElementById("planetInfo").innerHTML = "<strong>行星</strong>" + (data.planets || []).map(p =>
+        "<br>" + p.name + ": 方位 " + p.azimuth_deg.toFixed(1) + "° (" + p.azimuth_text + ") 高度 " + p.altitude_deg.toFixed(1) + "° 星等 " + p.magnitude.toFixed(1) + " 升 " + p.rise + " 落 " + p.set
+      ).join("");
       document.getElementById("ctxInfo").innerHTML = "<strong>定位</strong><br>城市: " + data.display + "<br>坐标: " + data.lat.toFixed(4) + ", " + data.lon.toFixed(4) + "<br>时区: " + data.timezone + "<br>当地时间: " + data.local_time;
       renderNowBar(data);
       renderMoonPhase(moon);
@@ -2198,6 +3801,26 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       return apiBaseUrl + (params.toString() ? "?" + params.toString() : "");
     }
 
+    function buildStreamUrl() {
+      const params = new URLSearchParams(baseQuery);
+      if (currentCity) params.set("city", currentCity);
+      params.set("interval", String(Math.round(refreshMs / 1000)));
+      return streamBaseUrl + "?" + params.toString();
+    }
+
+    function handleData(data) {
+      const nowTs = Date.now();
+      sunTrack.push({ azRaw: data.sun.azimuth_deg, alt: data.sun.altitude_deg, ts: nowTs });
+      moonTrack.push({ azRaw: data.moon.azimuth_deg, alt: data.moon.altitude_deg, ts: nowTs });
+      const cutoff = nowTs - trackWindowMs;
+      while (sunTrack.length > trackLimit || (sunTrack[0] && sunTrack[0].ts < cutoff)) sunTrack.shift();
+      while (moonTrack.length > trackLimit || (moonTrack[0] && moonTrack[0].ts < cutoff)) moonTrack.shift();
+
+      drawScene(data);
+      setInfo(data);
+      document.getElementById("status").textContent = "已更新：" + new Date().toLocaleTimeString();
+    }
+
     async function fetchAndDraw() {
       const status = document.getElementById("status");
       const errBox = document.getElementById("error");
@@ -2210,30 +3833,63 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       try {
         const res = await fetch(buildApiUrl(), { cache: "no-store" });
         if (!res.ok) {
-          throw new Error("HTTP " + res.status + " - " + (await res.text()));
+          throw new Error(await describeHttpError(res));
         }
-        const data = await res.json();
-
-        const nowTs = Date.now();
-        sunTrack.push({ azRaw: data.sun.azimuth_deg, alt: data.sun.altitude_deg, ts: nowTs });
-        moonTrack.push({ azRaw: data.moon.azimuth_deg, alt: data.moon.altitude_deg, ts: nowTs });
-        const cutoff = nowTs - trackWindowMs;
-        while (sunTrack.length > trackLimit || (sunTrack[0] && sunTrack[0].ts < cutoff)) sunTrack.shift();
-        while (moonTrack.length > trackLimit || (moonTrack[0] && moonTrack[0].ts < cutoff)) moonTrack.shift();
-
-        drawScene(data);
-        setInfo(data);
-        status.textContent = "已更新：" + new Date().toLocaleTimeString();
+        handleData(await res.json());
       } catch (err) {
         errBox.textContent = "拉取失败: " + err.message;
         status.textContent = "等待重试";
       }
     }
 
-    function startTimer() {
+    // describeHttpError 从结构化错误 {"error": {"code", "message"}} 中取出说明，非 JSON 时返回原文。
+    async function describeHttpError(res) {
+      const text = await res.text();
+      try {
+        const e = JSON.parse(text).error;
+        if (e && e.message) return "HTTP " + res.status + " " + e.code + ": " + e.message;
+      } catch (_) {}
+      return "HTTP " + res.status + " - " + text;
+    }
+
+    function startPolling() {
+      fetchAndDraw();
+      timer = setInterval(fetchAndDraw, refreshMs);
+    }
+
+    // 优先订阅 SSE 推送（服务端每个城市共用一个计时器，连接建立后立即推送一帧）；浏览器不支持时回退轮询。
+    function startStream() {
       if (!currentCity) return;
+      if (stream) stream.close();
       if (timer) clearInterval(timer);
-      timer = setInterval(fetchAndDraw, refreshMs);
+      stream = null;
+      timer = null;
+      if (!window.EventSource) {
+        startPolling();
+        return;
+      }
+      document.getElementById("status").textContent = "连接推送中...";
+      stream = new EventSource(buildStreamUrl());
+      stream.addEventListener("positions", (e) => {
+        document.getElementById("error").textContent = "";
+        try {
+          handleData(JSON.parse(e.data));
+        } catch (err) {
+          document.getElementById("error").textContent = "解析推送失败: " + err.message;
+        }
+      });
+      const current = stream;
+      stream.onerror = () => {
+        if (current !== stream) return;
+        if (current.readyState !== EventSource.CLOSED) {
+          document.getElementById("status").textContent = "推送连接中断，自动重连中...";
+          return;
+        }
+        // 服务端返回 4xx 等非事件流响应时浏览器不再重连：改为轮询，首次请求会在 #error 中显示 JSON 错误说明
+        current.close();
+        stream = null;
+        startPolling();
+      };
     }
 
     async function loadCities() {
@@ -2259,8 +3915,7 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
         } else {
           citySelect.value = currentCity;
         }
-        fetchAndDraw();
-        startTimer();
+        startStream();
       } catch (err) {
         citySelect.innerHTML = "<option value=\"\">加载失败</option>";
         document.getElementById("error").textContent = "城市列表获取失败: " + err.message;
@@ -2269,7 +3924,7 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
 
     citySelect.addEventListener("change", (e) => {
       currentCity = e.target.value;
-      fetchAndDraw();
+      startStream();
     });
 
     document.getElementById("refreshInput").addEventListener("change", (e) => {
@@ -2279,7 +3934,7 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
         return;
       }
       refreshMs = v * 1000;
-      startTimer();
+      startStream();
     });
 
     document.getElementById("clearTrack").addEventListener("click", () => {
@@ -2353,7 +4008,7 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       } else {
         currentCity = list[0].city;
         citySelect.value = currentCity;
-        fetchAndDraw();
+        startStream();
       }
     });
 
@@ -2363,88 +4018,338 @@ func positionsPageHandler(w http.ResponseWriter, r *http.Request) {
       cityWrap.style.display = "flex";
       loadCities();
     } else {
-      fetchAndDraw();
-      startTimer();
+      startStream();
     }
   </script>
 </body>
-</html>`, html.EscapeString(title), refreshSec, html.EscapeString(apiBasePath), html.EscapeString(baseQuery), html.EscapeString(initialCity), refreshSec)
+</html>`, html.EscapeString(title), refreshSec, html.EscapeString(apiBasePath), html.EscapeString(streamBasePath), html.EscapeString(baseQuery), html.EscapeString(initialCity), refreshSec)
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	_, _ = w.Write([]byte(htmlStr))
 }
 
-// astroAPIHandler 处理 /api/astro 请求，支持城市或坐标查询。
-func astroAPIHandler(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	mode := strings.ToLower(q.Get("mode"))
-	if mode == "" {
-		mode = "year"
-	}
+// astroAcceptTypes 为 Accept 头中可识别的 MIME 类型与输出格式的对应关系。
+var astroAcceptTypes = map[string]string{
+	"application/json": "json",
+	"text/csv":         "csv",
+	"text/plain":       "txt",
+	"text/calendar":    "ics",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": "excel",
+	"*/*":           "json",
+	"application/*": "json",
+}
 
-	ctx, status, err := resolveContextFromQuery(q)
-	if err != nil {
-		http.Error(w, err.Error(), status)
-		return
+// negotiateAstroFormat 按 Accept 头（支持 q 值）选择输出格式，无可识别类型时返回 json。
+func negotiateAstroFormat(accept string) string {
+	best, bestQ := "json", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := astroAcceptTypes[mediaType]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(qs, 64); err == nil {
+				q = v
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
 	}
+	return best
+}
 
-	var (
-		data []dailyAstro
-		desc string
-	)
+// astroContentDisposition 生成下载文件名头；日历订阅、图表与报告使用 inline，其余为 attachment。
+func astroContentDisposition(format, baseName string) string {
+	disposition := "attachment"
+	if format == "ics" || format == "svg" || format == "html" || format == "report" {
+		disposition = "inline"
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": baseName + "." + astroFormatSpecs[format].Ext})
+}
 
+// buildAstroDataFromQuery 按 mode=year/day/range 及 date/from/to 参数生成天文数据；参数错误保留其错误码，其余为内部错误。
+func buildAstroDataFromQuery(ctx *CityContext, mode string, q url.Values) (data []dailyAstro, desc, baseName string, err error) {
 	switch mode {
 	case "year":
-		var base string
-		data, desc, base, err = buildYearData(ctx)
-		_ = base
+		data, desc, baseName, err = buildYearData(ctx)
 	case "day":
 		dateStr := q.Get("date")
 		if dateStr == "" {
-			http.Error(w, "mode=day 时必须提供 date=YYYY-MM-DD", http.StatusBadRequest)
-			return
+			return nil, "", "", apiErrorf(errCodeMissingParam, "date", "mode=day 时必须提供 date=YYYY-MM-DD")
 		}
-		var base string
-		data, desc, base, err = buildDayData(ctx, dateStr)
-		_ = base
+		data, desc, baseName, err = buildDayData(ctx, dateStr)
 	case "range":
 		fromStr := q.Get("from")
 		toStr := q.Get("to")
 		if fromStr == "" || toStr == "" {
-			http.Error(w, "mode=range 时必须提供 from/to=YYYY-MM-DD", http.StatusBadRequest)
-			return
+			return nil, "", "", apiErrorf(errCodeMissingParam, missingRangeField(fromStr), "mode=range 时必须提供 from/to=YYYY-MM-DD")
 		}
-		var base string
-		data, desc, base, err = buildRangeData(ctx, fromStr, toStr)
-		_ = base
+		data, desc, baseName, err = buildRangeData(ctx, fromStr, toStr)
 	default:
-		http.Error(w, "mode 必须为 year/day/range", http.StatusBadRequest)
+		return nil, "", "", apiErrorf(errCodeInvalidMode, "mode", "mode 必须为 year/day/range")
+	}
+	if err != nil {
+		e := asAPIError(err)
+		return nil, "", "", apiErrorf(e.Code, e.Field, "生成天文数据失败: %w", err)
+	}
+	return data, desc, baseName, nil
+}
+
+// astroViewHandler 处理 /view/astro 页面：参数与 /api/astro 相同（mode 默认 year），实时生成与 --format html 一致的图表页面。
+func astroViewHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mode := strings.ToLower(q.Get("mode"))
+	if mode == "" {
+		mode = "year"
+	}
+	ctx, err := resolveContextFromQuery(r.Context(), q)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	if err := applyPhotoBandsQuery(ctx, q); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	data, desc, _, err := buildAstroDataFromQuery(ctx, mode, q)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeAstroHTMLTo(&buf, ctx.City, ctx.observerElevation(), ctx.Now, data, desc); err != nil {
+		writeAPIError(w, apiErrorf(errCodeInternal, "", "生成页面失败: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", astroFormatSpecs["html"].ContentType)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// astroAPIHandler 处理 /api/astro 请求，支持城市或坐标查询；
+// format=json/csv/txt/excel/ics/svg/html/report（或 Accept 头协商）决定输出格式，访问 /api/astro.ics 时固定为 ics，events= 过滤日历事件类型。
+func astroAPIHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mode := strings.ToLower(q.Get("mode"))
+	if mode == "" {
+		mode = "year"
+	}
+	format := q.Get("format")
+	if strings.HasSuffix(r.URL.Path, ".ics") {
+		format = "ics"
+	}
+	if format == "" {
+		format = negotiateAstroFormat(r.Header.Get("Accept"))
+	}
+	format, ok := normalizeAstroFormat(format)
+	if !ok {
+		writeAPIError(w, apiErrorf(errCodeInvalidFormat, "format", "format 必须为 json/csv/txt/excel/ics/svg/html/report"))
 		return
 	}
+	var icsTypes map[string]bool
+	if format == "ics" {
+		var err error
+		if icsTypes, err = parseICSEventTypes(q.Get("events")); err != nil {
+			writeAPIError(w, apiErrorf(errCodeInvalidParam, "events", "%w", err))
+			return
+		}
+	}
 
+	ctx, err := resolveContextFromQuery(r.Context(), q)
 	if err != nil {
-		http.Error(w, "生成天文数据失败: "+err.Error(), http.StatusInternalServerError)
+		writeAPIError(w, err)
+		return
+	}
+	if err := applyPhotoBandsQuery(ctx, q); err != nil {
+		writeAPIError(w, err)
 		return
 	}
+	if r.Method == http.MethodPost {
+		h, err := readHorizonBody(w, r)
+		if err != nil {
+			writeAPIError(w, apiErrorf(errCodeInvalidHorizon, "", "%w", err))
+			return
+		}
+		ctx.Horizon = h
+	}
 
-	resp := astroAPIResponse{
-		City:       ctx.City,
-		Display:    ctx.DisplayName,
-		Lat:        ctx.Lat,
-		Lon:        ctx.Lon,
-		Timezone:   ctx.TZID,
-		Mode:       mode,
-		Range:      desc,
-		Generated:  ctx.Now.Format(time.RFC3339),
-		Data:       data,
-		LocalTZTip: "所有时间均为城市所在时区的当地时间",
-		Notes:      []string{polarNote},
+	data, desc, baseName, err := buildAstroDataFromQuery(ctx, mode, q)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept")
+	if format == "json" {
+		resp := newAstroAPIResponse(ctx, mode, desc, data)
+		w.Header().Set("Content-Type", astroFormatSpecs[format].ContentType)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(resp)
+		return
+	}
+
+	// 先写入缓冲区，生成失败时仍可返回 500 而不是半截文件。
+	var buf bytes.Buffer
+	switch format {
+	case "csv":
+		err = writeAstroCSVTo(&buf, ctx.City, ctx.observerElevation(), ctx.Now, data, desc)
+	case "txt":
+		err = writeAstroTxtTo(&buf, ctx.City, ctx.observerElevation(), ctx.Now, data, desc)
+	case "excel":
+		err = writeAstroExcelTo(&buf, ctx.City, ctx.observerElevation(), ctx.Now, data, desc)
+	case "ics":
+		err = writeAstroICS(&buf, ctx.City, ctx.observerElevation(), ctx.Now, data, icsTypes)
+	case "svg":
+		err = writeAstroSVGTo(&buf, ctx.City, ctx.observerElevation(), ctx.Now, data, desc)
+	case "html":
+		err = writeAstroHTMLTo(&buf, ctx.City, ctx.observerElevation(), ctx.Now, data, desc)
+	case "report":
+		err = writeAstroReportTo(&buf, ctx.City, ctx.observerElevation(), ctx.Now, data, desc)
+	}
+	if err != nil {
+		writeAPIError(w, apiErrorf(errCodeInternal, "", "生成输出失败: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", astroFormatSpecs[format].ContentType)
+	w.Header().Set("Content-Disposition", astroContentDisposition(format, baseName))
+	_, _ = w.Write(buf.Bytes())
+}
+
+// phasesAPIHandler 返回指定城市 year/day/range 范围内的月相事件。
+func phasesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mode := strings.ToLower(q.Get("mode"))
+	if mode == "" {
+		mode = "year"
+	}
+
+	ctx, err := resolveContextFromQuery(r.Context(), q)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	events, desc, err := buildPhasesData(ctx, mode, q.Get("date"), q.Get("from"), q.Get("to"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	list := make([]moonPhaseJSON, 0, len(events))
+	for _, e := range events {
+		list = append(list, e.toJSON(ctx.Loc))
 	}
 
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
-	_ = enc.Encode(resp)
+	_ = enc.Encode(newPhasesAPIResponse(ctx, mode, desc, list))
+}
+
+// termsAPIHandler 返回指定城市某一公历年的二十四节气（默认当前年份）。
+func termsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ctx, err := resolveContextFromQuery(r.Context(), q)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	year := 0
+	if ys := q.Get("year"); ys != "" {
+		if year, err = strconv.Atoi(ys); err != nil {
+			writeAPIError(w, apiErrorf(errCodeInvalidParam, "year", "year 解析失败"))
+			return
+		}
+	}
+	events, year, _, err := buildTermsData(ctx, year)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	list := make([]solarTermJSON, 0, len(events))
+	for _, e := range events {
+		list = append(list, e.toJSON(ctx.Loc))
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(newTermsAPIResponse(ctx, year, list))
+}
+
+// sunPathAPIHandler 返回指定城市/坐标的太阳轨迹图 SVG，支持 year 与 projection=stereographic/cylindrical。
+func sunPathAPIHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	ctx, err := resolveContextFromQuery(r.Context(), q)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	year := 0
+	if ys := q.Get("year"); ys != "" {
+		if year, err = strconv.Atoi(ys); err != nil {
+			writeAPIError(w, apiErrorf(errCodeInvalidParam, "year", "year 解析失败"))
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if err := renderSunPathSVG(&buf, ctx, year, q.Get("projection")); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/svg+xml; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// eclipsesAPIHandler 返回指定城市 year/day/range 范围内的日食/月食，format 支持 json/csv/ics。
+func eclipsesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mode := strings.ToLower(q.Get("mode"))
+	if mode == "" {
+		mode = "year"
+	}
+	format := strings.ToLower(q.Get("format"))
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "ics" {
+		writeAPIError(w, apiErrorf(errCodeInvalidFormat, "format", "format 必须为 json/csv/ics"))
+		return
+	}
+
+	ctx, err := resolveContextFromQuery(r.Context(), q)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	visibleOnly := q.Get("visible") == "1" || strings.EqualFold(q.Get("visible"), "true")
+	events, desc, err := buildEclipsesData(ctx, mode, q.Get("date"), q.Get("from"), q.Get("to"), visibleOnly)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		_ = writeEclipses(w, format, ctx, events, desc)
+	case "ics":
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		_ = writeEclipses(w, format, ctx, events, desc)
+	default:
+		list := make([]eclipseJSON, 0, len(events))
+		for _, e := range events {
+			list = append(list, e.toJSON(ctx.Loc))
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(newEclipsesAPIResponse(ctx, mode, desc, list))
+	}
 }
 
 // healthHandler 健康检查接口。
@@ -2460,6 +4365,7 @@ var (
 	rangeFromS string
 	rangeToS   string
 	cacheForce bool
+	combine    bool // year/range 的 --combine
 
 	// coords 子命令 flags
 	coordsLat  float64
@@ -2471,6 +4377,36 @@ var (
 	coordsTo   string
 	coordsCity string
 
+	// phases 子命令 flags
+	phasesMode string
+	phasesDate string
+	phasesFrom string
+	phasesTo   string
+
+	// terms 子命令 flag
+	termsYear int
+
+	// eclipses 子命令 flags
+	eclipsesMode        string
+	eclipsesDate        string
+	eclipsesFrom        string
+	eclipsesTo          string
+	eclipsesVisibleOnly bool
+
+	// sunpath 子命令 flags
+	sunpathYear       int
+	sunpathProjection string
+	sunpathOutput     string
+
+	// batch 子命令 flags
+	batchInput   string
+	batchMode    string
+	batchDate    string
+	batchFrom    string
+	batchTo      string
+	batchCombine bool
+	batchOutput  string
+
 	// serve 子命令 flag
 	serveAddr     string
 	serveShutdown time.Duration
@@ -2502,14 +4438,33 @@ var rootCmd = &cobra.Command{
 
 默认行为：等同于 "esunmoon year <城市名>"，即从今天起一年。
 支持 --offline 仅使用本地缓存，不进行任何网络请求。
-支持 --format txt/csv/json/excel。`,
+支持 --format txt/csv/json/excel/ics（ics 可配合 --ics-events 过滤事件类型）。`,
 	Args: cobra.ArbitraryArgs,
-	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		config.LogLevel = logLevelFlag
 		config.LogJSON = logJSONFlag
 		config.LogQuiet = logQuietFlag
 		lvl := parseLogLevel(config.LogLevel)
 		app.logger = NewLogger(os.Stdout, lvl, config.LogJSON, config.LogQuiet, app.now)
+		applyGeocoderEnv(config, func(name string) bool {
+			f := cmd.Flag(name)
+			return f != nil && f.Changed
+		})
+		geocoder, err := buildGeocoder(config)
+		if err != nil {
+			return err
+		}
+		app.geocoder = geocoder
+		if err := config.Atmosphere.validate(); err != nil {
+			return err
+		}
+		if f := cmd.Flag("elevation"); f != nil && f.Changed {
+			if err := validateElevation(config.Elevation); err != nil {
+				return err
+			}
+			config.ElevationSet = true
+		}
+		return nil
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		city := getCityFromArgsOrPrompt(args)
@@ -2532,6 +4487,10 @@ var yearCmd = &cobra.Command{
 	Short: "从今天起一年（365 天）的天文数据",
 	Args:  cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if combine {
+			format := combineFormat(config.Format, cmd.Flags().Changed("format"))
+			return runCombinedCities(args, "year", "", "", OutputOptions{Format: format, AllowOverwrite: config.AllowOverwrite, OutDir: config.OutDir})
+		}
 		city := getCityFromArgsOrPrompt(args)
 		if city == "" {
 			return fmt.Errorf("城市名不能为空")
@@ -2578,6 +4537,10 @@ var rangeCmd = &cobra.Command{
 		if err := validateRangeFlags(rangeFromS, rangeToS); err != nil {
 			return err
 		}
+		if combine {
+			format := combineFormat(config.Format, cmd.Flags().Changed("format"))
+			return runCombinedCities(args, "range", rangeFromS, rangeToS, OutputOptions{Format: format, AllowOverwrite: config.AllowOverwrite, OutDir: config.OutDir})
+		}
 		city := getCityFromArgsOrPrompt(args)
 		if city == "" {
 			return fmt.Errorf("城市名不能为空")
@@ -2598,33 +4561,52 @@ var coordsCmd = &cobra.Command{
 	Use:   "coords",
 	Short: "通过经纬度 + 时区直接生成天文数据（绕过城市地理编码）",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if coordsTZ == "" {
-			return fmt.Errorf("--tz 必须指定，例如 Asia/Shanghai")
-		}
-		loc, err := app.loadTZ(coordsTZ)
+		tzID, loc, warnings, err := resolveCoordsTimezone(coordsLat, coordsLon, coordsTZ, time.Now())
 		if err != nil {
-			return fmt.Errorf("加载时区失败 (%s): %w", coordsTZ, err)
+			return err
+		}
+		for _, w := range warnings {
+			logWarnf("%s", w)
 		}
 		now := time.Now().In(loc)
-		cityName := coordsCity
+		cityName, displayName := coordsCity, coordsCity
 		if cityName == "" {
-			cityName = fmt.Sprintf("coords_%.4f_%.4f", coordsLat, coordsLon)
+			cityName, displayName = reverseGeocodeName(coordsLat, coordsLon, config.Offline)
 		}
 		ctx := &CityContext{
 			City:        cityName,
-			DisplayName: cityName,
+			DisplayName: displayName,
 			Lat:         coordsLat,
 			Lon:         coordsLon,
-			TZID:        coordsTZ,
+			TZID:        tzID,
 			Loc:         loc,
 			Now:         now,
+			Warnings:    warnings,
+		}
+		if config.ElevationSet {
+			ctx.Elevation, ctx.ElevationSource = config.Elevation, "manual"
+		} else if elev, ok := demElevation(coordsLat, coordsLon); ok {
+			ctx.Elevation, ctx.ElevationSource = elev, "dem"
+		}
+		if config.HorizonFile != "" {
+			if ctx.Horizon, err = loadHorizonFile(config.HorizonFile); err != nil {
+				return err
+			}
 		}
 
 		fmt.Println("-------------------------------------------------")
 		fmt.Printf("[eSunMoon] Coords 模式\n")
 		fmt.Printf("城市名: %s\n", cityName)
+		if displayName != cityName {
+			fmt.Printf("地点:   %s\n", displayName)
+		}
 		fmt.Printf("经纬度: %.4f, %.4f\n", coordsLat, coordsLon)
-		fmt.Printf("时区:   %s\n", coordsTZ)
+		fmt.Printf("海拔:   %s\n", formatElevation(ctx.Elevation, ctx.ElevationSource))
+		if coordsTZ == "" {
+			fmt.Printf("时区:   %s（按坐标推断）\n", tzID)
+		} else {
+			fmt.Printf("时区:   %s\n", tzID)
+		}
 		fmt.Printf("当前当地时间: %s\n", now.Format("2006-01-02 15:04:05"))
 		fmt.Println("-------------------------------------------------")
 		printSunMoonPosition(ctx)
@@ -2657,6 +4639,119 @@ var coordsCmd = &cobra.Command{
 	},
 }
 
+// phases 子命令：月相事件日历
+var phasesCmd = &cobra.Command{
+	Use:   "phases [城市名...]",
+	Short: "列出新月/上弦/满月/下弦的精确时刻（当地时间）",
+	Args:  cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		city := getCityFromArgsOrPrompt(args)
+		if city == "" {
+			return fmt.Errorf("城市名不能为空")
+		}
+		ctx, err := prepareCity(city, config.Offline)
+		if err != nil {
+			return err
+		}
+		events, desc, err := buildPhasesData(ctx, phasesMode, phasesDate, phasesFrom, phasesTo)
+		if err != nil {
+			return err
+		}
+		return writeMoonPhases(os.Stdout, config.Format, ctx, events, desc)
+	},
+}
+
+// terms 子命令：二分二至与二十四节气
+var termsCmd = &cobra.Command{
+	Use:   "terms [城市名...]",
+	Short: "列出某年二十四节气（含二分二至）的精确交节时刻（当地时间）",
+	Args:  cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		city := getCityFromArgsOrPrompt(args)
+		if city == "" {
+			return fmt.Errorf("城市名不能为空")
+		}
+		ctx, err := prepareCity(city, config.Offline)
+		if err != nil {
+			return err
+		}
+		events, year, desc, err := buildTermsData(ctx, termsYear)
+		if err != nil {
+			return err
+		}
+		return writeSolarTerms(os.Stdout, config.Format, ctx, year, events, desc)
+	},
+}
+
+// eclipses 子命令：日食/月食预报
+var eclipsesCmd = &cobra.Command{
+	Use:   "eclipses [城市名...]",
+	Short: "搜索日食/月食并给出本地接触时刻、食分与高度（--format 支持 txt/csv/json/ics）",
+	Args:  cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		city := getCityFromArgsOrPrompt(args)
+		if city == "" {
+			return fmt.Errorf("城市名不能为空")
+		}
+		ctx, err := prepareCity(city, config.Offline)
+		if err != nil {
+			return err
+		}
+		events, desc, err := buildEclipsesData(ctx, eclipsesMode, eclipsesDate, eclipsesFrom, eclipsesTo, eclipsesVisibleOnly)
+		if err != nil {
+			return err
+		}
+		return writeEclipses(os.Stdout, config.Format, ctx, events, desc)
+	},
+}
+
+// sunpath 子命令：太阳轨迹图
+var sunpathCmd = &cobra.Command{
+	Use:   "sunpath [城市名...]",
+	Short: "生成太阳轨迹图 SVG（每月 21 日曲线、整点时角线与当前太阳位置）",
+	Args:  cobra.ArbitraryArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		city := getCityFromArgsOrPrompt(args)
+		if city == "" {
+			return fmt.Errorf("城市名不能为空")
+		}
+		if _, err := parseSunPathProjection(sunpathProjection); err != nil {
+			return err
+		}
+		ctx, err := prepareCity(city, config.Offline)
+		if err != nil {
+			return err
+		}
+		return runSunPath(ctx, sunpathYear, sunpathProjection, sunpathOutput, OutputOptions{AllowOverwrite: config.AllowOverwrite, OutDir: config.OutDir})
+	},
+}
+
+// batch 子命令
+var batchCmd = &cobra.Command{
+	Use:   "batch --input cities.csv",
+	Short: "按地点列表（CSV/JSON）批量生成天文数据，每地点一个文件或合并为一个文件",
+	Long: "地点列表为带表头的 CSV（列：id,city,country,pick,lat,lon,tz,elev,mode,date,from,to，可省略、可任意顺序）" +
+		"或与 POST /api/astro/batch 请求体相同的 JSON 数组；每行为城市或经纬度，mode/date/from/to 留空时使用命令行参数。",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		items, err := readAstroBatchFile(batchInput)
+		if err != nil {
+			return err
+		}
+		defaults := url.Values{}
+		for k, v := range map[string]string{"mode": batchMode, "date": batchDate, "from": batchFrom, "to": batchTo} {
+			if v != "" {
+				defaults.Set(k, v)
+			}
+		}
+		opts := astroBatchOptions{Defaults: defaults, Combine: batchCombine, Output: batchOutput}
+		format := config.Format
+		if batchCombine {
+			format = combineFormat(format, cmd.Flags().Changed("format"))
+		}
+		return runAstroBatch(items, opts, OutputOptions{Format: format, AllowOverwrite: config.AllowOverwrite, OutDir: config.OutDir})
+	},
+}
+
 // TUI 子命令
 var tuiCmd = &cobra.Command{
 	Use:   "tui",
@@ -2664,6 +4759,11 @@ var tuiCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cache := loadCache()
 		m := newTuiModel(cache)
+		m.geocode = func(city string) ([]GeoCandidate, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 12*time.Second)
+			defer cancel()
+			return lookupCandidates(ctx, city, config.Country, config.Offline, geocodeDefaultLimit)
+		}
 		p := tea.NewProgram(m)
 		finalModel, err := p.Run()
 		if err != nil {
@@ -2675,7 +4775,12 @@ var tuiCmd = &cobra.Command{
 			return nil
 		}
 		city := tm.chosenCity
-		ctx, err := prepareCity(city, config.Offline)
+		geoOpts := cliGeoOptions()
+		if tm.chosenCandidate != nil {
+			geoOpts.Chosen = tm.chosenCandidate
+			geoOpts.Pick = tm.pickIndex + 1
+		}
+		ctx, err := prepareCityWith(city, config.Offline, geoOpts)
 		if err != nil {
 			return err
 		}
@@ -2762,22 +4867,25 @@ var serveCmd = &cobra.Command{
 		if serveAddr == "" {
 			serveAddr = ":8080"
 		}
-		mux := http.NewServeMux()
-		mux.HandleFunc("/api/astro", astroAPIHandler)
-		mux.HandleFunc("/api/positions", positionsAPIHandler)
-		mux.HandleFunc("/api/cities", citiesAPIHandler)
-		mux.HandleFunc("/view/positions", positionsPageHandler)
-		mux.HandleFunc("/healthz", healthHandler)
-		mux.HandleFunc("/readyz", readyHandler)
+		mux := newServeMux()
 
 		logInfof("eSunMoon HTTP 服务启动：%s", serveAddr)
 		logInfof("GET /healthz")
 		logInfof("GET /readyz")
 		logInfof("GET /api/astro?city=Beijing&mode=day&date=2025-01-01")
 		logInfof("GET /api/astro?lat=39.9&lon=116.4&tz=Asia/Shanghai&mode=year")
+		logInfof("GET /api/astro.ics?city=Beijing&events=sunrise,sunset,phase")
+		logInfof("GET /api/phases?city=Beijing&mode=range&from=2025-01-01&to=2025-03-31")
+		logInfof("GET /api/terms?city=Beijing&year=2025")
+		logInfof("GET /api/eclipses?city=Beijing&mode=range&from=2025-01-01&to=2027-12-31&format=ics")
 		logInfof("GET /api/positions?city=Beijing")
+		logInfof("GET /api/positions/stream?city=Beijing&city=Tokyo&interval=10")
 		logInfof("GET /api/cities")
+		logInfof("GET /api/geocode?q=Springfield&country=us")
 		logInfof("GET /view/positions?city=Beijing&refresh=30")
+		logInfof("POST /api/astro/batch?mode=day&date=2025-06-21  body: [{\"city\":\"Beijing\"},{\"lat\":31.23,\"lon\":121.47}]")
+		logInfof("GET /api/openapi.json")
+		logInfof("GET /api/docs")
 
 		stop := make(chan os.Signal, 1)
 		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
@@ -2787,7 +4895,21 @@ var serveCmd = &cobra.Command{
 
 func init() {
 	rootCmd.PersistentFlags().BoolVar(&config.Offline, "offline", false, "离线模式：仅使用本地缓存，不进行任何网络请求")
-	rootCmd.PersistentFlags().StringVar(&config.Format, "format", "txt", "输出格式：txt/csv/json/excel")
+	rootCmd.PersistentFlags().StringVar(&config.Format, "format", "txt", "输出格式：txt/csv/json/excel/ics/svg/html/report（svg/html 为图表，report 为可打印年报）")
+	rootCmd.PersistentFlags().StringVar(&config.ICSEvents, "ics-events", "", "ICS 导出的事件类型，逗号分隔：sunrise,sunset,moonrise,moonset,phase,solar_term（默认全部）")
+	rootCmd.PersistentFlags().IntVar(&config.Pick, "pick", 0, "城市有多个匹配时选择第 N 个候选（从 1 开始，非交互使用）")
+	rootCmd.PersistentFlags().StringVar(&config.Country, "country", "", "按国家代码过滤城市候选，例如 cn 或 us,ca")
+	rootCmd.PersistentFlags().StringVar(&config.Geocoder, "geocoder", config.Geocoder, "地理编码数据源，逗号分隔按顺序回退：gazetteer/nominatim/photon/file")
+	rootCmd.PersistentFlags().StringVar(&config.NominatimURL, "nominatim-url", defaultNominatimURL, "Nominatim 搜索接口地址（可指向自建实例）")
+	rootCmd.PersistentFlags().StringVar(&config.PhotonURL, "photon-url", defaultPhotonURL, "Photon 搜索接口地址（可指向自建实例）")
+	rootCmd.PersistentFlags().StringVar(&config.GeocoderFile, "geocoder-file", "", "本地城市文件（.csv/.json），配合 --geocoder file 使用")
+	rootCmd.PersistentFlags().StringVar(&config.GeocoderUserAgent, "geocoder-user-agent", "", "地理编码请求的 User-Agent（默认 eSunMoon/1.0 附联系邮箱）")
+	rootCmd.PersistentFlags().StringVar(&config.GeocoderEmail, "geocoder-email", "", "联系邮箱，按 Nominatim 使用政策随请求发送")
+	rootCmd.PersistentFlags().Float64Var(&config.Elevation, "elevation", 0, "观测点海拔（米），用于日出日落/晨昏蒙影/黄金蓝调时刻的地平俯角修正；城市模式下会写入缓存")
+	rootCmd.PersistentFlags().StringVar(&config.DEMDir, "dem-dir", "", "SRTM .hgt 瓦片目录（如 N39E116.hgt），未指定 --elevation 时离线查询海拔")
+	rootCmd.PersistentFlags().StringVar(&config.HorizonFile, "horizon", "", "地平线轮廓文件（方位,高度 CSV 或 JSON），计算地形/建筑遮挡后的可见升落；城市模式下会写入缓存")
+	rootCmd.PersistentFlags().Float64Var(&config.Atmosphere.TempC, "temp-c", config.Atmosphere.TempC, "地面气温（℃），用于计算视高度的大气折射")
+	rootCmd.PersistentFlags().Float64Var(&config.Atmosphere.PressureHPa, "pressure-hpa", config.Atmosphere.PressureHPa, "地面气压（hPa），用于计算视高度的大气折射；0 表示不计折射")
 	rootCmd.PersistentFlags().BoolVar(&config.AllowOverwrite, "overwrite", false, "允许覆盖已存在的输出文件")
 	rootCmd.PersistentFlags().StringVar(&config.OutDir, "outdir", "", "输出文件目录（默认当前目录）")
 	rootCmd.PersistentFlags().StringVar(&logLevelFlag, "log-level", config.LogLevel, "日志级别：debug/info/warn/error")
@@ -2795,10 +4917,17 @@ func init() {
 	rootCmd.PersistentFlags().BoolVar(&logQuietFlag, "log-quiet", config.LogQuiet, "禁用日志输出")
 	rootCmd.PersistentFlags().BoolVar(&config.LiveOnly, "live", false, "实时模式：仅输出太阳/月亮位置，跳过文件生成")
 	rootCmd.PersistentFlags().DurationVar(&config.LiveInterval, "live-interval", config.LiveInterval, "实时模式输出间隔，例如 5s、10s")
+	rootCmd.PersistentFlags().Float64Var(&config.Photo.Golden.Low, "golden-low", config.Photo.Golden.Low, "黄金时刻太阳高度下限（度）")
+	rootCmd.PersistentFlags().Float64Var(&config.Photo.Golden.High, "golden-high", config.Photo.Golden.High, "黄金时刻太阳高度上限（度）")
+	rootCmd.PersistentFlags().Float64Var(&config.Photo.Blue.Low, "blue-low", config.Photo.Blue.Low, "蓝调时刻太阳高度下限（度）")
+	rootCmd.PersistentFlags().Float64Var(&config.Photo.Blue.High, "blue-high", config.Photo.Blue.High, "蓝调时刻太阳高度上限（度）")
 
 	dayCmd.Flags().StringVarP(&dayDate, "date", "d", "", "指定日期（格式：YYYY-MM-DD）")
 	rangeCmd.Flags().StringVar(&rangeFromS, "from", "", "起始日期（格式：YYYY-MM-DD）")
 	rangeCmd.Flags().StringVar(&rangeToS, "to", "", "结束日期（格式：YYYY-MM-DD）")
+	for _, c := range []*cobra.Command{yearCmd, rangeCmd} {
+		c.Flags().BoolVar(&combine, "combine", false, "每个参数作为一个城市，合并输出：--format excel（默认）为每城市一个工作表加 Summary 对比表，csv 为带 city 列的长表")
+	}
 	_ = dayCmd.MarkFlagRequired("date")
 	_ = rangeCmd.MarkFlagRequired("from")
 	_ = rangeCmd.MarkFlagRequired("to")
@@ -2808,7 +4937,7 @@ func init() {
 	// coords flags
 	coordsCmd.Flags().Float64Var(&coordsLat, "lat", 0, "纬度（必填）")
 	coordsCmd.Flags().Float64Var(&coordsLon, "lon", 0, "经度（必填）")
-	coordsCmd.Flags().StringVar(&coordsTZ, "tz", "", "时区 ID（如 Asia/Shanghai，必填）")
+	coordsCmd.Flags().StringVar(&coordsTZ, "tz", "", "时区 ID（如 Asia/Shanghai，留空按经纬度推断）")
 	coordsCmd.Flags().StringVar(&coordsMode, "mode", "year", "模式：year/day/range")
 	coordsCmd.Flags().StringVar(&coordsDate, "date", "", "mode=day 时的日期 (YYYY-MM-DD)")
 	coordsCmd.Flags().StringVar(&coordsFrom, "from", "", "mode=range 起始日期 (YYYY-MM-DD)")
@@ -2817,7 +4946,37 @@ func init() {
 
 	_ = coordsCmd.MarkFlagRequired("lat")
 	_ = coordsCmd.MarkFlagRequired("lon")
-	_ = coordsCmd.MarkFlagRequired("tz")
+
+	// phases flags
+	phasesCmd.Flags().StringVar(&phasesMode, "mode", "year", "模式：year/day/range")
+	phasesCmd.Flags().StringVar(&phasesDate, "date", "", "mode=day 时的日期 (YYYY-MM-DD)")
+	phasesCmd.Flags().StringVar(&phasesFrom, "from", "", "mode=range 起始日期 (YYYY-MM-DD)")
+	phasesCmd.Flags().StringVar(&phasesTo, "to", "", "mode=range 结束日期 (YYYY-MM-DD)")
+
+	// terms flags
+	termsCmd.Flags().IntVar(&termsYear, "year", 0, "公历年份（默认当前年份）")
+
+	// eclipses flags
+	eclipsesCmd.Flags().StringVar(&eclipsesMode, "mode", "year", "模式：year/day/range")
+	eclipsesCmd.Flags().StringVar(&eclipsesDate, "date", "", "mode=day 时的日期 (YYYY-MM-DD)")
+	eclipsesCmd.Flags().StringVar(&eclipsesFrom, "from", "", "mode=range 起始日期 (YYYY-MM-DD)")
+	eclipsesCmd.Flags().StringVar(&eclipsesTo, "to", "", "mode=range 结束日期 (YYYY-MM-DD)")
+	eclipsesCmd.Flags().BoolVar(&eclipsesVisibleOnly, "visible-only", false, "仅列出本地可见的日食/月食")
+
+	// sunpath flags
+	sunpathCmd.Flags().IntVar(&sunpathYear, "year", 0, "公历年份（默认当前年份）")
+	sunpathCmd.Flags().StringVar(&sunpathProjection, "projection", sunPathStereographic, "投影：stereographic（立体投影）/cylindrical（圆柱投影）")
+	sunpathCmd.Flags().StringVarP(&sunpathOutput, "output", "o", "", "输出文件路径（默认 <城市>-sunpath-<年份>-<投影>.svg，- 表示标准输出）")
+
+	// batch flags
+	batchCmd.Flags().StringVarP(&batchInput, "input", "i", "", "地点列表文件（.csv 或 .json）")
+	batchCmd.Flags().StringVar(&batchMode, "mode", "year", "默认模式：year/day/range（可被列表中的 mode 列覆盖）")
+	batchCmd.Flags().StringVar(&batchDate, "date", "", "mode=day 时的默认日期 (YYYY-MM-DD)")
+	batchCmd.Flags().StringVar(&batchFrom, "from", "", "mode=range 默认起始日期 (YYYY-MM-DD)")
+	batchCmd.Flags().StringVar(&batchTo, "to", "", "mode=range 默认结束日期 (YYYY-MM-DD)")
+	batchCmd.Flags().BoolVar(&batchCombine, "combine", false, "合并输出：--format excel（默认）为每地点一个工作表加 Summary 对比表，csv 为带 city 列的长表")
+	batchCmd.Flags().StringVarP(&batchOutput, "output", "o", "", "--combine 时的输出路径（默认 batch-<日期>.xlsx 或 .csv）")
+	_ = batchCmd.MarkFlagRequired("input")
 
 	// serve flags
 	serveCmd.Flags().StringVar(&serveAddr, "addr", ":8080", "HTTP 监听地址，例如 :8080 或 127.0.0.1:9000")
@@ -2827,6 +4986,11 @@ func init() {
 	rootCmd.AddCommand(dayCmd)
 	rootCmd.AddCommand(rangeCmd)
 	rootCmd.AddCommand(coordsCmd)
+	rootCmd.AddCommand(phasesCmd)
+	rootCmd.AddCommand(termsCmd)
+	rootCmd.AddCommand(eclipsesCmd)
+	rootCmd.AddCommand(sunpathCmd)
+	rootCmd.AddCommand(batchCmd)
 	rootCmd.AddCommand(tuiCmd)
 	rootCmd.AddCommand(serveCmd)
 
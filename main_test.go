@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io"
 	"math"
 	"net"
@@ -13,15 +21,61 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	suncalc "github.com/redtim/sunmooncalc"
 	"github.com/spf13/pflag"
+	"github.com/xuri/excelize/v2"
 )
 
+// testHome 为 TestMain 创建的临时 HOME，未自行设置 HOME 的用例写入的缓存都落在其中。
+var testHome string
+
+// TestMain 将默认 HTTP 客户端替换为未实现的 mock，保证测试不发出真实网络请求（需要时由各用例自行注入）；
+// 并把 HOME 指向临时目录，避免坐标反查等写入开发者真实的 ~/.esunmoon-cache.json，结束后若真实缓存被改动则判为失败。
+func TestMain(m *testing.M) {
+	app.client = &httpClientMock{}
+	nominatimLimiter.interval = 0 // 测试中的 HTTP 请求均为 mock，不需要限速
+
+	realCache := cacheFilePath()
+	before := fileSnapshot(realCache)
+	home, err := os.MkdirTemp("", "esunmoon-test-home-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "创建测试 HOME 失败: %v\n", err)
+		os.Exit(1)
+	}
+	testHome = home
+	os.Setenv("HOME", home)
+
+	code := m.Run()
+	os.RemoveAll(home)
+	if after := fileSnapshot(realCache); after != before {
+		fmt.Fprintf(os.Stderr, "测试改动了临时 HOME 之外的缓存文件 %s（%s -> %s）\n", realCache, before, after)
+		if code == 0 {
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+// fileSnapshot 返回文件大小与修改时间的摘要，文件不存在时为 "missing"。
+func fileSnapshot(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "missing"
+	}
+	return fmt.Sprintf("%d@%s", info.Size(), info.ModTime().Format(time.RFC3339Nano))
+}
+
 //
 // ----------- 基础小工具函数测试 -----------
 //
@@ -533,6 +587,7 @@ func TestDescribeAzimuth(t *testing.T) {
 }
 
 func TestResolveContextFromQueryCoordsAndErrors(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
 	origNow := app.now
 	app.now = func() time.Time { return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC) }
 	defer func() { app.now = origNow }()
@@ -543,9 +598,9 @@ func TestResolveContextFromQueryCoordsAndErrors(t *testing.T) {
 		"lon": []string{"20"},
 		"tz":  []string{"UTC"},
 	}
-	ctx, status, err := resolveContextFromQuery(q)
-	if err != nil || status != http.StatusOK {
-		t.Fatalf("resolveContextFromQuery success expected, got status=%d err=%v", status, err)
+	ctx, err := resolveContextFromQuery(context.Background(), q)
+	if err != nil {
+		t.Fatalf("resolveContextFromQuery success expected, got err=%v", err)
 	}
 	if ctx.Lat != 10 || ctx.Lon != 20 || ctx.TZID != "UTC" || ctx.City == "" || ctx.Now.IsZero() {
 		t.Fatalf("ctx fields mismatch: %+v", ctx)
@@ -553,20 +608,20 @@ func TestResolveContextFromQueryCoordsAndErrors(t *testing.T) {
 
 	// lat parse error
 	q = url.Values{"lat": []string{"bad"}, "lon": []string{"0"}, "tz": []string{"UTC"}}
-	if _, status, err := resolveContextFromQuery(q); err == nil || status != http.StatusBadRequest {
-		t.Fatalf("expected bad request for invalid lat, got status=%d err=%v", status, err)
+	if _, err := resolveContextFromQuery(context.Background(), q); err == nil || asAPIError(err).status() != http.StatusBadRequest || asAPIError(err).Code != errCodeInvalidCoords || asAPIError(err).Field != "lat" {
+		t.Fatalf("expected INVALID_COORDS for invalid lat, got err=%#v", err)
 	}
 
 	// out of range
 	q = url.Values{"lat": []string{"200"}, "lon": []string{"0"}, "tz": []string{"UTC"}}
-	if _, status, err := resolveContextFromQuery(q); err == nil || status != http.StatusBadRequest {
-		t.Fatalf("expected bad request for out-of-range lat, got status=%d err=%v", status, err)
+	if _, err := resolveContextFromQuery(context.Background(), q); err == nil || asAPIError(err).status() != http.StatusBadRequest || asAPIError(err).Code != errCodeInvalidCoords {
+		t.Fatalf("expected INVALID_COORDS for out-of-range lat, got err=%#v", err)
 	}
 
-	// missing tz triggers must provide error (no city either)
-	q = url.Values{"lat": []string{"0"}, "lon": []string{"0"}}
-	if _, status, err := resolveContextFromQuery(q); err == nil || status != http.StatusBadRequest {
-		t.Fatalf("expected error when missing tz and city, got status=%d err=%v", status, err)
+	// missing lon triggers must provide error (no city either)
+	q = url.Values{"lat": []string{"0"}, "tz": []string{"UTC"}}
+	if _, err := resolveContextFromQuery(context.Background(), q); err == nil || asAPIError(err).status() != http.StatusBadRequest || asAPIError(err).Code != errCodeMissingLocation {
+		t.Fatalf("expected MISSING_LOCATION when missing lon and city, got err=%#v", err)
 	}
 }
 
@@ -598,7 +653,9 @@ func TestRootCmdFlagsAndPreRun(t *testing.T) {
 	config.LogJSON = false
 	config.LogQuiet = false
 
-	rootCmd.PersistentPreRun(rootCmd, []string{})
+	if err := rootCmd.PersistentPreRunE(rootCmd, []string{}); err != nil {
+		t.Fatalf("PersistentPreRunE: %v", err)
+	}
 
 	if config.LogLevel != "debug" {
 		t.Fatalf("config.LogLevel not updated, got %q", config.LogLevel)
@@ -642,13 +699,20 @@ func TestCoordsCmdRequiredFlags(t *testing.T) {
 	}
 }
 
-func TestCoordsCmdMissingTZ(t *testing.T) {
-	origTZ := coordsTZ
-	defer func() { coordsTZ = origTZ }()
-	coordsTZ = ""
+func TestCoordsCmdMissingTZInfers(t *testing.T) {
+	origTZ, origLat, origLon, origLoad := coordsTZ, coordsLat, coordsLon, app.loadTZ
+	defer func() {
+		coordsTZ, coordsLat, coordsLon, app.loadTZ = origTZ, origLat, origLon, origLoad
+	}()
+	coordsTZ, coordsLat, coordsLon = "", 43.8, 87.6
+	var loaded []string
+	app.loadTZ = func(id string) (*time.Location, error) {
+		loaded = append(loaded, id)
+		return nil, fmt.Errorf("mock tz load fail")
+	}
 	err := coordsCmd.RunE(coordsCmd, []string{"Dummy"})
-	if err == nil || !strings.Contains(err.Error(), "--tz 必须指定") {
-		t.Fatalf("expected missing tz error, got %v", err)
+	if err == nil || !strings.Contains(err.Error(), "加载推断时区失败 (Asia/Urumqi)") {
+		t.Fatalf("expected inferred tz to be loaded, got %v (loaded %v)", err, loaded)
 	}
 }
 
@@ -1151,7 +1215,7 @@ func TestWriteAstroJSONAndReadBack(t *testing.T) {
 
 	tmpDir := t.TempDir()
 	filePath := filepath.Join(tmpDir, "astro.json")
-	out, err := writeAstroJSON("TestCity", now, data, "test range", filePath, true)
+	out, err := writeAstroJSON("TestCity", observerElevation{}, now, data, "test range", filePath, true)
 	if err != nil {
 		t.Fatalf("writeAstroJSON error: %v", err)
 	}
@@ -1208,7 +1272,7 @@ func TestWriteAstroCSV(t *testing.T) {
 
 	tmpDir := t.TempDir()
 	filePath := filepath.Join(tmpDir, "astro.csv")
-	out, err := writeAstroCSV("TestCity", now, data, "test range", filePath, true)
+	out, err := writeAstroCSV("TestCity", observerElevation{}, now, data, "test range", filePath, true)
 	if err != nil {
 		t.Fatalf("writeAstroCSV error: %v", err)
 	}
@@ -1256,7 +1320,7 @@ func TestWriteAstroTxt(t *testing.T) {
 
 	tmpDir := t.TempDir()
 	filePath := filepath.Join(tmpDir, "astro.txt")
-	out, err := writeAstroTxt("TestCity", now, data, "test range", filePath, true)
+	out, err := writeAstroTxt("TestCity", observerElevation{}, now, data, "test range", filePath, true)
 	if err != nil {
 		t.Fatalf("writeAstroTxt error: %v", err)
 	}
@@ -1301,7 +1365,7 @@ func TestWriteAstroExcel(t *testing.T) {
 
 	tmpDir := t.TempDir()
 	filePath := filepath.Join(tmpDir, "astro.xlsx")
-	out, err := writeAstroExcel("TestCity", now, data, "test range", filePath, true)
+	out, err := writeAstroExcel("TestCity", observerElevation{}, now, data, "test range", filePath, true)
 	if err != nil {
 		t.Fatalf("writeAstroExcel error: %v", err)
 	}
@@ -1338,12 +1402,12 @@ func TestWriteAstroFile(t *testing.T) {
 	}
 
 	// 测试不同格式
-	formats := []string{"txt", "csv", "json", "excel"}
+	formats := []string{"txt", "csv", "json", "excel", "ics"}
 	for _, format := range formats {
 		tmpDir := t.TempDir()
 		filePath := filepath.Join(tmpDir, "astro."+format)
 
-		out, err := writeAstroFile(format, true, "", "TestCity", now, data, "test range", filePath[:len(filePath)-len(format)-1])
+		out, err := writeAstroFile(format, true, "", "TestCity", observerElevation{}, now, data, "test range", filePath[:len(filePath)-len(format)-1])
 
 		if err != nil {
 			t.Errorf("writeAstroFile with format %s error: %v", format, err)
@@ -1377,7 +1441,7 @@ func TestWriteAstroFileWithOutDir(t *testing.T) {
 		},
 	}
 	outDir := t.TempDir()
-	out, err := writeAstroFile("json", true, outDir, "TestCity", now, data, "test range", "TestCity-2025-01-01")
+	out, err := writeAstroFile("json", true, outDir, "TestCity", observerElevation{}, now, data, "test range", "TestCity-2025-01-01")
 	if err != nil {
 		t.Fatalf("writeAstroFile with outdir error: %v", err)
 	}
@@ -1457,6 +1521,20 @@ func TestRadToDeg(t *testing.T) {
 // ----------- 缓存相关函数测试 -----------
 //
 
+// TestCoordsCacheStaysInTestHome 坐标反查写入的缓存应落在 TestMain 的临时 HOME 中，而不是真实用户目录。
+func TestCoordsCacheStaysInTestHome(t *testing.T) {
+	if got := cacheFilePath(); !strings.HasPrefix(got, testHome+string(filepath.Separator)) {
+		t.Fatalf("cacheFilePath() = %q, want under %q", got, testHome)
+	}
+	q := url.Values{"lat": {"12.34"}, "lon": {"56.78"}, "tz": {"UTC"}}
+	if _, err := resolveContextFromQuery(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loadCache().Reverse["12.34,56.78"]; !ok {
+		t.Errorf("reverse entry not written to %s", cacheFilePath())
+	}
+}
+
 // TestCacheFilePath 测试cacheFilePath函数
 func TestCacheFilePath(t *testing.T) {
 	// 保存原始HOME环境变量
@@ -1828,8 +1906,8 @@ func TestAstroAPIHandlerInvalidCoords(t *testing.T) {
 		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
 	}
 
-	// 缺少时区
-	req = httptest.NewRequest("GET", "/api/astro?lat=0&lon=0&mode=year", nil)
+	// 缺少经度（时区可选，缺少时按坐标推断）
+	req = httptest.NewRequest("GET", "/api/astro?lat=0&tz=UTC&mode=year", nil)
 	w = httptest.NewRecorder()
 
 	astroAPIHandler(w, req)
@@ -1915,25 +1993,25 @@ func TestCacheSubCommands(t *testing.T) {
 // 测试各种输出格式函数的错误处理
 func TestOutputFunctionsErrorHandling(t *testing.T) {
 	// 测试writeAstroTxt错误处理（尝试写入无效路径）
-	_, err := writeAstroTxt("TestCity", time.Now(), []dailyAstro{}, "test", "/invalid/path/test.txt", false)
+	_, err := writeAstroTxt("TestCity", observerElevation{}, time.Now(), []dailyAstro{}, "test", "/invalid/path/test.txt", false)
 	if err == nil {
 		t.Error("writeAstroTxt should return error for invalid path")
 	}
 
 	// 测试writeAstroCSV错误处理
-	_, err = writeAstroCSV("TestCity", time.Now(), []dailyAstro{}, "test", "/invalid/path/test.csv", false)
+	_, err = writeAstroCSV("TestCity", observerElevation{}, time.Now(), []dailyAstro{}, "test", "/invalid/path/test.csv", false)
 	if err == nil {
 		t.Error("writeAstroCSV should return error for invalid path")
 	}
 
 	// 测试writeAstroJSON错误处理
-	_, err = writeAstroJSON("TestCity", time.Now(), []dailyAstro{}, "test", "/invalid/path/test.json", false)
+	_, err = writeAstroJSON("TestCity", observerElevation{}, time.Now(), []dailyAstro{}, "test", "/invalid/path/test.json", false)
 	if err == nil {
 		t.Error("writeAstroJSON should return error for invalid path")
 	}
 
 	// 测试writeAstroExcel错误处理
-	_, err = writeAstroExcel("TestCity", time.Now(), []dailyAstro{}, "test", "/invalid/path/test.xlsx", false)
+	_, err = writeAstroExcel("TestCity", observerElevation{}, time.Now(), []dailyAstro{}, "test", "/invalid/path/test.xlsx", false)
 	if err == nil {
 		t.Error("writeAstroExcel should return error for invalid path")
 	}
@@ -2069,7 +2147,7 @@ func TestWriteAstroFileFormats(t *testing.T) {
 
 	for _, format := range formats {
 		baseName := filepath.Join(tmpDir, "test")
-		out, err := writeAstroFile(format, true, "", "TestCity", now, data, "test range", baseName)
+		out, err := writeAstroFile(format, true, "", "TestCity", observerElevation{}, now, data, "test range", baseName)
 
 		// 检查结果
 		if err != nil {
@@ -3404,8 +3482,8 @@ func TestPrepareCity(t *testing.T) {
 		t.Errorf("prepareCity returned incorrect city: %s", ctx.City)
 	}
 
-	// 测试离线模式下不存在的城市
-	_, err = prepareCity("New York", true) // 离线模式
+	// 测试离线模式下缓存与内置城市库都没有的城市
+	_, err = prepareCity("Atlantis Nowhere", true) // 离线模式
 	if err == nil {
 		t.Error("prepareCity should return error for unknown city in offline mode")
 	}
@@ -3661,7 +3739,7 @@ func TestInitFunction(t *testing.T) {
 	}
 
 	// 验证子命令
-	subCommands := []string{"year", "day", "range", "coords", "tui", "serve", "cache"}
+	subCommands := []string{"year", "day", "range", "coords", "phases", "terms", "eclipses", "tui", "serve", "cache"}
 	for _, cmdName := range subCommands {
 		_, _, err := rootCmd.Find([]string{cmdName})
 		if err != nil {
@@ -3688,7 +3766,9 @@ func TestMainFunctionStructure(t *testing.T) {
 	logLevelFlag = "error"
 	logJSONFlag = true
 	logQuietFlag = true
-	rootCmd.PersistentPreRun(rootCmd, []string{})
+	if err := rootCmd.PersistentPreRunE(rootCmd, []string{}); err != nil {
+		t.Fatalf("PersistentPreRunE: %v", err)
+	}
 	if app.logger == nil {
 		t.Fatal("logger should be initialized in PersistentPreRun")
 	}
@@ -3699,3 +3779,3852 @@ func TestMainFunctionStructure(t *testing.T) {
 		t.Errorf("rootCmd Execute with --help returned error: %v", err)
 	}
 }
+
+//
+// ----------- 晨昏蒙影与黑夜时长 -----------
+//
+
+func TestGenerateAstroDataTwilight(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	start := time.Date(2025, 3, 20, 12, 0, 0, 0, loc)
+
+	data, err := generateAstroData("Beijing", 39.9042, 116.4074, loc, start, 1)
+	if err != nil {
+		t.Fatalf("generateAstroData error: %v", err)
+	}
+	d := data[0]
+	if !d.HasCivilDawn || !d.HasCivilDusk || !d.HasNauticalDawn || !d.HasNauticalDusk || !d.HasAstronomicalDawn || !d.HasAstronomicalDusk {
+		t.Fatalf("expected all twilight events at mid latitude: %+v", d)
+	}
+	// 晨光依次为 天文 < 航海 < 民用 < 日出，暮光顺序相反。
+	order := []string{d.AstronomicalDawn, d.NauticalDawn, d.CivilDawn, d.Sunrise, d.Sunset, d.CivilDusk, d.NauticalDusk, d.AstronomicalDusk}
+	for i := 1; i < len(order); i++ {
+		if order[i-1] >= order[i] {
+			t.Errorf("twilight order broken at %d: %v", i, order)
+		}
+	}
+	if d.DarknessMinutes < 8*60 || d.DarknessMinutes > 10*60 {
+		t.Errorf("DarknessMinutes = %d, want roughly 9h near equinox", d.DarknessMinutes)
+	}
+	if d.Darkness == "--" {
+		t.Errorf("Darkness should be formatted, got %q", d.Darkness)
+	}
+}
+
+func TestGenerateAstroDataTwilightPolar(t *testing.T) {
+	loc, _ := time.LoadLocation("UTC")
+
+	// 高纬度夏季：天文暮光不结束，黑夜时长为 0。
+	summer := time.Date(2025, 6, 21, 12, 0, 0, 0, loc)
+	data, err := generateAstroData("Tromso", 69.65, 18.96, loc, summer, 1)
+	if err != nil {
+		t.Fatalf("generateAstroData error: %v", err)
+	}
+	d := data[0]
+	if d.HasAstronomicalDusk || d.HasCivilDusk {
+		t.Errorf("expected no dusk in polar summer: %+v", d)
+	}
+	if d.DarknessMinutes != 0 || d.Darkness != "--" {
+		t.Errorf("expected zero darkness, got %d (%s)", d.DarknessMinutes, d.Darkness)
+	}
+
+	// 极点附近冬至：太阳全天低于 -18°，整日黑夜。
+	winter := time.Date(2025, 12, 21, 12, 0, 0, 0, loc)
+	data, err = generateAstroData("Pole", 85, 0, loc, winter, 1)
+	if err != nil {
+		t.Fatalf("generateAstroData error: %v", err)
+	}
+	if data[0].DarknessMinutes != 24*60 {
+		t.Errorf("DarknessMinutes = %d, want %d", data[0].DarknessMinutes, 24*60)
+	}
+}
+
+func TestWriteAstroCSVTwilightColumns(t *testing.T) {
+	loc, _ := time.LoadLocation("UTC")
+	now := time.Date(2025, 1, 2, 15, 4, 5, 0, loc)
+	data := []dailyAstro{{Date: "2025-01-01", CivilDawn: "05:30", AstronomicalDusk: "19:40", Darkness: "09:10", DarknessMinutes: 550}}
+
+	filePath := filepath.Join(t.TempDir(), "astro.csv")
+	if _, err := writeAstroCSV("TestCity", observerElevation{}, now, data, "", filePath, true); err != nil {
+		t.Fatalf("writeAstroCSV error: %v", err)
+	}
+	content, _ := os.ReadFile(filePath)
+	for _, want := range []string{"civil_dawn", "astronomical_dusk", "darkness_minutes", "05:30", "19:40", ",550"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("CSV missing %q", want)
+		}
+	}
+}
+
+//
+// ----------- 黄金时刻 / 蓝调时刻 -----------
+//
+
+func TestSunTimesAtAltitudeMatchesSunrise(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	day := time.Date(2025, 6, 1, 12, 0, 0, 0, loc)
+	times := suncalc.GetTimes(day, 39.9042, 116.4074)
+
+	rise, set := sunTimesAtAltitude(day, 39.9042, 116.4074, -0.833)
+	if d := rise.Sub(times[suncalc.Sunrise].Value); d > time.Minute || d < -time.Minute {
+		t.Errorf("sunrise mismatch: %v vs %v", rise, times[suncalc.Sunrise].Value)
+	}
+	if d := set.Sub(times[suncalc.Sunset].Value); d > time.Minute || d < -time.Minute {
+		t.Errorf("sunset mismatch: %v vs %v", set, times[suncalc.Sunset].Value)
+	}
+
+	// 夏季北京太阳到不了 80° 高度。
+	if r, s := sunTimesAtAltitude(day, 39.9042, 116.4074, 80); !r.IsZero() || !s.IsZero() {
+		t.Errorf("expected unreachable altitude to return zero times, got %v %v", r, s)
+	}
+}
+
+func TestGenerateAstroDataGoldenBlueHours(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	start := time.Date(2025, 3, 20, 12, 0, 0, 0, loc)
+	data, err := generateAstroData("Beijing", 39.9042, 116.4074, loc, start, 1)
+	if err != nil {
+		t.Fatalf("generateAstroData error: %v", err)
+	}
+	d := data[0]
+	if !d.HasGoldenHour || !d.HasBlueHour || d.GoldenHourAllDay || d.BlueHourAllDay {
+		t.Fatalf("unexpected golden/blue flags: %+v", d)
+	}
+	// 上午：蓝调始 < 蓝调终 = 黄金始 < 日出 < 黄金终；傍晚对称。
+	if !(d.BlueMorningStart < d.BlueMorningEnd && d.BlueMorningEnd == d.GoldenMorningStart &&
+		d.GoldenMorningStart < d.Sunrise && d.Sunrise < d.GoldenMorningEnd) {
+		t.Errorf("morning order broken: blue %s-%s golden %s-%s sunrise %s",
+			d.BlueMorningStart, d.BlueMorningEnd, d.GoldenMorningStart, d.GoldenMorningEnd, d.Sunrise)
+	}
+	if !(d.GoldenEveningStart < d.Sunset && d.Sunset < d.GoldenEveningEnd &&
+		d.GoldenEveningEnd == d.BlueEveningStart && d.BlueEveningStart < d.BlueEveningEnd) {
+		t.Errorf("evening order broken: golden %s-%s blue %s-%s sunset %s",
+			d.GoldenEveningStart, d.GoldenEveningEnd, d.BlueEveningStart, d.BlueEveningEnd, d.Sunset)
+	}
+}
+
+func TestGenerateAstroDataGoldenHourPolar(t *testing.T) {
+	loc, _ := time.LoadLocation("UTC")
+
+	// 近极点春分：太阳全天在 -4°~6° 之间徘徊，黄金时刻持续全天，蓝调时刻不出现。
+	equinox := time.Date(2025, 3, 20, 12, 0, 0, 0, loc)
+	data, err := generateAstroData("NearPole", 87, 0, loc, equinox, 1)
+	if err != nil {
+		t.Fatalf("generateAstroData error: %v", err)
+	}
+	if !data[0].GoldenHourAllDay || !data[0].HasGoldenHour {
+		t.Errorf("expected all-day golden hour: %+v", data[0])
+	}
+	if data[0].HasBlueHour {
+		t.Errorf("expected no blue hour: %+v", data[0])
+	}
+
+	// 极夜深处：太阳始终低于 -6°，两者都不出现。
+	winter := time.Date(2025, 12, 21, 12, 0, 0, 0, loc)
+	data, err = generateAstroData("Pole", 85, 0, loc, winter, 1)
+	if err != nil {
+		t.Fatalf("generateAstroData error: %v", err)
+	}
+	if data[0].HasGoldenHour || data[0].HasBlueHour || data[0].GoldenMorningStart != "--" {
+		t.Errorf("expected no golden/blue hour in polar night: %+v", data[0])
+	}
+}
+
+func TestGenerateAstroDataCustomPhotoBands(t *testing.T) {
+	loc, _ := time.LoadLocation("UTC")
+	ctx := &CityContext{City: "Eq", Lat: 0, Lon: 0, Loc: loc, Photo: &photoBands{
+		Golden: altitudeBand{Low: 0, High: 10},
+		Blue:   altitudeBand{Low: -8, High: -2},
+	}}
+	data, err := generateAstroDataFor(ctx, time.Date(2025, 3, 20, 12, 0, 0, 0, loc), 1)
+	if err != nil {
+		t.Fatalf("generateAstroDataFor error: %v", err)
+	}
+	// 赤道日出约 06:00，升到 10° 约需 40 分钟。
+	if data[0].GoldenMorningEnd < "06:30" || data[0].GoldenMorningEnd > "06:50" {
+		t.Errorf("GoldenMorningEnd = %s, want around 06:40", data[0].GoldenMorningEnd)
+	}
+
+	ctx.Photo = &photoBands{Golden: altitudeBand{Low: 6, High: -4}, Blue: defaultPhotoBands.Blue}
+	if _, err := generateAstroDataFor(ctx, time.Date(2025, 3, 20, 12, 0, 0, 0, loc), 1); err == nil {
+		t.Error("expected error for inverted golden band")
+	}
+}
+
+func TestAstroAPIHandlerPhotoBandParams(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/astro?lat=0&lon=0&tz=UTC&mode=day&date=2025-03-20&golden_high=10&golden_low=0", nil)
+	w := httptest.NewRecorder()
+	astroAPIHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var parsed astroAPIResponse
+	if err := json.NewDecoder(w.Body).Decode(&parsed); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if got := parsed.Data[0].GoldenMorningEnd; got < "06:30" || got > "06:50" {
+		t.Errorf("GoldenMorningEnd = %s, want around 06:40", got)
+	}
+
+	for _, bad := range []string{"golden_low=abc", "blue_low=0&blue_high=-5"} {
+		req = httptest.NewRequest("GET", "/api/astro?lat=0&lon=0&tz=UTC&mode=day&date=2025-03-20&"+bad, nil)
+		w = httptest.NewRecorder()
+		astroAPIHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", bad, w.Code)
+		}
+	}
+}
+
+//
+// ----------- 月相事件 -----------
+//
+
+func TestTruePhaseJDEMeeusExamples(t *testing.T) {
+	// Meeus 例 49.a：1977 年 2 月新月；例 49.b：2044 年 1 月下弦
+	cases := []struct {
+		k    float64
+		want float64
+	}{
+		{-283, 2443192.65118},
+		{544.75, 2467636.49186},
+	}
+	for _, c := range cases {
+		if got := truePhaseJDE(c.k); math.Abs(got-c.want) > 0.00005 {
+			t.Errorf("truePhaseJDE(%v) = %.5f, want %.5f", c.k, got, c.want)
+		}
+	}
+}
+
+func TestDeltaTSeconds(t *testing.T) {
+	if dt := deltaTSeconds(2000); math.Abs(dt-63.86) > 0.5 {
+		t.Errorf("deltaT(2000) = %.2f, want ~63.9", dt)
+	}
+	if dt := deltaTSeconds(2025); dt < 65 || dt > 75 {
+		t.Errorf("deltaT(2025) = %.2f, want ~70", dt)
+	}
+}
+
+func TestFindMoonPhases2024(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := findMoonPhases(from, from.AddDate(1, 0, 0))
+	if len(events) < 48 || len(events) > 51 {
+		t.Fatalf("len(events) = %d, want ~49", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if !events[i].Time.After(events[i-1].Time) {
+			t.Fatalf("events not sorted at %d", i)
+		}
+		if events[i].Kind != (events[i-1].Kind+1)%4 {
+			t.Errorf("event %d kind %v follows %v", i, events[i].Kind, events[i-1].Kind)
+		}
+	}
+	// 2024-01-11 11:57 UTC 新月，2024-01-25 17:54 UTC 满月
+	want := map[moonPhaseKind]time.Time{
+		phaseNewMoon:  time.Date(2024, 1, 11, 11, 57, 0, 0, time.UTC),
+		phaseFullMoon: time.Date(2024, 1, 25, 17, 54, 0, 0, time.UTC),
+	}
+	for kind, at := range want {
+		found := false
+		for _, e := range events[:8] {
+			if e.Kind == kind {
+				found = true
+				if d := e.Time.Sub(at); d < -2*time.Minute || d > 2*time.Minute {
+					t.Errorf("%s at %v, want %v", kind.Name(), e.Time, at)
+				}
+				break
+			}
+		}
+		if !found {
+			t.Errorf("%s not found in January 2024", kind.Name())
+		}
+	}
+
+	if got := findMoonPhases(from, from); got != nil {
+		t.Errorf("empty window should return nil, got %v", got)
+	}
+}
+
+func TestGenerateAstroDataPhaseEvent(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, loc)
+	data, err := generateAstroData("Beijing", 39.9, 116.4, loc, start, 31)
+	if err != nil {
+		t.Fatalf("generateAstroData error: %v", err)
+	}
+	marked := 0
+	for _, d := range data {
+		if d.PhaseEvent == "" {
+			if d.PhaseEventType != "" {
+				t.Errorf("%s: type %q without event", d.Date, d.PhaseEventType)
+			}
+			continue
+		}
+		marked++
+		if d.Date == "2024-01-26" && (d.PhaseEventType != "full_moon" || !strings.HasPrefix(d.PhaseEvent, "满月 01:5")) {
+			t.Errorf("2024-01-26 phase = %q (%s), want 满月 01:5x", d.PhaseEvent, d.PhaseEventType)
+		}
+	}
+	if marked != 4 {
+		t.Errorf("marked days = %d, want 4", marked)
+	}
+}
+
+func TestBuildPhasesDataModes(t *testing.T) {
+	ctx := &CityContext{City: "UTC", Loc: time.UTC, TZID: "UTC", Now: time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)}
+
+	events, _, err := buildPhasesData(ctx, "year", "", "", "")
+	if err != nil || len(events) < 48 {
+		t.Fatalf("year: len=%d err=%v", len(events), err)
+	}
+	events, desc, err := buildPhasesData(ctx, "day", "2024-01-25", "", "")
+	if err != nil || len(events) != 1 || events[0].Kind != phaseFullMoon {
+		t.Fatalf("day: events=%v err=%v", events, err)
+	}
+	if !strings.Contains(desc, "2024-01-25") {
+		t.Errorf("day desc = %q", desc)
+	}
+	events, _, err = buildPhasesData(ctx, "range", "", "2024-01-01", "2024-01-31")
+	if err != nil || len(events) != 4 {
+		t.Fatalf("range: len=%d err=%v", len(events), err)
+	}
+
+	bad := [][4]string{
+		{"day", "", "", ""},
+		{"day", "2024/01/01", "", ""},
+		{"range", "", "2024-01-01", ""},
+		{"range", "", "2024-02-01", "2024-01-01"},
+		{"week", "", "", ""},
+	}
+	for _, b := range bad {
+		if _, _, err := buildPhasesData(ctx, b[0], b[1], b[2], b[3]); err == nil {
+			t.Errorf("buildPhasesData(%v) expected error", b)
+		}
+	}
+}
+
+func TestWriteMoonPhasesFormats(t *testing.T) {
+	ctx := &CityContext{City: "Beijing", Loc: time.FixedZone("CST", 8*3600), TZID: "Asia/Shanghai", Now: time.Now()}
+	events := []moonPhaseEvent{{Kind: phaseFullMoon, Time: time.Date(2024, 1, 25, 17, 54, 0, 0, time.UTC)}}
+
+	var buf bytes.Buffer
+	if err := writeMoonPhases(&buf, "txt", ctx, events, "desc"); err != nil {
+		t.Fatalf("txt error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "2024-01-26\t01:54\t满月") {
+		t.Errorf("txt output = %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := writeMoonPhases(&buf, "csv", ctx, events, "desc"); err != nil {
+		t.Fatalf("csv error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "full_moon,满月,2024-01-26,01:54,") {
+		t.Errorf("csv output = %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := writeMoonPhases(&buf, "json", ctx, events, "desc"); err != nil {
+		t.Fatalf("json error: %v", err)
+	}
+	var parsed phasesAPIResponse
+	if err := json.Unmarshal(buf.Bytes(), &parsed); err != nil {
+		t.Fatalf("json decode error: %v", err)
+	}
+	if len(parsed.Events) != 1 || parsed.Events[0].Time != "2024-01-26T01:54:00+08:00" {
+		t.Errorf("json events = %+v", parsed.Events)
+	}
+}
+
+func TestPhasesAPIHandler(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/phases?lat=0&lon=0&tz=UTC&mode=range&from=2024-01-01&to=2024-01-31", nil)
+	w := httptest.NewRecorder()
+	phasesAPIHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var parsed phasesAPIResponse
+	if err := json.NewDecoder(w.Body).Decode(&parsed); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if parsed.Mode != "range" || len(parsed.Events) != 4 {
+		t.Errorf("mode=%s events=%d", parsed.Mode, len(parsed.Events))
+	}
+
+	for _, bad := range []string{"lat=0&lon=0&tz=UTC&mode=day", "lat=0&lon=0&tz=UTC&mode=bogus", "mode=year"} {
+		req = httptest.NewRequest("GET", "/api/phases?"+bad, nil)
+		w = httptest.NewRecorder()
+		phasesAPIHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", bad, w.Code)
+		}
+	}
+}
+
+//
+// ----------- 二分二至与二十四节气 -----------
+//
+
+func TestApparentSolarLongitudeMeeus(t *testing.T) {
+	// Meeus 例 25.b：1992-10-13 0h TD，视黄经 199°54′21.818″
+	got := apparentSolarLongitude(2448908.5)
+	want := 199 + 54.0/60 + 21.818/3600
+	if math.Abs(got-want) > 0.001 {
+		t.Errorf("apparentSolarLongitude = %.5f, want %.5f", got, want)
+	}
+}
+
+func TestSolarTermsInYear2024(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	events := solarTermsInYear(2024, loc)
+	if len(events) != 24 {
+		t.Fatalf("len(events) = %d, want 24", len(events))
+	}
+	if events[0].Term.Name != "小寒" || events[23].Term.Name != "冬至" {
+		t.Errorf("first/last = %s/%s, want 小寒/冬至", events[0].Term.Name, events[23].Term.Name)
+	}
+	want := map[string]time.Time{
+		"立春": time.Date(2024, 2, 4, 16, 27, 0, 0, loc),
+		"春分": time.Date(2024, 3, 20, 11, 6, 0, 0, loc),
+		"夏至": time.Date(2024, 6, 21, 4, 51, 0, 0, loc),
+		"秋分": time.Date(2024, 9, 22, 20, 44, 0, 0, loc),
+		"冬至": time.Date(2024, 12, 21, 17, 21, 0, 0, loc),
+	}
+	for _, e := range events {
+		at, ok := want[e.Term.Name]
+		if !ok {
+			continue
+		}
+		if d := e.Time.Sub(at); d < -2*time.Minute || d > 2*time.Minute {
+			t.Errorf("%s at %v, want %v", e.Term.Name, e.Time.In(loc), at)
+		}
+		delete(want, e.Term.Name)
+	}
+	if len(want) != 0 {
+		t.Errorf("missing terms: %v", want)
+	}
+	if got := findSolarTerms(time.Now(), time.Now().Add(-time.Hour)); got != nil {
+		t.Errorf("empty window should return nil")
+	}
+}
+
+func TestGenerateAstroDataSolarTerm(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	start := time.Date(2024, 12, 20, 12, 0, 0, 0, loc)
+	data, err := generateAstroData("Beijing", 39.9, 116.4, loc, start, 3)
+	if err != nil {
+		t.Fatalf("generateAstroData error: %v", err)
+	}
+	if data[0].SolarTerm != "" || data[2].SolarTerm != "" {
+		t.Errorf("unexpected solar terms: %q %q", data[0].SolarTerm, data[2].SolarTerm)
+	}
+	if !strings.HasPrefix(data[1].SolarTerm, "冬至 17:2") {
+		t.Errorf("2024-12-21 solar term = %q, want 冬至 17:2x", data[1].SolarTerm)
+	}
+}
+
+func TestBuildTermsDataAndWriter(t *testing.T) {
+	ctx := &CityContext{City: "Beijing", Loc: time.FixedZone("CST", 8*3600), TZID: "Asia/Shanghai", Now: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}
+	events, year, desc, err := buildTermsData(ctx, 0)
+	if err != nil || year != 2024 || len(events) != 24 || !strings.Contains(desc, "2024") {
+		t.Fatalf("buildTermsData: year=%d len=%d desc=%q err=%v", year, len(events), desc, err)
+	}
+	if _, _, _, err := buildTermsData(ctx, 1800); err == nil {
+		t.Error("expected out-of-range year error")
+	}
+
+	var buf bytes.Buffer
+	if err := writeSolarTerms(&buf, "csv", ctx, year, events, desc); err != nil {
+		t.Fatalf("csv error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "冬至,dongzhi,270,2024-12-21,17:2") {
+		t.Errorf("csv output missing 冬至: %q", buf.String())
+	}
+	buf.Reset()
+	if err := writeSolarTerms(&buf, "txt", ctx, year, events, desc); err != nil {
+		t.Fatalf("txt error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "2024-02-04\t16:2") || !strings.Contains(buf.String(), "立春\t315") {
+		t.Errorf("txt output missing 立春: %q", buf.String())
+	}
+	buf.Reset()
+	if err := writeSolarTerms(&buf, "json", ctx, year, events, desc); err != nil {
+		t.Fatalf("json error: %v", err)
+	}
+	var parsed termsAPIResponse
+	if err := json.Unmarshal(buf.Bytes(), &parsed); err != nil || parsed.Year != 2024 || len(parsed.Terms) != 24 {
+		t.Errorf("json: year=%d terms=%d err=%v", parsed.Year, len(parsed.Terms), err)
+	}
+}
+
+func TestTermsAPIHandler(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/terms?lat=39.9&lon=116.4&tz=Asia/Shanghai&year=2025", nil)
+	w := httptest.NewRecorder()
+	termsAPIHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var parsed termsAPIResponse
+	if err := json.NewDecoder(w.Body).Decode(&parsed); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if parsed.Year != 2025 || len(parsed.Terms) != 24 || parsed.Terms[23].Date != "2025-12-21" {
+		t.Errorf("year=%d terms=%d", parsed.Year, len(parsed.Terms))
+	}
+
+	for _, bad := range []string{"lat=0&lon=0&tz=UTC&year=abc", "lat=0&lon=0&tz=UTC&year=3000", "year=2025"} {
+		req = httptest.NewRequest("GET", "/api/terms?"+bad, nil)
+		w = httptest.NewRecorder()
+		termsAPIHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", bad, w.Code)
+		}
+	}
+}
+
+//
+// ----------- 农历 -----------
+//
+
+func TestSolarToLunar(t *testing.T) {
+	cases := []struct {
+		date   string
+		want   lunarDate
+		ganzhi string
+		zodiac string
+		text   string
+	}{
+		{"1900-01-31", lunarDate{1900, 1, 1, false}, "庚子", "鼠", "正月初一"},
+		{"2020-05-23", lunarDate{2020, 4, 1, true}, "庚子", "鼠", "闰四月初一"},
+		{"2023-03-22", lunarDate{2023, 2, 1, true}, "癸卯", "兔", "闰二月初一"},
+		{"2024-02-09", lunarDate{2023, 12, 30, false}, "癸卯", "兔", "腊月三十"},
+		{"2024-02-10", lunarDate{2024, 1, 1, false}, "甲辰", "龙", "正月初一"},
+		{"2024-12-31", lunarDate{2024, 12, 1, false}, "甲辰", "龙", "腊月初一"},
+		{"2025-01-29", lunarDate{2025, 1, 1, false}, "乙巳", "蛇", "正月初一"},
+		{"2025-07-25", lunarDate{2025, 6, 1, true}, "乙巳", "蛇", "闰六月初一"},
+		{"2025-10-06", lunarDate{2025, 8, 15, false}, "乙巳", "蛇", "八月十五"},
+	}
+	for _, c := range cases {
+		day, _ := time.Parse("2006-01-02", c.date)
+		got, err := lunarDateOf(day)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", c.date, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: got %+v, want %+v", c.date, got, c.want)
+		}
+		if got.GanZhiYear() != c.ganzhi || got.Zodiac() != c.zodiac || got.String() != c.text {
+			t.Errorf("%s: got %s/%s/%s, want %s/%s/%s", c.date, got.GanZhiYear(), got.Zodiac(), got.String(), c.ganzhi, c.zodiac, c.text)
+		}
+	}
+
+	for _, bad := range []string{"1900-01-30", "2101-06-01"} {
+		day, _ := time.Parse("2006-01-02", bad)
+		if _, err := lunarDateOf(day); err == nil {
+			t.Errorf("%s: expected out-of-range error", bad)
+		}
+		if s := lunarSummary(day); s != "" {
+			t.Errorf("%s: lunarSummary = %q, want empty", bad, s)
+		}
+	}
+	if s := lunarSummary(time.Date(2025, 1, 29, 0, 0, 0, 0, time.UTC)); s != "乙巳年（蛇）正月初一" {
+		t.Errorf("lunarSummary = %q", s)
+	}
+}
+
+func TestGenerateAstroDataLunarFields(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	start := time.Date(2025, 1, 28, 12, 0, 0, 0, loc)
+	data, err := generateAstroData("Beijing", 39.9, 116.4, loc, start, 2)
+	if err != nil {
+		t.Fatalf("generateAstroData error: %v", err)
+	}
+	if data[0].LunarDate != "腊月廿九" || data[0].GanZhiYear != "甲辰" || data[0].Zodiac != "龙" {
+		t.Errorf("day0 lunar = %s %s %s", data[0].LunarDate, data[0].GanZhiYear, data[0].Zodiac)
+	}
+	if data[1].LunarDate != "正月初一" || data[1].LunarYear != 2025 || data[1].LunarMonth != 1 || data[1].LunarDay != 1 || data[1].Zodiac != "蛇" {
+		t.Errorf("day1 lunar = %+v", data[1])
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lunar.csv")
+	if _, err := writeAstroCSV("Beijing", observerElevation{}, start, data, "desc", path, true); err != nil {
+		t.Fatalf("writeAstroCSV error: %v", err)
+	}
+	content, _ := os.ReadFile(path)
+	if !strings.Contains(string(content), "lunar_date,ganzhi_year,zodiac") || !strings.Contains(string(content), "正月初一,乙巳,蛇") {
+		t.Errorf("CSV missing lunar columns: %s", content)
+	}
+}
+
+func TestBuildLivePositionsLunar(t *testing.T) {
+	origNow := app.now
+	defer func() { app.now = origNow }()
+	loc := time.FixedZone("CST", 8*3600)
+	// UTC 仍是 1 月 28 日，当地已是正月初一
+	app.now = func() time.Time { return time.Date(2025, 1, 28, 17, 0, 0, 0, time.UTC) }
+
+	resp := buildLivePositions(&CityContext{City: "Beijing", TZID: "Asia/Shanghai", Loc: loc, Lat: 39.9, Lon: 116.4})
+	if resp.LunarDate != "正月初一" || resp.GanZhi != "乙巳" || resp.Zodiac != "蛇" {
+		t.Errorf("live lunar = %s %s %s", resp.LunarDate, resp.GanZhi, resp.Zodiac)
+	}
+}
+
+func TestTuiLunarPreview(t *testing.T) {
+	m := newTuiModel(&CityCache{Entries: map[string]CityCacheEntry{}})
+	m.step = stepDayInput
+	m.input = "2025-01-29"
+	if !strings.Contains(m.View(), "农历：乙巳年（蛇）正月初一") {
+		t.Errorf("View should preview lunar date, got %q", m.View())
+	}
+	m.input = "2025-01"
+	if strings.Contains(m.View(), "农历：") {
+		t.Error("incomplete date should not show lunar preview")
+	}
+}
+
+//
+// ----------- 日食与月食 -----------
+//
+
+func TestMoonGeocentricMeeus(t *testing.T) {
+	// Meeus 例 47.a：1992-04-12 0h TD
+	lon, lat, dist := moonGeocentric(2448724.5)
+	if math.Abs(lon-133.162655) > 0.002 || math.Abs(lat+3.229126) > 0.002 || math.Abs(dist-368409.7) > 5 {
+		t.Errorf("moonGeocentric = %.6f, %.6f, %.1f", lon, lat, dist)
+	}
+}
+
+func TestEclipseAtLunationMeeus(t *testing.T) {
+	// Meeus 例 54.a：1993-05-21 日偏食
+	e, ok := eclipseAtLunation(-82)
+	if !ok {
+		t.Fatal("expected eclipse at k=-82")
+	}
+	want := jdeToTime(2449129.0979)
+	if d := e.Greatest.Sub(want); d < -time.Minute || d > time.Minute {
+		t.Errorf("greatest = %v, want %v", e.Greatest, want)
+	}
+	if e.Kind != eclipseSolar || e.GlobalType != "partial" {
+		t.Errorf("kind/type = %s/%s", e.Kind, e.GlobalType)
+	}
+	if math.Abs(e.Gamma-1.1348) > 0.0005 || math.Abs(e.U-0.0097) > 0.0005 || math.Abs(e.Magnitude-0.740) > 0.002 {
+		t.Errorf("gamma=%.4f u=%.4f mag=%.3f", e.Gamma, e.U, e.Magnitude)
+	}
+	if _, ok := eclipseAtLunation(-81); ok {
+		t.Error("k=-81 should have no eclipse")
+	}
+}
+
+func TestFindEclipses2024to2025(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := findEclipses(from, from.AddDate(2, 0, 0))
+	want := []struct {
+		date, kind, typ string
+	}{
+		{"2024-03-25", eclipseLunar, "penumbral"},
+		{"2024-04-08", eclipseSolar, "total"},
+		{"2024-09-18", eclipseLunar, "partial"},
+		{"2024-10-02", eclipseSolar, "annular"},
+		{"2025-03-14", eclipseLunar, "total"},
+		{"2025-03-29", eclipseSolar, "partial"},
+		{"2025-09-07", eclipseLunar, "total"},
+		{"2025-09-21", eclipseSolar, "partial"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("len(events) = %d, want %d", len(events), len(want))
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Greatest.Format("2006-01-02") != w.date || e.Kind != w.kind || e.GlobalType != w.typ {
+			t.Errorf("event %d = %s %s %s, want %s %s %s", i, e.Greatest.Format("2006-01-02"), e.Kind, e.GlobalType, w.date, w.kind, w.typ)
+		}
+	}
+	// 2024-04-08 全球食甚 18:17:21 UTC
+	if d := events[1].Greatest.Sub(time.Date(2024, 4, 8, 18, 17, 21, 0, time.UTC)); d < -3*time.Minute || d > 3*time.Minute {
+		t.Errorf("2024-04-08 greatest = %v", events[1].Greatest)
+	}
+	if findEclipses(from, from) != nil {
+		t.Error("empty window should return nil")
+	}
+}
+
+func TestLocalSolarEclipseDallas2024(t *testing.T) {
+	from := time.Date(2024, 4, 8, 0, 0, 0, 0, time.UTC)
+	events := findLocalEclipses(from, from.AddDate(0, 0, 1), 32.7767, -96.797)
+	if len(events) != 1 {
+		t.Fatalf("len(events) = %d, want 1", len(events))
+	}
+	l := events[0].Local
+	if l.Type != "total" || !l.Visible {
+		t.Fatalf("local type = %s visible = %v", l.Type, l.Visible)
+	}
+	// NASA：C1 17:23:11、C2 18:40:43、C3 18:44:35、C4 20:02:39 UTC
+	checks := []struct {
+		name string
+		got  time.Time
+		want time.Time
+	}{
+		{"C1", l.PartialStart, time.Date(2024, 4, 8, 17, 23, 11, 0, time.UTC)},
+		{"C2", l.TotalStart, time.Date(2024, 4, 8, 18, 40, 43, 0, time.UTC)},
+		{"C3", l.TotalEnd, time.Date(2024, 4, 8, 18, 44, 35, 0, time.UTC)},
+		{"C4", l.PartialEnd, time.Date(2024, 4, 8, 20, 2, 39, 0, time.UTC)},
+	}
+	for _, c := range checks {
+		if d := c.got.Sub(c.want); d < -90*time.Second || d > 90*time.Second {
+			t.Errorf("%s = %v, want %v", c.name, c.got.UTC(), c.want)
+		}
+	}
+	if l.Magnitude < 1 || l.Obscuration != 1 {
+		t.Errorf("magnitude = %.3f obscuration = %.3f", l.Magnitude, l.Obscuration)
+	}
+	if l.SunAltitude < 60 || l.SunAltitude > 68 {
+		t.Errorf("sun altitude = %.1f, want ~64", l.SunAltitude)
+	}
+}
+
+func TestLocalSolarEclipseNotVisible(t *testing.T) {
+	from := time.Date(2024, 4, 8, 0, 0, 0, 0, time.UTC)
+	events := findLocalEclipses(from, from.AddDate(0, 0, 1), 39.9, 116.4)
+	if len(events) != 1 {
+		t.Fatalf("len(events) = %d, want 1", len(events))
+	}
+	l := events[0].Local
+	if l.Type != "none" || l.Visible || !l.PartialStart.IsZero() || !l.Maximum.IsZero() {
+		t.Errorf("Beijing should not see 2024-04-08 eclipse: %+v", l)
+	}
+	s, e := events[0].span()
+	if !s.Equal(events[0].Greatest) || !e.Equal(events[0].Greatest) {
+		t.Errorf("span should fall back to greatest, got %v ~ %v", s, e)
+	}
+}
+
+func TestLocalLunarEclipseBeijing2025(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	from := time.Date(2025, 9, 7, 0, 0, 0, 0, time.UTC)
+	events := findLocalEclipses(from, from.AddDate(0, 0, 2), 39.9, 116.4)
+	if len(events) != 1 {
+		t.Fatalf("len(events) = %d, want 1", len(events))
+	}
+	e := events[0]
+	l := e.Local
+	if e.Kind != eclipseLunar || l.Type != "total" || !l.Visible {
+		t.Fatalf("kind=%s type=%s visible=%v", e.Kind, l.Type, l.Visible)
+	}
+	if l.MoonAltitude < 20 || l.SunAltitude > -18 {
+		t.Errorf("moon alt = %.1f sun alt = %.1f", l.MoonAltitude, l.SunAltitude)
+	}
+	// 全食阶段约 17:30 ~ 18:53 UTC
+	if d := l.TotalStart.Sub(time.Date(2025, 9, 7, 17, 30, 0, 0, time.UTC)); d < -5*time.Minute || d > 5*time.Minute {
+		t.Errorf("U2 = %v", l.TotalStart.UTC())
+	}
+	if d := l.TotalEnd.Sub(time.Date(2025, 9, 7, 18, 53, 0, 0, time.UTC)); d < -5*time.Minute || d > 5*time.Minute {
+		t.Errorf("U3 = %v", l.TotalEnd.UTC())
+	}
+	j := e.toJSON(loc)
+	if j.Date != "2025-09-08" || j.Title != "月全食" || j.PenumbralStart == "" || j.Obscuration != 0 {
+		t.Errorf("json = %+v", j)
+	}
+
+	// 同一次月食在纽约为白天，不可见
+	ny := findLocalEclipses(from, from.AddDate(0, 0, 2), 40.71, -74.0)
+	if len(ny) != 1 || ny[0].Local.Visible {
+		t.Errorf("New York should not see 2025-09-07 lunar eclipse")
+	}
+}
+
+func TestDiskOverlapFraction(t *testing.T) {
+	if f := diskOverlapFraction(1, 1, 2); f != 0 {
+		t.Errorf("separate disks overlap = %v", f)
+	}
+	if f := diskOverlapFraction(1, 1.1, 0); f != 1 {
+		t.Errorf("covered disk overlap = %v", f)
+	}
+	if f := diskOverlapFraction(1, 0.9, 0); math.Abs(f-0.81) > 1e-9 {
+		t.Errorf("annular overlap = %v, want 0.81", f)
+	}
+	if f := diskOverlapFraction(1, 1, 1); f < 0.38 || f > 0.40 {
+		t.Errorf("half-offset overlap = %v, want ~0.391", f)
+	}
+}
+
+func TestEclipseTitle(t *testing.T) {
+	cases := map[[2]string]string{
+		{eclipseSolar, "total"}:     "日全食",
+		{eclipseSolar, "annular"}:   "日环食",
+		{eclipseSolar, "none"}:      "日食（本地不可见）",
+		{eclipseLunar, "partial"}:   "月偏食",
+		{eclipseLunar, "penumbral"}: "半影月食",
+	}
+	for in, want := range cases {
+		if got := eclipseTitle(in[0], in[1]); got != want {
+			t.Errorf("eclipseTitle(%v) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestICSHelpers(t *testing.T) {
+	if got := icsEscape("a,b;c\\d\ne"); got != `a\,b\;c\\d\ne` {
+		t.Errorf("icsEscape = %q", got)
+	}
+	long := "SUMMARY:" + strings.Repeat("日全食", 20)
+	folded := icsFoldLine(long)
+	for _, part := range strings.Split(folded, "\r\n") {
+		if len(part) > 75 {
+			t.Errorf("folded line too long: %d", len(part))
+		}
+	}
+	if strings.ReplaceAll(folded, "\r\n ", "") != long {
+		t.Error("unfolding should restore original line")
+	}
+
+	var buf bytes.Buffer
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := writeICS(&buf, "测试", start, time.UTC, []icsEvent{{UID: "x@esunmoon", Summary: "满月", Start: start}}); err != nil {
+		t.Fatalf("writeICS error: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{"BEGIN:VCALENDAR\r\n", "DTSTART:20250101T120000Z", "DTEND:20250101T120000Z", "SUMMARY:满月", "END:VCALENDAR\r\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("ICS missing %q", want)
+		}
+	}
+}
+
+func TestWriteEclipsesFormats(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	ctx := &CityContext{City: "Beijing", DisplayName: "北京", Lat: 39.9, Lon: 116.4, Loc: loc, TZID: "Asia/Shanghai", Now: time.Date(2025, 1, 1, 0, 0, 0, 0, loc)}
+	events, desc, err := buildEclipsesData(ctx, "range", "", "2025-01-01", "2025-12-31", true)
+	if err != nil {
+		t.Fatalf("buildEclipsesData error: %v", err)
+	}
+	if len(events) == 0 {
+		t.Fatal("expected visible eclipses in 2025 for Beijing")
+	}
+	for _, e := range events {
+		if !e.Local.Visible {
+			t.Errorf("visibleOnly returned invisible eclipse %v", e.Greatest)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeEclipses(&buf, "csv", ctx, events, desc); err != nil {
+		t.Fatalf("csv error: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "kind,title,global_type,local_type,visible") || !strings.Contains(buf.String(), "lunar,月全食,total,total,true,2025-09-08") {
+		t.Errorf("csv output = %q", buf.String())
+	}
+	buf.Reset()
+	if err := writeEclipses(&buf, "ics", ctx, events, desc); err != nil {
+		t.Fatalf("ics error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "SUMMARY:月全食") || !strings.Contains(buf.String(), "LOCATION:北京") {
+		t.Errorf("ics output = %q", buf.String())
+	}
+	buf.Reset()
+	if err := writeEclipses(&buf, "txt", ctx, events, desc); err != nil {
+		t.Fatalf("txt error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "2025-09-08\t月全食\t是\t02:") {
+		t.Errorf("txt output = %q", buf.String())
+	}
+	buf.Reset()
+	if err := writeEclipses(&buf, "json", ctx, events, desc); err != nil {
+		t.Fatalf("json error: %v", err)
+	}
+	var parsed eclipsesAPIResponse
+	if err := json.Unmarshal(buf.Bytes(), &parsed); err != nil || len(parsed.Eclipses) != len(events) || len(parsed.Notes) == 0 {
+		t.Errorf("json: err=%v eclipses=%d", err, len(parsed.Eclipses))
+	}
+}
+
+func TestEclipsesAPIHandler(t *testing.T) {
+	base := "/api/eclipses?lat=32.7767&lon=-96.797&tz=America/Chicago&mode=day&date=2024-04-08"
+	req := httptest.NewRequest("GET", base, nil)
+	w := httptest.NewRecorder()
+	eclipsesAPIHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var parsed eclipsesAPIResponse
+	if err := json.NewDecoder(w.Body).Decode(&parsed); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if len(parsed.Eclipses) != 1 || parsed.Eclipses[0].Type != "total" || !strings.HasPrefix(parsed.Eclipses[0].TotalStart, "2024-04-08T13:4") {
+		t.Errorf("eclipses = %+v", parsed.Eclipses)
+	}
+
+	for format, ct := range map[string]string{"csv": "text/csv", "ics": "text/calendar"} {
+		req = httptest.NewRequest("GET", base+"&format="+format, nil)
+		w = httptest.NewRecorder()
+		eclipsesAPIHandler(w, req)
+		if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), ct) {
+			t.Errorf("format=%s: status=%d content-type=%s", format, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+
+	for _, bad := range []string{base + "&format=xml", "/api/eclipses?lat=0&lon=0&tz=UTC&mode=range&from=2025-01-01", "/api/eclipses?mode=year"} {
+		req = httptest.NewRequest("GET", bad, nil)
+		w = httptest.NewRecorder()
+		eclipsesAPIHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", bad, w.Code)
+		}
+	}
+}
+
+//
+// ----------- 行星位置 -----------
+//
+
+func TestPlanetGeocentricVenusMeeus(t *testing.T) {
+	// Meeus 例 33.a / 41.a：1992-12-20 0h TD 金星
+	jde := 2448976.5
+	s := planetGeocentric(planetTable[1], jde)
+	tc := (jde - 2451545.0) / 36525
+	_, deps := nutation(tc)
+	ra, dec := eclipticToEquatorial(s.Lon, s.Lat, 23.4392911-0.0130042*tc+deps/3600)
+	raDeg := normalizeDeg(ra * 180 / math.Pi)
+	if math.Abs(raDeg-316.172725) > 0.03 || math.Abs(dec*180/math.Pi+18.888010) > 0.03 {
+		t.Errorf("venus ra/dec = %.5f, %.5f", raDeg, dec*180/math.Pi)
+	}
+	if math.Abs(s.Delta-0.910845) > 0.0005 || math.Abs(s.R-0.724604) > 0.0005 {
+		t.Errorf("venus delta/r = %.6f, %.6f", s.Delta, s.R)
+	}
+	if math.Abs(s.PhaseAngle-72.96) > 0.1 {
+		t.Errorf("venus phase angle = %.2f", s.PhaseAngle)
+	}
+	// 例 41.a 同时给出两套公式：Müller 旧式 -3.8，《天文年历》1984 式 -4.2（本实现）
+	if m := planetMagnitude("venus", s, tc); math.Abs(m+4.22) > 0.05 {
+		t.Errorf("venus magnitude = %.2f, want -4.2", m)
+	}
+}
+
+func TestPlanetMagnitudesAtOpposition(t *testing.T) {
+	cases := []struct {
+		idx  int
+		when time.Time
+		mag  float64
+		dist float64
+	}{
+		{2, time.Date(2020, 10, 6, 14, 0, 0, 0, time.UTC), -2.6, 0.4149}, // 火星近地点
+		{3, time.Date(2023, 11, 3, 5, 0, 0, 0, time.UTC), -2.9, 3.98},    // 木星冲日
+		{4, time.Date(2024, 9, 8, 4, 0, 0, 0, time.UTC), 0.6, 8.67},      // 土星冲日
+	}
+	for _, c := range cases {
+		jde := timeToJDE(c.when)
+		s := planetGeocentric(planetTable[c.idx], jde)
+		m := planetMagnitude(planetTable[c.idx].Key, s, (jde-2451545.0)/36525)
+		if math.Abs(m-c.mag) > 0.2 {
+			t.Errorf("%s magnitude = %.2f, want %.1f", planetTable[c.idx].Key, m, c.mag)
+		}
+		if math.Abs(s.Delta-c.dist)/c.dist > 0.01 {
+			t.Errorf("%s delta = %.4f, want %.4f", planetTable[c.idx].Key, s.Delta, c.dist)
+		}
+	}
+	if !math.IsNaN(planetMagnitude("pluto", planetState{R: 1, Delta: 1}, 0)) {
+		t.Error("unknown planet should return NaN")
+	}
+}
+
+func TestPlanetRiseSet(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	dayStart := time.Date(2025, 6, 1, 0, 0, 0, 0, loc)
+	for _, p := range planetTable {
+		rise, set := planetRiseSet(p, dayStart, 39.9, 116.4)
+		if rise.IsZero() && set.IsZero() {
+			t.Errorf("%s: expected rise or set at mid-latitude", p.Key)
+		}
+		for _, ev := range []time.Time{rise, set} {
+			if ev.IsZero() {
+				continue
+			}
+			if ev.Before(dayStart) || !ev.Before(dayStart.Add(24*time.Hour)) {
+				t.Errorf("%s event %v outside day", p.Key, ev)
+			}
+			if _, alt, _ := planetHorizontal(p, ev, 39.9, 116.4); math.Abs(alt-planetRiseSetAltitude) > 0.05 {
+				t.Errorf("%s altitude at event = %.3f", p.Key, alt)
+			}
+		}
+	}
+}
+
+func TestBuildPlanetPositionsAgreesWithSunConvention(t *testing.T) {
+	// 2020-12-21 木星土星大合：两者方位/高度应非常接近
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	now := time.Date(2020, 12, 21, 18, 0, 0, 0, loc)
+	list := buildPlanetPositions(now, 39.9, 116.4, loc)
+	if len(list) != 5 || list[0].Key != "mercury" || list[4].Name != "土星" {
+		t.Fatalf("planets = %+v", list)
+	}
+	j, s := list[3], list[4]
+	if math.Abs(j.AzimuthDeg-s.AzimuthDeg) > 0.3 || math.Abs(j.AltitudeDeg-s.AltitudeDeg) > 0.3 {
+		t.Errorf("jupiter %.2f/%.2f vs saturn %.2f/%.2f", j.AzimuthDeg, j.AltitudeDeg, s.AzimuthDeg, s.AltitudeDeg)
+	}
+	// 傍晚西南方低空（库定义方位：正南 0，西为正）
+	if j.AzimuthDeg < 20 || j.AzimuthDeg > 70 || j.AltitudeDeg < 5 || j.AltitudeDeg > 25 {
+		t.Errorf("jupiter az/alt = %.2f/%.2f", j.AzimuthDeg, j.AltitudeDeg)
+	}
+	if j.Rise == "" || j.Set == "--" || j.DistanceKm < 5e8 {
+		t.Errorf("jupiter = %+v", j)
+	}
+}
+
+func TestPositionsAPIHandlerIncludesPlanets(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/positions?lat=39.9&lon=116.4&tz=Asia/Shanghai", nil)
+	w := httptest.NewRecorder()
+	positionsAPIHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	var resp livePositionsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if len(resp.Planets) != len(planetTable) {
+		t.Fatalf("planets = %d, want %d", len(resp.Planets), len(planetTable))
+	}
+	for _, p := range resp.Planets {
+		if p.AzimuthText == "" || p.AltitudeDeg < -90 || p.AltitudeDeg > 90 || p.DistanceAU <= 0 {
+			t.Errorf("planet %+v", p)
+		}
+	}
+}
+
+//
+// ----------- ICS 日历导出 -----------
+//
+
+func TestICSOffset(t *testing.T) {
+	cases := map[int]string{28800: "+0800", -18000: "-0500", 19800: "+0530", 0: "+0000", 1172: "+001932"}
+	for in, want := range cases {
+		if got := icsOffset(in); got != want {
+			t.Errorf("icsOffset(%d) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTzTransitions(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, ny)
+	got := tzTransitions(ny, from, from.AddDate(1, 0, 0))
+	want := []time.Time{
+		time.Date(2025, 3, 9, 7, 0, 0, 0, time.UTC),
+		time.Date(2025, 11, 2, 6, 0, 0, 0, time.UTC),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("transitions = %v", got)
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("transition %d = %v, want %v", i, got[i].UTC(), want[i])
+		}
+	}
+
+	sh, _ := time.LoadLocation("Asia/Shanghai")
+	if tr := tzTransitions(sh, time.Date(2025, 1, 1, 0, 0, 0, 0, sh), time.Date(2026, 1, 1, 0, 0, 0, 0, sh)); len(tr) != 0 {
+		t.Errorf("Asia/Shanghai should have no transitions, got %v", tr)
+	}
+}
+
+func TestWriteICSWithVTimezone(t *testing.T) {
+	ny, _ := time.LoadLocation("America/New_York")
+	events := []icsEvent{
+		{UID: "a@esunmoon", Summary: "日出", Start: time.Date(2025, 3, 1, 6, 30, 0, 0, ny)},
+		{UID: "b@esunmoon", Summary: "日出", Start: time.Date(2025, 3, 20, 7, 10, 0, 0, ny)},
+	}
+	var buf bytes.Buffer
+	if err := writeICS(&buf, "NY", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), ny, events); err != nil {
+		t.Fatalf("writeICS error: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"BEGIN:VTIMEZONE\r\nTZID:America/New_York\r\n",
+		"BEGIN:STANDARD\r\nDTSTART:20250101T000000\r\nTZOFFSETFROM:-0500\r\nTZOFFSETTO:-0500\r\nTZNAME:EST\r\n",
+		"BEGIN:DAYLIGHT\r\nDTSTART:20250309T020000\r\nTZOFFSETFROM:-0500\r\nTZOFFSETTO:-0400\r\nTZNAME:EDT\r\n",
+		"DTSTART;TZID=America/New_York:20250301T063000",
+		"DTSTART;TZID=America/New_York:20250320T071000",
+		"X-WR-TIMEZONE:America/New_York",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("ICS missing %q", want)
+		}
+	}
+	// VTIMEZONE 仅覆盖事件范围，不应包含 11 月的回拨
+	if strings.Contains(out, "DTSTART:20251102") {
+		t.Error("VTIMEZONE should not extend past last event")
+	}
+	if strings.Index(out, "END:VTIMEZONE") > strings.Index(out, "BEGIN:VEVENT") {
+		t.Error("VTIMEZONE must precede VEVENT")
+	}
+}
+
+func TestParseICSEventTypes(t *testing.T) {
+	all, err := parseICSEventTypes("")
+	if err != nil || len(all) != len(astroICSEventTypes) {
+		t.Errorf("empty types = %v, %v", all, err)
+	}
+	if all2, _ := parseICSEventTypes("ALL"); len(all2) != len(astroICSEventTypes) {
+		t.Error("all should select every type")
+	}
+	some, err := parseICSEventTypes(" sunrise, phase ")
+	if err != nil || len(some) != 2 || !some["sunrise"] || !some["phase"] {
+		t.Errorf("types = %v, %v", some, err)
+	}
+	for _, bad := range []string{"sunrise,comet", ",,"} {
+		if _, err := parseICSEventTypes(bad); err == nil {
+			t.Errorf("parseICSEventTypes(%q) should fail", bad)
+		}
+	}
+}
+
+func TestAstroICSEvents(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	ctx := &CityContext{City: "Beijing", DisplayName: "北京", Lat: 39.9, Lon: 116.4, Loc: loc, TZID: "Asia/Shanghai"}
+	data, err := generateAstroDataFor(ctx, time.Date(2025, 1, 28, 0, 0, 0, 0, loc), 3)
+	if err != nil {
+		t.Fatalf("generateAstroDataFor error: %v", err)
+	}
+	all, _ := parseICSEventTypes("")
+	events := astroICSEvents("Beijing", loc, data, all)
+	counts := map[string]int{}
+	for _, e := range events {
+		counts[e.Summary]++
+		if !strings.HasSuffix(e.UID, "-beijing@esunmoon") || e.Location != "Beijing" {
+			t.Errorf("event = %+v", e)
+		}
+	}
+	if counts["日出"] != 3 || counts["日落"] != 3 || counts["新月"] != 1 {
+		t.Errorf("counts = %v", counts)
+	}
+
+	phaseOnly, _ := parseICSEventTypes("phase")
+	events = astroICSEvents("Beijing", loc, data, phaseOnly)
+	if len(events) != 1 || events[0].Summary != "新月" || events[0].Start.In(loc).Format("2006-01-02") != "2025-01-29" {
+		t.Errorf("phase events = %+v", events)
+	}
+	if _, ok := parseLocalClock("2025-01-01", "--", loc); ok {
+		t.Error("-- should not parse")
+	}
+}
+
+func TestWriteAstroFileICSRespectsConfig(t *testing.T) {
+	orig := config.ICSEvents
+	defer func() { config.ICSEvents = orig }()
+
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	now := time.Date(2025, 1, 28, 8, 0, 0, 0, loc)
+	data := []dailyAstro{{Date: "2025-01-28", Sunrise: "07:29", Sunset: "17:31", Moonrise: "--", Moonset: "16:02", MoonIllumFrac: "1.0%"}}
+
+	config.ICSEvents = "sunset"
+	out, err := writeAstroFile("ics", true, t.TempDir(), "Beijing", observerElevation{}, now, data, "", "beijing")
+	if err != nil {
+		t.Fatalf("writeAstroFile ics error: %v", err)
+	}
+	b, _ := os.ReadFile(out)
+	content := string(b)
+	if !strings.HasSuffix(out, ".ics") || !strings.Contains(content, "DTSTART;TZID=Asia/Shanghai:20250128T173100") || strings.Contains(content, "SUMMARY:日出") {
+		t.Errorf("ics content = %s", content)
+	}
+
+	config.ICSEvents = "bogus"
+	if _, err := writeAstroFile("ics", true, t.TempDir(), "Beijing", observerElevation{}, now, data, "", "beijing"); err == nil {
+		t.Error("unknown event type should fail")
+	}
+}
+
+func TestAstroAPIHandlerICS(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/astro.ics?lat=39.9&lon=116.4&tz=Asia/Shanghai&mode=range&from=2025-01-28&to=2025-01-30&events=phase,sunrise", nil)
+	w := httptest.NewRecorder()
+	astroAPIHandler(w, req)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("status = %d content-type = %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "SUMMARY:新月") || strings.Count(body, "SUMMARY:日出") != 3 || strings.Contains(body, "SUMMARY:月出") {
+		t.Errorf("body = %s", body)
+	}
+
+	req = httptest.NewRequest("GET", "/api/astro?lat=39.9&lon=116.4&tz=Asia/Shanghai&mode=day&date=2025-01-29&format=ics", nil)
+	w = httptest.NewRecorder()
+	astroAPIHandler(w, req)
+	if !strings.Contains(w.Body.String(), "BEGIN:VCALENDAR") {
+		t.Errorf("format=ics should return calendar, got %s", w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/api/astro.ics?lat=39.9&lon=116.4&tz=Asia/Shanghai&events=comet", nil)
+	w = httptest.NewRecorder()
+	astroAPIHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
+
+//
+// ----------- /api/astro 多格式下载 -----------
+//
+
+func TestNegotiateAstroFormat(t *testing.T) {
+	cases := map[string]string{
+		"":                                 "json",
+		"text/csv":                         "csv",
+		"text/plain;q=0.5, text/csv;q=0.9": "csv",
+		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": "excel",
+		"text/html, */*;q=0.1":                  "json",
+		"text/calendar, application/json;q=0.8": "ics",
+		"image/png":                             "json",
+		"text/csv;q=0, text/plain":              "txt",
+	}
+	for accept, want := range cases {
+		if got := negotiateAstroFormat(accept); got != want {
+			t.Errorf("negotiateAstroFormat(%q) = %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func TestNormalizeAstroFormat(t *testing.T) {
+	if f, ok := normalizeAstroFormat(" XLSX "); !ok || f != "excel" {
+		t.Errorf("xlsx -> %q, %v", f, ok)
+	}
+	if _, ok := normalizeAstroFormat("pdf"); ok {
+		t.Error("pdf should be unknown")
+	}
+}
+
+func TestAstroAPIHandlerFormats(t *testing.T) {
+	base := "/api/astro?lat=39.9&lon=116.4&tz=Asia/Shanghai&mode=day&date=2025-01-01&city=Beijing"
+	cases := []struct {
+		query, accept, contentType, filename, prefix string
+	}{
+		{"&format=csv", "", "text/csv", `attachment; filename=Beijing-2025-01-01.csv`, "city,Beijing"},
+		{"&format=txt", "", "text/plain", `attachment; filename=Beijing-2025-01-01.txt`, "# eSunMoon 城市天文数据：Beijing"},
+		{"&format=xlsx", "", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", `attachment; filename=Beijing-2025-01-01.xlsx`, "PK"},
+		{"", "text/csv", "text/csv", `attachment; filename=Beijing-2025-01-01.csv`, "city,Beijing"},
+		{"&format=json", "text/csv", "application/json", "", "{"},
+		{"", "", "application/json", "", "{"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", base+c.query, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		w := httptest.NewRecorder()
+		astroAPIHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s/%s: status = %d, body = %s", c.query, c.accept, w.Code, w.Body.String())
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, c.contentType) {
+			t.Errorf("%s/%s: content-type = %q", c.query, c.accept, ct)
+		}
+		if cd := w.Header().Get("Content-Disposition"); cd != c.filename {
+			t.Errorf("%s/%s: content-disposition = %q, want %q", c.query, c.accept, cd, c.filename)
+		}
+		if !strings.HasPrefix(w.Body.String(), c.prefix) {
+			t.Errorf("%s/%s: body prefix = %q", c.query, c.accept, w.Body.String()[:min(40, w.Body.Len())])
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("%s/%s: missing Vary: Accept", c.query, c.accept)
+		}
+	}
+
+	req := httptest.NewRequest("GET", base+"&format=pdf", nil)
+	w := httptest.NewRecorder()
+	astroAPIHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("format=pdf status = %d, want 400", w.Code)
+	}
+}
+
+func TestAstroContentDispositionNonASCII(t *testing.T) {
+	cd := astroContentDisposition("csv", "北京-2025-01-01")
+	if !strings.HasPrefix(cd, "attachment; filename*=utf-8''") || !strings.Contains(cd, "%E5%8C%97%E4%BA%AC") {
+		t.Errorf("content-disposition = %q", cd)
+	}
+	if cd := astroContentDisposition("ics", "Beijing-2025"); cd != "inline; filename=Beijing-2025.ics" {
+		t.Errorf("ics content-disposition = %q", cd)
+	}
+}
+
+func TestAstroWritersToWriter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	data := []dailyAstro{{Date: "2025-01-01", Sunrise: "07:00", Sunset: "17:00"}}
+	var buf bytes.Buffer
+	if err := writeAstroJSONTo(&buf, "TestCity", observerElevation{}, now, data, "desc"); err != nil {
+		t.Fatalf("writeAstroJSONTo error: %v", err)
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &parsed); err != nil || parsed["city"] != "TestCity" {
+		t.Errorf("json = %s, err = %v", buf.String(), err)
+	}
+	buf.Reset()
+	if err := writeAstroExcelTo(&buf, "TestCity", observerElevation{}, now, data, "desc"); err != nil || !bytes.HasPrefix(buf.Bytes(), []byte("PK")) {
+		t.Errorf("excel err = %v, prefix = %q", err, buf.Bytes()[:min(2, buf.Len())])
+	}
+}
+
+//
+// ----------- 地理编码多候选与消歧 -----------
+//
+
+const mockSpringfieldResponse = `[
+	{"lat":"39.7990","lon":"-89.6440","display_name":"Springfield, Sangamon County, Illinois, United States","name":"Springfield","class":"boundary","type":"administrative","addresstype":"city","importance":0.67,"address":{"country":"United States","country_code":"us","state":"Illinois"}},
+	{"lat":"37.2090","lon":"-93.2923","display_name":"Springfield, Greene County, Missouri, United States","name":"Springfield","class":"place","type":"city","importance":0.6,"address":{"country":"United States","country_code":"us","state":"Missouri"}},
+	{"lat":"-43.3333","lon":"171.9333","display_name":"Springfield, Selwyn District, Canterbury, New Zealand","name":"Springfield","class":"place","type":"village","importance":0.3,"address":{"country":"New Zealand","country_code":"nz","region":"Canterbury"}}
+]`
+
+func springfieldClient(gotQuery *url.Values) HTTPClient {
+	return &httpClientMock{
+		doFunc: func(req *http.Request) (*http.Response, error) {
+			if gotQuery != nil {
+				*gotQuery = req.URL.Query()
+			}
+			return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(mockSpringfieldResponse))}, nil
+		},
+	}
+}
+
+func TestGeocodeCandidates(t *testing.T) {
+	var q url.Values
+	cands, err := geocodeCandidates(context.Background(), springfieldClient(&q), "Springfield", "", 0)
+	if err != nil {
+		t.Fatalf("geocodeCandidates error: %v", err)
+	}
+	if q.Get("limit") != "10" || q.Get("addressdetails") != "1" || q.Has("countrycodes") {
+		t.Errorf("unexpected query: %v", q)
+	}
+	if len(cands) != 3 {
+		t.Fatalf("got %d candidates, want 3", len(cands))
+	}
+	first := cands[0]
+	if first.Country != "United States" || first.CountryCode != "us" || first.AdminArea != "Illinois" || first.Type != "city" || first.Importance != 0.67 {
+		t.Errorf("first candidate = %+v", first)
+	}
+	if cands[1].Type != "city" || cands[2].AdminArea != "Canterbury" {
+		t.Errorf("type/admin fallback wrong: %+v / %+v", cands[1], cands[2])
+	}
+
+	// country 过滤：请求带上 countrycodes，且本地再过滤一次
+	cands, err = geocodeCandidates(context.Background(), springfieldClient(&q), "Springfield", "NZ", 5)
+	if err != nil {
+		t.Fatalf("geocodeCandidates with country error: %v", err)
+	}
+	if q.Get("countrycodes") != "nz" || q.Get("limit") != "5" {
+		t.Errorf("unexpected query: %v", q)
+	}
+	if len(cands) != 1 || cands[0].CountryCode != "nz" {
+		t.Errorf("country filter result = %+v", cands)
+	}
+	if _, err := geocodeCandidates(context.Background(), springfieldClient(nil), "Springfield", "fr", 5); err == nil {
+		t.Error("expected not found when no candidate matches country")
+	}
+}
+
+func TestPromptCandidate(t *testing.T) {
+	cands := []GeoCandidate{{DisplayName: "A", Type: "city", Importance: 0.5}, {DisplayName: "B"}}
+	var out bytes.Buffer
+	n, err := promptCandidate(strings.NewReader("2\n"), &out, "X", cands)
+	if err != nil || n != 2 {
+		t.Errorf("promptCandidate = %d, %v; want 2", n, err)
+	}
+	if !strings.Contains(out.String(), "1) A  [city]  重要度 0.50") || !strings.Contains(out.String(), "2) B") {
+		t.Errorf("prompt output = %q", out.String())
+	}
+	if n, err := promptCandidate(strings.NewReader(""), io.Discard, "X", cands); err != nil || n != 1 {
+		t.Errorf("empty input = %d, %v; want default 1", n, err)
+	}
+	if _, err := promptCandidate(strings.NewReader("3\n"), io.Discard, "X", cands); err == nil {
+		t.Error("expected error for out-of-range input")
+	}
+}
+
+func TestSelectCandidate(t *testing.T) {
+	origPrompt := app.promptCandidate
+	defer func() { app.promptCandidate = origPrompt }()
+	cands := []GeoCandidate{{DisplayName: "A"}, {DisplayName: "B"}, {DisplayName: "C"}}
+
+	if c, n, err := selectCandidate("X", cands, geoOptions{Pick: 3}); err != nil || n != 3 || c.DisplayName != "C" {
+		t.Errorf("pick 3 = %v, %d, %v", c, n, err)
+	}
+	if _, _, err := selectCandidate("X", cands, geoOptions{Pick: 4}); err == nil {
+		t.Error("expected error for pick out of range")
+	}
+
+	prompted := false
+	app.promptCandidate = func(city string, cs []GeoCandidate) (int, error) {
+		prompted = true
+		return 2, nil
+	}
+	if c, _, _ := selectCandidate("X", cands, geoOptions{Interactive: true}); !prompted || c.DisplayName != "B" {
+		t.Errorf("interactive selection = %v, prompted = %v", c, prompted)
+	}
+	prompted = false
+	if c, n, _ := selectCandidate("X", cands, geoOptions{}); prompted || n != 1 || c.DisplayName != "A" {
+		t.Errorf("non-interactive selection = %v, %d, prompted = %v", c, n, prompted)
+	}
+	if _, _, _ = selectCandidate("X", cands[:1], geoOptions{Interactive: true}); prompted {
+		t.Error("single candidate should not prompt")
+	}
+}
+
+func TestCLIGeoOptionsNonTerminal(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origClient, origLookup, origPrompt, origTTY, origPick := app.client, app.tzLookup, app.promptCandidate, app.stdinIsTerminal, config.Pick
+	defer func() {
+		app.client, app.tzLookup, app.promptCandidate, app.stdinIsTerminal, config.Pick = origClient, origLookup, origPrompt, origTTY, origPick
+	}()
+	app.client = springfieldClient(nil)
+	app.tzLookup = func(lat, lon float64) (string, error) { return "America/Chicago", nil }
+	app.promptCandidate = func(string, []GeoCandidate) (int, error) {
+		t.Fatal("non-terminal stdin should not prompt")
+		return 0, nil
+	}
+	app.stdinIsTerminal = func() bool { return false }
+
+	if cliGeoOptions().Interactive {
+		t.Fatal("cliGeoOptions should not be interactive without a terminal")
+	}
+	// 管道/cron 下多候选时取排名第一的候选
+	ctx, err := prepareCity("Springfield", false)
+	if err != nil || !strings.Contains(ctx.DisplayName, "Illinois") {
+		t.Errorf("non-terminal default = %v, %v", ctx, err)
+	}
+	// --pick 仍然生效
+	config.Pick = 2
+	ctx, err = prepareCity("Springfield", false)
+	if err != nil || !strings.Contains(ctx.DisplayName, "Missouri") {
+		t.Errorf("non-terminal --pick 2 = %v, %v", ctx, err)
+	}
+
+	app.stdinIsTerminal = func() bool { return true }
+	if !cliGeoOptions().Interactive {
+		t.Error("cliGeoOptions should be interactive on a terminal")
+	}
+}
+
+func TestPrepareCityWithPickStoresCandidate(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origClient, origLookup := app.client, app.tzLookup
+	defer func() { app.client, app.tzLookup = origClient, origLookup }()
+	app.client = springfieldClient(nil)
+	app.tzLookup = func(lat, lon float64) (string, error) { return "America/Chicago", nil }
+
+	ctx, err := prepareCityWith("Springfield", false, geoOptions{Pick: 2})
+	if err != nil {
+		t.Fatalf("prepareCityWith error: %v", err)
+	}
+	if !strings.Contains(ctx.DisplayName, "Missouri") {
+		t.Errorf("picked display = %q, want Missouri", ctx.DisplayName)
+	}
+	entry, ok := findEntryInCache(loadCache(), "Springfield")
+	if !ok || entry.Pick != 2 || entry.Candidate == nil || entry.Candidate.AdminArea != "Missouri" {
+		t.Fatalf("cache entry = %+v", entry)
+	}
+
+	// 缓存与新的 --pick 不一致时重新查询，离线时仍使用缓存
+	ctx, err = prepareCityWith("Springfield", false, geoOptions{Pick: 1})
+	if err != nil || !strings.Contains(ctx.DisplayName, "Illinois") {
+		t.Errorf("re-pick = %v, %v", ctx, err)
+	}
+	ctx, err = prepareCityWith("Springfield", true, geoOptions{Country: "nz"})
+	if err != nil || !strings.Contains(ctx.DisplayName, "Illinois") {
+		t.Errorf("offline should use cached entry: %v, %v", ctx, err)
+	}
+	ctx, err = prepareCityWith("Springfield", false, geoOptions{Country: "nz"})
+	if err != nil || !strings.Contains(ctx.DisplayName, "New Zealand") {
+		t.Errorf("country filter = %v, %v", ctx, err)
+	}
+}
+
+func TestResolveContextFromQueryPick(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origClient, origLookup, origPrompt := app.client, app.tzLookup, app.promptCandidate
+	defer func() { app.client, app.tzLookup, app.promptCandidate = origClient, origLookup, origPrompt }()
+	app.client = springfieldClient(nil)
+	app.tzLookup = func(lat, lon float64) (string, error) { return "America/Chicago", nil }
+	app.promptCandidate = func(string, []GeoCandidate) (int, error) {
+		t.Error("HTTP requests must not prompt")
+		return 1, nil
+	}
+
+	ctx, err := resolveContextFromQuery(context.Background(), url.Values{"city": {"Springfield"}, "pick": {"2"}})
+	if err != nil || !strings.Contains(ctx.DisplayName, "Missouri") {
+		t.Errorf("pick=2 -> %v, %v", ctx, err)
+	}
+	if _, err := resolveContextFromQuery(context.Background(), url.Values{"city": {"Springfield"}, "pick": {"x"}}); err == nil || asAPIError(err).status() != http.StatusBadRequest {
+		t.Errorf("bad pick err = %v, want 400", err)
+	}
+}
+
+func TestGeocodeAPIHandler(t *testing.T) {
+	origClient := app.client
+	defer func() { app.client = origClient }()
+	var q url.Values
+	app.client = springfieldClient(&q)
+
+	w := httptest.NewRecorder()
+	geocodeAPIHandler(w, httptest.NewRequest("GET", "/api/geocode?q=Springfield&limit=3", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var resp geocodeAPIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Query != "Springfield" || resp.Source != "nominatim" || len(resp.Candidates) != 3 || q.Get("limit") != "3" {
+		t.Errorf("resp = %+v, query = %v", resp, q)
+	}
+
+	for _, bad := range []string{"/api/geocode", "/api/geocode?q=x&limit=0"} {
+		w := httptest.NewRecorder()
+		geocodeAPIHandler(w, httptest.NewRequest("GET", bad, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s status = %d, want 400", bad, w.Code)
+		}
+	}
+}
+
+func TestGeocodeAPIHandlerOffline(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origOffline := config.Offline
+	defer func() { config.Offline = origOffline }()
+	config.Offline = true
+	cache := &CityCache{Entries: map[string]CityCacheEntry{
+		"springfield": {City: "Springfield", DisplayName: "Springfield, Illinois, United States", Lat: 39.8, Lon: -89.6, TimezoneID: "America/Chicago",
+			Candidate: &GeoCandidate{DisplayName: "Springfield, Illinois, United States", CountryCode: "us", Lat: 39.8, Lon: -89.6}},
+	}}
+	if err := saveCache(cache); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	geocodeAPIHandler(w, httptest.NewRequest("GET", "/api/geocode?q=springfield", nil))
+	var resp geocodeAPIResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Source != "offline" || len(resp.Candidates) != 1 || resp.Candidates[0].CountryCode != "us" {
+		t.Errorf("offline resp = %+v", resp)
+	}
+	w = httptest.NewRecorder()
+	geocodeAPIHandler(w, httptest.NewRequest("GET", "/api/geocode?q=springfield&country=nz", nil))
+	if !strings.Contains(w.Body.String(), `"candidates": []`) {
+		t.Errorf("expected empty candidates, got %s", w.Body.String())
+	}
+}
+
+func TestTuiModelPickCandidate(t *testing.T) {
+	m := newTuiModel(&CityCache{Entries: map[string]CityCacheEntry{}})
+	cands := []GeoCandidate{{DisplayName: "Springfield, Illinois"}, {DisplayName: "Springfield, Missouri"}}
+	m.geocode = func(city string) ([]GeoCandidate, error) { return cands, nil }
+	m.input = "Springfield"
+
+	model, cmd := m.handleEnter()
+	tm := model.(tuiModel)
+	if !tm.searching || cmd == nil {
+		t.Fatalf("expected async geocode, searching = %v", tm.searching)
+	}
+	model, _ = tm.Update(cmd())
+	tm = model.(tuiModel)
+	if tm.step != stepPickCandidate {
+		t.Fatalf("step = %v, want stepPickCandidate", tm.step)
+	}
+	if !strings.Contains(tm.View(), "> 1) Springfield, Illinois") {
+		t.Errorf("view = %q", tm.View())
+	}
+	model, _ = tm.Update(tea.KeyMsg{Type: tea.KeyDown})
+	model, _ = model.(tuiModel).handleEnter()
+	tm = model.(tuiModel)
+	if tm.step != stepDone || tm.chosenCandidate == nil || tm.chosenCandidate.DisplayName != "Springfield, Missouri" || tm.pickIndex != 1 {
+		t.Errorf("after pick: step = %v, chosen = %+v", tm.step, tm.chosenCandidate)
+	}
+
+	// 单一候选直接进入下一步；出错时停留在主界面
+	m.geocode = func(city string) ([]GeoCandidate, error) { return cands[:1], nil }
+	model, cmd = m.handleEnter()
+	model, _ = model.(tuiModel).Update(cmd())
+	if tm = model.(tuiModel); tm.step != stepDone || tm.chosenCandidate == nil {
+		t.Errorf("single candidate: step = %v", tm.step)
+	}
+	m.geocode = func(city string) ([]GeoCandidate, error) { return nil, fmt.Errorf("boom") }
+	model, cmd = m.handleEnter()
+	model, _ = model.(tuiModel).Update(cmd())
+	if tm = model.(tuiModel); tm.step != stepMain || !strings.Contains(tm.errMsg, "boom") {
+		t.Errorf("error: step = %v, err = %q", tm.step, tm.errMsg)
+	}
+}
+
+//
+// ----------- 内置离线城市库 -----------
+//
+
+func TestParseGazetteerEmbedded(t *testing.T) {
+	cities := loadGazetteer()
+	if len(cities) < 100 {
+		t.Fatalf("gazetteer has %d cities, want >= 100", len(cities))
+	}
+	for _, c := range cities {
+		if c.Lat < -90 || c.Lat > 90 || c.Lon < -180 || c.Lon > 180 || c.Timezone == "" {
+			t.Errorf("invalid gazetteer row: %+v", c)
+		}
+	}
+	if _, err := parseGazetteer("Foo\tbar\n"); err == nil {
+		t.Error("expected error for malformed row")
+	}
+}
+
+func TestNormalizeGazetteerKey(t *testing.T) {
+	cases := map[string]string{
+		" Běijīng ": "beijing",
+		"Xi'an":     "xian",
+		"北京市":       "北京",
+		"São Paulo": "saopaulo",
+		"bei jing":  "beijing",
+	}
+	for in, want := range cases {
+		if got := normalizeGazetteerKey(in); got != want {
+			t.Errorf("normalizeGazetteerKey(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSearchGazetteer(t *testing.T) {
+	first := func(q string, exact bool) string {
+		c := searchGazetteer(q, "", exact, 10)
+		if len(c) == 0 {
+			return ""
+		}
+		return c[0].Name
+	}
+	cases := []struct {
+		query, want string
+		exact       bool
+	}{
+		{"北京", "Beijing", true},
+		{"北京市", "Beijing", true},
+		{"Peking", "Beijing", true},
+		{"xi an", "Xi'an", true},
+		{"NYC", "New York", true},
+		{"纽约", "New York", true},
+		{"bj", "Beijing", false},       // 拼音首字母，人口最多者优先
+		{"Shangai", "Shanghai", false}, // 编辑距离 1
+		{"Guangz", "Guangzhou", false}, // 前缀
+		{"bj", "", true},
+		{"Shangai", "", true},
+	}
+	for _, c := range cases {
+		if got := first(c.query, c.exact); got != c.want {
+			t.Errorf("search %q (exact=%v) = %q, want %q", c.query, c.exact, got, c.want)
+		}
+	}
+
+	// 同名城市按人口排序，country 过滤
+	su := searchGazetteer("Suzhou", "", false, 10)
+	if len(su) != 2 || su[0].AdminArea != "Jiangsu" || su[1].AdminArea != "Anhui" {
+		t.Errorf("Suzhou candidates = %+v", su)
+	}
+	if got := searchGazetteer("Santiago", "us", false, 10); len(got) != 0 {
+		t.Errorf("country filter should drop Santiago, got %+v", got)
+	}
+	c := searchGazetteer("Tokyo", "", true, 1)[0]
+	if c.Timezone != "Asia/Tokyo" || c.Source != "gazetteer" || c.CountryCode != "jp" || c.Population == 0 {
+		t.Errorf("Tokyo candidate = %+v", c)
+	}
+}
+
+func TestPrepareCityOfflineGazetteer(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origLookup := app.tzLookup
+	defer func() { app.tzLookup = origLookup }()
+	app.tzLookup = func(lat, lon float64) (string, error) {
+		t.Error("gazetteer timezone should be used instead of lookup")
+		return "", fmt.Errorf("unexpected")
+	}
+
+	ctx, err := prepareCity("东京", true)
+	if err != nil {
+		t.Fatalf("offline gazetteer lookup failed: %v", err)
+	}
+	if ctx.TZID != "Asia/Tokyo" || math.Abs(ctx.Lat-35.69) > 0.01 {
+		t.Errorf("ctx = %+v", ctx)
+	}
+	entry, ok := findEntryInCache(loadCache(), "Tokyo")
+	if !ok || entry.Candidate == nil || entry.Candidate.Source != "gazetteer" {
+		t.Fatalf("gazetteer result not cached with aliases: %+v", entry)
+	}
+
+	// 模糊匹配只在离线时生效
+	if ctx, err := prepareCity("Shangai", true); err != nil || ctx.TZID != "Asia/Shanghai" {
+		t.Errorf("fuzzy offline lookup = %v, %v", ctx, err)
+	}
+}
+
+func TestLookupCandidatesMergesGazetteer(t *testing.T) {
+	origClient := app.client
+	defer func() { app.client = origClient }()
+	called := false
+	app.client = &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		called = true
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(`[{"lat":"1","lon":"2","display_name":"Shangai Mock"}]`))}, nil
+	}}
+
+	// 联网时内置城市库的完全匹配不跳过 Nominatim，两者合并
+	cands, err := lookupCandidates(context.Background(), "Paris", "", false, 10)
+	if err != nil || !called || len(cands) != 2 || cands[0].Source != "nominatim" || cands[1].Source != "gazetteer" {
+		t.Errorf("Paris: cands = %+v, err = %v, network called = %v", cands, err, called)
+	}
+	called = false
+	cands, err = lookupCandidates(context.Background(), "Shangai", "", false, 10)
+	if err != nil || !called || cands[0].Source != "nominatim" {
+		t.Errorf("online fuzzy should go to Nominatim: %+v, %v", cands, err)
+	}
+}
+
+//
+// ----------- 可插拔地理编码器 -----------
+//
+
+func TestNominatimGeocoderConfig(t *testing.T) {
+	var got *http.Request
+	g := &NominatimGeocoder{
+		BaseURL: "http://geo.internal/search",
+		Email:   "ops@example.org",
+		Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+			got = req
+			return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(mockSpringfieldResponse))}, nil
+		}},
+	}
+	cands, err := g.Search(context.Background(), GeoQuery{Text: "Springfield", Limit: 3})
+	if err != nil || len(cands) != 3 {
+		t.Fatalf("Search = %v, %v", cands, err)
+	}
+	if got.URL.Host != "geo.internal" || got.URL.Query().Get("email") != "ops@example.org" {
+		t.Errorf("request URL = %s", got.URL)
+	}
+	if ua := got.Header.Get("User-Agent"); ua != "eSunMoon/1.0 (contact: ops@example.org)" {
+		t.Errorf("User-Agent = %q", ua)
+	}
+
+	g.UserAgent = "MyOrg-Astro/2.0"
+	_, _ = g.Search(context.Background(), GeoQuery{Text: "Springfield"})
+	if ua := got.Header.Get("User-Agent"); ua != "MyOrg-Astro/2.0" {
+		t.Errorf("custom User-Agent = %q", ua)
+	}
+	if _, err := g.Search(context.Background(), GeoQuery{Text: "Springfield", Offline: true}); !errors.Is(err, errGeocoderOffline) {
+		t.Errorf("offline search err = %v", err)
+	}
+}
+
+func TestPhotonGeocoder(t *testing.T) {
+	body := `{"features":[
+		{"geometry":{"coordinates":[13.3889,52.5170]},"properties":{"name":"Berlin","state":"Berlin","country":"Germany","countrycode":"DE","osm_value":"city"}},
+		{"geometry":{"coordinates":[-72.7787,41.6215]},"properties":{"name":"Berlin","county":"Hartford County","state":"Connecticut","country":"United States","countrycode":"US","osm_value":"town"}}
+	]}`
+	var got *http.Request
+	g := &PhotonGeocoder{BaseURL: "http://photon.local/api", Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}}}
+	cands, err := g.Search(context.Background(), GeoQuery{Text: "Berlin", Limit: 5})
+	if err != nil || len(cands) != 2 {
+		t.Fatalf("Search = %v, %v", cands, err)
+	}
+	if c := cands[0]; c.DisplayName != "Berlin, Germany" || c.Lat != 52.5170 || c.Lon != 13.3889 || c.CountryCode != "de" || c.Type != "city" || c.Source != "photon" {
+		t.Errorf("first = %+v", c)
+	}
+	if got.URL.Host != "photon.local" || got.URL.Query().Get("limit") != "5" {
+		t.Errorf("request URL = %s", got.URL)
+	}
+	cands, _ = g.Search(context.Background(), GeoQuery{Text: "Berlin", Country: "us", Limit: 5})
+	if len(cands) != 1 || cands[0].AdminArea != "Connecticut" || got.URL.Query().Get("limit") != "15" {
+		t.Errorf("country filter = %+v, url = %s", cands, got.URL)
+	}
+}
+
+func TestFileGeocoder(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "sites.csv")
+	csvData := "name,zh,pinyin,lat,lon,country,timezone,aliases\n" +
+		"Xinglong Observatory,兴隆观测站,xing long,40.3958,117.5775,CN,Asia/Shanghai,兴隆;Xinglong\n" +
+		"Lijiang Observatory,丽江观测站,li jiang,26.6951,100.0300,CN,Asia/Shanghai,\n"
+	if err := os.WriteFile(csvPath, []byte(csvData), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewFileGeocoder(csvPath)
+	if err != nil {
+		t.Fatalf("NewFileGeocoder csv: %v", err)
+	}
+	cands, err := g.Search(context.Background(), GeoQuery{Text: "兴隆"})
+	if err != nil || len(cands) != 1 || cands[0].Timezone != "Asia/Shanghai" || cands[0].Source != "file" {
+		t.Errorf("csv search = %+v, %v", cands, err)
+	}
+	if _, err := g.Search(context.Background(), GeoQuery{Text: "Xinglong Observator"}); !errors.Is(err, errCityNotFound) {
+		t.Errorf("online fuzzy should not match, err = %v", err)
+	}
+	if cands, _ := g.Search(context.Background(), GeoQuery{Text: "Xinglong Observator", Offline: true}); len(cands) != 1 {
+		t.Errorf("offline fuzzy should match, got %+v", cands)
+	}
+
+	jsonPath := filepath.Join(dir, "sites.json")
+	if err := os.WriteFile(jsonPath, []byte(`[{"name":"Mauna Kea","lat":19.8207,"lon":-155.4681,"country":"US","timezone":"Pacific/Honolulu","aliases":["MKO"]}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	g, err = NewFileGeocoder(jsonPath)
+	if err != nil {
+		t.Fatalf("NewFileGeocoder json: %v", err)
+	}
+	if cands, err := g.Search(context.Background(), GeoQuery{Text: "mko"}); err != nil || cands[0].Name != "Mauna Kea" {
+		t.Errorf("json search = %+v, %v", cands, err)
+	}
+
+	bad := filepath.Join(dir, "bad.csv")
+	_ = os.WriteFile(bad, []byte("name,lat\nX,1\n"), 0o644)
+	if _, err := NewFileGeocoder(bad); err == nil {
+		t.Error("expected error for csv without lon column")
+	}
+	if _, err := NewFileGeocoder(filepath.Join(dir, "sites.txt")); err == nil {
+		t.Error("expected error for unsupported extension")
+	}
+}
+
+type stubGeocoder struct {
+	name  string
+	cands []GeoCandidate
+	err   error
+	calls int
+}
+
+func (s *stubGeocoder) Name() string { return s.name }
+func (s *stubGeocoder) Search(ctx context.Context, q GeoQuery) ([]GeoCandidate, error) {
+	s.calls++
+	return s.cands, s.err
+}
+
+func TestChainGeocoder(t *testing.T) {
+	down := &stubGeocoder{name: "a", err: fmt.Errorf("connection refused")}
+	empty := &stubGeocoder{name: "b", err: notFound("X")}
+	ok := &stubGeocoder{name: "c", cands: []GeoCandidate{{DisplayName: "X"}}}
+	chain := ChainGeocoder{down, empty, ok}
+	if chain.Name() != "a,b,c" {
+		t.Errorf("Name = %q", chain.Name())
+	}
+	cands, err := chain.Search(context.Background(), GeoQuery{Text: "X"})
+	if err != nil || len(cands) != 1 || ok.calls != 1 {
+		t.Errorf("chain fallback = %v, %v", cands, err)
+	}
+	if _, err := (ChainGeocoder{down, empty}).Search(context.Background(), GeoQuery{Text: "X"}); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("expected last real error, got %v", err)
+	}
+	if _, err := (ChainGeocoder{empty}).Search(context.Background(), GeoQuery{Text: "X"}); !errors.Is(err, errCityNotFound) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestChainGeocoderMergesLocalOnline(t *testing.T) {
+	calls := 0
+	nominatim := &NominatimGeocoder{Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		calls++
+		body := `[{"lat":"51.5074","lon":"-0.1278","display_name":"London, Greater London, England, United Kingdom","address":{"country_code":"gb"}},
+			{"lat":"42.9849","lon":"-81.2453","display_name":"London, Ontario, Canada","address":{"country_code":"ca"}}]`
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}}}
+	chain := ChainGeocoder{GazetteerGeocoder{}, nominatim}
+
+	cands, err := chain.Search(context.Background(), GeoQuery{Text: "London", Limit: 5})
+	if err != nil || calls != 1 || len(cands) != 2 {
+		t.Fatalf("online London = %+v, %v (calls=%d)", cands, err, calls)
+	}
+	if !strings.Contains(cands[0].DisplayName, "England") || cands[0].Timezone != "Europe/London" || !containsFold(cands[0].Aliases, "伦敦") {
+		t.Errorf("gazetteer entry should enrich the matching network candidate: %+v", cands[0])
+	}
+	if !strings.Contains(cands[1].DisplayName, "Ontario") {
+		t.Errorf("second network candidate should be kept for --pick: %+v", cands[1])
+	}
+
+	// 离线时本地命中直接返回；网络失败时回退到本地结果
+	if cands, err := chain.Search(context.Background(), GeoQuery{Text: "London", Limit: 5, Offline: true}); err != nil || calls != 1 || cands[0].Source != "gazetteer" {
+		t.Errorf("offline London = %+v, %v (calls=%d)", cands, err, calls)
+	}
+	down := &stubGeocoder{name: "n", err: fmt.Errorf("connection refused")}
+	if cands, err := (ChainGeocoder{GazetteerGeocoder{}, down}).Search(context.Background(), GeoQuery{Text: "London", Limit: 5}); err != nil || len(cands) == 0 || cands[0].Source != "gazetteer" || down.calls != 1 {
+		t.Errorf("network down should fall back to gazetteer: %+v, %v", cands, err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{interval: 30 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("wait %d: %v", i, err)
+		}
+	}
+	if d := time.Since(start); d < 60*time.Millisecond {
+		t.Errorf("3 waits took %v, want >= 60ms", d)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled wait err = %v", err)
+	}
+	if err := (*rateLimiter)(nil).wait(context.Background()); err != nil {
+		t.Errorf("nil limiter err = %v", err)
+	}
+}
+
+func TestBuildGeocoder(t *testing.T) {
+	g, err := buildGeocoder(&AppConfig{})
+	if err != nil || g.Name() != "gazetteer,nominatim" {
+		t.Errorf("default geocoder = %v, %v", g, err)
+	}
+	g, err = buildGeocoder(&AppConfig{Geocoder: "photon", PhotonURL: "http://p/api", GeocoderEmail: "a@b"})
+	if p, ok := g.(*PhotonGeocoder); err != nil || !ok || p.BaseURL != "http://p/api" || p.UserAgent != "eSunMoon/1.0 (contact: a@b)" {
+		t.Errorf("photon geocoder = %#v, %v", g, err)
+	}
+	g, err = buildGeocoder(&AppConfig{Geocoder: "nominatim", NominatimURL: "http://n/search"})
+	if n, ok := g.(*NominatimGeocoder); err != nil || !ok || n.BaseURL != "http://n/search" || n.Limiter != nil {
+		t.Errorf("self-hosted nominatim geocoder = %#v, %v", g, err)
+	}
+	g, err = buildGeocoder(&AppConfig{Geocoder: "nominatim", NominatimURL: defaultNominatimURL})
+	if n, ok := g.(*NominatimGeocoder); err != nil || !ok || n.Limiter != nominatimLimiter {
+		t.Errorf("public nominatim should be rate limited: %#v, %v", g, err)
+	}
+	for _, bad := range []*AppConfig{{Geocoder: "google"}, {Geocoder: "file"}, {Geocoder: " , "}} {
+		if _, err := buildGeocoder(bad); err == nil {
+			t.Errorf("expected error for %q", bad.Geocoder)
+		}
+	}
+}
+
+func TestApplyGeocoderEnv(t *testing.T) {
+	t.Setenv("ESUNMOON_GEOCODER", "photon,nominatim")
+	t.Setenv("ESUNMOON_PHOTON_URL", " http://p/api ")
+	t.Setenv("ESUNMOON_GEOCODER_EMAIL", "ops@example.org")
+	t.Setenv("ESUNMOON_NOMINATIM_URL", "")
+	cfg := &AppConfig{Geocoder: defaultGeocoders, NominatimURL: defaultNominatimURL, GeocoderEmail: "cli@example.org"}
+	applyGeocoderEnv(cfg, func(name string) bool { return name == "geocoder-email" })
+	if cfg.Geocoder != "photon,nominatim" || cfg.PhotonURL != "http://p/api" {
+		t.Errorf("env should fill unset flags: %+v", cfg)
+	}
+	if cfg.GeocoderEmail != "cli@example.org" || cfg.NominatimURL != defaultNominatimURL {
+		t.Errorf("explicit flags and empty env should be kept: %+v", cfg)
+	}
+}
+
+//
+// ----------- 坐标反查地名 -----------
+//
+
+func TestReverseCacheKey(t *testing.T) {
+	cases := map[[2]float64]string{
+		{39.9042, 116.4074}: "39.90,116.41",
+		{-0.001, 0.004}:     "0.00,0.00",
+		{-33.8678, -70.65}:  "-33.87,-70.65",
+	}
+	for in, want := range cases {
+		if got := reverseCacheKey(in[0], in[1]); got != want {
+			t.Errorf("reverseCacheKey(%v) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestGazetteerReverse(t *testing.T) {
+	c, err := GazetteerGeocoder{}.Reverse(context.Background(), 39.95, 116.45, true)
+	if err != nil || c.Name != "Beijing" || c.DistanceKm < 5 || c.DistanceKm > 10 || !strings.Contains(c.DisplayName, "km") {
+		t.Errorf("Reverse near Beijing = %+v, %v", c, err)
+	}
+	if _, err := (GazetteerGeocoder{}).Reverse(context.Background(), 0, 0, true); !errors.Is(err, errCityNotFound) {
+		t.Errorf("Reverse in the ocean err = %v", err)
+	}
+}
+
+func TestNominatimReverse(t *testing.T) {
+	var got *http.Request
+	body := `{"lat":"46.5197","lon":"6.6323","display_name":"Lausanne, District de Lausanne, Vaud, Schweiz","name":"Lausanne","addresstype":"city","address":{"city":"Lausanne","state":"Vaud","country":"Schweiz","country_code":"ch"}}`
+	g := &NominatimGeocoder{BaseURL: "http://geo.internal/search", Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		got = req
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}}}
+	c, err := g.Reverse(context.Background(), 46.52, 6.63, false)
+	if err != nil || c.Name != "Lausanne" || c.AdminArea != "Vaud" || c.CountryCode != "ch" {
+		t.Errorf("Reverse = %+v, %v", c, err)
+	}
+	if got.URL.Path != "/reverse" || got.URL.Query().Get("zoom") != "10" {
+		t.Errorf("request URL = %s", got.URL)
+	}
+
+	body = `{"error":"Unable to geocode"}`
+	if _, err := g.Reverse(context.Background(), 0, 0, false); !errors.Is(err, errCityNotFound) {
+		t.Errorf("expected not found for error body, got %v", err)
+	}
+	if _, err := g.Reverse(context.Background(), 0, 0, true); !errors.Is(err, errGeocoderOffline) {
+		t.Errorf("offline err = %v", err)
+	}
+	if got := siblingEndpoint("https://photon.komoot.io/api/", "api", "reverse"); got != "https://photon.komoot.io/reverse" {
+		t.Errorf("siblingEndpoint = %q", got)
+	}
+}
+
+func TestReverseGeocodeNameCaching(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origGeocoder := app.geocoder
+	defer func() { app.geocoder = origGeocoder }()
+
+	calls := 0
+	app.geocoder = &NominatimGeocoder{Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		calls++
+		body := `{"lat":"46.5197","lon":"6.6323","display_name":"Lausanne, Vaud, Schweiz","address":{"city":"Lausanne","country_code":"ch"}}`
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}}}
+
+	city, display := reverseGeocodeName(46.5201, 6.6330, false)
+	if city != "Lausanne" || display != "Lausanne, Vaud, Schweiz" || calls != 1 {
+		t.Fatalf("first lookup = %q/%q, calls = %d", city, display, calls)
+	}
+	if e, ok := loadCache().Reverse["46.52,6.63"]; !ok || e.Source != "nominatim" {
+		t.Fatalf("reverse cache entry missing: %+v", loadCache().Reverse)
+	}
+	// 约 1 km 内的坐标命中缓存，离线时也可用
+	if city, _ := reverseGeocodeName(46.5198, 6.6321, true); city != "Lausanne" || calls != 1 {
+		t.Errorf("cached offline lookup = %q, calls = %d", city, calls)
+	}
+
+	// 反查失败回退为 coords_ 名称
+	if city, display := reverseGeocodeName(-10, -140, true); city != "coords_-10.0000_-140.0000" || display != city {
+		t.Errorf("fallback = %q/%q", city, display)
+	}
+}
+
+func TestReverseGeocodeNameNegativeCache(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origGeocoder, origNow := app.geocoder, app.now
+	defer func() { app.geocoder, app.now = origGeocoder, origNow }()
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	app.now = func() time.Time { return now }
+
+	calls := 0
+	app.geocoder = &NominatimGeocoder{Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		calls++
+		return nil, fmt.Errorf("connection refused")
+	}}}
+	fallback := "coords_-10.0000_-140.0000"
+	for i := 0; i < 3; i++ {
+		if city, _ := reverseGeocodeName(-10, -140, false); city != fallback {
+			t.Fatalf("lookup %d = %q", i, city)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("failed lookup should be cached for a short time, calls = %d", calls)
+	}
+	if e, ok := loadCache().Reverse["-10.00,-140.00"]; !ok || e.City != "" {
+		t.Errorf("negative cache entry = %+v, %v", e, ok)
+	}
+	now = now.Add(reverseRetryTTL + time.Minute)
+	reverseGeocodeName(-10, -140, false)
+	if calls != 2 {
+		t.Errorf("negative entry should expire after reverseRetryTTL, calls = %d", calls)
+	}
+
+	// 请求已取消（客户端断开）时不把失败写入负缓存
+	reqCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cache := loadCache()
+	if city, _ := reverseGeocodeNameIn(reqCtx, cache, 20, 20, false); city != "coords_20.0000_20.0000" {
+		t.Errorf("cancelled lookup = %q", city)
+	}
+	if _, ok := cache.Reverse["20.00,20.00"]; ok {
+		t.Error("cancelled lookup should not be cached")
+	}
+}
+
+func TestResolveContextFromQueryReverseName(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ctx, err := resolveContextFromQuery(context.Background(), url.Values{"lat": {"31.25"}, "lon": {"121.45"}, "tz": {"Asia/Shanghai"}})
+	if err != nil {
+		t.Fatalf("err = %v", err)
+	}
+	if ctx.City != "Shanghai" || !strings.Contains(ctx.DisplayName, "上海") {
+		t.Errorf("reverse-geocoded ctx = %q / %q", ctx.City, ctx.DisplayName)
+	}
+	ctx, _ = resolveContextFromQuery(context.Background(), url.Values{"lat": {"31.25"}, "lon": {"121.45"}, "tz": {"Asia/Shanghai"}, "city": {"Home"}})
+	if ctx.City != "Home" || ctx.DisplayName != "Home" {
+		t.Errorf("explicit city should win: %q / %q", ctx.City, ctx.DisplayName)
+	}
+}
+
+//
+// ----------- 坐标时区推断 -----------
+//
+
+func TestResolveCoordsTimezone(t *testing.T) {
+	ref := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tzID, loc, warnings, err := resolveCoordsTimezone(43.8, 87.6, "", ref)
+	if err != nil || tzID != "Asia/Urumqi" || loc == nil || len(warnings) != 0 {
+		t.Fatalf("inferred = %q %v %v", tzID, warnings, err)
+	}
+
+	// 新疆用户刻意使用北京时间：以指定为准，但给出提示
+	tzID, loc, warnings, err = resolveCoordsTimezone(43.8, 87.6, "Asia/Shanghai", ref)
+	if err != nil || tzID != "Asia/Shanghai" || loc.String() != "Asia/Shanghai" {
+		t.Fatalf("override = %q %v", tzID, err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "UTC+08:00") || !strings.Contains(warnings[0], "Asia/Urumqi（UTC+06:00）") {
+		t.Errorf("override warnings = %v", warnings)
+	}
+
+	// 同偏移的别名/相邻时区不提示
+	if _, _, warnings, _ := resolveCoordsTimezone(31.23, 121.47, "Asia/Chongqing", ref); len(warnings) != 0 {
+		t.Errorf("same-offset zone should not warn: %v", warnings)
+	}
+
+	// 仅夏令时不同（凤凰城全年 UTC-7，丹佛夏季 UTC-6）：冬至偏移相同，全年都不提示
+	for _, at := range []time.Time{ref, time.Date(2025, 12, 1, 0, 0, 0, 0, time.UTC)} {
+		if _, _, warnings, _ := resolveCoordsTimezone(39.74, -104.99, "America/Phoenix", at); len(warnings) != 0 {
+			t.Errorf("DST-only difference at %v should not warn: %v", at, warnings)
+		}
+	}
+
+	if _, _, _, err := resolveCoordsTimezone(39.9, 116.4, "Bad/Zone", ref); err == nil || !strings.Contains(err.Error(), "加载时区失败") {
+		t.Errorf("bad tz err = %v", err)
+	}
+}
+
+func TestResolveCoordsTimezoneFallback(t *testing.T) {
+	origLookup := app.tzLookup
+	defer func() { app.tzLookup = origLookup }()
+	app.tzLookup = func(float64, float64) (string, error) { return "", errors.New("no zone") }
+
+	tzID, _, warnings, err := resolveCoordsTimezone(-10, -140, "", time.Now())
+	if err != nil || tzID != "Etc/GMT+9" || len(warnings) != 1 {
+		t.Fatalf("fallback = %q %v %v", tzID, warnings, err)
+	}
+	for lon, want := range map[float64]string{0: "UTC", 7.4: "UTC", 120: "Etc/GMT-8", 179.9: "Etc/GMT-12", -179.9: "Etc/GMT+12"} {
+		if got := fallbackTimeZone(lon); got != want {
+			t.Errorf("fallbackTimeZone(%v) = %q, want %q", lon, got, want)
+		}
+	}
+	if got := formatUTCOffset(-(3*3600 + 1800)); got != "UTC-03:30" {
+		t.Errorf("formatUTCOffset = %q", got)
+	}
+}
+
+func TestPositionsAPIInfersTimezone(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/positions?lat=43.8&lon=87.6&city=Urumqi&tz=Asia/Shanghai", nil)
+	rr := httptest.NewRecorder()
+	positionsAPIHandler(rr, req)
+	var resp livePositionsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v (%s)", err, rr.Body.String())
+	}
+	if resp.Timezone != "Asia/Shanghai" || len(resp.Warnings) != 1 {
+		t.Errorf("override response tz=%q warnings=%v", resp.Timezone, resp.Warnings)
+	}
+
+	req = httptest.NewRequest("GET", "/api/positions?lat=43.8&lon=87.6&city=Urumqi", nil)
+	rr = httptest.NewRecorder()
+	positionsAPIHandler(rr, req)
+	resp = livePositionsResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v (%s)", err, rr.Body.String())
+	}
+	if rr.Code != http.StatusOK || resp.Timezone != "Asia/Urumqi" || len(resp.Warnings) != 0 {
+		t.Errorf("inferred response code=%d tz=%q warnings=%v", rr.Code, resp.Timezone, resp.Warnings)
+	}
+}
+
+//
+// ----------- 观测点海拔与地平俯角 -----------
+//
+
+func TestHorizonDipAndFormatElevation(t *testing.T) {
+	if d := horizonDipDeg(3000); math.Abs(d-1.895) > 0.001 {
+		t.Errorf("horizonDipDeg(3000) = %.4f", d)
+	}
+	if horizonDipDeg(-400) != 0 || horizonDipDeg(0) != 0 {
+		t.Errorf("non-positive elevation should have no dip")
+	}
+	if got := formatElevation(3000, "dem"); got != "3000 m（地平俯角 1.90°，DEM）" {
+		t.Errorf("formatElevation = %q", got)
+	}
+	if got := formatElevation(0, ""); got != "0 m" {
+		t.Errorf("formatElevation(0) = %q", got)
+	}
+	if validateElevation(9500) == nil || validateElevation(math.NaN()) == nil || validateElevation(-430) != nil {
+		t.Errorf("validateElevation range mismatch")
+	}
+}
+
+func TestGenerateAstroDataElevationDip(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	start := time.Date(2025, 3, 20, 0, 0, 0, 0, loc)
+	flat, err := generateAstroDataFor(&CityContext{City: "Beijing", Lat: 39.9, Lon: 116.4, Loc: loc}, start, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := generateAstroDataFor(&CityContext{City: "Beijing", Lat: 39.9, Lon: 116.4, Loc: loc, Elevation: 3000}, start, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(s string) time.Time {
+		tm, err := time.ParseInLocation("15:04", s, loc)
+		if err != nil {
+			t.Fatalf("parse %q: %v", s, err)
+		}
+		return tm
+	}
+	// 1.9° 俯角在春分的北京约提前/推后 9~11 分钟
+	earlier := parse(flat[0].Sunrise).Sub(parse(high[0].Sunrise))
+	later := parse(high[0].Sunset).Sub(parse(flat[0].Sunset))
+	if earlier < 8*time.Minute || earlier > 12*time.Minute || later < 8*time.Minute || later > 12*time.Minute {
+		t.Errorf("dip shift sunrise=%v sunset=%v", earlier, later)
+	}
+	if parse(high[0].CivilDusk).Sub(parse(flat[0].CivilDusk)) <= 0 {
+		t.Errorf("civil dusk should also be delayed: %s vs %s", high[0].CivilDusk, flat[0].CivilDusk)
+	}
+	if high[0].SolarNoon != flat[0].SolarNoon {
+		t.Errorf("solar noon should not change: %s vs %s", high[0].SolarNoon, flat[0].SolarNoon)
+	}
+	if parse(high[0].BlueEveningEnd).Sub(parse(flat[0].BlueEveningEnd)) <= 0 {
+		t.Errorf("blue hour should also be delayed: %s vs %s", high[0].BlueEveningEnd, flat[0].BlueEveningEnd)
+	}
+
+	// 黄金时刻下限取日出日落高度时，加俯角后的黄金时刻起止仍与同一行的日出日落一致
+	bands := &photoBands{Golden: altitudeBand{Low: -0.833, High: 6}, Blue: defaultPhotoBands.Blue}
+	high, err = generateAstroDataFor(&CityContext{City: "Beijing", Lat: 39.9, Lon: 116.4, Loc: loc, Elevation: 3000, Photo: bands}, start, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	near := func(a, b string) bool {
+		d := parse(a).Sub(parse(b))
+		return d >= -time.Minute && d <= time.Minute
+	}
+	if !near(high[0].GoldenMorningStart, high[0].Sunrise) || !near(high[0].GoldenEveningEnd, high[0].Sunset) {
+		t.Errorf("golden hour %s~%s should match sunrise/sunset %s~%s",
+			high[0].GoldenMorningStart, high[0].GoldenEveningEnd, high[0].Sunrise, high[0].Sunset)
+	}
+}
+
+func TestSRTMTileNameAndLookup(t *testing.T) {
+	for in, want := range map[[2]float64]string{
+		{39.9, 116.4}:   "N39E116.hgt",
+		{-33.45, -70.6}: "S34W071.hgt",
+		{0.5, -0.5}:     "N00W001.hgt",
+	} {
+		if got := srtmTileName(in[0], in[1]); got != want {
+			t.Errorf("srtmTileName(%v) = %q, want %q", in, got, want)
+		}
+	}
+
+	dir := t.TempDir()
+	const n = 1201
+	data := make([]byte, n*n*2)
+	set := func(r, c int, v int16) { binary.BigEndian.PutUint16(data[(r*n+c)*2:], uint16(v)) }
+	// 瓦片 N27E086：行 0 为北纬 28°，列 0 为东经 86°
+	set(600, 600, 1000)
+	set(600, 601, 2000)
+	set(601, 600, 1000)
+	set(601, 601, 2000)
+	set(0, 0, srtmVoid)
+	set(0, 1, srtmVoid)
+	set(1, 0, srtmVoid)
+	set(1, 1, srtmVoid)
+	if err := os.WriteFile(filepath.Join(dir, "N27E086.hgt"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	lat := 28 - 600.0/(n-1)
+	lon := 86 + 600.5/(n-1)
+	if elev, err := lookupSRTM(dir, lat, lon); err != nil || math.Abs(elev-1500) > 0.5 {
+		t.Errorf("lookupSRTM interpolated = %.2f, %v", elev, err)
+	}
+	if _, err := lookupSRTM(dir, 28-0.5/(n-1), 86+0.5/(n-1)); !errors.Is(err, errDEMNoData) {
+		t.Errorf("void area err = %v", err)
+	}
+	if _, err := lookupSRTM(dir, 39.9, 116.4); !errors.Is(err, errDEMNoData) {
+		t.Errorf("missing tile err = %v", err)
+	}
+
+	origDir := config.DEMDir
+	defer func() { config.DEMDir = origDir }()
+	config.DEMDir = dir
+	if elev, ok := demElevation(lat, lon); !ok || math.Abs(elev-1500) > 0.5 {
+		t.Errorf("demElevation = %.2f, %v", elev, ok)
+	}
+	ctx, err := resolveContextFromQuery(context.Background(), url.Values{"lat": {fmt.Sprint(lat)}, "lon": {fmt.Sprint(lon)}, "city": {"Camp"}})
+	if err != nil || ctx.ElevationSource != "dem" || math.Abs(ctx.Elevation-1500) > 0.5 {
+		t.Errorf("resolveContextFromQuery DEM = %+v, %v", ctx, err)
+	}
+
+	// 缓存命中时查到的 DEM 海拔写回缓存
+	t.Setenv("HOME", t.TempDir())
+	cache := &CityCache{Entries: map[string]CityCacheEntry{"camp": {
+		City: "Camp", Normalized: "camp", DisplayName: "Camp", Lat: lat, Lon: lon, TimezoneID: "Asia/Kathmandu", UpdatedAt: app.now().Format(time.RFC3339),
+	}}}
+	if err := saveCache(cache); err != nil {
+		t.Fatal(err)
+	}
+	if ctx, err := prepareCity("Camp", true); err != nil || ctx.ElevationSource != "dem" {
+		t.Fatalf("prepareCity DEM = %+v, %v", ctx, err)
+	}
+	if e := loadCache().Entries["camp"]; e.ElevationSource != "dem" || math.Abs(e.Elevation-1500) > 0.5 {
+		t.Errorf("DEM elevation not written back to cache: %+v", e)
+	}
+
+	// 缺少瓦片只告警一次
+	demElevation(39.9, 116.4)
+	if _, ok := demWarned.Load("N39E116.hgt"); !ok {
+		t.Error("missing tile should be remembered after the first warning")
+	}
+}
+
+func TestElevationQueryAndHeaders(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/positions?lat=39.9&lon=116.4&tz=Asia/Shanghai&city=Tower&elev=3000", nil)
+	rr := httptest.NewRecorder()
+	positionsAPIHandler(rr, req)
+	var resp livePositionsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Elevation != 3000 {
+		t.Errorf("positions elevation = %v, %v (%s)", resp.Elevation, err, rr.Body.String())
+	}
+	for _, bad := range []string{"abc", "12000"} {
+		rr = httptest.NewRecorder()
+		positionsAPIHandler(rr, httptest.NewRequest("GET", "/api/positions?lat=39.9&lon=116.4&city=Tower&elev="+bad, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("elev=%s status = %d", bad, rr.Code)
+		}
+	}
+
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, loc)
+	data := []dailyAstro{{Date: "2025-01-01"}}
+	var buf bytes.Buffer
+	if err := writeAstroTxtTo(&buf, "Tower", observerElevation{Meters: 3000}, now, data, "desc"); err != nil || !strings.Contains(buf.String(), "# 海拔：3000 m（地平俯角 1.90°）") {
+		t.Errorf("txt header missing elevation: %v\n%s", err, buf.String())
+	}
+	buf.Reset()
+	if err := writeAstroCSVTo(&buf, "Tower", observerElevation{Meters: 3000}, now, data, "desc"); err != nil || !strings.Contains(buf.String(), "elevation_m,3000\n") {
+		t.Errorf("csv header missing elevation: %v\n%s", err, buf.String())
+	}
+	buf.Reset()
+	if err := writeAstroJSONTo(&buf, "Tower", observerElevation{Meters: 3000}, now, data, "desc"); err != nil || !strings.Contains(buf.String(), `"elevation_m": 3000`) {
+		t.Errorf("json header missing elevation: %v", err)
+	}
+	buf.Reset()
+	if err := writeAstroICS(&buf, "Tower", observerElevation{Meters: 3000}, now, data, nil); err != nil || !strings.Contains(buf.String(), "海拔 3000 m") {
+		t.Errorf("ics calendar name missing elevation: %v", err)
+	}
+
+	// 海拔来源随导出文件头输出
+	dem := observerElevation{Meters: 3000, Source: "dem"}
+	buf.Reset()
+	if err := writeAstroTxtTo(&buf, "Tower", dem, now, data, "desc"); err != nil || !strings.Contains(buf.String(), "# 海拔：3000 m（地平俯角 1.90°，DEM）") {
+		t.Errorf("txt header missing elevation source: %v\n%s", err, buf.String())
+	}
+	buf.Reset()
+	if err := writeAstroCSVTo(&buf, "Tower", dem, now, data, "desc"); err != nil || !strings.Contains(buf.String(), "elevation_source,dem\n") {
+		t.Errorf("csv header missing elevation source: %v\n%s", err, buf.String())
+	}
+	buf.Reset()
+	if err := writeAstroJSONTo(&buf, "Tower", dem, now, data, "desc"); err != nil || !strings.Contains(buf.String(), `"elevation_source": "dem"`) {
+		t.Errorf("json header missing elevation source: %v", err)
+	}
+}
+
+func TestManualElevationPersistsInCache(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origElev, origSet := config.Elevation, config.ElevationSet
+	defer func() { config.Elevation, config.ElevationSet = origElev, origSet }()
+
+	config.Elevation, config.ElevationSet = 2100, true
+	ctx, err := prepareCity("Lhasa", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Elevation != 2100 || ctx.ElevationSource != "manual" {
+		t.Fatalf("ctx elevation = %v/%q", ctx.Elevation, ctx.ElevationSource)
+	}
+
+	config.Elevation, config.ElevationSet = 0, false
+	ctx, err = prepareCity("Lhasa", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Elevation != 2100 || ctx.ElevationSource != "manual" {
+		t.Errorf("cached elevation = %v/%q", ctx.Elevation, ctx.ElevationSource)
+	}
+}
+
+//
+// ----------- 地平线轮廓与可见升落 -----------
+//
+
+func TestHorizonProfileAltitudeAt(t *testing.T) {
+	h, err := parseHorizonCSV(strings.NewReader("azimuth,altitude\n# 东侧山脊\n90,10\n270;2\n\n180\t4\n360 6\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 4 || h[0].Az != 0 || h[3].Az != 270 {
+		t.Fatalf("profile not sorted/normalized: %+v", h)
+	}
+	cases := map[float64]float64{0: 6, 45: 8, 90: 10, 135: 7, 270: 2, 315: 4, 360: 6, -45: 4, 765: 8}
+	for az, want := range cases {
+		if got := h.altitudeAt(az); math.Abs(got-want) > 1e-9 {
+			t.Errorf("altitudeAt(%v) = %v, want %v", az, got, want)
+		}
+	}
+	if got := (horizonProfile{{Az: 10, Alt: 3}}).altitudeAt(200); got != 3 {
+		t.Errorf("single point profile = %v", got)
+	}
+
+	for _, bad := range []string{"", "90,10\nabc,1\n", "400,1\n", "90,95\n", "90\n"} {
+		if _, err := parseHorizonCSV(strings.NewReader(bad)); err == nil {
+			t.Errorf("parseHorizonCSV(%q) expected error", bad)
+		}
+	}
+	for _, js := range []string{`[{"az":0,"alt":1},{"az":180,"alt":3}]`, `{"points":[{"az":180,"alt":3},{"az":0,"alt":1}]}`} {
+		h, err := parseHorizonJSON(strings.NewReader(js))
+		if err != nil || len(h) != 2 || h.altitudeAt(90) != 2 {
+			t.Errorf("parseHorizonJSON(%s) = %+v, %v", js, h, err)
+		}
+	}
+}
+
+func TestVisibleRiseSetAgainstHorizon(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	day := time.Date(2025, 3, 20, 0, 0, 0, 0, loc)
+	lat, lon := 39.9, 116.4
+
+	// 平坦地平线：可见升落与几何升落一致。阈值相同，即太阳几何高度为 -0.833° 时恰好可见
+	flat := computeVisibleTimes(day, lat, lon, horizonProfile{{Az: 0, Alt: 0}})
+	from := time.Date(2025, 3, 20, 0, 0, 0, 0, loc)
+	geoRise, geoSet := visibleRiseSet(from, from.AddDate(0, 0, 1), func(t time.Time) float64 {
+		return radToDeg(suncalc.GetPosition(t, lat, lon).Altitude) - sunRiseAltitudeDeg
+	})
+	if d := flat.Sunrise.Sub(geoRise); d.Abs() > horizonPrecision {
+		t.Errorf("flat visible sunrise %v vs altitude %v° at %v (%v)", flat.Sunrise, sunRiseAltitudeDeg, geoRise, d)
+	}
+	if d := flat.Sunset.Sub(geoSet); d.Abs() > horizonPrecision {
+		t.Errorf("flat visible sunset %v vs altitude %v° at %v (%v)", flat.Sunset, sunRiseAltitudeDeg, geoSet, d)
+	}
+	// sunmooncalc 的 GetTimes 为近似解（与 GetPosition 相差约 1 分钟），只做粗略比较
+	times := suncalc.GetTimes(day.Add(12*time.Hour), lat, lon)
+	if d := flat.Sunrise.Sub(times[suncalc.Sunrise].Value); d.Abs() > 2*time.Minute {
+		t.Errorf("flat visible sunrise %v vs geometric %v (%v)", flat.Sunrise, times[suncalc.Sunrise].Value, d)
+	}
+	if d := flat.Sunset.Sub(times[suncalc.Sunset].Value); d.Abs() > 2*time.Minute {
+		t.Errorf("flat visible sunset %v vs geometric %v (%v)", flat.Sunset, times[suncalc.Sunset].Value, d)
+	}
+	moon := suncalc.GetMoonTimes(day, lat, lon, false)
+	if !moon.Rise.IsZero() && !flat.Moonrise.IsZero() {
+		if d := flat.Moonrise.Sub(moon.Rise); d.Abs() > time.Minute {
+			t.Errorf("flat visible moonrise %v vs geometric %v (%v)", flat.Moonrise, moon.Rise, d)
+		}
+	}
+
+	// 东侧 8° 山脊：可见日出明显推迟，日落不受影响
+	valley := horizonProfile{{Az: 45, Alt: 0}, {Az: 60, Alt: 8}, {Az: 120, Alt: 8}, {Az: 135, Alt: 0}}
+	v := computeVisibleTimes(day, lat, lon, valley)
+	if delay := v.Sunrise.Sub(flat.Sunrise); delay < 40*time.Minute || delay > 70*time.Minute {
+		t.Errorf("ridge delay = %v", delay)
+	}
+	if d := v.Sunset.Sub(flat.Sunset); d != 0 && (d > time.Minute || d < -time.Minute) {
+		t.Errorf("sunset should be unaffected: %v vs %v", v.Sunset, flat.Sunset)
+	}
+}
+
+func TestVisibleColumnsInExports(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	start := time.Date(2025, 3, 20, 0, 0, 0, 0, loc)
+	ctx := &CityContext{City: "Valley", Lat: 39.9, Lon: 116.4, Loc: loc, Horizon: horizonProfile{{Az: 90, Alt: 8}, {Az: 270, Alt: 1}}}
+	data, err := generateAstroDataFor(ctx, start, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[0].VisibleSunrise == "" || data[0].VisibleSunrise <= data[0].Sunrise {
+		t.Fatalf("visible sunrise %q should follow geometric %q", data[0].VisibleSunrise, data[0].Sunrise)
+	}
+
+	var buf bytes.Buffer
+	if err := writeAstroCSVTo(&buf, "Valley", observerElevation{}, start, data, ""); err != nil || !strings.Contains(buf.String(), "date,sunrise,visible_sunrise,sunset,visible_sunset,") {
+		t.Errorf("csv header missing visible columns: %v\n%s", err, buf.String())
+	}
+	buf.Reset()
+	if err := writeAstroTxtTo(&buf, "Valley", observerElevation{}, start, data, ""); err != nil || !strings.Contains(buf.String(), "日出\t可见日出\t日落\t可见日落") {
+		t.Errorf("txt header missing visible columns: %v", err)
+	}
+	buf.Reset()
+	if err := writeAstroICS(&buf, "Valley", observerElevation{}, start, data, map[string]bool{"sunrise": true}); err != nil || !strings.Contains(buf.String(), "SUMMARY:可见日出") || strings.Contains(buf.String(), "可见日落") {
+		t.Errorf("ics visible events mismatch: %v", err)
+	}
+
+	// 未设置轮廓时不输出 visible_* 列
+	plain := []dailyAstro{{Date: "2025-03-20", Sunrise: "06:10"}}
+	buf.Reset()
+	_ = writeAstroCSVTo(&buf, "Plain", observerElevation{}, start, plain, "")
+	if strings.Contains(buf.String(), "visible_") {
+		t.Errorf("plain csv should omit visible columns")
+	}
+}
+
+func TestAstroAPIHorizonPost(t *testing.T) {
+	body := "az,alt\n60,8\n120,8\n240,1\n"
+	req := httptest.NewRequest("POST", "/api/astro?lat=39.9&lon=116.4&tz=Asia/Shanghai&city=Valley&mode=day&date=2025-03-20&format=json", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+	rr := httptest.NewRecorder()
+	astroAPIHandler(rr, req)
+	var resp astroAPIResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || len(resp.Data) != 1 {
+		t.Fatalf("decode: %v (%d %s)", err, rr.Code, rr.Body.String())
+	}
+	if resp.Data[0].VisibleSunrise == "" || resp.Data[0].VisibleSunset == "" {
+		t.Errorf("POST horizon should yield visible times: %+v", resp.Data[0])
+	}
+
+	req = httptest.NewRequest("POST", "/api/astro?lat=39.9&lon=116.4&city=Valley&mode=day&date=2025-03-20", strings.NewReader(`{"points":[{"az":400,"alt":1}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	astroAPIHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid horizon status = %d", rr.Code)
+	}
+}
+
+func TestHorizonFilePersistsInCache(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "horizon.json")
+	if err := os.WriteFile(path, []byte(`[{"az":90,"alt":12},{"az":270,"alt":3}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	orig := config.HorizonFile
+	defer func() { config.HorizonFile = orig }()
+
+	config.HorizonFile = path
+	if ctx, err := prepareCity("Kunming", true); err != nil || len(ctx.Horizon) != 2 {
+		t.Fatalf("prepareCity with horizon = %+v, %v", ctx, err)
+	}
+	config.HorizonFile = ""
+	ctx, err := prepareCity("Kunming", true)
+	if err != nil || len(ctx.Horizon) != 2 || ctx.Horizon.altitudeAt(90) != 12 {
+		t.Errorf("cached horizon = %+v, %v", ctx, err)
+	}
+
+	config.HorizonFile = filepath.Join(t.TempDir(), "missing.csv")
+	if _, err := prepareCity("Kunming", true); err == nil {
+		t.Errorf("missing horizon file should fail")
+	}
+}
+
+//
+// ----------- 大气折射与视高度 -----------
+//
+
+func TestRefractionModels(t *testing.T) {
+	std := standardAtmosphere
+	// 地平线附近约 29′，45° 约 1′
+	if r := saemundssonRefractionDeg(0, std) * 60; math.Abs(r-29) > 1 {
+		t.Errorf("refraction at horizon = %.2f′", r)
+	}
+	if r := saemundssonRefractionDeg(45, std) * 60; math.Abs(r-1) > 0.1 {
+		t.Errorf("refraction at 45° = %.2f′", r)
+	}
+	if saemundssonRefractionDeg(-3, std) != 0 {
+		t.Errorf("no refraction expected well below the horizon")
+	}
+	// 适用下限处连续：其下线性减小到 0，视高度单调递增
+	edge := saemundssonRefractionDeg(refractionMinAltitude, std)
+	if below := saemundssonRefractionDeg(refractionMinAltitude-1e-9, std); math.Abs(below-edge) > 1e-6 {
+		t.Errorf("refraction jumps at %v°: %v -> %v", refractionMinAltitude, below, edge)
+	}
+	if mid := saemundssonRefractionDeg(refractionMinAltitude-refractionTaperDeg/2, std); math.Abs(mid-edge/2) > 1e-9 {
+		t.Errorf("taper midpoint = %v, want %v", mid, edge/2)
+	}
+	prev := apparentAltitude(-3, std)
+	for h := -3.0; h <= 1; h += 0.01 {
+		cur := apparentAltitude(h, std)
+		if cur < prev {
+			t.Errorf("apparent altitude not monotonic at %.2f°: %v < %v", h, cur, prev)
+			break
+		}
+		prev = cur
+	}
+	// 寒冷高压时折射更强，真空无折射
+	cold := atmosphere{TempC: -30, PressureHPa: 1040}
+	if saemundssonRefractionDeg(5, cold) <= saemundssonRefractionDeg(5, std) {
+		t.Errorf("cold dense air should refract more")
+	}
+	if apparentAltitude(5, atmosphere{TempC: 10, PressureHPa: 0}) != 5 {
+		t.Errorf("zero pressure should disable refraction")
+	}
+	if (atmosphere{TempC: 100, PressureHPa: 1010}).validate() == nil || (atmosphere{TempC: 0, PressureHPa: 2000}).validate() == nil {
+		t.Errorf("validate should reject out-of-range values")
+	}
+
+	// 去掉库中月亮高度的标准折射
+	for _, g := range []float64{-5, -0.5, 0, 3, 40} {
+		lib := g + refractionDeg(g)
+		if got := moonGeometricAltitude(lib); math.Abs(got-g) > 1e-6 {
+			t.Errorf("moonGeometricAltitude(%v) = %v, want %v", lib, got, g)
+		}
+	}
+}
+
+func TestPositionsAPIApparentAltitude(t *testing.T) {
+	origNow := app.now
+	defer func() { app.now = origNow }()
+	// 北京日落前后，太阳接近地平线，折射最明显
+	app.now = func() time.Time { return time.Date(2025, 3, 20, 10, 15, 0, 0, time.UTC) }
+
+	get := func(query string) livePositionsResponse {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		positionsAPIHandler(rr, httptest.NewRequest("GET", "/api/positions?lat=39.9&lon=116.4&city=Beijing"+query, nil))
+		var resp livePositionsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode: %v (%d %s)", err, rr.Code, rr.Body.String())
+		}
+		return resp
+	}
+	resp := get("")
+	sun := resp.Sun
+	if sun.AltitudeDeg < -1 || sun.AltitudeDeg > 5 {
+		t.Fatalf("unexpected sun altitude %.2f", sun.AltitudeDeg)
+	}
+	if diff := sun.ApparentAltitudeDeg - sun.AltitudeDeg; diff < 0.1 || diff > 0.6 {
+		t.Errorf("sun refraction = %.3f°", diff)
+	}
+	if resp.Atmosphere != standardAtmosphere || len(resp.Planets) == 0 || resp.Planets[0].ApparentAltitudeDeg == 0 {
+		t.Errorf("atmosphere/planets mismatch: %+v", resp.Atmosphere)
+	}
+
+	cold := get("&temp_c=-20&pressure_hpa=1040")
+	if cold.Sun.ApparentAltitudeDeg-cold.Sun.AltitudeDeg <= sun.ApparentAltitudeDeg-sun.AltitudeDeg {
+		t.Errorf("cold air refraction should be larger")
+	}
+
+	rr := httptest.NewRecorder()
+	positionsAPIHandler(rr, httptest.NewRequest("GET", "/api/positions?lat=39.9&lon=116.4&city=Beijing&pressure_hpa=abc", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("bad pressure status = %d", rr.Code)
+	}
+}
+
+//
+// ----------- 太阳轨迹图 -----------
+//
+
+func TestSunPathProjectionAndRuns(t *testing.T) {
+	for in, want := range map[string]string{"": sunPathStereographic, "Polar": sunPathStereographic, "cyl": sunPathCylindrical} {
+		if got, err := parseSunPathProjection(in); err != nil || got != want {
+			t.Errorf("parseSunPathProjection(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := parseSunPathProjection("mercator"); err == nil {
+		t.Error("expected projection error")
+	}
+
+	st := newSunPathChart(sunPathStereographic, 40)
+	if x, y := st.project(sunPathPoint{Az: 123, Alt: 90}); math.Abs(x-st.cx) > 1e-9 || math.Abs(y-st.cy) > 1e-9 {
+		t.Errorf("zenith = (%.2f, %.2f)", x, y)
+	}
+	if x, y := st.project(sunPathPoint{Az: 90, Alt: 0}); math.Abs(x-(st.cx+st.r)) > 1e-9 || math.Abs(y-st.cy) > 1e-9 {
+		t.Errorf("east horizon = (%.2f, %.2f)", x, y)
+	}
+	cyl := newSunPathChart(sunPathCylindrical, 40)
+	if x, _ := cyl.project(sunPathPoint{Az: 180}); math.Abs(x-(cyl.x0+cyl.x1)/2) > 1e-9 {
+		t.Errorf("north hemisphere should center south, x=%.2f", x)
+	}
+	if newSunPathChart(sunPathCylindrical, -33).center != 0 {
+		t.Error("south hemisphere should center north")
+	}
+
+	runs := visibleRuns([]sunPathPoint{{350, -2}, {10, 2}, {20, 4}, {30, -4}})
+	if len(runs) != 1 || len(runs[0]) != 4 {
+		t.Fatalf("runs = %+v", runs)
+	}
+	if first, last := runs[0][0], runs[0][3]; math.Abs(first.Az-0) > 1e-9 || first.Alt != 0 || math.Abs(last.Az-25) > 1e-9 {
+		t.Errorf("horizon endpoints = %+v / %+v", first, last)
+	}
+	// 圆柱投影跨越正北（画布左右边界）时断开
+	if paths := cyl.paths([]sunPathPoint{{340, 5}, {350, 6}, {10, 6}, {20, 5}}); len(paths) != 2 {
+		t.Errorf("cylindrical paths = %d, want 2", len(paths))
+	}
+}
+
+func TestRenderSunPathSVG(t *testing.T) {
+	loc, _ := time.LoadLocation("America/New_York")
+	ctx := &CityContext{City: "NYC", DisplayName: "New York", Lat: 40.71, Lon: -74.01, TZID: "America/New_York", Loc: loc,
+		Now:     time.Date(2025, 6, 21, 16, 0, 0, 0, time.UTC),
+		Horizon: horizonProfile{{Az: 0, Alt: 2}, {Az: 180, Alt: 6}}}
+	for _, proj := range []string{sunPathStereographic, sunPathCylindrical} {
+		var buf bytes.Buffer
+		if err := renderSunPathSVG(&buf, ctx, 0, proj); err != nil {
+			t.Fatalf("%s: %v", proj, err)
+		}
+		out := buf.String()
+		dec := xml.NewDecoder(strings.NewReader(out))
+		for {
+			if _, err := dec.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: invalid SVG: %v", proj, err)
+			}
+		}
+		for _, want := range []string{"New York 2025 年太阳轨迹图", "标准时 UTC-05:00", "12 月 21 日", `fill="#ffd43b"`, `fill-rule="evenodd"`} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: missing %q", proj, want)
+			}
+		}
+		for _, c := range sunPathMonthColors {
+			if !strings.Contains(out, `stroke="`+c+`"/>`) {
+				t.Errorf("%s: missing month curve %s", proj, c)
+			}
+		}
+		// 纽约夏至正午前后可见 5~19 时的时角线
+		if !strings.Contains(out, ">5</text>") || !strings.Contains(out, ">19</text>") || strings.Contains(out, ">2</text>") {
+			t.Errorf("%s: unexpected hour labels", proj)
+		}
+	}
+
+	night := *ctx
+	night.Now = time.Date(2025, 6, 21, 5, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	if err := renderSunPathSVG(&buf, &night, 2025, ""); err != nil || !strings.Contains(buf.String(), "位于地平线下") || strings.Contains(buf.String(), "#ffd43b") {
+		t.Errorf("night marker: err=%v", err)
+	}
+	if err := renderSunPathSVG(io.Discard, ctx, 1800, ""); err == nil {
+		t.Error("expected out-of-range year error")
+	}
+}
+
+func TestSunPathAPIAndFile(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sunPathAPIHandler(rr, httptest.NewRequest("GET", "/api/sunpath.svg?lat=39.9&lon=116.4&tz=Asia/Shanghai&year=2025&projection=cylindrical", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "image/svg+xml") || !strings.Contains(rr.Body.String(), "圆柱投影") {
+		t.Fatalf("status=%d type=%q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	for _, bad := range []string{"year=abc", "year=3000", "projection=mercator"} {
+		rr = httptest.NewRecorder()
+		sunPathAPIHandler(rr, httptest.NewRequest("GET", "/api/sunpath.svg?lat=39.9&lon=116.4&tz=Asia/Shanghai&"+bad, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", bad, rr.Code)
+		}
+	}
+
+	dir := t.TempDir()
+	ctx := &CityContext{City: "Beijing", Lat: 39.9, Lon: 116.4, TZID: "Asia/Shanghai", Loc: time.FixedZone("CST", 8*3600), Now: time.Date(2025, 3, 20, 4, 0, 0, 0, time.UTC)}
+	opts := OutputOptions{OutDir: dir}
+	if err := runSunPath(ctx, 0, "cyl", "", opts); err != nil {
+		t.Fatalf("runSunPath: %v", err)
+	}
+	path := filepath.Join(dir, "Beijing-sunpath-2025-cylindrical.svg")
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected %s: %v", path, err)
+	}
+	if err := runSunPath(ctx, 0, "cyl", "", opts); err == nil || !strings.Contains(err.Error(), "文件已存在") {
+		t.Errorf("expected overwrite protection, got %v", err)
+	}
+	opts.AllowOverwrite = true
+	if err := runSunPath(ctx, 0, "cyl", "", opts); err != nil {
+		t.Errorf("overwrite: %v", err)
+	}
+}
+
+//
+// ----------- 日序列图表 -----------
+//
+
+func TestAstroChartSeries(t *testing.T) {
+	// 显示字符串故意与数值字段不一致：序列只应取数值字段
+	data := []dailyAstro{
+		{Date: "2025-06-21", Sunrise: "04:45", Sunset: "19:46", DayLength: "xx", MaxAltitude: "xx", MoonIllumFrac: "xx",
+			HasSunrise: true, HasSunset: true, HasDayLength: true, DayLengthMinutes: 901, MaxAltitudeNum: 73.55, MoonIlluminationNum: 0.184},
+		{Date: "2025-06-22", Sunrise: "--", Sunset: "--", DayLength: "--", MaxAltitudeNum: 46.5, MoonIlluminationNum: 0.11},
+		{Date: "2025-12-21", Sunrise: "--", Sunset: "--", DayLength: "--", MaxAltitudeNum: -3.1, MoonIlluminationNum: 0.012},
+		{Date: "2025-12-22", Sunrise: "10:58", Sunset: "--", DayLength: "--", HasSunrise: true, MaxAltitudeNum: 0.4},
+	}
+	s := newAstroChartSeries(data)
+	if math.Abs(s.DayLength[0]-(15+1.0/60)) > 1e-9 || math.Abs(s.Sunrise[0]-4.75) > 1e-9 || s.NoonAltitude[0] != 73.55 || math.Abs(s.MoonIllum[0]-18.4) > 1e-9 {
+		t.Errorf("row 0 = %v %v %v %v", s.DayLength[0], s.Sunrise[0], s.NoonAltitude[0], s.MoonIllum[0])
+	}
+	if s.DayLength[1] != 24 || s.DayLength[2] != 0 {
+		t.Errorf("polar day/night = %v / %v, want 24 / 0", s.DayLength[1], s.DayLength[2])
+	}
+	if !math.IsNaN(s.DayLength[3]) || !math.IsNaN(s.Sunset[3]) || math.Abs(s.Sunrise[3]-(10+58.0/60)) > 1e-9 {
+		t.Errorf("partial day: day length and sunset should be NaN: %+v", s)
+	}
+
+	if lo, hi := niceRange(2, 0, 24, []float64{9.3, math.NaN(), 14.9}); lo != 8 || hi != 16 {
+		t.Errorf("niceRange = %v ~ %v", lo, hi)
+	}
+	if lo, hi := niceRange(2, 0, 24, []float64{24}); lo != 22 || hi != 24 {
+		t.Errorf("niceRange flat = %v ~ %v", lo, hi)
+	}
+	if lo, hi := niceRange(10, -90, 90, []float64{math.NaN()}); lo != -90 || hi != 90 {
+		t.Errorf("niceRange empty = %v ~ %v", lo, hi)
+	}
+
+	year := make([]string, 365)
+	for i := range year {
+		year[i] = time.Date(2025, 1, 1+i, 0, 0, 0, 0, time.UTC).Format("2006-01-02")
+	}
+	if got := chartXLabels(year); len(got) != 12 || got[1] != 31 {
+		t.Errorf("year labels = %v", got)
+	}
+	if got := chartXLabels(year[:20]); len(got) != 10 || got[1] != 2 {
+		t.Errorf("short labels = %v", got)
+	}
+}
+
+func TestAstroChartOutputs(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	ctx := &CityContext{City: "Beijing", Lat: 39.9, Lon: 116.4, Loc: loc}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, loc)
+	data, err := generateAstroDataFor(ctx, start, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	svgPath, err := writeAstroFile("svg", false, dir, "Beijing", observerElevation{Meters: 50}, start, data, "2025 Q1", "beijing-q1")
+	if err != nil || filepath.Ext(svgPath) != ".svg" {
+		t.Fatalf("svg: %q %v", svgPath, err)
+	}
+	raw, _ := os.ReadFile(svgPath)
+	dec := xml.NewDecoder(bytes.NewReader(raw))
+	for {
+		if _, err := dec.Token(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("invalid SVG: %v", err)
+		}
+	}
+	for _, want := range []string{"昼长（小时）", "正午太阳高度（度）", "日出 / 日落（当地时间）", "月面照亮比例（%）", "范围：2025 Q1", `data-n="90"`, ">02-01</text>"} {
+		if !bytes.Contains(raw, []byte(want)) {
+			t.Errorf("svg missing %q", want)
+		}
+	}
+
+	htmlPath, err := writeAstroFile("html", false, dir, "Beijing", observerElevation{Meters: 50}, start, data, "2025 Q1", "beijing-q1")
+	if err != nil || filepath.Ext(htmlPath) != ".html" {
+		t.Fatalf("html: %q %v", htmlPath, err)
+	}
+	page, _ := os.ReadFile(htmlPath)
+	if !bytes.Contains(page, []byte("<svg")) || !bytes.Contains(page, []byte(`id="astro-data">[{"date":"2025-01-01"`)) || bytes.Contains(page, []byte("<script src")) {
+		t.Errorf("html should embed svg and data without external scripts")
+	}
+}
+
+func TestAstroChartsAPIAndView(t *testing.T) {
+	rr := httptest.NewRecorder()
+	astroAPIHandler(rr, httptest.NewRequest("GET", "/api/astro?lat=39.9&lon=116.4&tz=Asia/Shanghai&mode=range&from=2025-03-01&to=2025-03-31&format=svg", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "image/svg+xml") ||
+		!strings.HasPrefix(rr.Header().Get("Content-Disposition"), "inline") || !strings.Contains(rr.Body.String(), `data-n="31"`) {
+		t.Fatalf("svg api: status=%d headers=%v", rr.Code, rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	astroViewHandler(rr, httptest.NewRequest("GET", "/view/astro?lat=39.9&lon=116.4&tz=Asia/Shanghai&city=Beijing", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("view: status=%d body=%s", rr.Code, rr.Body.String())
+	}
+	if body := rr.Body.String(); !strings.Contains(body, "城市天文数据图表：Beijing") || !strings.Contains(body, "astro-data") || strings.Count(body, `{"date":`) < 365 {
+		t.Errorf("view should embed a full year of data")
+	}
+
+	for _, bad := range []string{"mode=day", "mode=range&from=2025-03-01", "mode=week", "mode=range&from=2025-03-05&to=2025-03-01"} {
+		rr = httptest.NewRecorder()
+		astroViewHandler(rr, httptest.NewRequest("GET", "/view/astro?lat=39.9&lon=116.4&tz=Asia/Shanghai&"+bad, nil))
+		if rr.Code == http.StatusOK {
+			t.Errorf("%s: expected error status", bad)
+		}
+	}
+}
+
+//
+// ----------- 年度 HTML 报告 -----------
+//
+
+func TestDailyMoonGlyphs(t *testing.T) {
+	data := []dailyAstro{{}, {PhaseEventType: "full_moon"}, {}, {}, {PhaseEventType: "last_quarter"}, {}, {PhaseEventType: "new_moon"}, {}}
+	got := strings.Join(dailyMoonGlyphs(data), "")
+	if want := "🌔🌕🌖🌖🌗🌘🌑🌒"; got != want {
+		t.Errorf("glyphs = %s, want %s", got, want)
+	}
+	if got := dailyMoonGlyphs([]dailyAstro{{}, {}}); got[0] != "" || got[1] != "" {
+		t.Errorf("no events should leave glyphs empty: %q", got)
+	}
+}
+
+func TestAstroReportStats(t *testing.T) {
+	data := []dailyAstro{
+		{Date: "2025-06-20", Sunrise: "04:46", Sunset: "19:45", DayLength: "14:59", DayLengthMinutes: 899, HasSunrise: true, HasSunset: true, HasDayLength: true},
+		{Date: "2025-06-21", Sunrise: "04:46", Sunset: "19:46", DayLength: "15:00", DayLengthMinutes: 900, HasSunrise: true, HasSunset: true, HasDayLength: true, PhaseEventType: "full_moon", PhaseEvent: "满月 03:12"},
+		{Date: "2025-06-22", Sunrise: "04:47", Sunset: "19:46", DayLength: "14:59", DayLengthMinutes: 899, HasSunrise: true, HasSunset: true, HasDayLength: true},
+		{Date: "2025-06-23", Sunrise: "--", Sunset: "--", DayLength: "--"},
+	}
+	stats, fullMoons := astroReportStats(data)
+	want := []astroReportStat{
+		{"最长白昼", "15:00", "2025-06-21"},
+		{"最短白昼", "14:59", "2025-06-20"},
+		{"最早日出", "04:46", "2025-06-20"},
+		{"最晚日落", "19:46", "2025-06-21"},
+	}
+	for i, w := range want {
+		if stats[i] != w {
+			t.Errorf("stats[%d] = %+v, want %+v", i, stats[i], w)
+		}
+	}
+	if len(fullMoons) != 1 || fullMoons[0] != "2025-06-21 03:12" {
+		t.Errorf("full moons = %v", fullMoons)
+	}
+	if stats, _ := astroReportStats(data[3:]); stats[0].Value != "--" || stats[3].Date != "" {
+		t.Errorf("polar stats = %+v", stats)
+	}
+}
+
+func TestAstroReportOutput(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	ctx := &CityContext{City: "Beijing", Lat: 39.9, Lon: 116.4, Loc: loc, Now: time.Date(2025, 1, 1, 8, 0, 0, 0, loc)}
+	data, desc, baseName, err := buildYearData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := writeAstroFile("report", false, t.TempDir(), ctx.City, observerElevation{}, ctx.Now, data, desc, baseName)
+	if err != nil || !strings.HasSuffix(path, "-year.report.html") {
+		t.Fatalf("report: %q %v", path, err)
+	}
+	raw, _ := os.ReadFile(path)
+	page := string(raw)
+	for _, want := range []string{"eSunMoon 天文年报：Beijing", "2025 年 1 月", "2025 年 12 月", "最长白昼", "2025-06-2", "满月（12 次）", "🌕", "冬至", "<svg", "@page"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("report missing %q", want)
+		}
+	}
+	if strings.Contains(page, "2026 年 1 月") || strings.Count(page, `<div class="month">`) != 12 {
+		t.Errorf("expected exactly 12 month calendars")
+	}
+	for _, external := range []string{"src=", "href=", "url(", "@import"} {
+		if strings.Contains(page, external) {
+			t.Errorf("report should not reference external assets (%s)", external)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	astroAPIHandler(rr, httptest.NewRequest("GET", "/api/astro?lat=39.9&lon=116.4&tz=Asia/Shanghai&mode=range&from=2025-03-01&to=2025-03-31&format=report", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") || !strings.Contains(rr.Header().Get("Content-Disposition"), ".report.html") {
+		t.Errorf("report api: status=%d headers=%v", rr.Code, rr.Header())
+	}
+}
+
+//
+// ----------- 实时位置推送（SSE） -----------
+//
+
+// readSSEEvent 读取下一条 SSE 事件（跳过 retry 与心跳注释），返回事件名与数据。
+func readSSEEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+	var event, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read SSE: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			if event != "" || data != "" {
+				return event, data
+			}
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestPositionsHubSharesFeed(t *testing.T) {
+	hub := newPositionsHub()
+	beijing := &CityContext{City: "Beijing", Lat: 39.9, Lon: 116.4, TZID: "Asia/Shanghai", Loc: time.FixedZone("CST", 8*3600)}
+	beijing2 := *beijing
+	tokyo := &CityContext{City: "Tokyo", Lat: 35.68, Lon: 139.69, TZID: "Asia/Tokyo", Loc: time.FixedZone("JST", 9*3600)}
+
+	a := newPositionsSubscriber(time.Hour)
+	b := newPositionsSubscriber(time.Second)
+	hub.subscribe(a, beijing)
+	hub.subscribe(b, &beijing2)
+	hub.subscribe(b, tokyo)
+	if n := hub.feedCount(); n != 2 {
+		t.Fatalf("feeds = %d, want 2 (Beijing shared)", n)
+	}
+	if f := hub.feeds[streamKey(beijing)]; f.tick != time.Second || len(f.subs) != 2 {
+		t.Errorf("shared feed tick=%v subs=%d", f.tick, len(f.subs))
+	}
+
+	recv := func(s *positionsSubscriber) livePositionsResponse {
+		t.Helper()
+		select {
+		case frame := <-s.frames:
+			var resp livePositionsResponse
+			if err := json.Unmarshal(frame, &resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for frame")
+		}
+		return livePositionsResponse{}
+	}
+	if got := recv(a); got.City != "Beijing" {
+		t.Errorf("a initial frame city = %q", got.City)
+	}
+	cities := map[string]int{}
+	for i := 0; i < 3; i++ {
+		cities[recv(b).City]++
+	}
+	if cities["Beijing"] == 0 || cities["Tokyo"] == 0 {
+		t.Errorf("b should receive both cities, got %v", cities)
+	}
+	// a 的间隔为 1 小时，共享 ticker 按 1 秒触发也不应再收到帧
+	select {
+	case <-a.frames:
+		t.Error("hourly subscriber received an extra frame")
+	default:
+	}
+
+	hub.unsubscribe(b)
+	if f := hub.feeds[streamKey(beijing)]; hub.feedCount() != 1 || f.tick != time.Hour {
+		t.Errorf("after unsubscribe feeds=%d", hub.feedCount())
+	}
+	hub.closeAll()
+	select {
+	case <-a.done:
+	default:
+		t.Error("closeAll should end subscribers")
+	}
+	hub.unsubscribe(a) // 关闭后再退订不应 panic
+	if hub.feedCount() != 0 {
+		t.Errorf("feeds after closeAll = %d", hub.feedCount())
+	}
+}
+
+func TestPositionsStreamHandler(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origHub := app.streams
+	app.streams = newPositionsHub()
+	defer func() { app.streams = origHub }()
+
+	srv := httptest.NewServer(http.HandlerFunc(positionsStreamHandler))
+	defer srv.Close()
+
+	for _, bad := range []string{"lat=39.9&lon=116.4&interval=0", "lat=39.9&lon=116.4&interval=abc", "", "lat=39.9&lon=116.4&pressure_hpa=-1",
+		"city=a&city=b&city=c&city=d&city=e&city=f&city=g&city=h&city=i&city=j&city=k"} {
+		resp, err := http.Get(srv.URL + "?" + bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want 400", bad, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "?city=Beijing&city=Shanghai&interval=1&temp_c=-5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Fatalf("content type = %q", ct)
+	}
+	br := bufio.NewReader(resp.Body)
+	seen := map[string]bool{}
+	for i := 0; i < 4 && len(seen) < 2; i++ {
+		event, data := readSSEEvent(t, br)
+		var frame livePositionsResponse
+		if err := json.Unmarshal([]byte(data), &frame); err != nil || event != streamEventPositions {
+			t.Fatalf("event %q data %q: %v", event, data, err)
+		}
+		if frame.Atmosphere.TempC != -5 {
+			t.Errorf("atmosphere not applied: %+v", frame.Atmosphere)
+		}
+		seen[frame.City] = true
+	}
+	if len(seen) != 2 || app.streams.feedCount() != 2 {
+		t.Errorf("seen cities %v, feeds %d", seen, app.streams.feedCount())
+	}
+	resp.Body.Close()
+
+	// 客户端断开后推送源随之停止
+	deadline := time.Now().Add(3 * time.Second)
+	for app.streams.feedCount() != 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := app.streams.feedCount(); n != 0 {
+		t.Errorf("feeds after disconnect = %d", n)
+	}
+}
+
+func TestServeGracefulShutdownClosesStreams(t *testing.T) {
+	origHub := app.streams
+	app.streams = newPositionsHub()
+	defer func() { app.streams = origHub }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot grab ephemeral port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/positions/stream", positionsStreamHandler)
+	stop := make(chan os.Signal, 1)
+	errCh := make(chan error, 1)
+	go func() { errCh <- serveWithGracefulShutdown(addr, mux, stop) }()
+
+	var resp *http.Response
+	for i := 0; i < 20; i++ {
+		if resp, err = http.Get("http://" + addr + "/api/positions/stream?lat=39.9&lon=116.4&tz=Asia/Shanghai&interval=60"); err == nil {
+			break
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+	if err != nil {
+		t.Skipf("server not reachable (possible sandbox bind restrictions): %v", err)
+	}
+	defer resp.Body.Close()
+	readSSEEvent(t, bufio.NewReader(resp.Body))
+
+	start := time.Now()
+	stop <- syscall.SIGTERM
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("shutdown error: %v", err)
+		}
+	case <-time.After(serveShutdown + time.Second):
+		t.Fatal("shutdown blocked by open stream")
+	}
+	if d := time.Since(start); d > serveShutdown/2 {
+		t.Errorf("shutdown took %v, stream should close immediately", d)
+	}
+}
+
+//
+// ----------- OpenAPI 文档与路由表 -----------
+//
+
+// queryParamsReadBy 静态分析包内函数 name 读取的查询参数名：收集 url.Values 变量上 Get("x") 与 ["x"] 的字面量，
+// 并递归进入以 url.Values 为实参调用的包内函数；键名不是字面量时（如遍历字段表）收集函数内复合字面量的首个字符串元素。
+func queryParamsReadBy(funcs map[string]*ast.FuncDecl, name string, visited, out map[string]bool) {
+	fn := funcs[name]
+	if fn == nil || visited[name] {
+		return
+	}
+	visited[name] = true
+	isValues := func(e ast.Expr) bool {
+		sel, ok := e.(*ast.SelectorExpr)
+		return ok && sel.Sel.Name == "Values"
+	}
+	literal := func(e ast.Expr) (string, bool) {
+		lit, ok := e.(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			return "", false
+		}
+		s, err := strconv.Unquote(lit.Value)
+		return s, err == nil
+	}
+	vals := make(map[string]bool)
+	for _, field := range fn.Type.Params.List {
+		if isValues(field.Type) {
+			for _, n := range field.Names {
+				vals[n.Name] = true
+			}
+		}
+	}
+	dynamic := false
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.AssignStmt:
+			for i, rhs := range n.Rhs {
+				id, ok := n.Lhs[i].(*ast.Ident)
+				if !ok || len(n.Lhs) != len(n.Rhs) {
+					continue
+				}
+				switch r := rhs.(type) {
+				case *ast.CallExpr:
+					if sel, ok := r.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Query" {
+						vals[id.Name] = true
+					}
+				case *ast.CompositeLit:
+					if isValues(r.Type) {
+						vals[id.Name] = true
+					}
+				}
+			}
+		case *ast.IndexExpr:
+			if id, ok := n.X.(*ast.Ident); ok && vals[id.Name] {
+				if key, ok := literal(n.Index); ok {
+					out[key] = true
+				}
+			}
+		case *ast.CallExpr:
+			if sel, ok := n.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Get" && len(n.Args) == 1 {
+				if id, ok := sel.X.(*ast.Ident); ok && vals[id.Name] {
+					if key, ok := literal(n.Args[0]); ok {
+						out[key] = true
+					} else {
+						dynamic = true
+					}
+				}
+			}
+			if callee, ok := n.Fun.(*ast.Ident); ok {
+				for _, a := range n.Args {
+					if id, ok := a.(*ast.Ident); ok && vals[id.Name] {
+						queryParamsReadBy(funcs, callee.Name, visited, out)
+						break
+					}
+				}
+			}
+		}
+		return true
+	})
+	if dynamic {
+		// 键来自循环变量时：纯字符串切片（参数名列表）取全部元素，其余复合字面量（如 {参数名, 目标字段} 表）取首个元素
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			cl, ok := n.(*ast.CompositeLit)
+			if !ok || len(cl.Elts) == 0 {
+				return true
+			}
+			var keys []string
+			for _, e := range cl.Elts {
+				key, ok := literal(e)
+				if !ok {
+					keys = nil
+					break
+				}
+				keys = append(keys, key)
+			}
+			if len(keys) == 0 {
+				if key, ok := literal(cl.Elts[0]); ok {
+					keys = []string{key}
+				}
+			}
+			for _, key := range keys {
+				out[key] = true
+			}
+			return true
+		})
+	}
+}
+
+// packageFuncs 解析包内非测试源码，返回函数名到声明的映射（不含方法）。
+func packageFuncs(t *testing.T) map[string]*ast.FuncDecl {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	funcs := make(map[string]*ast.FuncDecl)
+	for _, path := range files {
+		if strings.HasSuffix(path, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			t.Fatalf("parse %s: %v", path, err)
+		}
+		for _, d := range f.Decls {
+			if fd, ok := d.(*ast.FuncDecl); ok && fd.Recv == nil {
+				funcs[fd.Name.Name] = fd
+			}
+		}
+	}
+	return funcs
+}
+
+func TestOpenAPIParamsMatchHandlers(t *testing.T) {
+	funcs := packageFuncs(t)
+	for _, rt := range apiRoutes() {
+		full := runtime.FuncForPC(reflect.ValueOf(rt.Handler).Pointer()).Name()
+		name := full[strings.LastIndex(full, ".")+1:]
+		if funcs[name] == nil {
+			t.Fatalf("%s: handler %s not found in package source", rt.Path, name)
+		}
+		read := make(map[string]bool)
+		queryParamsReadBy(funcs, name, make(map[string]bool), read)
+		var got, want []string
+		for k := range read {
+			got = append(got, k)
+		}
+		for _, p := range rt.Params {
+			if p.In == "query" {
+				want = append(want, p.Name)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s (%s): handler reads %v, spec documents %v", rt.Path, name, got, want)
+		}
+	}
+}
+
+func TestOpenAPIRoutesRegistered(t *testing.T) {
+	mux := newServeMux()
+	for _, rt := range apiRoutes() {
+		_, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, rt.Path, nil))
+		if pattern != rt.Path {
+			t.Errorf("%s served by pattern %q", rt.Path, pattern)
+		}
+	}
+	// 未登记的路径不应被服务
+	if _, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, "/api/unknown", nil)); pattern != "" {
+		t.Errorf("unexpected pattern %q for unknown path", pattern)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newServeMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("status=%d content-type=%q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if doc["openapi"] != openAPIVersion {
+		t.Errorf("openapi = %v", doc["openapi"])
+	}
+	paths := doc["paths"].(map[string]interface{})
+	routes := apiRoutes()
+	if len(paths) != len(routes) {
+		t.Errorf("spec has %d paths, registry has %d routes", len(paths), len(routes))
+	}
+	for _, rt := range routes {
+		ops, ok := paths[rt.Path].(map[string]interface{})
+		if !ok || len(ops) != len(rt.Methods) {
+			t.Errorf("%s: operations %v, want methods %v", rt.Path, ops, rt.Methods)
+		}
+	}
+	if _, ok := paths["/api/astro"].(map[string]interface{})["post"].(map[string]interface{})["requestBody"]; !ok {
+		t.Error("POST /api/astro should document the horizon request body")
+	}
+
+	components := doc["components"].(map[string]interface{})
+	schemas := components["schemas"].(map[string]interface{})
+	for _, name := range []string{"astroAPIResponse", "dailyAstro", "livePositionsResponse", "bodyPosition", "planetPosition", "cachedCity"} {
+		if _, ok := schemas[name]; !ok {
+			t.Errorf("schema %s missing", name)
+		}
+	}
+	live := schemas["livePositionsResponse"].(map[string]interface{})
+	props := live["properties"].(map[string]interface{})
+	if ref := props["sun"].(map[string]interface{})["$ref"]; ref != "#/components/schemas/bodyPosition" {
+		t.Errorf("sun $ref = %v", ref)
+	}
+	required := fmt.Sprint(live["required"])
+	if !strings.Contains(required, "planets") || strings.Contains(required, "warnings") {
+		t.Errorf("required = %s, want planets but not omitempty warnings", required)
+	}
+	if len(props) != reflect.TypeOf(livePositionsResponse{}).NumField() {
+		t.Errorf("livePositionsResponse has %d properties, struct has %d fields", len(props), reflect.TypeOf(livePositionsResponse{}).NumField())
+	}
+
+	// 所有 $ref 都必须指向已定义的组件
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				parts := strings.Split(strings.TrimPrefix(ref, "#/components/"), "/")
+				if len(parts) != 2 || components[parts[0]] == nil || components[parts[0]].(map[string]interface{})[parts[1]] == nil {
+					t.Errorf("dangling $ref %s", ref)
+				}
+			}
+			for _, c := range v {
+				walk(c)
+			}
+		case []interface{}:
+			for _, c := range v {
+				walk(c)
+			}
+		}
+	}
+	walk(doc)
+}
+
+func TestOpenAPIOperationIDs(t *testing.T) {
+	if got := operationID(http.MethodGet, "/api/astro.ics"); got != "getApiAstroIcs" {
+		t.Errorf("operationID = %q", got)
+	}
+	seen := make(map[string]bool)
+	for _, ops := range buildOpenAPIDocument().Paths {
+		for _, op := range ops {
+			if seen[op.OperationID] {
+				t.Errorf("duplicate operationId %s", op.OperationID)
+			}
+			seen[op.OperationID] = true
+		}
+	}
+}
+
+func TestAPIDocsPage(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newServeMux().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/docs", nil))
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("status=%d content-type=%q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(body, `fetch("openapi.json")`) {
+		t.Error("docs page should load the relative openapi.json")
+	}
+	for _, ext := range []string{`src="http`, `href="http`, `@import`} {
+		if strings.Contains(body, ext) {
+			t.Errorf("docs page references external resource: %s", ext)
+		}
+	}
+}
+
+//
+// ----------- 结构化错误 -----------
+//
+
+func TestAPIErrorModel(t *testing.T) {
+	base := errors.New("boom")
+	e := apiErrorf(errCodeInvalidDate, "from", "解析起始日期失败: %w", base)
+	if e.Error() != "解析起始日期失败: boom" || !errors.Is(e, base) || e.status() != http.StatusBadRequest {
+		t.Errorf("apiErrorf = %q, is=%v, status=%d", e.Error(), errors.Is(e, base), e.status())
+	}
+	// 外层包装不影响错误码
+	if got := asAPIError(fmt.Errorf("外层: %w", e)); got != e {
+		t.Errorf("asAPIError(wrapped) = %+v", got)
+	}
+	if got := asAPIError(base); got.Code != errCodeInternal || got.status() != http.StatusInternalServerError || got.Message != "boom" {
+		t.Errorf("asAPIError(plain) = %+v", got)
+	}
+	for _, code := range apiErrorCodes() {
+		if _, ok := openAPIErrorResponses[errorCodeStatus[code]]; !ok {
+			t.Errorf("status %d of %s not documented in openAPIErrorResponses", errorCodeStatus[code], code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	writeAPIError(rec, e)
+	if rec.Code != http.StatusBadRequest || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("status=%d content-type=%q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var body map[string]map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if want := map[string]string{"code": "INVALID_DATE", "message": "解析起始日期失败: boom", "field": "from"}; fmt.Sprint(body["error"]) != fmt.Sprint(want) {
+		t.Errorf("body = %v", body)
+	}
+}
+
+// decodeAPIError 解析错误响应体，检查其 code/field。
+func decodeAPIError(t *testing.T, rec *httptest.ResponseRecorder) apiError {
+	t.Helper()
+	var resp struct {
+		Error apiError `json:"error"`
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("error content-type = %q", rec.Header().Get("Content-Type"))
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error.Code == "" || resp.Error.Message == "" {
+		t.Fatalf("invalid error body %q: %v", rec.Body.String(), err)
+	}
+	return resp.Error
+}
+
+func TestAPIErrorResponses(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origGeocoder := app.geocoder
+	defer func() { app.geocoder = origGeocoder }()
+
+	coords := "lat=39.9&lon=116.4&tz=Asia/Shanghai"
+	cases := []struct {
+		url    string
+		status int
+		code   string
+		field  string
+	}{
+		{"/api/astro?lat=abc&lon=116.4", 400, errCodeInvalidCoords, "lat"},
+		{"/api/astro?lat=39.9&lon=200", 400, errCodeInvalidCoords, "lon"},
+		{"/api/astro?lat=39.9&lon=116.4&tz=Mars/Base", 400, errCodeInvalidTimezone, "tz"},
+		{"/api/astro", 400, errCodeMissingLocation, "city"},
+		{"/api/astro?" + coords + "&mode=week", 400, errCodeInvalidMode, "mode"},
+		{"/api/astro?" + coords + "&mode=day", 400, errCodeMissingParam, "date"},
+		{"/api/astro?" + coords + "&mode=range&from=2025-01-01", 400, errCodeMissingParam, "to"},
+		{"/api/astro?" + coords + "&mode=day&date=2025-13-01", 400, errCodeInvalidDate, "date"},
+		{"/api/astro?" + coords + "&mode=range&from=2025-02-01&to=2025-01-01", 400, errCodeInvalidDate, "to"},
+		{"/api/astro?" + coords + "&format=pdf", 400, errCodeInvalidFormat, "format"},
+		{"/api/astro?" + coords + "&elev=abc", 400, errCodeInvalidParam, "elev"},
+		{"/api/astro?" + coords + "&golden_low=x", 400, errCodeInvalidParam, "golden_low"},
+		{"/api/positions?" + coords + "&temp_c=warm", 400, errCodeInvalidParam, "temp_c"},
+		{"/api/phases?" + coords + "&mode=range&from=2025-01-01&to=bad", 400, errCodeInvalidDate, "to"},
+		{"/api/terms?" + coords + "&year=3000", 400, errCodeInvalidParam, "year"},
+		{"/api/sunpath.svg?" + coords + "&projection=mercator", 400, errCodeInvalidParam, "projection"},
+		{"/api/positions/stream?" + coords + "&interval=0", 400, errCodeInvalidParam, "interval"},
+		{"/api/geocode", 400, errCodeMissingParam, "q"},
+	}
+	mux := newServeMux()
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, c.url, nil))
+		if rec.Code != c.status {
+			t.Errorf("%s: status = %d, want %d (%s)", c.url, rec.Code, c.status, rec.Body.String())
+			continue
+		}
+		if e := decodeAPIError(t, rec); e.Code != c.code || e.Field != c.field {
+			t.Errorf("%s: error = %+v, want %s/%s", c.url, e, c.code, c.field)
+		}
+	}
+
+	// 地理编码服务不可用 → 502，服务正常但无结果 → 404
+	app.geocoder = &NominatimGeocoder{Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("dial tcp: connection refused")
+	}}}
+	for _, u := range []string{"/api/astro?city=Atlantis", "/api/positions?city=Atlantis", "/api/geocode?q=Atlantis"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u, nil))
+		if e := decodeAPIError(t, rec); rec.Code != http.StatusBadGateway || e.Code != errCodeGeocoderUnavailable {
+			t.Errorf("%s: status = %d, error = %+v, want 502 GEOCODER_UNAVAILABLE", u, rec.Code, e)
+		}
+	}
+	app.geocoder = &NominatimGeocoder{Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("[]"))}, nil
+	}}}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/astro?city=Atlantis", nil))
+	if e := decodeAPIError(t, rec); rec.Code != http.StatusNotFound || e.Code != errCodeCityNotFound || e.Field != "city" {
+		t.Errorf("unknown city: status = %d, error = %+v, want 404 CITY_NOT_FOUND", rec.Code, e)
+	}
+}
+
+//
+// ----------- 批量天文数据 -----------
+//
+
+func TestAstroBatchAPI(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origGeocoder := app.geocoder
+	defer func() { app.geocoder = origGeocoder }()
+	calls := 0
+	app.geocoder = &NominatimGeocoder{Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/search") {
+			calls++
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(mockGeocodeCityResponse(39.9, 116.4, "Atlantis")))}, nil
+	}}}
+
+	body := `[
+		{"id": "a", "city": "Atlantis"},
+		{"id": "b", "city": "Shanghai", "lat": 31.23, "lon": 121.47, "tz": "Asia/Shanghai", "mode": "range", "from": "2025-01-01", "to": "2025-01-03"},
+		{"id": "c", "lat": 99, "lon": 0},
+		{"city": "atlantis"},
+		{"id": "e", "lat": 1, "lon": 1, "tz": "UTC", "mode": "range"}
+	]`
+	rec := httptest.NewRecorder()
+	newServeMux().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/astro/batch?mode=day&date=2025-06-21", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp astroBatchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Count != 5 || resp.Succeeded != 3 || resp.Failed != 2 || len(resp.Items) != 5 {
+		t.Fatalf("count/succeeded/failed = %d/%d/%d, items = %d", resp.Count, resp.Succeeded, resp.Failed, len(resp.Items))
+	}
+	for i, it := range resp.Items {
+		if it.Index != i || (it.Result == nil) == (it.Error == nil) {
+			t.Errorf("item %d: index = %d, result = %v, error = %v", i, it.Index, it.Result != nil, it.Error)
+		}
+	}
+	if r := resp.Items[0].Result; resp.Items[0].ID != "a" || r == nil || r.City != "Atlantis" || r.Mode != "day" || len(r.Data) != 1 || r.Data[0].Date != "2025-06-21" {
+		t.Errorf("item a = %+v", resp.Items[0])
+	}
+	if r := resp.Items[1].Result; r == nil || r.Mode != "range" || len(r.Data) != 3 || r.Timezone != "Asia/Shanghai" {
+		t.Errorf("item b = %+v", resp.Items[1])
+	}
+	if e := resp.Items[2].Error; e == nil || e.Code != errCodeInvalidCoords || e.Field != "lat" {
+		t.Errorf("item c error = %+v", e)
+	}
+	if e := resp.Items[4].Error; e == nil || e.Code != errCodeMissingParam || e.Field != "from" {
+		t.Errorf("item e error = %+v", e)
+	}
+	// 整批共用一份缓存：同一城市只查询一次地理编码
+	if calls != 1 {
+		t.Errorf("geocoder searched %d times, want 1", calls)
+	}
+	if _, ok := findEntryInCache(loadCache(), "Atlantis"); !ok {
+		t.Error("batch should save newly resolved cities to the cache")
+	}
+}
+
+func TestAstroBatchAPIErrors(t *testing.T) {
+	mux := newServeMux()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/astro/batch", nil))
+	if e := decodeAPIError(t, rec); rec.Code != http.StatusMethodNotAllowed || e.Code != errCodeMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("GET: status = %d, error = %+v, allow = %q", rec.Code, e, rec.Header().Get("Allow"))
+	}
+
+	many := "[" + strings.TrimSuffix(strings.Repeat(`{"lat":0,"lon":0},`, maxAstroBatchItems+1), ",") + "]"
+	for _, body := range []string{"", `{"city":"Beijing"}`, "[]", `[{"city":"Beijing","latitude":1}]`, many, strings.Repeat(" ", maxAstroBatchBody+1) + "[]"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/astro/batch", strings.NewReader(body)))
+		if e := decodeAPIError(t, rec); rec.Code != http.StatusBadRequest || e.Code != errCodeInvalidBody {
+			t.Errorf("body %.40q: status = %d, error = %+v", body, rec.Code, e)
+		}
+	}
+}
+
+func TestResolveAstroBatchCancelled(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	origGeocoder := app.geocoder
+	defer func() { app.geocoder = origGeocoder }()
+	calls := 0
+	app.geocoder = ChainGeocoder{GazetteerGeocoder{}, &NominatimGeocoder{Client: &httpClientMock{doFunc: func(req *http.Request) (*http.Response, error) {
+		calls++
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(mockGeocodeCityResponse(1, 2, "Atlantis")))}, nil
+	}}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	one := 1.0
+	items := []astroBatchItem{{City: "Atlantis"}, {City: "Tokyo"}, {Lat: &one, Lon: &one, TZ: "UTC"}}
+	jobs := resolveAstroBatch(ctx, items, url.Values{"mode": {"day"}, "date": {"2025-06-21"}})
+	if e := asAPIError(jobs[0].Err); jobs[0].Err == nil || e.Code != errCodeGeocoderUnavailable || !strings.Contains(e.Message, "超时或被取消") {
+		t.Errorf("uncached city after cancel: %+v", jobs[0].Err)
+	}
+	if jobs[1].Err != nil || jobs[1].Ctx.City != "Tokyo" {
+		t.Errorf("gazetteer city should still resolve: %+v, %v", jobs[1].Ctx, jobs[1].Err)
+	}
+	if jobs[2].Err != nil {
+		t.Errorf("coordinates should still resolve: %v", jobs[2].Err)
+	}
+	if _, ok := loadCache().Reverse["1.00,1.00"]; ok {
+		t.Error("cancelled reverse lookup should not be cached")
+	}
+}
+
+func TestRunBounded(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	seen := make([]int, 50)
+	runBounded(len(seen), 4, func(i int) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		seen[i]++
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	if peak > 4 {
+		t.Errorf("peak concurrency = %d, want <= 4", peak)
+	}
+	for i, n := range seen {
+		if n != 1 {
+			t.Errorf("index %d called %d times", i, n)
+		}
+	}
+	// workers 非正数时仍至少用一个 goroutine
+	called := 0
+	runBounded(3, 0, func(int) { called++ })
+	if called != 3 {
+		t.Errorf("workers=0: called = %d, want 3", called)
+	}
+}
+
+func TestParseAstroBatchCSV(t *testing.T) {
+	items, err := parseAstroBatchCSV("\ufeffCity, ID ,lat,lon,tz,pick,elev,mode\n北京,bj,,,,2,,\n\n,sh,31.23,121.47,Asia/Shanghai,,15.5,day\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("items = %+v", items)
+	}
+	if it := items[0]; it.City != "北京" || it.ID != "bj" || it.Pick != 2 || it.Lat != nil || it.Elev != nil {
+		t.Errorf("row 1 = %+v", it)
+	}
+	if it := items[1]; it.ID != "sh" || it.Lat == nil || *it.Lat != 31.23 || *it.Lon != 121.47 || it.TZ != "Asia/Shanghai" || *it.Elev != 15.5 || it.Mode != "day" {
+		t.Errorf("row 2 = %+v", it)
+	}
+	q := items[1].query(url.Values{"mode": {"year"}, "date": {"2025-06-21"}})
+	if q.Get("mode") != "day" || q.Get("date") != "2025-06-21" || q.Get("lat") != "31.23" || q.Get("elev") != "15.5" || q.Has("city") {
+		t.Errorf("query = %v", q)
+	}
+	if _, err := parseAstroBatchCSV("city,lat\nX,north\n"); err == nil || !strings.Contains(err.Error(), "第 2 行 lat") {
+		t.Errorf("invalid lat error = %v", err)
+	}
+}
+
+func TestExcelSheetName(t *testing.T) {
+	used := make(map[string]bool)
+	long := strings.Repeat("很长的城市名", 6)
+	for _, c := range []struct{ in, want string }{
+		{"Beijing", "Beijing"},
+		{"beijing", "beijing (2)"},
+		{"a/b:c[1]", "a_b_c_1_"},
+		{"", "Sheet"},
+		{long, string([]rune(long)[:31])},
+		{long, string([]rune(long)[:27]) + " (2)"},
+	} {
+		if got := excelSheetName(c.in, used); got != c.want {
+			t.Errorf("excelSheetName(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestRunAstroBatch(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	f := func(v float64) *float64 { return &v }
+	items := []astroBatchItem{
+		{ID: "bj", City: "Beijing", Lat: f(39.9), Lon: f(116.4), TZ: "Asia/Shanghai"},
+		{City: "Shanghai", Lat: f(31.23), Lon: f(121.47), TZ: "Asia/Shanghai", Mode: "range", From: "2025-01-01", To: "2025-01-02"},
+		{ID: "bad", Lat: f(0), Lon: f(0), TZ: "Mars/Base"},
+	}
+	defaults := url.Values{"mode": {"day"}, "date": {"2025-06-21"}}
+
+	err := runAstroBatch(items, astroBatchOptions{Defaults: defaults}, OutputOptions{Format: "csv", OutDir: dir})
+	if err == nil || !strings.Contains(err.Error(), "1/3") {
+		t.Errorf("err = %v, want 1/3 failed", err)
+	}
+	for _, name := range []string{"bj-Beijing-2025-06-21.csv", "Shanghai-2025-01-01_to_2025-01-02.csv"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			entries, _ := os.ReadDir(dir)
+			t.Errorf("missing %s (dir: %v)", name, entries)
+		}
+	}
+
+	// 未填 id 且解析到同一城市、模式相同的地点写入不同文件
+	dupDir := t.TempDir()
+	dup := []astroBatchItem{items[1], items[1], {ID: "x", City: "Shanghai", Lat: f(31.23), Lon: f(121.47), TZ: "Asia/Shanghai"}}
+	if err := runAstroBatch(dup, astroBatchOptions{Defaults: defaults}, OutputOptions{Format: "csv", OutDir: dupDir}); err != nil {
+		t.Fatalf("duplicate items: %v", err)
+	}
+	for _, name := range []string{"Shanghai-2025-01-01_to_2025-01-02.csv", "Shanghai-2025-01-01_to_2025-01-02-2.csv", "x-Shanghai-2025-06-21.csv"} {
+		if _, err := os.Stat(filepath.Join(dupDir, name)); err != nil {
+			entries, _ := os.ReadDir(dupDir)
+			t.Errorf("missing %s (dir: %v)", name, entries)
+		}
+	}
+
+	if err := runAstroBatch(items[:2], astroBatchOptions{Defaults: defaults, Combine: true}, OutputOptions{Format: combineFormat("txt", true), OutDir: dir}); err == nil {
+		t.Error("--combine with explicit --format txt should fail")
+	}
+	// 未指定 --format 时（根命令默认 txt）合并输出为工作簿
+	out := filepath.Join(dir, "all.xlsx")
+	if err := runAstroBatch(items[:2], astroBatchOptions{Defaults: defaults, Combine: true, Output: out}, OutputOptions{Format: combineFormat("txt", false), OutDir: dir}); err != nil {
+		t.Fatalf("combine: %v", err)
+	}
+	wb, err := excelize.OpenFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wb.Close()
+	if got := wb.GetSheetList(); strings.Join(got, ",") != "Summary,bj,Shanghai" {
+		t.Errorf("sheets = %v", got)
+	}
+	if v, _ := wb.GetCellValue("Shanghai", "B1"); v != "Shanghai" {
+		t.Errorf("Shanghai!B1 = %q", v)
+	}
+}
+
+//
+// ----------- 多城市合并输出 -----------
+//
+
+func TestRunCombinedCities(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	opts := OutputOptions{Format: "excel", OutDir: dir}
+	if err := runCombinedCities(nil, "year", "", "", opts); err == nil {
+		t.Error("no cities should fail")
+	}
+	if err := runCombinedCities([]string{"Beijing"}, "year", "", "", OutputOptions{Format: "json", OutDir: dir}); err == nil || !strings.Contains(err.Error(), "--combine") {
+		t.Errorf("json format: err = %v", err)
+	}
+	if got := combineFormat("txt", false); got != "excel" {
+		t.Errorf("default combine format = %q, want excel", got)
+	}
+	if got := combineFormat("csv", true); got != "csv" {
+		t.Errorf("explicit combine format = %q, want csv", got)
+	}
+
+	cities := []string{"Beijing", "Shanghai"}
+	if err := runCombinedCities(cities, "range", "2025-01-01", "2025-01-03", opts); err != nil {
+		t.Fatalf("excel: %v", err)
+	}
+	wb, err := excelize.OpenFile(filepath.Join(dir, "Beijing_Shanghai-2025-01-01_to_2025-01-03.xlsx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wb.Close()
+	if got := wb.GetSheetList(); strings.Join(got, ",") != "Summary,Beijing,Shanghai" {
+		t.Errorf("sheets = %v", got)
+	}
+	rows, err := wb.GetRows(astroSummarySheet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || strings.Join(rows[0], ",") != "日期,Beijing 日出,Beijing 日落,Beijing 日照时长(分钟),Shanghai 日出,Shanghai 日落,Shanghai 日照时长(分钟)" {
+		t.Fatalf("summary rows = %v", rows)
+	}
+	if rows[1][0] != "2025-01-01" || rows[3][0] != "2025-01-03" || len(rows[1]) != 7 {
+		t.Errorf("summary row = %v", rows[1])
+	}
+	// 上海冬季白昼长于北京
+	bj, _ := strconv.Atoi(rows[1][3])
+	sh, _ := strconv.Atoi(rows[1][6])
+	if bj < 500 || sh <= bj {
+		t.Errorf("day length minutes: Beijing %q, Shanghai %q", rows[1][3], rows[1][6])
+	}
+
+	opts.Format = "csv"
+	if err := runCombinedCities(cities, "range", "2025-01-01", "2025-01-03", opts); err != nil {
+		t.Fatalf("csv: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "Beijing_Shanghai-2025-01-01_to_2025-01-03.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 7 || records[0][0] != "city" || records[0][1] != "date" {
+		t.Fatalf("long csv = %v", records)
+	}
+	for i, want := range []string{"Beijing", "Beijing", "Beijing", "Shanghai", "Shanghai", "Shanghai"} {
+		if records[i+1][0] != want || len(records[i+1]) != len(records[0]) {
+			t.Errorf("row %d = %v, want city %s", i+1, records[i+1], want)
+		}
+	}
+	if records[4][1] != "2025-01-01" {
+		t.Errorf("Shanghai first date = %q", records[4][1])
+	}
+}
+
+func TestCombinedBaseName(t *testing.T) {
+	var jobs []*astroBatchJob
+	for _, c := range []string{"北京", "上海", "广州", "深圳", "成都"} {
+		jobs = append(jobs, &astroBatchJob{Ctx: &CityContext{City: c}, BaseName: c + "-2025-01-01-year"})
+	}
+	if got := combinedBaseName(jobs[:2]); got != "北京_上海-2025-01-01-year" {
+		t.Errorf("two cities = %q", got)
+	}
+	if got := combinedBaseName(jobs); got != "北京_上海_广州_等5城-2025-01-01-year" {
+		t.Errorf("five cities = %q", got)
+	}
+}
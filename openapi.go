@@ -0,0 +1,589 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// -------------------- HTTP 路由表与 OpenAPI 文档 --------------------
+
+// apiDocsHTML 为 /api/docs 的离线文档页面：运行时读取 /api/openapi.json 渲染，不引用任何外部资源。
+//
+//go:embed docs.html
+var apiDocsHTML []byte
+
+// openAPIVersion 为生成文档遵循的 OpenAPI 规范版本。
+const openAPIVersion = "3.0.3"
+
+// openAPISchema 为 OpenAPI Schema Object 的子集。
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Default              interface{}               `json:"default,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+}
+
+// openAPIParameter 为 OpenAPI Parameter Object（本服务只使用查询参数）。
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Ref         string                      `json:"$ref,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIRequestBody struct {
+	Description string                      `json:"description,omitempty"`
+	Required    bool                        `json:"required,omitempty"`
+	Content     map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIOperation struct {
+	Tags        []string                   `json:"tags,omitempty"`
+	Summary     string                     `json:"summary,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	OperationID string                     `json:"operationId"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type openAPIComponents struct {
+	Schemas   map[string]*openAPISchema  `json:"schemas"`
+	Responses map[string]openAPIResponse `json:"responses"`
+}
+
+// openAPIDocument 为 /api/openapi.json 的返回体。
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+// apiContent 为接口的一种请求/响应媒体类型：Model 为 Go 值时按其类型（json 标签）反射生成 schema，
+// 为 *openAPISchema 时直接使用，为 nil 时按字符串处理。
+type apiContent struct {
+	MediaType string
+	Model     interface{}
+}
+
+// apiResponse 为接口的一种成功响应。
+type apiResponse struct {
+	Status      int
+	Description string
+	Content     []apiContent
+}
+
+// apiRoute 为路由表中的一项：serve 按它注册处理函数，/api/openapi.json 按它生成文档，二者不会各自维护。
+type apiRoute struct {
+	Path        string
+	Methods     []string
+	Handler     http.HandlerFunc
+	Tag         string
+	Summary     string
+	Description string
+	Params      []openAPIParameter
+	Body        []apiContent // 仅 POST 使用
+	BodyDesc    string
+	Responses   []apiResponse
+	Errors      []int // 可能返回 apiErrorResponse 的状态码
+}
+
+// openAPIErrorResponses 为各错误状态码在 components.responses 中的名称与说明。
+var openAPIErrorResponses = map[int][2]string{
+	http.StatusBadRequest:          {"BadRequest", "参数错误（INVALID_PARAM、MISSING_PARAM、MISSING_LOCATION、INVALID_COORDS、INVALID_TIMEZONE、INVALID_DATE、INVALID_MODE、INVALID_FORMAT、INVALID_HORIZON、INVALID_BODY）"},
+	http.StatusMethodNotAllowed:    {"MethodNotAllowed", "不支持的请求方法（METHOD_NOT_ALLOWED）"},
+	http.StatusNotFound:            {"NotFound", "未找到城市（CITY_NOT_FOUND）"},
+	http.StatusInternalServerError: {"InternalError", "生成数据或输出失败（INTERNAL_ERROR）"},
+	http.StatusBadGateway:          {"BadGateway", "上游地理编码服务失败（GEOCODER_UNAVAILABLE）"},
+	http.StatusServiceUnavailable:  {"ServiceUnavailable", "服务未就绪（NOT_READY）"},
+}
+
+// queryParam 返回一个可选查询参数，typ 为 string/number/integer，format 可为空。
+func queryParam(name, typ, format, desc string) openAPIParameter {
+	return openAPIParameter{Name: name, In: "query", Description: desc, Schema: &openAPISchema{Type: typ, Format: format}}
+}
+
+// enumParam 返回取值受限的字符串查询参数，def 为空时不声明默认值。
+func enumParam(name, desc, def string, values ...string) openAPIParameter {
+	p := queryParam(name, "string", "", desc)
+	p.Schema.Enum = values
+	if def != "" {
+		p.Schema.Default = def
+	}
+	return p
+}
+
+// joinParams 拼接多组参数。
+func joinParams(groups ...[]openAPIParameter) []openAPIParameter {
+	var out []openAPIParameter
+	for _, g := range groups {
+		out = append(out, g...)
+	}
+	return out
+}
+
+// locationParams 为 resolveContextFromQuery 与 applyElevationQuery 读取的地点参数。
+func locationParams() []openAPIParameter {
+	return []openAPIParameter{
+		queryParam("city", "string", "", "城市名（未提供 lat+lon 时必填）；与 lat+lon 同时提供时仅作为显示名"),
+		queryParam("lat", "number", "double", "纬度（-90~90），与 lon 同时提供时优先于 city"),
+		queryParam("lon", "number", "double", "经度（-180~180）"),
+		queryParam("tz", "string", "", "IANA 时区，例如 Asia/Shanghai；坐标模式下省略时按坐标推断"),
+		queryParam("country", "string", "", "按国家代码过滤城市候选，例如 cn 或 us,ca"),
+		queryParam("pick", "integer", "", "城市有多个匹配时选择第 N 个候选（从 1 开始）"),
+		queryParam("elev", "number", "double", "观测点海拔（米），覆盖缓存或 DEM 中的海拔"),
+	}
+}
+
+// periodParams 为 mode=year/day/range 及其日期参数。
+func periodParams() []openAPIParameter {
+	date := func(name, desc string) openAPIParameter { return queryParam(name, "string", "date", desc) }
+	return []openAPIParameter{
+		enumParam("mode", "时间范围：当前年份、单日或日期区间", "year", "year", "day", "range"),
+		date("date", "mode=day 时必填，YYYY-MM-DD"),
+		date("from", "mode=range 时必填，起始日期 YYYY-MM-DD"),
+		date("to", "mode=range 时必填，结束日期 YYYY-MM-DD（含）"),
+	}
+}
+
+// photoBandParams 为 applyPhotoBandsQuery 读取的黄金/蓝调时刻阈值参数（太阳高度，度）。
+func photoBandParams() []openAPIParameter {
+	return []openAPIParameter{
+		queryParam("golden_low", "number", "double", "黄金时刻下限（默认 -4）"),
+		queryParam("golden_high", "number", "double", "黄金时刻上限（默认 6）"),
+		queryParam("blue_low", "number", "double", "蓝调时刻下限（默认 -6）"),
+		queryParam("blue_high", "number", "double", "蓝调时刻上限（默认 -4）"),
+	}
+}
+
+// atmosphereParams 为 applyAtmosphereQuery 读取的折射计算参数。
+func atmosphereParams() []openAPIParameter {
+	return []openAPIParameter{
+		queryParam("temp_c", "number", "double", "地面气温（℃，-90~60，默认 10）"),
+		queryParam("pressure_hpa", "number", "double", "地面气压（hPa，0~1100，默认 1010；0 表示不计折射）"),
+	}
+}
+
+// astroFormatNames 返回 /api/astro 支持的 format 取值（含别名 xlsx）。
+func astroFormatNames() []string {
+	names := []string{"xlsx"}
+	for f := range astroFormatSpecs {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// astroResponseContents 按 astroFormatSpecs 列出 /api/astro 的全部响应媒体类型。
+func astroResponseContents() []apiContent {
+	var out []apiContent
+	for _, f := range astroFormatNames() {
+		spec, ok := astroFormatSpecs[f]
+		if !ok {
+			continue
+		}
+		var model interface{}
+		switch f {
+		case "json":
+			model = astroAPIResponse{}
+		case "excel":
+			model = &openAPISchema{Type: "string", Format: "binary"}
+		}
+		out = append(out, apiContent{MediaType: spec.ContentType, Model: model})
+	}
+	return out
+}
+
+// apiRoutes 返回服务的全部路由；新增接口时只需在此登记，文档与漂移测试会随之覆盖。
+func apiRoutes() []apiRoute {
+	get := []string{http.MethodGet}
+	astroParams := joinParams(
+		locationParams(),
+		periodParams(),
+		[]openAPIParameter{
+			enumParam("format", "输出格式；省略时按 Accept 头协商，默认 json", "", astroFormatNames()...),
+			queryParam("events", "string", "", "format=ics 时导出的事件类型，逗号分隔：sunrise,sunset,moonrise,moonset,phase,solar_term（默认全部）"),
+		},
+		photoBandParams(),
+	)
+	astroICSParams := joinParams(astroParams)
+	for i := range astroICSParams {
+		if astroICSParams[i].Name == "format" {
+			astroICSParams[i].Description = "此路径固定输出 ics，format 参数被忽略"
+		}
+	}
+	streamParams := joinParams(
+		[]openAPIParameter{queryParam("interval", "integer", "", "推送间隔（秒，1~3600，默认 30）")},
+		locationParams(),
+		atmosphereParams(),
+	)
+	for i := range streamParams {
+		if streamParams[i].Name == "city" {
+			streamParams[i].Description = fmt.Sprintf("城市名，可重复以同时订阅多个城市（最多 %d 个）", maxStreamLocations)
+			streamParams[i].Schema = &openAPISchema{Type: "array", Items: &openAPISchema{Type: "string"}}
+		}
+	}
+	text := []apiContent{{MediaType: "text/plain; charset=utf-8"}}
+	// 按城市解析地点的接口还可能返回 404（未找到城市）与 502（地理编码服务失败）
+	located := func(extra ...int) []int {
+		return append([]int{http.StatusBadRequest, http.StatusNotFound, http.StatusBadGateway}, extra...)
+	}
+	page := []apiContent{{MediaType: "text/html; charset=utf-8"}}
+
+	return []apiRoute{
+		{
+			Path: "/api/astro", Methods: []string{http.MethodGet, http.MethodPost}, Handler: astroAPIHandler, Tag: "天文数据",
+			Summary:     "逐日日出日落、晨昏蒙影、月出月落、月相与节气",
+			Description: "format 省略时按 Accept 头协商（application/json、text/csv、text/calendar 等）。POST 时请求体为地平线轮廓，返回按遮挡计算的可见升落。",
+			Params:      astroParams,
+			Body: []apiContent{
+				{MediaType: "text/csv", Model: &openAPISchema{Type: "string", Description: "每行 方位,高度（度，罗盘方位正北 0°）"}},
+				{MediaType: "application/json", Model: []horizonPoint{}},
+			},
+			BodyDesc:  "地平线轮廓",
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "天文数据，媒体类型由 format 决定", Content: astroResponseContents()}},
+			Errors:    located(http.StatusInternalServerError),
+		},
+		{
+			Path: "/api/astro/batch", Methods: []string{http.MethodPost}, Handler: astroBatchHandler, Tag: "天文数据",
+			Summary: "一次请求计算多个地点的逐日天文数据",
+			Description: fmt.Sprintf("请求体为地点数组（最多 %d 个），每项为 city（可配 country/pick）或 lat+lon（tz 可选），可单独指定 mode/date/from/to 覆盖查询参数中的默认值。"+
+				"整批只读取一次城市缓存，按地点并发计算；单个地点出错时该项返回 error，其余照常返回。", maxAstroBatchItems),
+			Params:    joinParams(periodParams(), photoBandParams()),
+			Body:      []apiContent{{MediaType: "application/json", Model: []astroBatchItem{}}},
+			BodyDesc:  "地点列表",
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "与请求数组一一对应的结果", Content: []apiContent{{MediaType: "application/json", Model: astroBatchResponse{}}}}},
+			Errors:    []int{http.StatusBadRequest, http.StatusMethodNotAllowed},
+		},
+		{
+			Path: "/api/astro.ics", Methods: get, Handler: astroAPIHandler, Tag: "天文数据",
+			Summary:   "以 iCalendar 订阅天文事件",
+			Params:    astroICSParams,
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "iCalendar 日历", Content: []apiContent{{MediaType: astroFormatSpecs["ics"].ContentType}}}},
+			Errors:    located(http.StatusInternalServerError),
+		},
+		{
+			Path: "/api/phases", Methods: get, Handler: phasesAPIHandler, Tag: "天文数据",
+			Summary:   "月相事件（新月/上弦/满月/下弦）",
+			Params:    joinParams(locationParams(), periodParams()),
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "月相事件列表", Content: []apiContent{{MediaType: "application/json", Model: phasesAPIResponse{}}}}},
+			Errors:    located(),
+		},
+		{
+			Path: "/api/terms", Methods: get, Handler: termsAPIHandler, Tag: "天文数据",
+			Summary:   "二十四节气",
+			Params:    joinParams(locationParams(), []openAPIParameter{queryParam("year", "integer", "", "公历年份（默认当前年份）")}),
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "节气列表", Content: []apiContent{{MediaType: "application/json", Model: termsAPIResponse{}}}}},
+			Errors:    located(),
+		},
+		{
+			Path: "/api/eclipses", Methods: get, Handler: eclipsesAPIHandler, Tag: "天文数据",
+			Summary: "日食与月食",
+			Params: joinParams(locationParams(), periodParams(), []openAPIParameter{
+				enumParam("format", "输出格式", "json", "json", "csv", "ics"),
+				queryParam("visible", "string", "", "为 1 或 true 时只返回当地可见的食"),
+			}),
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "日月食列表，媒体类型由 format 决定", Content: []apiContent{
+				{MediaType: "application/json", Model: eclipsesAPIResponse{}},
+				{MediaType: "text/csv; charset=utf-8"},
+				{MediaType: "text/calendar; charset=utf-8"},
+			}}},
+			Errors: located(),
+		},
+		{
+			Path: "/api/positions", Methods: get, Handler: positionsAPIHandler, Tag: "实时位置",
+			Summary:   "当前太阳、月亮与五颗肉眼行星的位置",
+			Params:    joinParams(locationParams(), atmosphereParams()),
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "实时位置", Content: []apiContent{{MediaType: "application/json", Model: livePositionsResponse{}}}}},
+			Errors:    located(),
+		},
+		{
+			Path: "/api/positions/stream", Methods: get, Handler: positionsStreamHandler, Tag: "实时位置",
+			Summary:     "以 Server-Sent Events 推送实时位置",
+			Description: "每帧为 event: positions，data 为与 /api/positions 相同的 livePositionsResponse JSON；每 15 秒发送一次 : ping 心跳。",
+			Params:      streamParams,
+			Responses:   []apiResponse{{Status: http.StatusOK, Description: "SSE 事件流", Content: []apiContent{{MediaType: "text/event-stream; charset=utf-8"}}}},
+			Errors:      located(http.StatusInternalServerError),
+		},
+		{
+			Path: "/api/sunpath.svg", Methods: get, Handler: sunPathAPIHandler, Tag: "天文数据",
+			Summary: "太阳轨迹图（SVG）",
+			Params: joinParams(locationParams(), []openAPIParameter{
+				queryParam("year", "integer", "", "公历年份（1900~2150，默认当前年份）"),
+				enumParam("projection", "投影方式（stereo/polar 为 stereographic 的别名，cyl 为 cylindrical 的别名）", sunPathStereographic,
+					sunPathStereographic, "stereo", "polar", sunPathCylindrical, "cyl"),
+			}),
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "SVG 图像", Content: []apiContent{{MediaType: "image/svg+xml; charset=utf-8"}}}},
+			Errors:    located(),
+		},
+		{
+			Path: "/api/cities", Methods: get, Handler: citiesAPIHandler, Tag: "城市",
+			Summary:   "本地缓存中的城市",
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "按显示名排序的城市列表（缓存为空时为 null）", Content: []apiContent{{MediaType: "application/json", Model: []cachedCity{}}}}},
+		},
+		{
+			Path: "/api/geocode", Methods: get, Handler: geocodeAPIHandler, Tag: "城市",
+			Summary: "城市名的全部候选地点，供前端消歧后以 pick/country 调用其他接口",
+			Params: []openAPIParameter{
+				{Name: "q", In: "query", Required: true, Description: "城市名", Schema: &openAPISchema{Type: "string"}},
+				queryParam("limit", "integer", "", fmt.Sprintf("候选数量上限（1~50，默认 %d）", geocodeDefaultLimit)),
+				queryParam("country", "string", "", "按国家代码过滤，例如 cn 或 us,ca"),
+			},
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "候选地点", Content: []apiContent{{MediaType: "application/json", Model: geocodeAPIResponse{}}}}},
+			Errors:    []int{http.StatusBadRequest, http.StatusBadGateway},
+		},
+		{
+			Path: "/view/positions", Methods: get, Handler: positionsPageHandler, Tag: "页面",
+			Summary:     "太阳/月亮实时 2D 视图",
+			Description: "除 refresh 外的其余查询参数原样转发给 /api/positions 与 /api/positions/stream。",
+			Params: []openAPIParameter{
+				queryParam("city", "string", "", "初始城市"),
+				queryParam("refresh", "integer", "", "刷新间隔（秒，默认 30）"),
+			},
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "HTML 页面", Content: page}},
+		},
+		{
+			Path: "/view/astro", Methods: get, Handler: astroViewHandler, Tag: "页面",
+			Summary:   "日长、正午高度、升落时刻与月面照明图表页面",
+			Params:    joinParams(locationParams(), periodParams(), photoBandParams()),
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "HTML 页面", Content: page}},
+			Errors:    located(http.StatusInternalServerError),
+		},
+		{
+			Path: "/healthz", Methods: get, Handler: healthHandler, Tag: "运维",
+			Summary:   "健康检查",
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "ok", Content: text}},
+		},
+		{
+			Path: "/readyz", Methods: get, Handler: readyHandler, Tag: "运维",
+			Summary:   "就绪检查（缓存目录可写）",
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "ready", Content: text}},
+			Errors:    []int{http.StatusServiceUnavailable},
+		},
+		{
+			Path: "/api/openapi.json", Methods: get, Handler: openAPIHandler, Tag: "文档",
+			Summary:   "本文档（OpenAPI 3）",
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "OpenAPI 文档", Content: []apiContent{{MediaType: "application/json", Model: &openAPISchema{Type: "object"}}}}},
+		},
+		{
+			Path: "/api/docs", Methods: get, Handler: apiDocsHandler, Tag: "文档",
+			Summary:   "离线 API 文档页面",
+			Responses: []apiResponse{{Status: http.StatusOK, Description: "HTML 页面", Content: page}},
+		},
+	}
+}
+
+// newServeMux 按 apiRoutes 注册全部 HTTP 路由。
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rt := range apiRoutes() {
+		mux.HandleFunc(rt.Path, rt.Handler)
+	}
+	return mux
+}
+
+// openAPISchemaBuilder 按 Go 类型生成 schema：具名结构体登记到 components.schemas 并以 $ref 引用，
+// 字段名取 json 标签，未标 omitempty 的字段列为 required。
+type openAPISchemaBuilder struct {
+	schemas map[string]*openAPISchema
+}
+
+// schemaFor 返回类型 t 对应的 schema。
+func (b *openAPISchemaBuilder) schemaFor(t reflect.Type) *openAPISchema {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schemaFor(t.Elem())
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case reflect.Slice, reflect.Array:
+		return &openAPISchema{Type: "array", Items: b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &openAPISchema{Type: "object", AdditionalProperties: b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.schemas[t.Name()]; !ok {
+			b.schemas[t.Name()] = &openAPISchema{} // 先占位，避免自引用类型无限递归
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + t.Name()}
+	}
+	return &openAPISchema{}
+}
+
+// structSchema 按导出字段的 json 标签生成对象 schema。
+func (b *openAPISchemaBuilder) structSchema(t reflect.Type) *openAPISchema {
+	s := &openAPISchema{Type: "object", Properties: make(map[string]*openAPISchema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = b.schemaFor(f.Type)
+		if !strings.Contains(","+opts+",", ",omitempty,") {
+			s.Required = append(s.Required, name)
+		}
+	}
+	return s
+}
+
+// mediaType 构造一种媒体类型；文档中的键去掉 charset 等参数。
+func (b *openAPISchemaBuilder) mediaType(c apiContent) (string, openAPIMediaType) {
+	key := c.MediaType
+	if mt, _, err := mime.ParseMediaType(c.MediaType); err == nil {
+		key = mt
+	}
+	switch m := c.Model.(type) {
+	case nil:
+		return key, openAPIMediaType{Schema: &openAPISchema{Type: "string"}}
+	case *openAPISchema:
+		return key, openAPIMediaType{Schema: m}
+	default:
+		return key, openAPIMediaType{Schema: b.schemaFor(reflect.TypeOf(m))}
+	}
+}
+
+// content 构造媒体类型表；同一类型出现多次时保留第一次（如 html 与 report）。
+func (b *openAPISchemaBuilder) content(list []apiContent) map[string]openAPIMediaType {
+	out := make(map[string]openAPIMediaType, len(list))
+	for _, c := range list {
+		key, mt := b.mediaType(c)
+		if _, ok := out[key]; !ok {
+			out[key] = mt
+		}
+	}
+	return out
+}
+
+// operationID 由方法与路径生成操作 ID，例如 GET /api/astro.ics → getApiAstroIcs。
+func operationID(method, path string) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(method))
+	upper := true
+	for _, r := range path {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// buildOpenAPIDocument 由路由表生成 OpenAPI 3 文档。
+func buildOpenAPIDocument() openAPIDocument {
+	b := &openAPISchemaBuilder{schemas: make(map[string]*openAPISchema)}
+	doc := openAPIDocument{
+		OpenAPI: openAPIVersion,
+		Info: openAPIInfo{
+			Title:       "eSunMoon HTTP API",
+			Description: "日出日落、月相、节气、日月食与实时位置查询。所有时间均为城市所在时区的当地时间；地点以 city 或 lat+lon 指定。",
+			Version:     "1.0",
+		},
+		Paths: make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			Schemas:   b.schemas,
+			Responses: make(map[string]openAPIResponse),
+		},
+	}
+	for _, rt := range apiRoutes() {
+		ops := make(map[string]*openAPIOperation, len(rt.Methods))
+		for _, method := range rt.Methods {
+			op := &openAPIOperation{
+				Tags:        []string{rt.Tag},
+				Summary:     rt.Summary,
+				Description: rt.Description,
+				OperationID: operationID(method, rt.Path),
+				Parameters:  rt.Params,
+				Responses:   make(map[string]openAPIResponse),
+			}
+			if method == http.MethodPost && len(rt.Body) > 0 {
+				op.RequestBody = &openAPIRequestBody{Description: rt.BodyDesc, Required: true, Content: b.content(rt.Body)}
+			}
+			for _, resp := range rt.Responses {
+				op.Responses[fmt.Sprint(resp.Status)] = openAPIResponse{Description: resp.Description, Content: b.content(resp.Content)}
+			}
+			for _, status := range rt.Errors {
+				name := openAPIErrorResponses[status][0]
+				op.Responses[fmt.Sprint(status)] = openAPIResponse{Ref: "#/components/responses/" + name}
+				doc.Components.Responses[name] = openAPIResponse{
+					Description: openAPIErrorResponses[status][1],
+					Content:     b.content([]apiContent{{MediaType: "application/json", Model: apiErrorResponse{}}}),
+				}
+			}
+			ops[strings.ToLower(method)] = op
+		}
+		doc.Paths[rt.Path] = ops
+	}
+	if e, ok := b.schemas["apiError"]; ok {
+		e.Properties["code"].Enum = apiErrorCodes()
+		e.Properties["code"].Description = "稳定的错误码，同一错误码在所有接口返回相同的 HTTP 状态码"
+		e.Properties["field"].Description = "出错的查询参数名，与具体参数无关时省略"
+	}
+	return doc
+}
+
+// openAPIHandler 处理 /api/openapi.json。
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(buildOpenAPIDocument())
+}
+
+// apiDocsHandler 处理 /api/docs，返回内嵌的离线文档页面。
+func apiDocsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(apiDocsHTML)
+}
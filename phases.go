@@ -0,0 +1,221 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// -------------------- 月相事件（新月/上弦/满月/下弦） --------------------
+
+// moonPhaseKind 表示四个主要月相。
+type moonPhaseKind int
+
+const (
+	phaseNewMoon moonPhaseKind = iota
+	phaseFirstQuarter
+	phaseFullMoon
+	phaseLastQuarter
+)
+
+var moonPhaseKeys = [...]string{"new_moon", "first_quarter", "full_moon", "last_quarter"}
+var moonPhaseNames = [...]string{"新月", "上弦", "满月", "下弦"}
+
+// Key 返回月相的机器可读标识。
+func (k moonPhaseKind) Key() string { return moonPhaseKeys[k] }
+
+// Name 返回月相的中文名称。
+func (k moonPhaseKind) Name() string { return moonPhaseNames[k] }
+
+// moonPhaseEvent 为一次月相事件的精确时刻（UTC，调用方按城市时区转换）。
+type moonPhaseEvent struct {
+	Kind moonPhaseKind
+	Time time.Time
+}
+
+// moonPhaseJSON 为月相事件的对外 JSON 结构（时间为城市当地时间）。
+type moonPhaseJSON struct {
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Date      string `json:"date"`
+	LocalTime string `json:"local_time"`
+	Time      string `json:"time"`
+}
+
+// toJSON 将月相事件转换为指定时区下的 JSON 结构。
+func (e moonPhaseEvent) toJSON(loc *time.Location) moonPhaseJSON {
+	t := e.Time.In(loc)
+	return moonPhaseJSON{
+		Type:      e.Kind.Key(),
+		Name:      e.Kind.Name(),
+		Date:      t.Format("2006-01-02"),
+		LocalTime: t.Format("15:04"),
+		Time:      t.Format(time.RFC3339),
+	}
+}
+
+// degSin/degCos 以角度为单位的三角函数，便于对照 Meeus 公式。
+func degSin(d float64) float64 { return math.Sin(d * math.Pi / 180) }
+func degCos(d float64) float64 { return math.Cos(d * math.Pi / 180) }
+
+// meanLunationArgs 返回 Meeus 第 49 章的平均月相参数：JDE、E、M、M'、F、Ω（角度）。
+func meanLunationArgs(k float64) (jde, e, m, mp, f, om float64) {
+	t := k / 1236.85
+	t2, t3, t4 := t*t, t*t*t, t*t*t*t
+	jde = 2451550.09766 + 29.530588861*k + 0.00015437*t2 - 0.000000150*t3 + 0.00000000073*t4
+	e = 1 - 0.002516*t - 0.0000074*t2
+	m = 2.5534 + 29.10535670*k - 0.0000014*t2 - 0.00000011*t3
+	mp = 201.5643 + 385.81693528*k + 0.0107582*t2 + 0.00001238*t3 - 0.000000058*t4
+	f = 160.7108 + 390.67050284*k - 0.0016118*t2 - 0.00000227*t3 + 0.000000011*t4
+	om = 124.7746 - 1.56375588*k + 0.0020672*t2 + 0.00000215*t3
+	return
+}
+
+// truePhaseJDE 按 Meeus 第 49 章计算第 k 个月相的力学时儒略日（JDE）。
+// k 的小数部分决定月相：.00 新月、.25 上弦、.50 满月、.75 下弦；精度约数秒。
+func truePhaseJDE(k float64) float64 {
+	jde, e, m, mp, f, om := meanLunationArgs(k)
+	t := k / 1236.85
+
+	var corr float64
+	switch frac := k - math.Floor(k); {
+	case frac < 0.1: // 新月
+		corr = -0.40720*degSin(mp) + 0.17241*e*degSin(m) + 0.01608*degSin(2*mp) +
+			0.01039*degSin(2*f) + 0.00739*e*degSin(mp-m) - 0.00514*e*degSin(mp+m) +
+			0.00208*e*e*degSin(2*m) - 0.00111*degSin(mp-2*f) - 0.00057*degSin(mp+2*f) +
+			0.00056*e*degSin(2*mp+m) - 0.00042*degSin(3*mp) + 0.00042*e*degSin(m+2*f) +
+			0.00038*e*degSin(m-2*f) - 0.00024*e*degSin(2*mp-m) - 0.00017*degSin(om) -
+			0.00007*degSin(mp+2*m) + 0.00004*degSin(2*mp-2*f) + 0.00004*degSin(3*m) +
+			0.00003*degSin(mp+m-2*f) + 0.00003*degSin(2*mp+2*f) - 0.00003*degSin(mp+m+2*f) +
+			0.00003*degSin(mp-m+2*f) - 0.00002*degSin(mp-m-2*f) - 0.00002*degSin(3*mp+m) +
+			0.00002*degSin(4*mp)
+	case frac > 0.4 && frac < 0.6: // 满月
+		corr = -0.40614*degSin(mp) + 0.17302*e*degSin(m) + 0.01614*degSin(2*mp) +
+			0.01043*degSin(2*f) + 0.00734*e*degSin(mp-m) - 0.00515*e*degSin(mp+m) +
+			0.00209*e*e*degSin(2*m) - 0.00111*degSin(mp-2*f) - 0.00057*degSin(mp+2*f) +
+			0.00056*e*degSin(2*mp+m) - 0.00042*degSin(3*mp) + 0.00042*e*degSin(m+2*f) +
+			0.00038*e*degSin(m-2*f) - 0.00024*e*degSin(2*mp-m) - 0.00017*degSin(om) -
+			0.00007*degSin(mp+2*m) + 0.00004*degSin(2*mp-2*f) + 0.00004*degSin(3*m) +
+			0.00003*degSin(mp+m-2*f) + 0.00003*degSin(2*mp+2*f) - 0.00003*degSin(mp+m+2*f) +
+			0.00003*degSin(mp-m+2*f) - 0.00002*degSin(mp-m-2*f) - 0.00002*degSin(3*mp+m) +
+			0.00002*degSin(4*mp)
+	default: // 上弦 / 下弦
+		corr = -0.62801*degSin(mp) + 0.17172*e*degSin(m) - 0.01183*e*degSin(mp+m) +
+			0.00862*degSin(2*mp) + 0.00804*degSin(2*f) + 0.00454*e*degSin(mp-m) +
+			0.00204*e*e*degSin(2*m) - 0.00180*degSin(mp-2*f) - 0.00070*degSin(mp+2*f) -
+			0.00040*degSin(3*mp) - 0.00034*e*degSin(2*mp-m) + 0.00032*e*degSin(m+2*f) +
+			0.00032*e*degSin(m-2*f) - 0.00028*e*e*degSin(mp+2*m) + 0.00027*e*degSin(2*mp+m) -
+			0.00017*degSin(om) - 0.00005*degSin(mp-m-2*f) + 0.00004*degSin(2*mp+2*f) -
+			0.00004*degSin(mp+m+2*f) + 0.00004*degSin(mp-2*m) + 0.00003*degSin(mp+m-2*f) +
+			0.00003*degSin(3*m) + 0.00002*degSin(2*mp-2*f) + 0.00002*degSin(mp-m+2*f) -
+			0.00002*degSin(3*mp+m)
+		w := 0.00306 - 0.00038*e*degCos(m) + 0.00026*degCos(mp) - 0.00002*degCos(mp-m) +
+			0.00002*degCos(mp+m) + 0.00002*degCos(2*f)
+		if frac < 0.5 {
+			corr += w
+		} else {
+			corr -= w
+		}
+	}
+
+	// 行星摄动附加项 A1~A14
+	a := [...]float64{
+		299.77 + 0.107408*k - 0.009173*t*t,
+		251.88 + 0.016321*k,
+		251.83 + 26.651886*k,
+		349.42 + 36.412478*k,
+		84.66 + 18.206239*k,
+		141.74 + 53.303771*k,
+		207.14 + 2.453732*k,
+		154.84 + 7.306860*k,
+		34.52 + 27.261239*k,
+		207.19 + 0.121824*k,
+		291.34 + 1.844379*k,
+		161.72 + 24.198154*k,
+		239.56 + 25.513099*k,
+		331.55 + 3.592518*k,
+	}
+	coef := [...]float64{
+		0.000325, 0.000165, 0.000164, 0.000126, 0.000110, 0.000062, 0.000060,
+		0.000056, 0.000047, 0.000042, 0.000040, 0.000037, 0.000035, 0.000023,
+	}
+	for i := range a {
+		corr += coef[i] * degSin(a[i])
+	}
+	return jde + corr
+}
+
+// deltaTSeconds 估算 ΔT = TT - UT（秒），采用 Espenak & Meeus 多项式。
+func deltaTSeconds(year float64) float64 {
+	switch {
+	case year >= 2005 && year < 2050:
+		t := year - 2000
+		return 62.92 + 0.32217*t + 0.005589*t*t
+	case year >= 1986 && year < 2005:
+		t := year - 2000
+		return 63.86 + 0.3345*t - 0.060374*t*t + 0.0017275*t*t*t + 0.000651814*t*t*t*t + 0.00002373599*t*t*t*t*t
+	case year >= 1961 && year < 1986:
+		t := year - 1975
+		return 45.45 + 1.067*t - t*t/260 - t*t*t/718
+	case year >= 1941 && year < 1961:
+		t := year - 1950
+		return 29.07 + 0.407*t - t*t/233 + t*t*t/2547
+	case year >= 1920 && year < 1941:
+		t := year - 1920
+		return 21.20 + 0.84493*t - 0.076100*t*t + 0.0020936*t*t*t
+	case year >= 1900 && year < 1920:
+		t := year - 1900
+		return -2.79 + 1.494119*t - 0.0598939*t*t + 0.0061966*t*t*t - 0.000197*t*t*t*t
+	case year >= 2050 && year < 2150:
+		u := (year - 1820) / 100
+		return -20 + 32*u*u - 0.5628*(2150-year)
+	default:
+		u := (year - 1820) / 100
+		return -20 + 32*u*u
+	}
+}
+
+// decimalYear 返回时间对应的小数年份（用于 ΔT 与月相序号估算）。
+func decimalYear(t time.Time) float64 {
+	u := t.UTC()
+	start := time.Date(u.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+	return float64(u.Year()) + u.Sub(start).Seconds()/end.Sub(start).Seconds()
+}
+
+// jdeToTime 将力学时儒略日转换为 UTC 时间（扣除 ΔT）。
+func jdeToTime(jde float64) time.Time {
+	t := julianToTime(jde)
+	return t.Add(-time.Duration(deltaTSeconds(decimalYear(t)) * float64(time.Second)))
+}
+
+// findMoonPhases 返回 [from, to) 区间内的全部主要月相事件，按时间排序。
+func findMoonPhases(from, to time.Time) []moonPhaseEvent {
+	if !to.After(from) {
+		return nil
+	}
+	k := math.Floor((decimalYear(from)-2000)*12.3685) - 1
+	var events []moonPhaseEvent
+	for ; ; k += 0.25 {
+		t := jdeToTime(truePhaseJDE(k))
+		if !t.Before(to) {
+			break
+		}
+		if t.Before(from) {
+			continue
+		}
+		kind := moonPhaseKind(int(math.Round((k-math.Floor(k))*4)) % 4)
+		events = append(events, moonPhaseEvent{Kind: kind, Time: t})
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+// moonPhasesByDate 将区间内月相事件按城市当地日期（YYYY-MM-DD）索引。
+func moonPhasesByDate(from, to time.Time, loc *time.Location) map[string]moonPhaseEvent {
+	byDate := make(map[string]moonPhaseEvent)
+	for _, e := range findMoonPhases(from, to) {
+		byDate[e.Time.In(loc).Format("2006-01-02")] = e
+	}
+	return byDate
+}
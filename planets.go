@@ -0,0 +1,267 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// -------------------- 行星（水星~土星）位置 --------------------
+
+// planetElements 为 JPL 近似星历（Standish，适用 1800~2050）的 J2000 黄道开普勒根数及每儒略世纪变化率：
+// 半长轴 a（AU）、偏心率 e、倾角 I、平黄经 L、近日点黄经 ϖ、升交点黄经 Ω（度）。
+type planetElements struct {
+	A, E, I, L, Peri, Node       float64
+	DA, DE, DI, DL, DPeri, DNode float64
+}
+
+// planetInfo 描述一颗肉眼行星：机器标识、中文名与轨道根数。
+type planetInfo struct {
+	Key  string
+	Name string
+	El   planetElements
+}
+
+// planetTable 为五颗肉眼行星，按离太阳由近及远排列。
+var planetTable = []planetInfo{
+	{"mercury", "水星", planetElements{
+		0.38709927, 0.20563593, 7.00497902, 252.25032350, 77.45779628, 48.33076593,
+		0.00000037, 0.00001906, -0.00594749, 149472.67411175, 0.16047689, -0.12534081}},
+	{"venus", "金星", planetElements{
+		0.72333566, 0.00677672, 3.39467605, 181.97909950, 131.60246718, 76.67984255,
+		0.00000390, -0.00004107, -0.00078890, 58517.81538729, 0.00268329, -0.27769418}},
+	{"mars", "火星", planetElements{
+		1.52371034, 0.09339410, 1.84969142, -4.55343205, -23.94362959, 49.55953891,
+		0.00001847, 0.00007882, -0.00813131, 19140.30268499, 0.44441088, -0.29257343}},
+	{"jupiter", "木星", planetElements{
+		5.20288700, 0.04838624, 1.30439695, 34.39644051, 14.72847983, 100.47390909,
+		-0.00011607, -0.00013253, -0.00183714, 3034.74612775, 0.21252668, 0.20469106}},
+	{"saturn", "土星", planetElements{
+		9.53667594, 0.05386179, 2.48599187, 49.95424423, 92.59887831, 113.66242448,
+		-0.00125060, -0.00050991, 0.00193609, 1222.49362201, -0.41897216, -0.28867794}},
+}
+
+// earthElements 为地月质心的轨道根数（近似代替地球）。
+var earthElements = planetElements{
+	1.00000261, 0.01671123, -0.00001531, 100.46457166, 102.93768193, 0,
+	0.00000562, -0.00004392, -0.01294668, 35999.37244981, 0.32327364, 0,
+}
+
+// lightTimeDaysPerAU 为光行 1 AU 所需天数。
+const lightTimeDaysPerAU = 0.0057755183
+
+// planetRiseSetAltitude 为行星出没的几何高度阈值（度，仅含标准大气折射）。
+const planetRiseSetAltitude = -0.5667
+
+// heliocentricPosition 返回 J2000 黄道坐标系下的日心直角坐标（AU）；tc 为力学时儒略世纪数。
+func heliocentricPosition(el planetElements, tc float64) [3]float64 {
+	a := el.A + el.DA*tc
+	e := el.E + el.DE*tc
+	inc := (el.I + el.DI*tc) * math.Pi / 180
+	l := el.L + el.DL*tc
+	peri := el.Peri + el.DPeri*tc
+	node := (el.Node + el.DNode*tc) * math.Pi / 180
+	w := peri*math.Pi/180 - node
+
+	m := math.Mod(l-peri, 360) * math.Pi / 180
+	ea := keplerEccentricAnomaly(m, e)
+	xp := a * (math.Cos(ea) - e)
+	yp := a * math.Sqrt(1-e*e) * math.Sin(ea)
+
+	cw, sw := math.Cos(w), math.Sin(w)
+	cn, sn := math.Cos(node), math.Sin(node)
+	ci, si := math.Cos(inc), math.Sin(inc)
+	return [3]float64{
+		(cw*cn-sw*sn*ci)*xp + (-sw*cn-cw*sn*ci)*yp,
+		(cw*sn+sw*cn*ci)*xp + (-sw*sn+cw*cn*ci)*yp,
+		sw*si*xp + cw*si*yp,
+	}
+}
+
+// keplerEccentricAnomaly 以牛顿迭代解开普勒方程 E - e·sinE = M（弧度）。
+func keplerEccentricAnomaly(m, e float64) float64 {
+	ea := m + e*math.Sin(m)
+	for i := 0; i < 10; i++ {
+		d := (ea - e*math.Sin(ea) - m) / (1 - e*math.Cos(ea))
+		ea -= d
+		if math.Abs(d) < 1e-12 {
+			break
+		}
+	}
+	return ea
+}
+
+// vecNorm 返回三维向量的模。
+func vecNorm(v [3]float64) float64 {
+	return math.Sqrt(v[0]*v[0] + v[1]*v[1] + v[2]*v[2])
+}
+
+// planetState 为行星在某时刻的地心视位置（黄道坐标为当天分点）。
+type planetState struct {
+	Lon, Lat   float64 // 地心视黄经、黄纬（度）
+	HelioLon   float64 // 日心黄经（度）
+	HelioLat   float64 // 日心黄纬（度）
+	Delta      float64 // 地心距离（AU）
+	R          float64 // 日心距离（AU）
+	PhaseAngle float64 // 相位角（度）
+}
+
+// planetGeocentric 计算力学时 JDE 时刻行星的地心视位置：含光行时、岁差（黄经近似）与黄经章动。
+func planetGeocentric(p planetInfo, jde float64) planetState {
+	tc := (jde - 2451545.0) / 36525
+	earth := heliocentricPosition(earthElements, tc)
+
+	var helio, geo [3]float64
+	tau := 0.0
+	for i := 0; i < 3; i++ {
+		helio = heliocentricPosition(p.El, tc-tau/36525)
+		for j := range geo {
+			geo[j] = helio[j] - earth[j]
+		}
+		tau = vecNorm(geo) * lightTimeDaysPerAU
+	}
+
+	delta, r, rEarth := vecNorm(geo), vecNorm(helio), vecNorm(earth)
+	precession := 1.396971 * tc // J2000 → 当天分点的黄经总岁差（一阶近似）
+	dpsi, _ := nutation(tc)
+	cosPhase := (r*r + delta*delta - rEarth*rEarth) / (2 * r * delta)
+	return planetState{
+		Lon:        normalizeDeg(math.Atan2(geo[1], geo[0])*180/math.Pi + precession + dpsi/3600),
+		Lat:        math.Asin(geo[2]/delta) * 180 / math.Pi,
+		HelioLon:   normalizeDeg(math.Atan2(helio[1], helio[0])*180/math.Pi + precession),
+		HelioLat:   math.Asin(helio[2]/r) * 180 / math.Pi,
+		Delta:      delta,
+		R:          r,
+		PhaseAngle: math.Acos(math.Max(-1, math.Min(1, cosPhase))) * 180 / math.Pi,
+	}
+}
+
+// planetMagnitude 按 Meeus 第 41 章（《天文年历》1984 公式）估算视星等；土星含光环倾角项。
+func planetMagnitude(key string, s planetState, tc float64) float64 {
+	base := 5 * math.Log10(s.R*s.Delta)
+	i := s.PhaseAngle
+	switch key {
+	case "mercury":
+		return -0.42 + base + 0.0380*i - 0.000273*i*i + 0.000002*i*i*i
+	case "venus":
+		return -4.40 + base + 0.0009*i + 0.000239*i*i - 0.00000065*i*i*i
+	case "mars":
+		return -1.52 + base + 0.016*i
+	case "jupiter":
+		return -9.40 + base + 0.005*i
+	case "saturn":
+		// 光环平面倾角与升交点（Meeus 第 45 章）
+		ri := 28.075216 - 0.012998*tc
+		rn := 169.508470 + 1.394681*tc
+		sinB := degSin(ri)*degCos(s.Lat)*degSin(s.Lon-rn) - degCos(ri)*degSin(s.Lat)
+		u1 := math.Atan2(degSin(ri)*degSin(s.HelioLat)+degCos(ri)*degCos(s.HelioLat)*degSin(s.HelioLon-rn), degCos(s.HelioLat)*degCos(s.HelioLon-rn))
+		u2 := math.Atan2(degSin(ri)*degSin(s.Lat)+degCos(ri)*degCos(s.Lat)*degSin(s.Lon-rn), degCos(s.Lat)*degCos(s.Lon-rn))
+		du := math.Abs(math.Remainder(u1-u2, 2*math.Pi)) * 180 / math.Pi
+		absB := math.Abs(math.Asin(sinB))
+		return -8.88 + base + 0.044*du - 2.60*math.Sin(absB) + 1.25*sinB*sinB
+	}
+	return math.NaN()
+}
+
+// eclipticToEquatorial 将黄经、黄纬（度）按黄赤交角 eps（度）转换为赤经、赤纬（弧度）。
+func eclipticToEquatorial(lam, beta, eps float64) (ra, dec float64) {
+	ra = math.Atan2(degSin(lam)*degCos(eps)-math.Tan(beta*math.Pi/180)*degSin(eps), degCos(lam))
+	dec = math.Asin(degSin(beta)*degCos(eps) + degCos(beta)*degSin(eps)*degSin(lam))
+	return
+}
+
+// apparentSiderealDeg 返回 UTC 时刻 t 的格林尼治视恒星时（度）；dpsi 为黄经章动（角秒），eps 为黄赤交角（度）。
+func apparentSiderealDeg(t time.Time, dpsi, eps float64) float64 {
+	jd := julianDay(t)
+	tu := (jd - 2451545.0) / 36525
+	gmst := 280.46061837 + 360.98564736629*(jd-2451545.0) + 0.000387933*tu*tu - tu*tu*tu/38710000
+	return gmst + dpsi/3600*degCos(eps)
+}
+
+// planetHorizontal 返回行星在 t 时刻的方位角（库定义：0 为正南，向西为正）、高度角（度）及地心状态。
+func planetHorizontal(p planetInfo, t time.Time, lat, lon float64) (azDeg, altDeg float64, s planetState) {
+	jde := timeToJDE(t)
+	tc := (jde - 2451545.0) / 36525
+	s = planetGeocentric(p, jde)
+	dpsi, deps := nutation(tc)
+	eps := 23.4392911 - 0.0130042*tc + deps/3600
+	ra, dec := eclipticToEquatorial(s.Lon, s.Lat, eps)
+
+	h := (apparentSiderealDeg(t, dpsi, eps)+lon)*math.Pi/180 - ra
+	phi := lat * math.Pi / 180
+	azDeg = math.Atan2(math.Sin(h), math.Cos(h)*math.Sin(phi)-math.Tan(dec)*math.Cos(phi)) * 180 / math.Pi
+	altDeg = math.Asin(math.Sin(phi)*math.Sin(dec)+math.Cos(phi)*math.Cos(dec)*math.Cos(h)) * 180 / math.Pi
+	return
+}
+
+// planetRiseSet 在 [dayStart, dayStart+24h) 内以 10 分钟步长扫描行星高度，二分求首次升起与落下时刻；无事件时返回零值。
+func planetRiseSet(p planetInfo, dayStart time.Time, lat, lon float64) (rise, set time.Time) {
+	f := func(t time.Time) float64 {
+		_, alt, _ := planetHorizontal(p, t, lat, lon)
+		return alt - planetRiseSetAltitude
+	}
+	step := 10 * time.Minute
+	prevT := dayStart
+	prev := f(prevT)
+	for t := dayStart.Add(step); !t.After(dayStart.Add(24 * time.Hour)); t = t.Add(step) {
+		cur := f(t)
+		if (prev < 0) != (cur < 0) {
+			c := bisectContact(prevT, t, f)
+			if cur >= 0 && rise.IsZero() {
+				rise = c
+			} else if cur < 0 && set.IsZero() {
+				set = c
+			}
+		}
+		prevT, prev = t, cur
+	}
+	return rise, set
+}
+
+// planetPosition 为行星实时位置的对外 JSON 结构（升落时间为城市当地时间）。
+type planetPosition struct {
+	Key                 string  `json:"key"`
+	Name                string  `json:"name"`
+	AzimuthDeg          float64 `json:"azimuth_deg"`
+	AzimuthText         string  `json:"azimuth_text"`
+	AltitudeDeg         float64 `json:"altitude_deg"`
+	ApparentAltitudeDeg float64 `json:"apparent_altitude_deg"`
+	DistanceKm          float64 `json:"distance_km"`
+	DistanceAU          float64 `json:"distance_au"`
+	Magnitude           float64 `json:"magnitude"`
+	Rise                string  `json:"rise"`
+	Set                 string  `json:"set"`
+}
+
+// withApparentAltitudes 按给定气温/气压为行星列表补充视高度。
+func withApparentAltitudes(list []planetPosition, atm atmosphere) []planetPosition {
+	for i := range list {
+		list[i].ApparentAltitudeDeg = apparentAltitude(list[i].AltitudeDeg, atm)
+	}
+	return list
+}
+
+// buildPlanetPositions 返回 now 时刻五颗肉眼行星的位置、星等与当地当天升落时间。
+func buildPlanetPositions(now time.Time, lat, lon float64, loc *time.Location) []planetPosition {
+	local := now.In(loc)
+	dayStart := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	tc := (timeToJDE(now) - 2451545.0) / 36525
+
+	list := make([]planetPosition, 0, len(planetTable))
+	for _, p := range planetTable {
+		az, alt, s := planetHorizontal(p, now, lat, lon)
+		rise, set := planetRiseSet(p, dayStart, lat, lon)
+		list = append(list, planetPosition{
+			Key:         p.Key,
+			Name:        p.Name,
+			AzimuthDeg:  az,
+			AzimuthText: describeAzimuth(az),
+			AltitudeDeg: alt,
+			DistanceKm:  s.Delta * auKmExact,
+			DistanceAU:  s.Delta,
+			Magnitude:   math.Round(planetMagnitude(p.Key, s, tc)*100) / 100,
+			Rise:        formatTimeLocal(rise.In(loc)),
+			Set:         formatTimeLocal(set.In(loc)),
+		})
+	}
+	return list
+}
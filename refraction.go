@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// -------------------- 大气折射 --------------------
+
+// atmosphere 为计算大气折射用的地面气温（℃）与气压（hPa）。
+type atmosphere struct {
+	TempC       float64 `json:"temp_c"`
+	PressureHPa float64 `json:"pressure_hpa"`
+}
+
+// standardAtmosphere 为 Saemundsson 公式的标准条件（10℃、1010 hPa）。
+var standardAtmosphere = atmosphere{TempC: 10, PressureHPa: 1010}
+
+// refractionMinAltitude 为折射公式的适用下限：公式在地平线下迅速失真，低于它时折射量在 refractionTaperDeg 内
+// 线性减小到 0（保持视高度连续），再往下视高度即几何高度。
+const (
+	refractionMinAltitude = -1.0
+	refractionTaperDeg    = 1.0
+)
+
+// validate 检查气温与气压是否在合理范围内；气压为 0 表示真空（无折射）。
+func (a atmosphere) validate() error {
+	if math.IsNaN(a.TempC) || a.TempC < -90 || a.TempC > 60 {
+		return fmt.Errorf("气温 %.1f℃ 超出范围（-90 ~ 60℃）", a.TempC)
+	}
+	if math.IsNaN(a.PressureHPa) || a.PressureHPa < 0 || a.PressureHPa > 1100 {
+		return fmt.Errorf("气压 %.1f hPa 超出范围（0 ~ 1100 hPa）", a.PressureHPa)
+	}
+	return nil
+}
+
+// factor 返回相对标准条件的折射缩放系数 (P/1010)·(283/(273+T))。
+func (a atmosphere) factor() float64 {
+	return a.PressureHPa / 1010 * 283 / (273 + a.TempC)
+}
+
+// saemundssonRefractionDeg 由几何（真）高度 h 计算折射量（度）：R = 1.02′ / tan(h + 10.3/(h+5.11))；
+// 低于 refractionMinAltitude 时按该处的折射量线性减小，refractionTaperDeg 之下为 0。
+func saemundssonRefractionDeg(h float64, a atmosphere) float64 {
+	if h >= refractionMinAltitude {
+		return a.factor() * 1.02 / math.Tan((h+10.3/(h+5.11))*math.Pi/180) / 60
+	}
+	w := (h - (refractionMinAltitude - refractionTaperDeg)) / refractionTaperDeg
+	if w <= 0 {
+		return 0
+	}
+	return w * saemundssonRefractionDeg(refractionMinAltitude, a)
+}
+
+// apparentAltitude 将几何高度换算为视高度。
+func apparentAltitude(h float64, a atmosphere) float64 {
+	return h + saemundssonRefractionDeg(h, a)
+}
+
+// moonGeometricAltitude 去掉 sunmooncalc 月亮高度中已按标准条件加入的折射（Meeus 16.4，负高度按 0 计），
+// 迭代求得几何高度，以便与太阳一样按实际气温气压重新计算视高度。
+func moonGeometricAltitude(libAlt float64) float64 {
+	h := libAlt
+	for i := 0; i < 20; i++ {
+		next := libAlt - refractionDeg(h)
+		if math.Abs(next-h) < 1e-9 {
+			return next
+		}
+		h = next
+	}
+	return h
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+)
+
+// -------------------- 年度 HTML 报告 --------------------
+
+// moonPhaseGlyphs 为八个月相阶段的符号：新月、娥眉月、上弦、盈凸、满月、亏凸、下弦、残月。
+var moonPhaseGlyphs = [8]string{"🌑", "🌒", "🌓", "🌔", "🌕", "🌖", "🌗", "🌘"}
+
+// moonPhaseStage 将月相事件类型映射为 moonPhaseGlyphs 下标（0/2/4/6）。
+var moonPhaseStage = map[string]int{"new_moon": 0, "first_quarter": 2, "full_moon": 4, "last_quarter": 6}
+
+// dailyMoonGlyphs 仅依据数据中的月相事件推算每天的月相符号：事件当天取主月相，
+// 两次事件之间取其间的过渡阶段；首个事件之前按其前一阶段处理。
+func dailyMoonGlyphs(data []dailyAstro) []string {
+	glyphs := make([]string, len(data))
+	stage := -1
+	for _, d := range data {
+		if s, ok := moonPhaseStage[d.PhaseEventType]; ok {
+			stage = (s + 7) % 8
+			break
+		}
+	}
+	if stage < 0 {
+		return glyphs // 数据中没有月相事件（如单日），不标注
+	}
+	for i, d := range data {
+		if s, ok := moonPhaseStage[d.PhaseEventType]; ok {
+			glyphs[i] = moonPhaseGlyphs[s]
+			stage = s + 1
+			continue
+		}
+		glyphs[i] = moonPhaseGlyphs[stage]
+	}
+	return glyphs
+}
+
+// astroReportStat 为报告摘要中的一项统计。
+type astroReportStat struct {
+	Label, Value, Date string
+}
+
+// astroReportStats 统计最长/最短白昼、最早日出、最晚日落与满月日期；缺少相应数据时值为 "--"。
+func astroReportStats(data []dailyAstro) (stats []astroReportStat, fullMoons []string) {
+	longest, shortest, earliest, latest := -1, -1, -1, -1
+	for i, d := range data {
+		if d.HasDayLength {
+			if longest < 0 || d.DayLengthMinutes > data[longest].DayLengthMinutes {
+				longest = i
+			}
+			if shortest < 0 || d.DayLengthMinutes < data[shortest].DayLengthMinutes {
+				shortest = i
+			}
+		}
+		if d.HasSunrise && (earliest < 0 || d.Sunrise < data[earliest].Sunrise) {
+			earliest = i
+		}
+		if d.HasSunset && (latest < 0 || d.Sunset > data[latest].Sunset) {
+			latest = i
+		}
+		if d.PhaseEventType == "full_moon" {
+			fullMoons = append(fullMoons, d.Date+" "+strings.TrimPrefix(d.PhaseEvent, "满月 "))
+		}
+	}
+	stat := func(label string, i int, value func(dailyAstro) string) astroReportStat {
+		if i < 0 {
+			return astroReportStat{Label: label, Value: "--"}
+		}
+		return astroReportStat{Label: label, Value: value(data[i]), Date: data[i].Date}
+	}
+	stats = []astroReportStat{
+		stat("最长白昼", longest, func(d dailyAstro) string { return d.DayLength }),
+		stat("最短白昼", shortest, func(d dailyAstro) string { return d.DayLength }),
+		stat("最早日出", earliest, func(d dailyAstro) string { return d.Sunrise }),
+		stat("最晚日落", latest, func(d dailyAstro) string { return d.Sunset }),
+	}
+	return stats, fullMoons
+}
+
+// writeAstroReport 以可打印的自包含 HTML 年度报告输出天文数据。
+func writeAstroReport(cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc, filePath string, allowOverwrite bool) (string, error) {
+	return writeAstroToFile(filePath, allowOverwrite, func(w io.Writer) error {
+		return writeAstroReportTo(w, cityName, elev, now, data, desc)
+	})
+}
+
+// writeAstroReportTo 输出年度报告：摘要统计、逐月日历（日出/日落/月相符号/节气）与日序列图表，
+// CSS 与 SVG 全部内联，不引用任何外部资源。
+func writeAstroReportTo(w io.Writer, cityName string, elev observerElevation, now time.Time, data []dailyAstro, desc string) error {
+	title := "eSunMoon 天文年报：" + cityName
+	_, sub := astroChartTitles(cityName, elev, now, desc)
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>%s</title>
+<style>
+@page { size: A4; margin: 12mm; }
+body { margin: 0 auto; padding: 16px; max-width: 1000px; font-family: sans-serif; color: #212529; }
+h1 { font-size: 22px; margin: 0 0 4px; }
+h2 { font-size: 16px; margin: 24px 0 8px; border-bottom: 2px solid #dee2e6; padding-bottom: 4px; }
+.meta { color: #555; font-size: 12px; margin: 0; }
+.stats { display: grid; grid-template-columns: repeat(4, 1fr); gap: 8px; }
+.stat { border: 1px solid #dee2e6; border-radius: 4px; padding: 8px; }
+.stat .label { font-size: 12px; color: #555; }
+.stat .value { font-size: 20px; font-weight: bold; }
+.stat .date { font-size: 12px; color: #555; }
+.fullmoons { font-size: 12px; margin: 8px 0 0; }
+.months { display: grid; grid-template-columns: repeat(3, 1fr); gap: 12px; }
+.month { break-inside: avoid; page-break-inside: avoid; }
+.month h3 { font-size: 14px; margin: 0 0 4px; text-align: center; }
+table.cal { width: 100%%; border-collapse: collapse; table-layout: fixed; font-size: 9px; }
+table.cal th { font-weight: normal; color: #555; border-bottom: 1px solid #adb5bd; }
+table.cal td { border: 1px solid #e9ecef; vertical-align: top; height: 46px; padding: 1px 2px; }
+table.cal td.empty { background: #f8f9fa; }
+table.cal td.nodata { color: #adb5bd; }
+table.cal .d { font-weight: bold; font-size: 11px; }
+table.cal .m { float: right; font-size: 11px; }
+table.cal .t { color: #c2255c; }
+.legend { font-size: 11px; color: #555; margin-top: 6px; }
+.charts { break-before: page; page-break-before: always; }
+.charts svg { width: 100%%; height: auto; }
+@media print { body { padding: 0; } .months { gap: 8px; } }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<p class="meta">%s</p>
+`, html.EscapeString(title), html.EscapeString(title), html.EscapeString(sub))
+
+	// 摘要统计
+	stats, fullMoons := astroReportStats(data)
+	b.WriteString("<h2>摘要</h2>\n<div class=\"stats\">\n")
+	for _, s := range stats {
+		fmt.Fprintf(&b, `<div class="stat"><div class="label">%s</div><div class="value">%s</div><div class="date">%s</div></div>`+"\n",
+			html.EscapeString(s.Label), html.EscapeString(s.Value), html.EscapeString(s.Date))
+	}
+	b.WriteString("</div>\n")
+	if len(fullMoons) > 0 {
+		fmt.Fprintf(&b, "<p class=\"fullmoons\">🌕 满月（%d 次）：%s</p>\n", len(fullMoons), html.EscapeString(strings.Join(fullMoons, "，")))
+	} else {
+		b.WriteString("<p class=\"fullmoons\">🌕 满月：范围内无</p>\n")
+	}
+
+	// 逐月日历
+	b.WriteString("<h2>逐月日历</h2>\n<div class=\"months\">\n")
+	writeReportCalendars(&b, data)
+	b.WriteString("</div>\n")
+	fmt.Fprintf(&b, "<p class=\"legend\">↑ 日出　↓ 日落　%s 新月　%s 上弦　%s 满月　%s 下弦；红字为节气；时间均为城市当地时间，“--” 表示当日无日出或日落（极昼/极夜）。</p>\n",
+		moonPhaseGlyphs[0], moonPhaseGlyphs[2], moonPhaseGlyphs[4], moonPhaseGlyphs[6])
+
+	// 图表
+	b.WriteString("<div class=\"charts\">\n<h2>全年变化</h2>\n")
+	if err := renderAstroChartsSVG(&b, title, sub, newAstroChartSeries(data)); err != nil {
+		return err
+	}
+	b.WriteString("</div>\n</body>\n</html>\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// writeReportCalendars 按月份输出日历表格（周一为每周第一天），数据覆盖不到的日期置灰。
+func writeReportCalendars(b *bytes.Buffer, data []dailyAstro) {
+	glyphs := dailyMoonGlyphs(data)
+	byDate := make(map[string]int, len(data))
+	var months []time.Time
+	for i, d := range data {
+		day, err := time.Parse("2006-01-02", d.Date)
+		if err != nil {
+			continue
+		}
+		byDate[d.Date] = i
+		first := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if len(months) == 0 || !months[len(months)-1].Equal(first) {
+			months = append(months, first)
+		}
+	}
+	for _, first := range months {
+		fmt.Fprintf(b, "<div class=\"month\">\n<h3>%d 年 %d 月</h3>\n<table class=\"cal\">\n<tr>", first.Year(), int(first.Month()))
+		for _, wd := range []string{"一", "二", "三", "四", "五", "六", "日"} {
+			fmt.Fprintf(b, "<th>%s</th>", wd)
+		}
+		b.WriteString("</tr>\n<tr>")
+		col := (int(first.Weekday()) + 6) % 7
+		for i := 0; i < col; i++ {
+			b.WriteString(`<td class="empty"></td>`)
+		}
+		for day := first; day.Month() == first.Month(); day = day.AddDate(0, 0, 1) {
+			if col == 7 {
+				b.WriteString("</tr>\n<tr>")
+				col = 0
+			}
+			i, ok := byDate[day.Format("2006-01-02")]
+			if !ok {
+				fmt.Fprintf(b, `<td class="nodata"><span class="d">%d</span></td>`, day.Day())
+			} else {
+				d := data[i]
+				fmt.Fprintf(b, `<td><span class="d">%d</span><span class="m">%s</span><br>↑%s<br>↓%s`,
+					day.Day(), glyphs[i], html.EscapeString(d.Sunrise), html.EscapeString(d.Sunset))
+				if d.SolarTerm != "" {
+					name, _, _ := strings.Cut(d.SolarTerm, " ")
+					fmt.Fprintf(b, `<br><span class="t">%s</span>`, html.EscapeString(name))
+				}
+				b.WriteString("</td>")
+			}
+			col++
+		}
+		for ; col < 7; col++ {
+			b.WriteString(`<td class="empty"></td>`)
+		}
+		b.WriteString("</tr>\n</table>\n</div>\n")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// -------------------- 二分二至与二十四节气 --------------------
+
+// solarTermInfo 描述一个节气：名称、拼音与对应的太阳视黄经（度）。
+type solarTermInfo struct {
+	Name      string
+	Pinyin    string
+	Longitude int
+}
+
+// solarTermTable 按太阳视黄经 0°（春分）起每 15° 一个节气。
+var solarTermTable = [24]solarTermInfo{
+	{"春分", "chunfen", 0}, {"清明", "qingming", 15}, {"谷雨", "guyu", 30},
+	{"立夏", "lixia", 45}, {"小满", "xiaoman", 60}, {"芒种", "mangzhong", 75},
+	{"夏至", "xiazhi", 90}, {"小暑", "xiaoshu", 105}, {"大暑", "dashu", 120},
+	{"立秋", "liqiu", 135}, {"处暑", "chushu", 150}, {"白露", "bailu", 165},
+	{"秋分", "qiufen", 180}, {"寒露", "hanlu", 195}, {"霜降", "shuangjiang", 210},
+	{"立冬", "lidong", 225}, {"小雪", "xiaoxue", 240}, {"大雪", "daxue", 255},
+	{"冬至", "dongzhi", 270}, {"小寒", "xiaohan", 285}, {"大寒", "dahan", 300},
+	{"立春", "lichun", 315}, {"雨水", "yushui", 330}, {"惊蛰", "jingzhe", 345},
+}
+
+// solarTermEvent 为一次节气交节的精确时刻（UTC，调用方按城市时区转换）。
+type solarTermEvent struct {
+	Term solarTermInfo
+	Time time.Time
+}
+
+// solarTermJSON 为节气事件的对外 JSON 结构（时间为城市当地时间）。
+type solarTermJSON struct {
+	Name      string `json:"name"`
+	Pinyin    string `json:"pinyin"`
+	Longitude int    `json:"longitude_deg"`
+	Date      string `json:"date"`
+	LocalTime string `json:"local_time"`
+	Time      string `json:"time"`
+}
+
+// toJSON 将节气事件转换为指定时区下的 JSON 结构。
+func (e solarTermEvent) toJSON(loc *time.Location) solarTermJSON {
+	t := e.Time.In(loc)
+	return solarTermJSON{
+		Name:      e.Term.Name,
+		Pinyin:    e.Term.Pinyin,
+		Longitude: e.Term.Longitude,
+		Date:      t.Format("2006-01-02"),
+		LocalTime: t.Format("15:04"),
+		Time:      t.Format(time.RFC3339),
+	}
+}
+
+// vsopTerm 为 VSOP87 级数的一项：A·cos(B + C·τ)。
+type vsopTerm struct{ A, B, C float64 }
+
+// 地球日心黄经 VSOP87D 截断级数（Meeus 附录 III 主要项，单位 1e-8 弧度）。
+var earthL0 = []vsopTerm{
+	{175347046, 0, 0}, {3341656, 4.6692568, 6283.0758500}, {34894, 4.62610, 12566.15170},
+	{3497, 2.7441, 5753.3849}, {3418, 2.8289, 3.5231}, {3136, 3.6277, 77713.7715},
+	{2676, 4.4181, 7860.4194}, {2343, 6.1352, 3930.2097}, {1324, 0.7425, 11506.7698},
+	{1273, 2.0371, 529.6910}, {1199, 1.1096, 1577.3435}, {990, 5.233, 5884.927},
+	{902, 2.045, 26.298}, {857, 3.508, 398.149}, {780, 1.179, 5223.694},
+	{753, 2.533, 5507.553}, {505, 4.583, 18849.228}, {492, 4.205, 775.523},
+	{357, 2.920, 0.067}, {317, 5.849, 11790.629}, {284, 1.899, 796.298},
+	{271, 0.315, 10977.079}, {243, 0.345, 5486.778}, {206, 4.806, 2544.314},
+	{205, 1.869, 5573.143}, {202, 2.458, 6069.777}, {156, 0.833, 213.299},
+	{132, 3.411, 2942.463}, {126, 1.083, 20.775}, {115, 0.645, 0.980},
+	{103, 0.636, 4694.003}, {102, 0.976, 15720.839}, {102, 4.267, 7.114},
+	{99, 6.21, 2146.17}, {98, 0.68, 155.42}, {86, 5.98, 161000.69},
+	{85, 1.30, 6275.96}, {85, 3.67, 71430.70}, {80, 1.81, 17260.15},
+}
+
+var earthL1 = []vsopTerm{
+	{628331966747, 0, 0}, {206059, 2.678235, 6283.075850}, {4303, 2.6351, 12566.1517},
+	{425, 1.590, 3.523}, {119, 5.796, 26.298}, {109, 2.966, 1577.344},
+	{93, 2.59, 18849.23}, {72, 1.14, 529.69}, {68, 1.87, 398.15},
+	{67, 4.41, 5507.55}, {59, 2.89, 5223.69}, {56, 2.17, 155.42},
+	{45, 0.40, 796.30}, {36, 0.47, 775.52}, {29, 2.65, 7.11},
+	{21, 5.34, 0.98}, {19, 1.85, 5486.78}, {19, 4.97, 213.30},
+	{17, 2.99, 6275.96}, {16, 0.03, 2544.31},
+}
+
+var earthL2 = []vsopTerm{
+	{52919, 0, 0}, {8720, 1.0721, 6283.0758}, {309, 0.867, 12566.152},
+	{27, 0.05, 3.52}, {16, 5.19, 26.30}, {16, 3.68, 155.42},
+	{10, 0.76, 18849.23}, {9, 2.06, 77713.77}, {7, 0.83, 775.52},
+	{5, 4.66, 1577.34},
+}
+
+var earthL3 = []vsopTerm{
+	{289, 5.844, 6283.076}, {35, 0, 0}, {17, 5.49, 12566.15},
+	{3, 5.20, 155.42}, {1, 4.72, 3.52},
+}
+
+var earthL4 = []vsopTerm{{114, 3.142, 0}, {8, 4.13, 6283.08}, {1, 3.84, 12566.15}}
+
+var earthL5 = []vsopTerm{{1, 3.14, 0}}
+
+// sumVSOP 计算一组 VSOP87 级数之和。
+func sumVSOP(terms []vsopTerm, tau float64) float64 {
+	var s float64
+	for _, t := range terms {
+		s += t.A * math.Cos(t.B+t.C*tau)
+	}
+	return s
+}
+
+// normalizeDeg 将角度归一化到 [0, 360)。
+func normalizeDeg(d float64) float64 {
+	d = math.Mod(d, 360)
+	if d < 0 {
+		d += 360
+	}
+	return d
+}
+
+// apparentSolarLongitude 计算力学时 JDE 时刻太阳的地心视黄经（度），
+// 含 FK5 修正、黄经章动（主要项）与光行差，精度约数角秒。
+func apparentSolarLongitude(jde float64) float64 {
+	lon, _ := sunApparentPosition(jde)
+	return lon
+}
+
+// sunApparentPosition 返回太阳地心视黄经（度）与日地距离（AU）。
+func sunApparentPosition(jde float64) (lonDeg, rAU float64) {
+	tau := (jde - 2451545.0) / 365250
+	l := (sumVSOP(earthL0, tau) + sumVSOP(earthL1, tau)*tau + sumVSOP(earthL2, tau)*tau*tau +
+		sumVSOP(earthL3, tau)*tau*tau*tau + sumVSOP(earthL4, tau)*tau*tau*tau*tau +
+		sumVSOP(earthL5, tau)*tau*tau*tau*tau*tau) / 1e8
+	lon := normalizeDeg(l*180/math.Pi + 180)
+
+	t := tau * 10
+	lon -= 0.09033 / 3600 // FK5
+	dpsi, _ := nutation(t)
+
+	// 光行差：-20.4898″/R，R 取第 25 章近似日地距离（AU）
+	m := 357.52911 + 35999.05029*t
+	e := 0.016708634 - 0.000042037*t
+	c := (1.914602-0.004817*t)*degSin(m) + (0.019993-0.000101*t)*degSin(2*m) + 0.000289*degSin(3*m)
+	r := 1.000001018 * (1 - e*e) / (1 + e*degCos(m+c))
+
+	return normalizeDeg(lon + (dpsi-20.4898/r)/3600), r
+}
+
+// nutation 返回黄经章动 Δψ 与交角章动 Δε（角秒），采用 Meeus 第 22 章低精度公式；t 为儒略世纪数。
+func nutation(t float64) (dpsi, deps float64) {
+	omega := 125.04452 - 1934.136261*t
+	lSun := 280.4665 + 36000.7698*t
+	lMoon := 218.3165 + 481267.8813*t
+	dpsi = -17.20*degSin(omega) - 1.32*degSin(2*lSun) - 0.23*degSin(2*lMoon) + 0.21*degSin(2*omega)
+	deps = 9.20*degCos(omega) + 0.57*degCos(2*lSun) + 0.10*degCos(2*lMoon) - 0.09*degCos(2*omega)
+	return
+}
+
+// timeToJDE 将 UTC 时间转换为力学时儒略日（加上 ΔT）。
+func timeToJDE(t time.Time) float64 {
+	return julianDay(t) + deltaTSeconds(decimalYear(t))/86400
+}
+
+// solarTermInstant 从估计时刻 guess 出发迭代求太阳视黄经等于 target（度）的时刻。
+func solarTermInstant(target float64, guess time.Time) time.Time {
+	jde := timeToJDE(guess)
+	for i := 0; i < 20; i++ {
+		diff := math.Mod(target-apparentSolarLongitude(jde)+540, 360) - 180
+		step := diff * 365.2422 / 360
+		jde += step
+		if math.Abs(step) < 1e-7 {
+			break
+		}
+	}
+	return jdeToTime(jde)
+}
+
+// findSolarTerms 返回 [from, to) 区间内的全部节气（含二分二至），按时间排序。
+func findSolarTerms(from, to time.Time) []solarTermEvent {
+	if !to.After(from) {
+		return nil
+	}
+	lon := apparentSolarLongitude(timeToJDE(from))
+	idx := int(math.Floor(lon/15)) + 1
+	guess := from.Add(time.Duration((float64(idx*15) - lon) * 365.2422 / 360 * 24 * float64(time.Hour)))
+
+	var events []solarTermEvent
+	for {
+		info := solarTermTable[idx%24]
+		t := solarTermInstant(float64(info.Longitude), guess)
+		if !t.Before(to) {
+			break
+		}
+		if !t.Before(from) {
+			events = append(events, solarTermEvent{Term: info, Time: t})
+		}
+		idx++
+		guess = t.Add(time.Duration(15.2 * 24 * float64(time.Hour)))
+	}
+	return events
+}
+
+// solarTermsInYear 返回城市当地公历年内的 24 个节气（小寒 ~ 冬至）。
+func solarTermsInYear(year int, loc *time.Location) []solarTermEvent {
+	from := time.Date(year, 1, 1, 0, 0, 0, 0, loc)
+	return findSolarTerms(from, from.AddDate(1, 0, 0))
+}
+
+// solarTermsByDate 将区间内节气按城市当地日期（YYYY-MM-DD）索引。
+func solarTermsByDate(from, to time.Time, loc *time.Location) map[string]solarTermEvent {
+	byDate := make(map[string]solarTermEvent)
+	for _, e := range findSolarTerms(from, to) {
+		byDate[e.Time.In(loc).Format("2006-01-02")] = e
+	}
+	return byDate
+}
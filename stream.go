@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// -------------------- 实时位置推送（SSE） --------------------
+
+// 推送参数：订阅间隔范围、单连接最多订阅的地点数、心跳间隔与每个连接的帧缓冲。
+const (
+	minStreamInterval    = time.Second
+	maxStreamInterval    = time.Hour
+	maxStreamLocations   = 10
+	streamHeartbeat      = 15 * time.Second
+	streamSubscriberBuf  = 16
+	streamEventPositions = "positions"
+)
+
+// positionsHub 管理 /api/positions/stream 的订阅：同一地点（坐标、时区、名称、海拔与大气参数相同）共享一个
+// positionsFeed 与一个 ticker，每次触发只计算一次 livePositionsResponse 再分发给到期的订阅者。
+type positionsHub struct {
+	mu    sync.Mutex
+	feeds map[string]*positionsFeed
+}
+
+// positionsFeed 为单个地点的推送源，ticker 周期取订阅者间隔的最小值。
+type positionsFeed struct {
+	key  string
+	ctx  *CityContext
+	subs map[*positionsSubscriber]struct{} // 受 hub.mu 保护
+	tick time.Duration                     // 受 hub.mu 保护
+	kick chan struct{}
+	stop chan struct{}
+	once sync.Once
+}
+
+// halt 停止推送源的主循环（可重复调用）。
+func (f *positionsFeed) halt() {
+	f.once.Do(func() { close(f.stop) })
+}
+
+// positionsSubscriber 为一个 SSE 连接，可同时订阅多个地点，所有地点的帧写入同一 frames。
+type positionsSubscriber struct {
+	interval time.Duration
+	frames   chan []byte
+	done     chan struct{}
+	once     sync.Once
+	feeds    []*positionsFeed             // 受 hub.mu 保护
+	next     map[*positionsFeed]time.Time // 受 hub.mu 保护：各地点下次推送时间，零值表示立即推送
+}
+
+// newPositionsHub 创建空的推送中心。
+func newPositionsHub() *positionsHub {
+	return &positionsHub{feeds: make(map[string]*positionsFeed)}
+}
+
+// newPositionsSubscriber 创建按 interval 接收帧的订阅者。
+func newPositionsSubscriber(interval time.Duration) *positionsSubscriber {
+	return &positionsSubscriber{
+		interval: interval,
+		frames:   make(chan []byte, streamSubscriberBuf),
+		done:     make(chan struct{}),
+		next:     make(map[*positionsFeed]time.Time),
+	}
+}
+
+// close 通知连接结束（可重复调用）。
+func (s *positionsSubscriber) close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// streamKey 返回地点的共享键：影响 livePositionsResponse 内容的字段都参与计算。
+func streamKey(ctx *CityContext) string {
+	atm := ctx.atmosphereOrDefault()
+	return fmt.Sprintf("%.6f,%.6f|%s|%s|%s|%.1f|%.2f,%.2f", ctx.Lat, ctx.Lon, ctx.TZID, ctx.City, ctx.DisplayName, ctx.Elevation, atm.TempC, atm.PressureHPa)
+}
+
+// subscribe 将订阅者加入 ctx 对应的推送源，不存在时创建并启动；新订阅立即收到一帧。
+func (h *positionsHub) subscribe(sub *positionsSubscriber, ctx *CityContext) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := streamKey(ctx)
+	f, ok := h.feeds[key]
+	if !ok {
+		f = &positionsFeed{
+			key:  key,
+			ctx:  ctx,
+			subs: make(map[*positionsSubscriber]struct{}),
+			tick: sub.interval,
+			kick: make(chan struct{}, 1),
+			stop: make(chan struct{}),
+		}
+		h.feeds[key] = f
+		go h.run(f)
+	}
+	f.subs[sub] = struct{}{}
+	f.tick = min(f.tick, sub.interval)
+	sub.feeds = append(sub.feeds, f)
+	sub.next[f] = time.Time{}
+	select {
+	case f.kick <- struct{}{}:
+	default:
+	}
+}
+
+// unsubscribe 将订阅者从所有推送源移除；推送源无订阅者时停止 ticker。
+func (h *positionsHub) unsubscribe(sub *positionsSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, f := range sub.feeds {
+		delete(f.subs, sub)
+		if len(f.subs) == 0 {
+			if h.feeds[f.key] == f {
+				delete(h.feeds, f.key)
+			}
+			f.halt()
+			continue
+		}
+		f.tick = maxStreamInterval
+		for s := range f.subs {
+			f.tick = min(f.tick, s.interval)
+		}
+	}
+	sub.feeds = nil
+	sub.close()
+}
+
+// closeAll 结束所有推送源与连接，供 HTTP 服务优雅关闭时调用（SSE 连接不会自行空闲，否则 Shutdown 会等到超时）。
+func (h *positionsHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, f := range h.feeds {
+		for s := range f.subs {
+			s.close()
+		}
+		f.halt()
+		delete(h.feeds, key)
+	}
+}
+
+// feedCount 返回当前活跃的推送源数量。
+func (h *positionsHub) feedCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.feeds)
+}
+
+// run 为推送源的主循环：ticker 或新订阅触发时，向到期订阅者发送同一帧；订阅者缓冲已满时丢弃该帧。
+func (h *positionsHub) run(f *positionsFeed) {
+	h.mu.Lock()
+	tick := f.tick
+	h.mu.Unlock()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		case <-f.kick:
+		}
+
+		h.mu.Lock()
+		if f.tick != tick {
+			tick = f.tick
+			ticker.Reset(tick)
+		}
+		// 允许提前半个周期，避免不同间隔的订阅者因 ticker 相位差整整晚一拍
+		now := time.Now()
+		var due []*positionsSubscriber
+		for s := range f.subs {
+			if !now.Add(tick / 2).Before(s.next[f]) {
+				due = append(due, s)
+			}
+		}
+		h.mu.Unlock()
+		if len(due) == 0 {
+			continue
+		}
+
+		frame, err := json.Marshal(buildLivePositions(f.ctx))
+		if err != nil {
+			logErrorf("序列化实时位置失败: %v", err)
+			continue
+		}
+		h.mu.Lock()
+		for _, s := range due {
+			if _, ok := f.subs[s]; !ok {
+				continue
+			}
+			s.next[f] = now.Add(s.interval)
+			select {
+			case s.frames <- frame:
+			default:
+				logDebugf("SSE 订阅者缓冲已满，丢弃一帧：%s", f.ctx.City)
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+// parseStreamInterval 解析 interval（秒），留空时使用页面默认刷新间隔。
+func parseStreamInterval(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultPositionsRefresh, nil
+	}
+	n, err := strconv.Atoi(s)
+	d := time.Duration(n) * time.Second
+	if err != nil || d < minStreamInterval || d > maxStreamInterval {
+		return 0, apiErrorf(errCodeInvalidParam, "interval", "interval 必须为 %d~%d 的整数（秒）", int(minStreamInterval/time.Second), int(maxStreamInterval/time.Second))
+	}
+	return d, nil
+}
+
+// resolveStreamContexts 解析要订阅的地点：提供 lat+lon 时为单个坐标，否则为一个或多个 city 参数（可重复）。
+func resolveStreamContexts(reqCtx context.Context, q url.Values) ([]*CityContext, error) {
+	cities := q["city"]
+	if (q.Get("lat") != "" && q.Get("lon") != "") || len(cities) <= 1 {
+		ctx, err := resolveContextFromQuery(reqCtx, q)
+		if err != nil {
+			return nil, err
+		}
+		return []*CityContext{ctx}, nil
+	}
+	if len(cities) > maxStreamLocations {
+		return nil, apiErrorf(errCodeInvalidParam, "city", "一次最多订阅 %d 个城市", maxStreamLocations)
+	}
+	out := make([]*CityContext, 0, len(cities))
+	for _, c := range cities {
+		one := url.Values{}
+		for k, vs := range q {
+			one[k] = vs
+		}
+		one.Set("city", c)
+		ctx, err := resolveContextFromQuery(reqCtx, one)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ctx)
+	}
+	return out, nil
+}
+
+// positionsStreamHandler 处理 /api/positions/stream：以 SSE 按 interval 秒推送 livePositionsResponse（event: positions），
+// 支持重复 city 参数同时订阅多个城市；参数解析（含城市缓存读取）只在建立连接时进行一次。
+func positionsStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, apiErrorf(errCodeInternal, "", "当前连接不支持流式输出"))
+		return
+	}
+	q := r.URL.Query()
+	interval, err := parseStreamInterval(q.Get("interval"))
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	ctxs, err := resolveStreamContexts(r.Context(), q)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	for _, ctx := range ctxs {
+		if err := applyAtmosphereQuery(ctx, q); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // 关闭 nginx 缓冲
+	fmt.Fprintf(w, "retry: %d\n\n", (5 * time.Second).Milliseconds())
+	flusher.Flush()
+
+	hub := app.streams
+	sub := newPositionsSubscriber(interval)
+	for _, ctx := range ctxs {
+		hub.subscribe(sub, ctx)
+	}
+	defer hub.unsubscribe(sub)
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.done:
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case frame := <-sub.frames:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", streamEventPositions, frame)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	suncalc "github.com/redtim/sunmooncalc"
+)
+
+// -------------------- 太阳轨迹图（SVG） --------------------
+
+// 太阳轨迹图投影方式。
+const (
+	sunPathStereographic = "stereographic"
+	sunPathCylindrical   = "cylindrical"
+)
+
+// 日期曲线与时角线（日行迹）的采样间隔。
+const (
+	sunPathCurveStep = 5 * time.Minute
+	sunPathDayStep   = 1
+)
+
+// sunPathMonthColors 为 1~12 月 21 日曲线的颜色。
+var sunPathMonthColors = [12]string{
+	"#1f4e9c", "#2f7fc1", "#2aa198", "#3c9d3c", "#98b734", "#e0a526",
+	"#d9541e", "#c23b3b", "#a63a82", "#7047a8", "#4b4fb5", "#36689e",
+}
+
+// parseSunPathProjection 解析投影参数，留空为立体投影。
+func parseSunPathProjection(s string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "stereo", sunPathStereographic, "polar":
+		return sunPathStereographic, nil
+	case "cyl", sunPathCylindrical:
+		return sunPathCylindrical, nil
+	default:
+		return "", apiErrorf(errCodeInvalidParam, "projection", "projection 必须为 stereographic/cylindrical: %q", s)
+	}
+}
+
+// sunPathPoint 为天球上的一点：Az 为罗盘方位（正北 0°、顺时针），Alt 为几何高度（度）。
+type sunPathPoint struct {
+	Az, Alt float64
+}
+
+// sunCompassPosition 返回 t 时刻太阳的罗盘方位与几何高度（度）。
+func sunCompassPosition(t time.Time, lat, lon float64) sunPathPoint {
+	pos := suncalc.GetPosition(t, lat, lon)
+	return sunPathPoint{Az: normalizeCompass(radToDeg(pos.Azimuth) + 180), Alt: radToDeg(pos.Altitude)}
+}
+
+// normalizeCompass 将方位归一到 [0, 360)。
+func normalizeCompass(az float64) float64 {
+	az = math.Mod(az, 360)
+	if az < 0 {
+		az += 360
+	}
+	return az
+}
+
+// visibleRuns 将按时间顺序的采样点切分为地平线以上的连续段，并在出入地平处线性插值出 0° 端点。
+func visibleRuns(samples []sunPathPoint) [][]sunPathPoint {
+	var runs [][]sunPathPoint
+	var cur []sunPathPoint
+	horizonAt := func(a, b sunPathPoint) sunPathPoint {
+		f := a.Alt / (a.Alt - b.Alt)
+		da := math.Remainder(b.Az-a.Az, 360)
+		return sunPathPoint{Az: normalizeCompass(a.Az + da*f), Alt: 0}
+	}
+	for i, p := range samples {
+		if p.Alt >= 0 {
+			if cur == nil && i > 0 {
+				cur = append(cur, horizonAt(samples[i-1], p))
+			}
+			cur = append(cur, p)
+			continue
+		}
+		if cur != nil {
+			cur = append(cur, horizonAt(samples[i-1], p))
+			runs = append(runs, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 0 {
+		runs = append(runs, cur)
+	}
+	return runs
+}
+
+// sunPathDayCurve 采样 day 当天（当地 0 点起 24 小时）的太阳轨迹。
+func sunPathDayCurve(day time.Time, lat, lon float64) []sunPathPoint {
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	to := from.AddDate(0, 0, 1)
+	var pts []sunPathPoint
+	for t := from; !t.After(to); t = t.Add(sunPathCurveStep) {
+		pts = append(pts, sunCompassPosition(t, lat, lon))
+	}
+	return pts
+}
+
+// sunPathAnalemma 采样 year 年每天标准时 hour 点的太阳位置（时角线，呈 8 字形），末尾取次年 1 月 1 日以闭合曲线。
+func sunPathAnalemma(year, hour int, std *time.Location, lat, lon float64) []sunPathPoint {
+	start := time.Date(year, 1, 1, hour, 0, 0, 0, std)
+	end := start.AddDate(1, 0, 0)
+	var pts []sunPathPoint
+	for t := start; !t.After(end); t = t.AddDate(0, 0, sunPathDayStep) {
+		pts = append(pts, sunCompassPosition(t, lat, lon))
+	}
+	return pts
+}
+
+// standardZone 返回 loc 在 year 年的标准时（取 1 月与 7 月偏移中较小者，即不含夏令时），
+// 使时角线在夏令时切换处不断开。
+func standardZone(loc *time.Location, year int) *time.Location {
+	_, jan := time.Date(year, 1, 1, 12, 0, 0, 0, loc).Zone()
+	_, jul := time.Date(year, 7, 1, 12, 0, 0, 0, loc).Zone()
+	off := min(jan, jul)
+	return time.FixedZone(formatUTCOffset(off), off)
+}
+
+// sunPathChart 描述画布尺寸与投影参数。
+type sunPathChart struct {
+	projection    string
+	width, height float64
+	// 立体投影：天顶在圆心，地平圈半径 r，北在上、东在右（俯视平面图）
+	cx, cy, r float64
+	// 圆柱投影：横轴方位、纵轴高度，center 为居中的方位（北半球为正南，南半球为正北）
+	x0, y0, x1, y1, center float64
+	legendX, legendY       float64
+}
+
+// newSunPathChart 按投影方式与纬度创建画布。
+func newSunPathChart(projection string, lat float64) *sunPathChart {
+	if projection == sunPathCylindrical {
+		c := &sunPathChart{projection: projection, width: 1000, height: 560,
+			x0: 60, y0: 90, x1: 820, y1: 500, center: 180, legendX: 850, legendY: 110}
+		if lat < 0 {
+			c.center = 0
+		}
+		return c
+	}
+	return &sunPathChart{projection: projection, width: 960, height: 880,
+		cx: 420, cy: 470, r: 360, legendX: 820, legendY: 110}
+}
+
+// project 将罗盘方位/高度映射为画布坐标。
+func (c *sunPathChart) project(p sunPathPoint) (x, y float64) {
+	if c.projection == sunPathCylindrical {
+		rel := normalizeCompass(p.Az - c.center + 180)
+		x = c.x0 + rel/360*(c.x1-c.x0)
+		y = c.y1 - p.Alt/90*(c.y1-c.y0)
+		return x, y
+	}
+	rr := c.r * math.Tan((90-p.Alt)/2*math.Pi/180)
+	az := p.Az * math.Pi / 180
+	return c.cx + rr*math.Sin(az), c.cy - rr*math.Cos(az)
+}
+
+// paths 将地平线以上的采样段投影为 SVG path 数据；圆柱投影下跨越画布左右边界时断开。
+func (c *sunPathChart) paths(samples []sunPathPoint) []string {
+	var out []string
+	for _, run := range visibleRuns(samples) {
+		var b strings.Builder
+		var px float64
+		n := 0
+		for i, p := range run {
+			x, y := c.project(p)
+			if i > 0 && c.projection == sunPathCylindrical && math.Abs(x-px) > (c.x1-c.x0)/2 {
+				if n > 1 {
+					out = append(out, b.String())
+				}
+				b.Reset()
+				n = 0
+			}
+			if n == 0 {
+				fmt.Fprintf(&b, "M%.1f %.1f", x, y)
+			} else {
+				fmt.Fprintf(&b, " L%.1f %.1f", x, y)
+			}
+			px = x
+			n++
+		}
+		if n > 1 {
+			out = append(out, b.String())
+		}
+	}
+	return out
+}
+
+// renderSunPathSVG 为 ctx 生成 year 年的太阳轨迹图：每月 21 日的日期曲线、整点时角线（8 字形日行迹）、
+// 当日轨迹与 ctx.Now 时刻的太阳位置；若设置了地平线轮廓一并绘出遮挡区域。
+func renderSunPathSVG(w io.Writer, ctx *CityContext, year int, projection string) error {
+	projection, err := parseSunPathProjection(projection)
+	if err != nil {
+		return err
+	}
+	if year <= 0 {
+		year = ctx.Now.Year()
+	}
+	if year < 1900 || year > 2150 {
+		return apiErrorf(errCodeInvalidParam, "year", "年份超出支持范围（1900~2150）: %d", year)
+	}
+	c := newSunPathChart(projection, ctx.Lat)
+	std := standardZone(ctx.Loc, year)
+	bw := bufio.NewWriter(w)
+
+	name := ctx.DisplayName
+	if name == "" {
+		name = ctx.City
+	}
+	projName := "立体投影"
+	if projection == sunPathCylindrical {
+		projName = "圆柱投影"
+	}
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f" font-family="sans-serif" font-size="12">`+"\n",
+		c.width, c.height, c.width, c.height)
+	fmt.Fprintf(bw, `<rect width="100%%" height="100%%" fill="#ffffff"/>`+"\n")
+	fmt.Fprintf(bw, `<text x="20" y="32" font-size="20" font-weight="bold">%s</text>`+"\n",
+		html.EscapeString(fmt.Sprintf("%s %d 年太阳轨迹图（%s）", name, year, projName)))
+	fmt.Fprintf(bw, `<text x="20" y="54" fill="#555">%s</text>`+"\n",
+		html.EscapeString(fmt.Sprintf("纬度 %.4f，经度 %.4f，时区 %s；时角线按标准时 %s，高度为几何高度", ctx.Lat, ctx.Lon, ctx.TZID, std.String())))
+
+	c.writeGrid(bw)
+	if len(ctx.Horizon) > 0 {
+		c.writeHorizon(bw, ctx.Horizon)
+	}
+
+	// 整点时角线
+	fmt.Fprintln(bw, `<g fill="none" stroke="#888" stroke-width="0.8">`)
+	type hourLabel struct {
+		hour int
+		p    sunPathPoint
+	}
+	var labels []hourLabel
+	for h := 0; h < 24; h++ {
+		samples := sunPathAnalemma(year, h, std, ctx.Lat, ctx.Lon)
+		paths := c.paths(samples)
+		for _, d := range paths {
+			fmt.Fprintf(bw, `<path d="%s"/>`+"\n", d)
+		}
+		if len(paths) > 0 {
+			top := samples[0]
+			for _, p := range samples {
+				if p.Alt > top.Alt {
+					top = p
+				}
+			}
+			labels = append(labels, hourLabel{h, top})
+		}
+	}
+	fmt.Fprintln(bw, `</g>`)
+	fmt.Fprintln(bw, `<g fill="#555" text-anchor="middle" font-size="11">`)
+	for _, l := range labels {
+		x, y := c.project(l.p)
+		fmt.Fprintf(bw, `<text x="%.1f" y="%.1f">%d</text>`+"\n", x, y-6, l.hour)
+	}
+	fmt.Fprintln(bw, `</g>`)
+
+	// 每月 21 日日期曲线
+	fmt.Fprintln(bw, `<g fill="none" stroke-width="1.6">`)
+	for m := 1; m <= 12; m++ {
+		day := time.Date(year, time.Month(m), 21, 0, 0, 0, 0, ctx.Loc)
+		for _, d := range c.paths(sunPathDayCurve(day, ctx.Lat, ctx.Lon)) {
+			fmt.Fprintf(bw, `<path d="%s" stroke="%s"/>`+"\n", d, sunPathMonthColors[m-1])
+		}
+	}
+	fmt.Fprintln(bw, `</g>`)
+
+	// 当日轨迹与当前太阳位置
+	fmt.Fprintln(bw, `<g fill="none" stroke="#e8590c" stroke-width="1.4" stroke-dasharray="5 4">`)
+	for _, d := range c.paths(sunPathDayCurve(ctx.Now.In(ctx.Loc), ctx.Lat, ctx.Lon)) {
+		fmt.Fprintf(bw, `<path d="%s"/>`+"\n", d)
+	}
+	fmt.Fprintln(bw, `</g>`)
+	now := sunCompassPosition(ctx.Now, ctx.Lat, ctx.Lon)
+	nowText := fmt.Sprintf("当前 %s：方位 %.1f°，高度 %.1f°", ctx.Now.In(ctx.Loc).Format("2006-01-02 15:04"), now.Az, now.Alt)
+	if now.Alt >= 0 {
+		x, y := c.project(now)
+		fmt.Fprintf(bw, `<circle cx="%.1f" cy="%.1f" r="7" fill="#ffd43b" stroke="#e8590c" stroke-width="2"/>`+"\n", x, y)
+	} else {
+		nowText += "（位于地平线下）"
+	}
+
+	// 图例
+	lx, ly := c.legendX, c.legendY
+	for m := 1; m <= 12; m++ {
+		y := ly + float64(m-1)*22
+		fmt.Fprintf(bw, `<line x1="%.0f" y1="%.0f" x2="%.0f" y2="%.0f" stroke="%s" stroke-width="3"/>`+"\n", lx, y, lx+24, y, sunPathMonthColors[m-1])
+		fmt.Fprintf(bw, `<text x="%.0f" y="%.0f">%d 月 21 日</text>`+"\n", lx+32, y+4, m)
+	}
+	y := ly + 12*22
+	fmt.Fprintf(bw, `<line x1="%.0f" y1="%.0f" x2="%.0f" y2="%.0f" stroke="#888"/>`+"\n", lx, y, lx+24, y)
+	fmt.Fprintf(bw, `<text x="%.0f" y="%.0f">整点时角线</text>`+"\n", lx+32, y+4)
+	y += 22
+	fmt.Fprintf(bw, `<line x1="%.0f" y1="%.0f" x2="%.0f" y2="%.0f" stroke="#e8590c" stroke-dasharray="5 4"/>`+"\n", lx, y, lx+24, y)
+	fmt.Fprintf(bw, `<text x="%.0f" y="%.0f">当日轨迹</text>`+"\n", lx+32, y+4)
+	fmt.Fprintf(bw, `<text x="20" y="%.0f" fill="#333">%s</text>`+"\n", c.height-16, html.EscapeString(nowText))
+	fmt.Fprintln(bw, `</svg>`)
+	return bw.Flush()
+}
+
+// writeGrid 绘制高度圈/方位线与方位标注。
+func (c *sunPathChart) writeGrid(w io.Writer) {
+	cardinal := map[int]string{0: "北", 90: "东", 180: "南", 270: "西"}
+	fmt.Fprintln(w, `<g fill="none" stroke="#ccc" stroke-width="0.6">`)
+	if c.projection == sunPathCylindrical {
+		for alt := 0; alt <= 90; alt += 10 {
+			_, y := c.project(sunPathPoint{Alt: float64(alt)})
+			fmt.Fprintf(w, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/>`+"\n", c.x0, y, c.x1, y)
+		}
+		for az := 0; az < 360; az += 15 {
+			x, _ := c.project(sunPathPoint{Az: float64(az)})
+			fmt.Fprintf(w, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/>`+"\n", x, c.y0, x, c.y1)
+		}
+		fmt.Fprintf(w, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" stroke="#333" stroke-width="1"/>`+"\n", c.x0, c.y0, c.x1-c.x0, c.y1-c.y0)
+		fmt.Fprintln(w, `</g>`)
+		fmt.Fprintln(w, `<g fill="#333" font-size="11">`)
+		for alt := 0; alt <= 90; alt += 10 {
+			_, y := c.project(sunPathPoint{Alt: float64(alt)})
+			fmt.Fprintf(w, `<text x="%.1f" y="%.1f" text-anchor="end">%d°</text>`+"\n", c.x0-6, y+4, alt)
+		}
+		for az := 0; az < 360; az += 30 {
+			x, _ := c.project(sunPathPoint{Az: float64(az)})
+			label := fmt.Sprintf("%d°", az)
+			if s, ok := cardinal[az]; ok {
+				label = s
+			}
+			fmt.Fprintf(w, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`+"\n", x, c.y1+18, label)
+		}
+		fmt.Fprintln(w, `</g>`)
+		return
+	}
+	for alt := 0; alt < 90; alt += 10 {
+		rr := c.r * math.Tan((90-float64(alt))/2*math.Pi/180)
+		width := 0.6
+		if alt == 0 {
+			width = 1.2
+		}
+		fmt.Fprintf(w, `<circle cx="%.1f" cy="%.1f" r="%.1f" stroke-width="%.1f"/>`+"\n", c.cx, c.cy, rr, width)
+	}
+	for az := 0; az < 360; az += 15 {
+		x, y := c.project(sunPathPoint{Az: float64(az)})
+		fmt.Fprintf(w, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f"/>`+"\n", c.cx, c.cy, x, y)
+	}
+	fmt.Fprintln(w, `</g>`)
+	fmt.Fprintln(w, `<g fill="#333" font-size="11" text-anchor="middle">`)
+	for alt := 10; alt < 90; alt += 10 {
+		x, y := c.project(sunPathPoint{Az: 0, Alt: float64(alt)})
+		fmt.Fprintf(w, `<text x="%.1f" y="%.1f">%d°</text>`+"\n", x+12, y+4, alt)
+	}
+	for az := 0; az < 360; az += 30 {
+		rr := c.r + 16
+		a := float64(az) * math.Pi / 180
+		label := fmt.Sprintf("%d°", az)
+		if s, ok := cardinal[az]; ok {
+			label = s
+		}
+		fmt.Fprintf(w, `<text x="%.1f" y="%.1f">%s</text>`+"\n", c.cx+rr*math.Sin(a), c.cy-rr*math.Cos(a)+4, label)
+	}
+	fmt.Fprintln(w, `</g>`)
+}
+
+// writeHorizon 以灰色区域绘制地平线轮廓遮挡（地平线以下部分不显示）。
+func (c *sunPathChart) writeHorizon(w io.Writer, h horizonProfile) {
+	var b strings.Builder
+	if c.projection == sunPathCylindrical {
+		// 沿画布从左到右逐度采样，底边闭合
+		for i := 0; i <= 360; i++ {
+			az := normalizeCompass(c.center - 180 + float64(i))
+			x := c.x0 + float64(i)/360*(c.x1-c.x0)
+			_, y := c.project(sunPathPoint{Az: az, Alt: max(h.altitudeAt(az), 0)})
+			if i == 0 {
+				fmt.Fprintf(&b, "M%.1f %.1f", x, c.y1)
+			}
+			fmt.Fprintf(&b, " L%.1f %.1f", x, y)
+		}
+		fmt.Fprintf(&b, " L%.1f %.1f Z", c.x1, c.y1)
+	} else {
+		// 外圈为地平圈，内圈为轮廓，按 evenodd 填充两者之间的区域
+		for i := 0; i <= 360; i++ {
+			x, y := c.project(sunPathPoint{Az: float64(i), Alt: 0})
+			if i == 0 {
+				fmt.Fprintf(&b, "M%.1f %.1f", x, y)
+			} else {
+				fmt.Fprintf(&b, " L%.1f %.1f", x, y)
+			}
+		}
+		b.WriteString(" Z")
+		for i := 0; i <= 360; i++ {
+			x, y := c.project(sunPathPoint{Az: float64(i), Alt: max(h.altitudeAt(float64(i)), 0)})
+			if i == 0 {
+				fmt.Fprintf(&b, " M%.1f %.1f", x, y)
+			} else {
+				fmt.Fprintf(&b, " L%.1f %.1f", x, y)
+			}
+		}
+		b.WriteString(" Z")
+	}
+	fmt.Fprintf(w, `<path d="%s" fill="#999" fill-opacity="0.35" fill-rule="evenodd" stroke="#666" stroke-width="0.8"/>`+"\n", b.String())
+}